@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// Настройки служебного HTTP-сервера
+type Admin struct {
+	// Адрес, например "127.0.0.1:9100". Пустой адрес отключает сервер.
+	Listen string `yaml:"listen"`
+	// Токен для заголовка Authorization: Bearer <token> в запросах,
+	// меняющих состояние; пусто - без проверки
+	Token string `yaml:"token"`
+	// Интервал проверки доступности API для /healthz; 0 отключает проверку
+	PingInterval time.Duration `yaml:"ping_interval"`
+	// Веб-панель на / с очередью, последними результатами, ошибками
+	// и конфигурацией
+	Dashboard bool `yaml:"dashboard"`
+}
+
+// adminMux возвращает обработчики служебного сервера
+func adminMux(cfg Admin) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", metricsHandler)
+	mux.HandleFunc("GET /healthz", healthHandler)
+	mux.HandleFunc("POST /pause", adminAction(cfg.Token, intakeHandler(func() error {
+		pauseIntake()
+		return nil
+	})))
+	mux.HandleFunc("POST /resume", adminAction(cfg.Token, intakeHandler(resumeIntake)))
+	mux.HandleFunc("POST /rescan", adminAction(cfg.Token, intakeHandler(func() error {
+		requestRescan()
+		return nil
+	})))
+	if cfg.Dashboard {
+		registerDashboard(mux, cfg.Token)
+	}
+	return mux
+}
+
+// adminAction проверяет токен запроса, меняющего состояние, и требует
+// тело JSON. Браузер не отправит такой запрос с чужой страницы без
+// предварительной проверки CORS, которую сервер не проходит, поэтому
+// посещенный сайт не может выполнить действие от имени оператора.
+func adminAction(token string, next http.HandlerFunc) http.HandlerFunc {
+	return requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mt != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("ожидается Content-Type: application/json"))
+			return
+		}
+		next(w, r)
+	})
+}
+
+// startAdmin запускает служебный HTTP-сервер с /metrics, /healthz
+// и управлением приемом файлов (POST /pause, POST /resume и POST /rescan).
+// Сервер останавливается при отмене ctx.
+func startAdmin(ctx context.Context, cfg Admin) {
+	if cfg.Listen == "" {
+		return
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           adminMux(cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go pingAPI(ctx, cfg.PingInterval)
+	go func() {
+		slog.Info("admin server started", "listen", cfg.Listen)
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin server failed", "error", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+}
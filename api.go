@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// Таймауты запросов к API
+type Timeouts struct {
+	// Установка TCP-соединения и TLS-рукопожатие
+	Connect time.Duration `yaml:"connect"`
+	// Одна попытка запроса целиком, включая загрузку и скачивание
+	Request time.Duration `yaml:"request"`
+	// Обработка одного файла целиком, со всеми повторами; 0 - без ограничения
+	File time.Duration `yaml:"file"`
+}
+
+// Стратегии использования нескольких ключей
+const (
+	keyFailover   = "failover"
+	keyRoundRobin = "round-robin"
+)
+
+func validKeyStrategy(strategy string) error {
+	switch strategy {
+	case "", keyFailover, keyRoundRobin:
+		return nil
+	}
+	return fmt.Errorf("неизвестная стратегия ключей %q, ожидается %s или %s", strategy, keyFailover, keyRoundRobin)
+}
+
+// newAPIClient создает клиент PhotoRoom по конфигурации
+func newAPIClient(cfg *Config) *photoroom.Client {
+	strategy := photoroom.Failover
+	if cfg.KeyStrategy == keyRoundRobin {
+		strategy = photoroom.RoundRobin
+	}
+
+	var rt http.RoundTripper = &instrumentedTransport{next: transport}
+	if cfg.HTTP.Debug {
+		rt = &debugTransport{next: rt}
+	}
+
+	// В песочнице запросы не расходуют кредиты, результаты с водяным знаком
+	apiKey, apiKeys := cfg.APIKey, cfg.APIKeys
+	if cfg.Sandbox {
+		apiKey = photoroom.SandboxKey(apiKey)
+		apiKeys = make([]string, len(cfg.APIKeys))
+		for i, key := range cfg.APIKeys {
+			apiKeys[i] = photoroom.SandboxKey(key)
+		}
+	}
+
+	return photoroom.NewClient(apiKey,
+		photoroom.WithAPIKeys(apiKeys, strategy),
+		photoroom.WithKeyRotationHook(func(from, to, status int) {
+			slog.Warn("API key exhausted, switching to next key", "from", from, "to", to, "status", status)
+		}),
+		photoroom.WithEditURL(cfg.APIUrl),
+		photoroom.WithSegmentURL(cfg.RemoveBGURL),
+		photoroom.WithAccountURL(cfg.Credits.AccountURL),
+		photoroom.WithHTTPClient(&http.Client{Transport: rt}),
+		photoroom.WithUserAgent(cfg.HTTP.UserAgent),
+		photoroom.WithHeaders(cfg.HTTP.Headers),
+		photoroom.WithRequestTimeout(cfg.Timeouts.Request),
+		// Ответ записывается рядом с результатами, чтобы перенести его на место без копирования
+		photoroom.WithTempDir(cfg.ProcessedDir),
+		photoroom.WithRateLimit(cfg.RateLimit.Requests, cfg.RateLimit.Per),
+		photoroom.WithConcurrency(cfg.MaxConcurrentRequests),
+		photoroom.WithRetry(photoroom.RetryPolicy{
+			MaxAttempts:    cfg.Retry.MaxAttempts,
+			InitialBackoff: cfg.Retry.InitialBackoff,
+			MaxBackoff:     cfg.Retry.MaxBackoff,
+		}),
+	)
+}
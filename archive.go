@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Политики обращения с исходником после успешной обработки
+const (
+	archiveMove   = "move"
+	archiveCopy   = "copy"
+	archiveDelete = "delete"
+	archiveDated  = "dated"
+	archiveZip    = "zip"
+)
+
+// Настройки архивирования исходных файлов в destination_dir
+type Archive struct {
+	// move - перенести в destination_dir, dated - перенести в поддиректорию
+	// с датой обработки (destination_dir/2024-06-01/), copy - скопировать,
+	// оставив исходник в source, delete - удалить, zip - дописать в архив
+	// за период (destination_dir/2024-06.zip)
+	Policy string `yaml:"policy"`
+	// Для zip: период архива - month или day, и сжатие - deflate или store
+	ZipPeriod string `yaml:"zip_period"`
+	ZipMethod string `yaml:"zip_method"`
+	// Сколько дней хранить файлы в destination_dir; 0 - бессрочно
+	RetentionDays int `yaml:"retention_days"`
+}
+
+func validArchive(a Archive, stateFile string) error {
+	switch a.Policy {
+	case "", archiveMove, archiveDated, archiveDelete, archiveZip:
+	case archiveCopy:
+		// Без базы состояния оставленные в source файлы
+		// обрабатывались бы заново при каждом сканировании
+		if stateFile == "" {
+			return fmt.Errorf("для политики copy нужен state_file")
+		}
+	default:
+		return fmt.Errorf("неизвестная политика %q, ожидается move, copy, delete, dated или zip", a.Policy)
+	}
+	switch a.ZipPeriod {
+	case "", zipMonth, zipDay:
+	default:
+		return fmt.Errorf("неизвестный zip_period %q, ожидается %s или %s", a.ZipPeriod, zipMonth, zipDay)
+	}
+	switch a.ZipMethod {
+	case "", zipDeflate, zipStore:
+	default:
+		return fmt.Errorf("неизвестный zip_method %q, ожидается %s или %s", a.ZipMethod, zipDeflate, zipStore)
+	}
+	if a.RetentionDays < 0 {
+		return fmt.Errorf("retention_days не может быть отрицательным")
+	}
+	return nil
+}
+
+// archiveDir возвращает директорию архива для файла, обработанного в момент t
+func archiveDir(destDir string, t time.Time) string {
+	if config.Archive.Policy == archiveDated {
+		return filepath.Join(destDir, t.Format(time.DateOnly))
+	}
+	return destDir
+}
+
+// archiveSource убирает обработанный исходник по политике archive.policy.
+// Запись о файле в базе состояния удаляется; при политике copy файл
+// отмечается оставленным, чтобы не обрабатывать его повторно. Если убрать
+// исходник не удалось, попытка повторяется позже. Возвращает путь исходника
+// после архивирования: пусто, если он удален, дописан в zip или не убран.
+func archiveSource(filePath string) string {
+	archived, err := archiveFile(filePath)
+	if err != nil {
+		retryMove(filePath)
+		return ""
+	}
+	if config.Archive.Policy != archiveCopy {
+		states.remove(filePath)
+		return archived
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		states.remove(filePath)
+		return archived
+	}
+	states.update(filePath, func(st *fileState) {
+		st.Status = statusKept
+		st.MoveAttempts = 0
+		st.Size = info.Size()
+		st.ModTime = info.ModTime()
+	})
+	return archived
+}
+
+// archiveFile убирает исходник и возвращает его новый путь. При политике
+// copy это путь в source: архивная копия остается нетронутой.
+func archiveFile(filePath string) (string, error) {
+	destDir := watchFor(filePath).DestDir
+	now := time.Now()
+
+	switch config.Archive.Policy {
+	case archiveDelete:
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("failed to delete file", "file", filePath, "error", err)
+			return "", err
+		}
+		if sidecar := sidecarPath(filePath); sidecar != "" {
+			os.Remove(sidecar)
+		}
+		slog.Info("file deleted", "file", filePath)
+		return "", nil
+
+	case archiveCopy:
+		target, err := placeFile(filePath, destDir, true)
+		if err != nil {
+			slog.Error("failed to copy file", "file", filePath, "destination", destDir, "error", err)
+			return "", err
+		}
+		if sidecar := sidecarPath(filePath); sidecar != "" {
+			err = copyFile(sidecar, target+filepath.Ext(sidecar))
+			if err != nil {
+				slog.Warn("failed to copy sidecar file", "file", sidecar, "error", err)
+			}
+		}
+		slog.Info("file copied", "file", filePath, "destination", target)
+		touchArchived(target, now)
+		return filePath, nil
+
+	case archiveZip:
+		_, err := zipSource(filePath, destDir, now)
+		if err != nil {
+			slog.Error("failed to archive file", "file", filePath, "error", err)
+		}
+		return "", err
+	}
+
+	target, err := moveFile(filePath, archiveDir(destDir, now))
+	if err != nil {
+		return "", err
+	}
+	touchArchived(target, now)
+	return target, nil
+}
+
+// touchArchived при включенном сроке хранения выставляет время изменения
+// файла в архиве равным времени архивирования: по нему считается возраст
+func touchArchived(path string, t time.Time) {
+	if config.Archive.RetentionDays > 0 {
+		os.Chtimes(path, t, t)
+	}
+}
+
+// errKept - файл уже обработан и оставлен в source без изменений. Такой файл
+// снова попадает в очередь при каждом обходе и не учитывается в счетчиках.
+var errKept = errors.New("файл уже обработан")
+
+// keptUnchanged сообщает, что файл уже обработан и оставлен в source
+// политикой copy и с тех пор не менялся
+func keptUnchanged(filePath string, st fileState) bool {
+	if st.Status != statusKept {
+		return false
+	}
+	info, err := os.Stat(filePath)
+	return err == nil && info.Size() == st.Size && info.ModTime().Equal(st.ModTime)
+}
+
+// pruneArchives раз в час удаляет из destination_dir файлы старше
+// archive.retention_days до отмены ctx
+func pruneArchives(ctx context.Context) {
+	if config.Archive.RetentionDays <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		pruneArchivesOnce()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneArchivesOnce удаляет устаревшие файлы и опустевшие поддиректории
+// архивов всех отслеживаемых директорий
+func pruneArchivesOnce() {
+	if config.Archive.RetentionDays <= 0 {
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -config.Archive.RetentionDays)
+	for _, w := range allWatches() {
+		removed := 0
+		var dirs []string
+		err := filepath.WalkDir(w.DestDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if path != w.DestDir {
+					dirs = append(dirs, path)
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || !info.Mode().IsRegular() || !info.ModTime().Before(cutoff) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				slog.Warn("failed to remove archived file", "file", path, "error", err)
+				return nil
+			}
+			removed++
+			return nil
+		})
+		if err != nil {
+			slog.Warn("failed to prune archive", "dir", w.DestDir, "error", err)
+			continue
+		}
+		// Вложенные директории идут после родительских, поэтому с конца;
+		// непустые не удаляются
+		for i := len(dirs) - 1; i >= 0; i-- {
+			os.Remove(dirs[i])
+		}
+		if removed > 0 {
+			slog.Info("archive pruned", "dir", w.DestDir, "removed", removed)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Режимы группировки файлов в партии
+const (
+	batchOff = "off"
+	// Партия - файлы, поступившие без перерыва дольше window
+	batchWindow = "window"
+	// Партия - файлы директории с файлом-маркером
+	batchMarker = "marker"
+)
+
+// Группировка файлов в партии (съемки). Результаты партии пишутся
+// в processed/<партия>/, а после закрытия партии туда же - ее отчет.
+type Batches struct {
+	// off, window или marker
+	Mode string `yaml:"mode"`
+	// Партия закрывается, если столько времени не поступало новых файлов
+	Window time.Duration `yaml:"window"`
+	// Имя файла-маркера. Первая строка маркера - идентификатор партии;
+	// пустой маркер называет партию по директории и времени.
+	Marker string `yaml:"marker"`
+}
+
+// Открытая партия
+type batch struct {
+	id string
+	// Директория результатов партии
+	dir     string
+	started time.Time
+	// Время последнего поступившего или обработанного файла
+	last time.Time
+	// Файлы партии в обработке
+	pending int
+	entries []reportEntry
+	// Партия закрыта, отчет пишется после обработки оставшихся файлов
+	closed bool
+}
+
+type batchTracker struct {
+	mu sync.Mutex
+	// Открытые партии: по source для window, по директории маркера для marker
+	open map[string]*batch
+	// Партии файлов в обработке по абсолютному пути
+	files map[string]*batch
+	// Запись отчетов закрытых партий
+	writes sync.WaitGroup
+}
+
+var batches = &batchTracker{
+	open:  make(map[string]*batch),
+	files: make(map[string]*batch),
+}
+
+// assign относит файл к партии перед обработкой
+func (t *batchTracker) assign(filePath string) {
+	if config.Batches.Mode == batchOff {
+		return
+	}
+	w := watchFor(filePath)
+	key, id := absPath(w.SourceDir), ""
+	if config.Batches.Mode == batchMarker {
+		var ok bool
+		key, id, ok = findBatchMarker(filePath, key)
+		if !ok {
+			return
+		}
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.open[key]
+	// Партия закрывается по перерыву, а для marker - и при смене маркера
+	if b != nil && (b.pending == 0 && now.Sub(b.last) >= config.Batches.Window || id != "" && id != b.id) {
+		t.closeLocked(key, b)
+		b = nil
+	}
+	if b == nil {
+		if id == "" {
+			id = now.Format("2006-01-02_150405")
+		}
+		b = &batch{id: id, dir: filepath.Join(w.ProcessedDir, id), started: now}
+		t.open[key] = b
+		slog.Info("batch opened", "batch", id, "dir", b.dir)
+	}
+	b.pending++
+	b.last = now
+	t.files[absPath(filePath)] = b
+}
+
+// record добавляет итог обработки файла в отчет его партии
+func (t *batchTracker) record(filePath string, entry reportEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.files[absPath(filePath)]
+	if b == nil {
+		return
+	}
+	delete(t.files, absPath(filePath))
+	b.pending--
+	b.last = time.Now()
+	b.entries = append(b.entries, entry)
+	t.finishLocked(b)
+}
+
+// release снимает файл с партии, если обработка прервана без итога
+// (отмена, отложенный повтор)
+func (t *batchTracker) release(filePath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.files[absPath(filePath)]
+	if b == nil {
+		return
+	}
+	delete(t.files, absPath(filePath))
+	b.pending--
+	t.finishLocked(b)
+}
+
+// closeLocked закрывает партию; отчет пишется, когда в ней не останется
+// файлов в обработке
+func (t *batchTracker) closeLocked(key string, b *batch) {
+	delete(t.open, key)
+	b.closed = true
+	t.finishLocked(b)
+}
+
+// finishLocked пишет отчет закрытой партии без файлов в обработке
+func (t *batchTracker) finishLocked(b *batch) {
+	if !b.closed || b.pending > 0 {
+		return
+	}
+	t.writes.Add(1)
+	go func() {
+		defer t.writes.Done()
+		writeBatchReport(b)
+	}()
+}
+
+// dir возвращает директорию результатов партии файла, если он в партии
+func (t *batchTracker) dir(filePath string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.files[absPath(filePath)]
+	if b == nil {
+		return "", false
+	}
+	return b.dir, true
+}
+
+// closeIdle закрывает партии без файлов в обработке, в которые не поступало
+// файлов дольше window; all закрывает все партии и ждет записи отчетов
+func (t *batchTracker) closeIdle(all bool) {
+	t.mu.Lock()
+	for key, b := range t.open {
+		if all || b.pending == 0 && time.Since(b.last) >= config.Batches.Window {
+			t.closeLocked(key, b)
+		}
+	}
+	t.mu.Unlock()
+
+	if all {
+		t.writes.Wait()
+	}
+}
+
+// processedDir возвращает директорию результатов файла: директорию его
+// партии или processed его отслеживаемой директории
+func processedDir(filePath string) string {
+	if dir, ok := batches.dir(filePath); ok {
+		return dir
+	}
+	return watchFor(filePath).ProcessedDir
+}
+
+// findBatchMarker ищет маркер в директории файла и выше до root.
+// Возвращает директорию маркера и идентификатор партии.
+func findBatchMarker(filePath, root string) (string, string, bool) {
+	dir := filepath.Dir(absPath(filePath))
+	for {
+		marker := filepath.Join(dir, config.Batches.Marker)
+		if _, err := os.Stat(marker); err == nil {
+			return dir, batchMarkerID(marker, dir), true
+		}
+		if dir == root || filepath.Dir(dir) == dir || !strings.HasPrefix(dir, root) {
+			return "", "", false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// batchMarkerID возвращает идентификатор партии из первой строки маркера.
+// Идентификатор используется как имя директории, поэтому разделители
+// путей в нем заменяются.
+func batchMarkerID(marker, dir string) string {
+	var line string
+	file, err := os.Open(marker)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		if scanner.Scan() {
+			line = strings.TrimSpace(scanner.Text())
+		}
+		file.Close()
+	}
+	if line == "" {
+		info, err := os.Stat(marker)
+		if err != nil {
+			return filepath.Base(dir)
+		}
+		line = filepath.Base(dir) + "_" + info.ModTime().Format("2006-01-02_150405")
+	}
+	id := strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(line)
+	if id == "." || id == ".." {
+		id = strings.ReplaceAll(id, ".", "_")
+	}
+	return id
+}
+
+// isBatchMarker сообщает, является ли файл маркером партии
+func isBatchMarker(filePath string) bool {
+	return config.Batches.Mode == batchMarker && filepath.Base(filePath) == config.Batches.Marker
+}
+
+// writeBatchReport пишет отчет партии в ее директорию результатов
+// в форматах report.formats
+func writeBatchReport(b *batch) {
+	if len(b.entries) == 0 {
+		return
+	}
+	r := newBatchReport(b.started, b.entries)
+	slog.Info("batch closed", "batch", b.id, "files", len(b.entries), "counts", r.Counts)
+
+	err := os.MkdirAll(b.dir, os.ModePerm)
+	if err != nil {
+		slog.Error("failed to write batch report", "batch", b.id, "error", err)
+		return
+	}
+	for _, format := range config.Report.Formats {
+		path := filepath.Join(b.dir, "batch-report."+format)
+		err := writeReportFile(path, format, r)
+		if err != nil {
+			slog.Error("failed to write batch report", "path", path, "error", err)
+			continue
+		}
+		slog.Info("batch report written", "path", path)
+	}
+}
+
+// batchLoop закрывает партии после перерыва в поступлении файлов
+// до отмены ctx
+func batchLoop(ctx context.Context) {
+	if config.Batches.Mode == batchOff {
+		return
+	}
+
+	ticker := time.NewTicker(max(min(config.Batches.Window/4, time.Minute), time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			batches.closeIdle(false)
+		}
+	}
+}
+
+// validBatches проверяет секцию batches при загрузке конфигурации
+func validBatches(b Batches) error {
+	switch b.Mode {
+	case batchOff:
+		return nil
+	case batchWindow, batchMarker:
+	default:
+		return fmt.Errorf("неизвестный режим %q, ожидается %s, %s или %s", b.Mode, batchOff, batchWindow, batchMarker)
+	}
+	if b.Window <= 0 {
+		return fmt.Errorf("window должен быть больше нуля")
+	}
+	if b.Mode == batchMarker && (b.Marker == "" || strings.ContainsAny(b.Marker, `/\`)) {
+		return fmt.Errorf("marker должен быть именем файла")
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// Настройки кэша ответов API. Ответ хранится по хешу исходника вместе
+// с параметрами запроса, поэтому повторная обработка того же файла с теми
+// же параметрами не обращается к API и не расходует кредиты. Варианты
+// результата, преобразование формата и метаданные применяются к ответу
+// из кэша заново.
+type Cache struct {
+	// Директория кэша; пусто - кэш отключен
+	Dir string `yaml:"dir"`
+	// Сколько хранить ответ с последнего использования; 0 - бессрочно
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// cacheKey возвращает ключ ответа API для файла с параметрами profile
+// или пустую строку, если кэш отключен
+func cacheKey(filePath string, profile Profile) string {
+	if config.Cache.Dir == "" {
+		return ""
+	}
+	key, err := contentHash(filePath, profile)
+	if err != nil {
+		slog.Warn("failed to hash file for cache", "file", filePath, "error", err)
+		return ""
+	}
+	return key
+}
+
+func cachePath(key string) string {
+	return filepath.Join(config.Cache.Dir, key[:2], key)
+}
+
+// cachedResult возвращает ответ API из кэша или nil, если его нет.
+// Использование продлевает срок хранения ответа.
+func cachedResult(key string) *photoroom.Result {
+	if key == "" {
+		return nil
+	}
+	path := cachePath(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if expiredCache(info, time.Now()) {
+		os.Remove(path)
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("failed to read cached result", "path", path, "error", err)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &photoroom.Result{ContentType: http.DetectContentType(data), Image: data}
+}
+
+// storeResult сохраняет ответ API в кэш. Ошибки кэша не прерывают обработку.
+func storeResult(key string, result *photoroom.Result) {
+	if key == "" {
+		return
+	}
+	path := cachePath(key)
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err == nil {
+		if result.File != "" {
+			err = copyFile(result.File, path)
+		} else {
+			err = os.WriteFile(path, result.Image, 0644)
+		}
+	}
+	if err != nil {
+		slog.Warn("failed to cache result", "path", path, "error", err)
+	}
+}
+
+func expiredCache(info fs.FileInfo, now time.Time) bool {
+	return config.Cache.MaxAge > 0 && now.Sub(info.ModTime()) > config.Cache.MaxAge
+}
+
+// pruneCache раз в час удаляет ответы, не использованные дольше max_age
+func pruneCache(ctx context.Context) {
+	if config.Cache.Dir == "" || config.Cache.MaxAge <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		pruneCacheOnce()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneCacheOnce удаляет устаревшие ответы из кэша
+func pruneCacheOnce() {
+	if config.Cache.Dir == "" || config.Cache.MaxAge <= 0 {
+		return
+	}
+
+	now := time.Now()
+	removed := 0
+	filepath.WalkDir(config.Cache.Dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return nil
+		}
+		info, err := e.Info()
+		if err == nil && expiredCache(info, now) && os.Remove(path) == nil {
+			removed++
+		}
+		return nil
+	})
+	if removed > 0 {
+		slog.Info("expired cached results removed", "count", removed)
+	}
+}
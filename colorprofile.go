@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"slices"
+	"unicode/utf16"
+)
+
+// Цветовой профиль ICC вида matrix/TRC (так устроены AdobeRGB, ProPhoto,
+// Display P3 и большинство профилей камер): кривая тона каждого канала
+// и матрица перевода линейных RGB в XYZ пространства связи профилей (D50)
+type iccProfile struct {
+	desc  string
+	toXYZ [3][3]float64
+	trc   [3]toneCurve
+}
+
+// Кривая тона: таблица значений на [0, 1] или параметрическая функция ICC
+type toneCurve struct {
+	table  []float64
+	params []float64
+	kind   int
+}
+
+var errUnsupportedProfile = errors.New("неподдерживаемый цветовой профиль")
+
+// parseICC разбирает профиль RGB с матрицей и кривыми тона. Профили,
+// заданные только таблицами преобразования (A2B0), не поддерживаются.
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errMalformedImage
+	}
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, fmt.Errorf("%w: пространство %q", errUnsupportedProfile, data[16:20])
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, errMalformedImage
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, errMalformedImage
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	p := &iccProfile{desc: iccDescription(tags["desc"])}
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, ok := iccXYZ(tags[name])
+		if !ok {
+			return nil, fmt.Errorf("%w: нет тега %s", errUnsupportedProfile, name)
+		}
+		for row := range 3 {
+			p.toXYZ[row][i] = xyz[row]
+		}
+	}
+	for i, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, ok := iccCurve(tags[name])
+		if !ok {
+			return nil, fmt.Errorf("%w: нет тега %s", errUnsupportedProfile, name)
+		}
+		p.trc[i] = curve
+	}
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func iccXYZ(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+func iccCurve(tag []byte) (toneCurve, bool) {
+	if len(tag) < 12 {
+		return toneCurve{}, false
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*n {
+			return toneCurve{}, false
+		}
+		switch n {
+		case 0:
+			return toneCurve{params: []float64{1}}, true
+		case 1:
+			// Показатель степени в формате u8Fixed8
+			return toneCurve{params: []float64{float64(binary.BigEndian.Uint16(tag[12:])) / 256}}, true
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return toneCurve{table: table}, true
+	case "para":
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if kind >= len(counts) || len(tag) < 12+4*counts[kind] {
+			return toneCurve{}, false
+		}
+		params := make([]float64, counts[kind])
+		for i := range params {
+			params[i] = s15Fixed16(tag[12+4*i:])
+		}
+		return toneCurve{params: params, kind: kind}, true
+	}
+	return toneCurve{}, false
+}
+
+// iccDescription возвращает название профиля из тега desc (ICC v2)
+// или mluc (ICC v4)
+func iccDescription(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > 0 && 12+n <= len(tag) {
+			return string(bytes.TrimRight(tag[12:12+n], "\x00"))
+		}
+	case "mluc":
+		if len(tag) < 28 {
+			return ""
+		}
+		// Первая запись: язык, страна, длина и смещение текста UTF-16BE
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+n > len(tag) {
+			return ""
+		}
+		text := make([]uint16, n/2)
+		for i := range text {
+			text[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+		return string(utf16.Decode(text))
+	}
+	return ""
+}
+
+// linear переводит значение канала в линейное
+func (c toneCurve) linear(v float64) float64 {
+	if c.table != nil {
+		pos := v * float64(len(c.table)-1)
+		i := min(int(pos), len(c.table)-2)
+		return c.table[i] + (c.table[i+1]-c.table[i])*(pos-float64(i))
+	}
+
+	p := c.params
+	switch c.kind {
+	case 1:
+		if v >= -p[2]/p[1] {
+			return math.Pow(p[1]*v+p[2], p[0])
+		}
+		return 0
+	case 2:
+		if v >= -p[2]/p[1] {
+			return math.Pow(p[1]*v+p[2], p[0]) + p[3]
+		}
+		return p[3]
+	case 3:
+		if v >= p[4] {
+			return math.Pow(p[1]*v+p[2], p[0])
+		}
+		return p[3] * v
+	case 4:
+		if v >= p[4] {
+			return math.Pow(p[1]*v+p[2], p[0]) + p[5]
+		}
+		return p[3]*v + p[6]
+	}
+	return math.Pow(v, p[0])
+}
+
+// Основные цвета sRGB в пространстве связи профилей (D50)
+var srgbColorants = [3][3]float64{
+	{0.4361, 0.3851, 0.1431},
+	{0.2225, 0.7169, 0.0606},
+	{0.0139, 0.0971, 0.7141},
+}
+
+// Перевод XYZ (D50) в линейные sRGB с адаптацией Брэдфорда
+var xyzToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// isSRGB сообщает, что основные цвета профиля совпадают с sRGB
+func (p *iccProfile) isSRGB() bool {
+	for row := range 3 {
+		for col := range 3 {
+			if math.Abs(p.toXYZ[row][col]-srgbColorants[row][col]) > 0.01 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toSRGB переводит изображение из пространства профиля в sRGB.
+// Прозрачность сохраняется.
+func (p *iccProfile) toSRGB(src image.Image) *image.NRGBA {
+	b := src.Bounds()
+	img, ok := src.(*image.NRGBA)
+	if !ok {
+		img = image.NewNRGBA(b)
+		draw.Draw(img, b, src, b.Min, draw.Src)
+	}
+
+	var decode [3][256]float64
+	for ch := range 3 {
+		for v := range 256 {
+			decode[ch][v] = p.trc[ch].linear(float64(v) / 255)
+		}
+	}
+	var m [3][3]float64
+	for row := range 3 {
+		for col := range 3 {
+			for k := range 3 {
+				m[row][col] += xyzToSRGB[row][k] * p.toXYZ[k][col]
+			}
+		}
+	}
+	// Кодирование в sRGB по таблице линейных значений
+	const steps = 4096
+	var encode [steps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(srgbEncode(float64(i)/steps) * 255))
+	}
+
+	dst := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		out := dst.Pix[dst.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			px := row[x*4 : x*4+4]
+			r, g, bl := decode[0][px[0]], decode[1][px[1]], decode[2][px[2]]
+			for ch := range 3 {
+				v := m[ch][0]*r + m[ch][1]*g + m[ch][2]*bl
+				out[x*4+ch] = encode[int(math.Round(min(max(v, 0), 1)*steps))]
+			}
+			out[x*4+3] = px[3]
+		}
+	}
+	return dst
+}
+
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// srgbProfile - профиль sRGB (ICC v2), которым помечаются результаты
+// после приведения к sRGB
+var srgbProfile = buildSRGBProfile()
+
+func buildSRGBProfile() []byte {
+	appendXYZ := func(b []byte, x, y, z float64) []byte {
+		b = append(b, "XYZ \x00\x00\x00\x00"...)
+		for _, v := range []float64{x, y, z} {
+			b = binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(v*65536))))
+		}
+		return b
+	}
+
+	desc := []byte("desc\x00\x00\x00\x00")
+	desc = binary.BigEndian.AppendUint32(desc, uint32(len("sRGB")+1))
+	desc = append(desc, "sRGB\x00"...)
+	// Пустые описания Unicode и ScriptCode
+	desc = append(desc, make([]byte, 4+4+2+1+67)...)
+
+	const points = 1024
+	trc := []byte("curv\x00\x00\x00\x00")
+	trc = binary.BigEndian.AppendUint32(trc, points)
+	for i := range points {
+		v := float64(i) / (points - 1)
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		trc = binary.BigEndian.AppendUint16(trc, uint16(math.Round(v*65535)))
+	}
+
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", desc},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright, use freely\x00")},
+		{"wtpt", appendXYZ(nil, 0.9642, 1, 0.8249)},
+		{"rXYZ", appendXYZ(nil, srgbColorants[0][0], srgbColorants[1][0], srgbColorants[2][0])},
+		{"gXYZ", appendXYZ(nil, srgbColorants[0][1], srgbColorants[1][1], srgbColorants[2][1])},
+		{"bXYZ", appendXYZ(nil, srgbColorants[0][2], srgbColorants[1][2], srgbColorants[2][2])},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc},
+	}
+
+	// Заголовок, таблица тегов и данные тегов с выравниванием по 4 байта;
+	// кривые каналов совпадают и хранятся один раз
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntrRGB XYZ ")
+	copy(header[36:], "acsp")
+	// Освещение пространства связи профилей - D50
+	for i, v := range []float64{0.9642, 1, 0.8249} {
+		binary.BigEndian.PutUint32(header[68+4*i:], uint32(int32(math.Round(v*65536))))
+	}
+
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := 128 + 4 + 12*len(tags)
+	var body []byte
+	offsets := make(map[string]int)
+	for _, t := range tags {
+		key := string(t.data)
+		if _, ok := offsets[key]; !ok {
+			offsets[key] = offset + len(body)
+			body = append(body, t.data...)
+			for len(body)%4 != 0 {
+				body = append(body, 0)
+			}
+		}
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offsets[key]))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+	}
+
+	profile := slices.Concat(header, table, body)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
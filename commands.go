@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+var commands = map[string]command{
+	"watch": {
+		usage: "следить за source и обрабатывать новые файлы (по умолчанию)",
+		run:   runWatch,
+	},
+	"once": {
+		usage: "обработать все файлы из source и завершиться",
+		run:   runOnce,
+	},
+	"process": {
+		usage: "<файл|директория>... | -manifest jobs.csv обработать указанные файлы и завершиться",
+		run:   runProcess,
+	},
+	"service": {
+		usage: "install|uninstall|start|stop|restart|status|run [флаги] управлять системной службой",
+		run:   runService,
+	},
+	"init": {
+		usage: "создать config.yaml (с вопросами или по флагам), проверить ключ API и создать директории",
+		run:   runInit,
+	},
+	"config": {
+		usage: "validate [-config путь] проверить файл конфигурации и завершиться",
+		run:   runConfig,
+	},
+	"mock-server": {
+		usage: "[-listen адрес] [-response input|stub] локальный сервер с эндпоинтами API для проверки без ключа и кредитов",
+		run:   runMockServer,
+	},
+	"retry": {
+		usage: "-failed | -file путь... [-profile имя] [-param ключ=значение]... вернуть в обработку файлы из failed_dir и отложенные файлы",
+		run:   runRetry,
+	},
+	"review": {
+		usage: "list | approve <путь>... | reject [-profile имя] [-param ключ=значение]... <путь>... проверить результаты из review.dir",
+		run:   runReview,
+	},
+	"serve": {
+		usage: "[адрес] принимать изображения по HTTP (POST /process) и возвращать результат",
+		run:   runServeCommand,
+	},
+}
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Использование: %s <команда> [флаги] [аргументы]\n\nКоманды:\n", name)
+
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", n, commands[n].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nФлаги команды: %s <команда> -h\n", name)
+	fmt.Fprintln(os.Stderr, "\nКоманды once и process выводят итог в JSON в stdout. Код завершения: 0 - все файлы\n"+
+		"обработаны или пропущены, 1 - часть файлов не обработана, 2 - ошибка конфигурации или аргументов.")
+}
+
+// Общие флаги всех команд. Приоритет параметров: флаги, затем переменные
+// окружения PHOTOROOM_*, затем файл конфигурации.
+type options struct {
+	configPath  string
+	apiKey      string
+	apiURL      string
+	mode        string
+	workers     int
+	source      string
+	destination string
+	processed   string
+	logFormat   string
+	logLevel    string
+	progress    bool
+	debugHTTP   bool
+	manifest    string
+	// Не открывать базу состояния: ее держит запущенная служба
+	skipState bool
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	configPath := os.Getenv(envPrefix + "CONFIG")
+	if configPath == "" {
+		configPath = "config.yaml"
+	}
+	fs.StringVar(&o.configPath, "config", configPath, "путь к файлу конфигурации (PHOTOROOM_CONFIG)")
+	fs.StringVar(&o.apiKey, "api-key", "", "ключ API (лучше задавать через PHOTOROOM_API_KEY)")
+	fs.StringVar(&o.apiURL, "api-url", "", "адрес эндпоинта редактирования")
+	fs.StringVar(&o.mode, "mode", "", "режим обработки: edit или remove-bg")
+	fs.IntVar(&o.workers, "workers", 0, "число одновременных запросов к API")
+	fs.StringVar(&o.source, "source", "", "директория с исходными файлами")
+	fs.StringVar(&o.destination, "destination", "", "директория для обработанных исходников")
+	fs.StringVar(&o.processed, "processed", "", "директория для результатов")
+	fs.StringVar(&o.logFormat, "log-format", "", "формат логов: text или json")
+	fs.StringVar(&o.logLevel, "log-level", "", "уровень логов: debug, info, warn, error")
+	fs.BoolVar(&o.progress, "progress", true, "показывать индикатор выполнения в терминале (once, process)")
+	fs.BoolVar(&o.debugHTTP, "debug-http", false, "выводить в лог запросы к API и ответы без ключей и изображений")
+	fs.StringVar(&o.manifest, "manifest", "", "CSV или JSON со списком изображений, именами результатов и параметрами (process)")
+}
+
+// parseFlags разбирает флаги команды и возвращает позиционные аргументы
+func parseFlags(name string, args []string) []string {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var opts options
+	opts.register(fs)
+	fs.Parse(args)
+
+	setup(opts)
+	return fs.Args()
+}
+
+// Флаги, с которыми запущена команда
+var startOptions options
+
+// setup загружает конфигурацию и готовит клиент, логгер и директории
+func setup(opts options) {
+	startOptions = opts
+	var err error
+	config, err = loadConfig(opts.configPath)
+	if err != nil {
+		fatalConfig("failed to read config", "path", opts.configPath, "error", err)
+	}
+
+	if opts.logFormat != "" {
+		config.Log.Format = opts.logFormat
+	}
+	if opts.logLevel != "" {
+		config.Log.Level = opts.logLevel
+	}
+	err = setupLogger(os.Stderr, config.Log)
+	if err != nil {
+		fatalConfig("failed to set up logger", "error", err)
+	}
+	if config.Sandbox {
+		// Каждая строка лога отмечена, чтобы результаты песочницы
+		// не приняли за настоящие
+		slog.SetDefault(slog.Default().With("sandbox", true))
+		slog.Warn("sandbox mode: API credits are not consumed, results are watermarked")
+	}
+	progressEnabled = opts.progress && isTerminal(os.Stderr) &&
+		(config.Log.Format == "" || strings.EqualFold(config.Log.Format, "text"))
+
+	// Флаги имеют приоритет над окружением и файлом конфигурации
+	if opts.apiKey != "" {
+		config.APIKey = opts.apiKey
+	}
+	if opts.apiURL != "" {
+		config.APIUrl = opts.apiURL
+	}
+	if opts.mode != "" {
+		if err := validMode(opts.mode); err != nil {
+			fatalConfig("invalid -mode flag", "error", err)
+		}
+		config.Mode = opts.mode
+	}
+	if opts.workers > 0 {
+		config.Workers = opts.workers
+	}
+	if opts.source != "" {
+		config.SourceDir = opts.source
+	}
+	if opts.destination != "" {
+		config.DestDir = opts.destination
+	}
+	if opts.processed != "" {
+		config.ProcessedDir = opts.processed
+	}
+	if opts.debugHTTP {
+		config.HTTP.Debug = true
+	}
+	err = validRequired(config)
+	if err == nil {
+		err = setupWatches(config)
+	}
+	if err != nil {
+		fatalConfig("invalid configuration", "error", err)
+	}
+	err = configure()
+	if err != nil {
+		fatal("failed to set up", "error", err)
+	}
+}
+
+// configure готовит по загруженной конфигурации HTTP-транспорт, клиент API,
+// хранилища, базу состояния и директории. Ничего не завершает сам, поэтому
+// тесты вызывают его с конфигурацией, направленной на тестовый сервер.
+func configure() error {
+	err := setupTransport(config)
+	if err != nil {
+		return fmt.Errorf("не удалось настроить HTTP-транспорт: %w", err)
+	}
+	setupTracing(config.Tracing)
+	client = newAPIClient(config)
+	setupTenantAccounts(config)
+
+	err = setupUploader(config.S3Output)
+	if err != nil {
+		return fmt.Errorf("не удалось настроить выгрузку в S3: %w", err)
+	}
+	err = setupS3Input(config.S3Input)
+	if err != nil {
+		return fmt.Errorf("не удалось настроить получение из S3: %w", err)
+	}
+
+	if config.StateFile != "" && !startOptions.skipState {
+		states, err = openState(config.StateFile)
+		if err != nil {
+			return fmt.Errorf("не удалось открыть базу состояния %s: %w", config.StateFile, err)
+		}
+	}
+
+	// Создаем директории, если они не существуют
+	for _, w := range allWatches() {
+		for _, dir := range []string{w.SourceDir, w.DestDir, w.ProcessedDir} {
+			err = os.MkdirAll(dir, os.ModePerm)
+			if err != nil {
+				return fmt.Errorf("не удалось создать директорию: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// start запускает пул воркеров и служебный сервер
+func start(ctx context.Context) {
+	jobs = newPool(config.Workers, config.QueueSize, config.Watches)
+	metricQueueDepth.fn = func() float64 { return float64(jobs.depth()) }
+	startAdmin(ctx, config.Admin)
+	go pollCredits(ctx, client, &credits, config.Credits.PollInterval)
+	for _, a := range tenantAccounts {
+		go pollCredits(ctx, a.client, a.credits, config.Credits.PollInterval)
+	}
+	diskSpaceLoop(ctx)
+}
+
+// finish останавливает пул, выводит итог в лог и возвращает число
+// файлов, оставшихся в очереди
+func finish() int {
+	slog.Info("shutting down, waiting for in-flight uploads", "timeout", config.ShutdownTimeout)
+
+	left := jobs.stop(config.ShutdownTimeout)
+	notifications.flushBatch()
+	waitWebhooks(30 * time.Second)
+	writeReport()
+	batches.closeIdle(true)
+	states.close()
+	shutdownTracing()
+	slog.Info("stopped",
+		"processed", jobs.processed.Load(),
+		"failed", jobs.failed.Load(),
+		"skipped", jobs.skipped.Load(),
+		"deferred", jobs.deferred.Load(),
+		"queued", left)
+	return left
+}
+
+func runWatch(args []string) int {
+	parseFlags("watch", args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	watch(ctx, stop)
+	return 0
+}
+
+// watch следит за source до отмены ctx и останавливает обработку.
+// stop вызывается перед остановкой, чтобы повторный сигнал
+// завершил программу сразу.
+func watch(ctx context.Context, stop context.CancelFunc) {
+	start(ctx)
+	startGRPC(ctx, config.GRPC)
+	handleIntakeSignals(ctx)
+	resumeFromState()
+	go pollS3Input(ctx)
+	go pollQueueInput(ctx)
+	go pollRemoteInputs(ctx)
+	go pruneArchives(ctx)
+	go pruneCache(ctx)
+	go retryLoop(ctx)
+	go notifyLoop(ctx)
+	go reportLoop(ctx)
+	go batchLoop(ctx)
+	dirWatcher(ctx)
+
+	stop()
+	finish()
+}
+
+func runOnce(args []string) int {
+	parseFlags("once", args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	start(ctx)
+	drain(ctx, func() {
+		resumeFromState()
+		fetchS3Input(ctx)
+		fetchRemoteInputs(ctx)
+		pruneArchivesOnce()
+		pruneCacheOnce()
+		for _, w := range allWatches() {
+			if scanTree(ctx, w.SourceDir) != nil {
+				return
+			}
+		}
+	})
+	interrupted := ctx.Err() != nil
+	if !interrupted {
+		finishScans()
+	}
+
+	stop()
+	return writeSummary(os.Stdout, finish(), interrupted)
+}
+
+func runProcess(args []string) int {
+	paths := parseFlags("process", args)
+	var rows []manifestRow
+	if startOptions.manifest != "" {
+		var err error
+		rows, err = loadManifest(startOptions.manifest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", startOptions.manifest, err)
+			return exitConfig
+		}
+	}
+	if len(paths) == 0 && len(rows) == 0 {
+		fmt.Fprintln(os.Stderr, "не указаны файлы для обработки")
+		return exitConfig
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	start(ctx)
+	var staged string
+	drain(ctx, func() {
+		if len(rows) > 0 {
+			var err error
+			staged, err = stageManifest(ctx, rows)
+			if err != nil {
+				slog.Error("failed to stage manifest", "error", err)
+			}
+		}
+		for _, path := range paths {
+			if ctx.Err() != nil {
+				return
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				slog.Error("failed to stat file", "file", path, "error", err)
+				continue
+			}
+			if info.IsDir() {
+				// Структура поддиректорий повторяется относительно указанной директории
+				addSourceRoot(path)
+				if scanTree(ctx, path) != nil {
+					return
+				}
+				continue
+			}
+			if !jobs.enqueue(path) {
+				return
+			}
+		}
+	})
+	interrupted := ctx.Err() != nil
+	if !interrupted {
+		finishScans()
+	}
+
+	stop()
+	left := finish()
+	if staged != "" {
+		removeEmptyDirs(staged)
+	}
+	return writeSummary(os.Stdout, left, interrupted)
+}
+
+func runServeCommand(args []string) int {
+	rest := parseFlags("serve", args)
+	if len(rest) > 0 {
+		config.Serve.Listen = rest[0]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	startAdmin(ctx, config.Admin)
+	startGRPC(ctx, config.GRPC)
+
+	err := runServe(ctx, config.Serve)
+	if err != nil {
+		slog.Error("server failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// drain ставит файлы в очередь с помощью enqueue и ждет, пока очередь
+// опустеет или ctx будет отменен
+func drain(ctx context.Context, enqueue func()) {
+	bar := startProgress()
+	defer bar.stop()
+
+	enqueue()
+
+	idle := make(chan struct{})
+	go func() {
+		jobs.wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.Canceled) {
+			slog.Info("interrupted")
+		}
+	}
+}
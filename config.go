@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+type Config struct {
+	APIUrl      string `yaml:"api_url"`
+	RemoveBGURL string `yaml:"remove_bg_url"`
+	APIKey      string `yaml:"api_key"`
+	// Дополнительные ключи: при исчерпании квоты (402, 429) используется следующий
+	APIKeys []string `yaml:"api_keys"`
+	// failover - переходить к следующему ключу при исчерпании квоты,
+	// round-robin - чередовать ключи
+	KeyStrategy string `yaml:"key_strategy"`
+	// Отправлять запросы с ключами песочницы (sandbox_...): кредиты не
+	// расходуются, результаты с водяным знаком и суффиксом _sandbox в имени
+	Sandbox bool `yaml:"sandbox"`
+
+	// Директории и файлы
+	SourceDir string `yaml:"source_dir"`
+	// Отслеживание новых файлов: fsnotify, poll или hybrid
+	WatchMode    string        `yaml:"watch_mode"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	DestDir      string        `yaml:"destination_dir"`
+	ProcessedDir string        `yaml:"processed_dir"`
+	FailedDir    string        `yaml:"failed_dir"`
+	StateFile    string        `yaml:"state_file"`
+	// Шаблон имени результата, например "{{.Name}}_{{.Profile}}_{{.Timestamp}}.{{.Ext}}"
+	OutputName string `yaml:"output_name"`
+	// Результат с занятым именем: version, overwrite, skip или fail
+	OutputExists string `yaml:"output_exists"`
+	// Исходник с занятым именем в destination_dir, failed_dir или skipped_dir:
+	// version, overwrite или dated
+	DestinationExists string `yaml:"destination_exists"`
+	// Преобразование результата в другой формат
+	Convert Convert `yaml:"convert"`
+	// Несколько вариантов результата вместо одного
+	Renditions []Rendition `yaml:"renditions"`
+	// Наборы параметров для A/B-сравнения: файл обрабатывается с каждым
+	Variants []Variant `yaml:"variants"`
+	// Выгрузка результатов в S3
+	S3Output S3Output `yaml:"s3_output"`
+	// Получение исходных файлов из S3
+	S3Input S3Input `yaml:"s3_input"`
+	// Получение заданий из очереди сообщений NATS
+	QueueInput QueueInput `yaml:"queue_input"`
+	// Получение исходных файлов с сервера FTP или SFTP и выгрузка
+	// результатов на него; для директорий из watches задаются в них
+	RemoteInput  Remote `yaml:"remote_input"`
+	RemoteOutput Remote `yaml:"remote_output"`
+	// Отправка результатов HTTP-приемнику
+	HTTPOutput HTTPOutput `yaml:"http_output"`
+	// Изображения по адресу из манифеста и очереди: download - скачивать,
+	// direct - передавать адрес в API
+	ImageURLs string `yaml:"image_urls"`
+
+	// Параметры обработки по умолчанию
+	Mode     string                           `yaml:"mode"`
+	Edit     photoroom.EditParams             `yaml:"edit"`
+	RemoveBG photoroom.RemoveBackgroundParams `yaml:"remove_bg"`
+	// Директория фоновых изображений, которые можно указать файлом
+	// в sidecar-файлах, манифестах, запросах и заданиях из очереди
+	BackgroundsDir string `yaml:"backgrounds_dir"`
+
+	// Именованные профили, дополняющие параметры по умолчанию,
+	// и соответствие им поддиректорий source
+	Profiles map[string]Profile `yaml:"profiles"`
+	Folders  map[string]string  `yaml:"folders"`
+	// Дополнительные отслеживаемые директории со своими параметрами
+	Watches []Watch `yaml:"watches"`
+	// Клиенты агентства со своими аккаунтами, директориями и отчетами
+	Tenants []Tenant `yaml:"tenants"`
+
+	Workers int `yaml:"workers"`
+	// Сколько запросов к API выполняется одновременно на весь процесс,
+	// включая воркеров директорий из watches; 0 - без ограничения
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+
+	QueueSize int       `yaml:"queue_size"`
+	Priority  Priority  `yaml:"priority"`
+	Retry     Retry     `yaml:"retry"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	Timeouts  Timeouts  `yaml:"timeouts"`
+	HTTP      HTTP      `yaml:"http"`
+	// Сколько ждать текущие загрузки при остановке
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Stability       Stability     `yaml:"stability"`
+	Filter          Filter        `yaml:"filter"`
+	Validate        Validate      `yaml:"validate"`
+	QA              QA            `yaml:"qa"`
+	Review          Review        `yaml:"review"`
+	Transcode       Transcode     `yaml:"transcode"`
+	InputFormats    InputFormats  `yaml:"input_formats"`
+	Preprocess      Preprocess    `yaml:"preprocess"`
+	Metadata        Metadata      `yaml:"metadata"`
+	Dedup           Dedup         `yaml:"dedup"`
+	Cache           Cache         `yaml:"cache"`
+	Scan            Scan          `yaml:"scan"`
+	Batches         Batches       `yaml:"batches"`
+	DiskSpace       DiskSpace     `yaml:"disk_space"`
+	Archive         Archive       `yaml:"archive"`
+	Report          Report        `yaml:"report"`
+	Credits         Credits       `yaml:"credits"`
+	Log             Log           `yaml:"log"`
+	Admin           Admin         `yaml:"admin"`
+	Serve           Serve         `yaml:"serve"`
+	GRPC            GRPC          `yaml:"grpc"`
+	Tracing         Tracing       `yaml:"tracing"`
+	// Уведомления о завершении обработки
+	Webhooks []Webhook `yaml:"webhooks"`
+	// Сообщения в Slack, Telegram и на почту
+	Notifications Notifications `yaml:"notifications"`
+	// Внешние команды на этапах обработки
+	Hooks Hooks `yaml:"hooks"`
+
+	// Устаревшие параметры, используются если не заданы в секции edit
+	BackgroundPrompt string `yaml:"background_prompt"`
+	Margin           string `yaml:"margin"`
+	OutputSize       string `yaml:"output_size"`
+
+	outputName *template.Template
+}
+
+// Ограничение частоты запросов к API: не более Requests за Per
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+}
+
+// Настройки повтора запросов к API
+type Retry struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	// Отложенные повторы файлов, не обработанных из-за недоступности API
+	// или сети (нужен state_file); 0 отключает их
+	DeferInterval    time.Duration `yaml:"defer_interval"`
+	DeferMaxInterval time.Duration `yaml:"defer_max_interval"`
+	// Сколько повторять файл, после чего он считается необработанным; 0 - бессрочно
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// Функция для загрузки конфигурации из файла
+func loadConfig(path string) (*Config, error) {
+	// Значения по умолчанию, если они не заданы в файле
+	config := Config{
+		Mode:         modeEdit,
+		SourceDir:    "./source",
+		WatchMode:    watchFSNotify,
+		PollInterval: 30 * time.Second,
+		DestDir:      "./destination",
+		ProcessedDir: "./processed",
+		FailedDir:    "./failed",
+		StateFile:    "./photoroom.db",
+		S3Output:     S3Output{KeepLocal: true},
+		Workers:      4,
+		QueueSize:    1000,
+		Scan:         Scan{Workers: 4, Batch: 1000},
+		DiskSpace:    DiskSpace{Interval: 30 * time.Second},
+		Tracing:      Tracing{ServiceName: "photoroom", SampleRatio: 1},
+		Batches:      Batches{Mode: batchOff, Window: 10 * time.Minute, Marker: "_batch.txt"},
+		InputFormats: InputFormats{TIFF: formatConvert, PSD: formatConvert, GIF: formatConvert, Frames: framesFirst, MaxFrames: 50},
+		Log:          Log{MaxSize: 100, MaxBackups: 10},
+		Notifications: Notifications{
+			BatchIdle: time.Minute,
+			Window:    15 * time.Minute,
+			MinFiles:  10,
+		},
+		Retry: Retry{
+			MaxAttempts:      5,
+			InitialBackoff:   time.Second,
+			MaxBackoff:       30 * time.Second,
+			DeferInterval:    time.Minute,
+			DeferMaxInterval: 30 * time.Minute,
+			MaxAge:           24 * time.Hour,
+		},
+		Validate: Validate{
+			Enabled: true,
+			Formats: []string{"jpeg", "png", "webp"},
+		},
+		QA: QA{
+			ReviewDir:      "./review",
+			MinSubjectArea: 0.01,
+		},
+		Review: Review{Dir: "./review"},
+		Filter: Filter{
+			Patterns: []string{
+				"*.jpg", "*.jpeg", "*.png", "*.webp",
+				"!.*", "!~*", "!*.tmp", "!*.part", "!*.crdownload",
+			},
+			SniffMIME:  true,
+			SkippedDir: "./skipped",
+		},
+		Timeouts: Timeouts{
+			Connect: 10 * time.Second,
+			Request: 2 * time.Minute,
+		},
+		HTTP:            HTTP{HTTP2: true},
+		ShutdownTimeout: time.Minute,
+		Admin:           Admin{PingInterval: time.Minute, Dashboard: true},
+		Report: Report{
+			Formats: []string{"json"},
+			Credits: map[string]float64{modeEdit: 1, modeRemoveBG: 1},
+		},
+		Credits: Credits{
+			Headers:    []string{"X-Credits-Remaining", "X-Remaining-Credits"},
+			AccountURL: photoroom.DefaultAccountURL,
+		},
+		Serve: Serve{
+			Listen:        ":8080",
+			MaxUploadSize: 32 << 20,
+		},
+		GRPC: GRPC{MaxUploadSize: 32 << 20},
+		Stability: Stability{
+			PollInterval: 500 * time.Millisecond,
+			StablePolls:  2,
+			Timeout:      10 * time.Minute,
+		},
+	}
+
+	yamlFile, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = decodeConfig(yamlFile, &config)
+	if err != nil {
+		return nil, err
+	}
+	err = applyEnv(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Edit.Background.Prompt == "" {
+		config.Edit.Background.Prompt = config.BackgroundPrompt
+	}
+	if config.Edit.Margin == "" {
+		config.Edit.Margin = config.Margin
+	}
+	if config.Edit.OutputSize == "" {
+		config.Edit.OutputSize = config.OutputSize
+	}
+
+	err = validMode(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+	err = validPrompts(Profile{Edit: config.Edit})
+	if err != nil {
+		return nil, err
+	}
+	err = validEditParams(Profile{Edit: config.Edit})
+	if err != nil {
+		return nil, err
+	}
+	for name, profile := range config.Profiles {
+		if err := validMode(profile.Mode); err != nil {
+			return nil, fmt.Errorf("профиль %s: %w", name, err)
+		}
+		if err := validPrompts(profile); err != nil {
+			return nil, fmt.Errorf("профиль %s: %w", name, err)
+		}
+		if err := validEditParams(profile); err != nil {
+			return nil, fmt.Errorf("профиль %s: %w", name, err)
+		}
+	}
+	err = validWatchMode(config.WatchMode)
+	if err != nil {
+		return nil, err
+	}
+	err = validKeyStrategy(config.KeyStrategy)
+	if err != nil {
+		return nil, err
+	}
+	err = validImageURLs(config.ImageURLs)
+	if err != nil {
+		return nil, err
+	}
+	err = validOutputExists(config.OutputExists)
+	if err != nil {
+		return nil, err
+	}
+	err = validDestinationExists(config.DestinationExists)
+	if err != nil {
+		return nil, err
+	}
+	err = validDedupMode(config.Dedup.Mode)
+	if err != nil {
+		return nil, err
+	}
+	err = validArchive(config.Archive, config.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("archive: %w", err)
+	}
+	for _, format := range config.Report.Formats {
+		if format != "json" && format != "csv" && format != "html" {
+			return nil, fmt.Errorf("неизвестный формат отчета %q", format)
+		}
+	}
+	_, err = normalizeFormat(config.Convert.Format)
+	if err != nil {
+		return nil, fmt.Errorf("convert: %w", err)
+	}
+	err = validTranscode(&config.Transcode)
+	if err != nil {
+		return nil, fmt.Errorf("transcode: %w", err)
+	}
+	err = validDiskSpace(config.DiskSpace)
+	if err != nil {
+		return nil, fmt.Errorf("disk_space: %w", err)
+	}
+	err = validBatches(config.Batches)
+	if err != nil {
+		return nil, fmt.Errorf("batches: %w", err)
+	}
+	err = validQA(config.QA)
+	if err != nil {
+		return nil, fmt.Errorf("qa: %w", err)
+	}
+	err = validReview(config.Review, config.Archive.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("review: %w", err)
+	}
+	err = validHTTP(config.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("http: %w", err)
+	}
+	err = validTracing(config.Tracing)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	err = validInputFormats(config.InputFormats)
+	if err != nil {
+		return nil, fmt.Errorf("input_formats: %w", err)
+	}
+	err = validMetadata(config.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	err = validTransparency(&config)
+	if err != nil {
+		return nil, err
+	}
+	err = validHooks(config.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	err = validCredits(config.Credits)
+	if err != nil {
+		return nil, err
+	}
+	err = validNotifications(config.Notifications)
+	if err != nil {
+		return nil, fmt.Errorf("notifications: %w", err)
+	}
+	err = validS3Input(config.S3Input)
+	if err != nil {
+		return nil, fmt.Errorf("s3_input: %w", err)
+	}
+	err = validQueueInput(config.QueueInput)
+	if err != nil {
+		return nil, fmt.Errorf("queue_input: %w", err)
+	}
+	err = validRemote(config.RemoteInput)
+	if err != nil {
+		return nil, fmt.Errorf("remote_input: %w", err)
+	}
+	err = validRemote(config.RemoteOutput)
+	if err != nil {
+		return nil, fmt.Errorf("remote_output: %w", err)
+	}
+	err = setupVariants(config.Variants)
+	if err != nil {
+		return nil, fmt.Errorf("variants: %w", err)
+	}
+	err = validRenditions(config.Renditions)
+	if err != nil {
+		return nil, fmt.Errorf("renditions: %w", err)
+	}
+	config.outputName, err = parseOutputName(config.OutputName)
+	if err != nil {
+		return nil, err
+	}
+	for folder, profile := range config.Folders {
+		if _, ok := config.Profiles[profile]; !ok {
+			return nil, fmt.Errorf("директории %s назначен неизвестный профиль %s", folder, profile)
+		}
+	}
+
+	return &config, nil
+}
+
+// Префикс переменных окружения, переопределяющих параметры из файла
+const envPrefix = "PHOTOROOM_"
+
+// applyEnv переопределяет параметры значениями переменных окружения
+// PHOTOROOM_<ПАРАМЕТР>, чтобы ключи и пароли не хранились в файле
+func applyEnv(c *Config) error {
+	strs := map[string]*string{
+		"API_KEY":                     &c.APIKey,
+		"API_URL":                     &c.APIUrl,
+		"REMOVE_BG_URL":               &c.RemoveBGURL,
+		"KEY_STRATEGY":                &c.KeyStrategy,
+		"SOURCE_DIR":                  &c.SourceDir,
+		"WATCH_MODE":                  &c.WatchMode,
+		"DESTINATION_DIR":             &c.DestDir,
+		"PROCESSED_DIR":               &c.ProcessedDir,
+		"FAILED_DIR":                  &c.FailedDir,
+		"STATE_FILE":                  &c.StateFile,
+		"MODE":                        &c.Mode,
+		"LOG_LEVEL":                   &c.Log.Level,
+		"LOG_FORMAT":                  &c.Log.Format,
+		"LOG_FILE":                    &c.Log.File,
+		"ADMIN_LISTEN":                &c.Admin.Listen,
+		"ADMIN_TOKEN":                 &c.Admin.Token,
+		"SERVE_LISTEN":                &c.Serve.Listen,
+		"SERVE_TOKEN":                 &c.Serve.Token,
+		"GRPC_LISTEN":                 &c.GRPC.Listen,
+		"GRPC_TOKEN":                  &c.GRPC.Token,
+		"S3_OUTPUT_ACCESS_KEY":        &c.S3Output.AccessKey,
+		"S3_OUTPUT_SECRET_KEY":        &c.S3Output.SecretKey,
+		"S3_INPUT_ACCESS_KEY":         &c.S3Input.AccessKey,
+		"S3_INPUT_SECRET_KEY":         &c.S3Input.SecretKey,
+		"QUEUE_INPUT_URL":             &c.QueueInput.URL,
+		"QUEUE_INPUT_TOKEN":           &c.QueueInput.Token,
+		"REMOTE_INPUT_PASSWORD":       &c.RemoteInput.Password,
+		"REMOTE_OUTPUT_PASSWORD":      &c.RemoteOutput.Password,
+		"REMOTE_INPUT_CLIENT_SECRET":  &c.RemoteInput.ClientSecret,
+		"REMOTE_INPUT_REFRESH_TOKEN":  &c.RemoteInput.RefreshToken,
+		"REMOTE_OUTPUT_CLIENT_SECRET": &c.RemoteOutput.ClientSecret,
+		"REMOTE_OUTPUT_REFRESH_TOKEN": &c.RemoteOutput.RefreshToken,
+		"HTTP_OUTPUT_TOKEN":           &c.HTTPOutput.Token,
+	}
+	for name, field := range strs {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			*field = v
+		}
+	}
+
+	// Несколько ключей перечисляются через запятую
+	if v, ok := os.LookupEnv(envPrefix + "API_KEYS"); ok {
+		c.APIKeys = nil
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				c.APIKeys = append(c.APIKeys, key)
+			}
+		}
+	}
+
+	ints := map[string]*int{
+		"WORKERS":                 &c.Workers,
+		"MAX_CONCURRENT_REQUESTS": &c.MaxConcurrentRequests,
+		"QUEUE_SIZE":              &c.QueueSize,
+	}
+	for name, field := range ints {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s%s: %w", envPrefix, name, err)
+			}
+			*field = n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeConfig разбирает файл конфигурации в c. Неизвестные ключи
+// считаются ошибкой: опечатка в имени параметра иначе молча
+// отключала бы его. Для неизвестного ключа подсказывается похожий.
+func decodeConfig(data []byte, c *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(c)
+	if errors.Is(err, io.EOF) {
+		// Пустой файл: остаются значения по умолчанию
+		return nil
+	}
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+
+	msgs := make([]string, len(typeErr.Errors))
+	for i, msg := range typeErr.Errors {
+		msgs[i] = explainYAMLError(msg)
+	}
+	return fmt.Errorf("ошибки в файле конфигурации:\n  %s", strings.Join(msgs, "\n  "))
+}
+
+// Сообщения yaml.v3 о неизвестном ключе и о неверном значении
+var (
+	unknownFieldRe = regexp.MustCompile(`^line (\d+): field (\S+) not found in type (\S+)$`)
+	badValueRe     = regexp.MustCompile("^line (\\d+): cannot unmarshal !!\\w+ `(.*)` into (\\S+)$")
+)
+
+// explainYAMLError переводит сообщение yaml.v3 и добавляет подсказку
+func explainYAMLError(msg string) string {
+	if m := unknownFieldRe.FindStringSubmatch(msg); m != nil {
+		line, field, typ := m[1], m[2], m[3]
+		text := fmt.Sprintf("строка %s: неизвестный параметр %s", line, field)
+		if s := suggestKey(field, configKeys()[typ]); s != "" {
+			text += fmt.Sprintf(", возможно, имелся в виду %s", s)
+		}
+		return text
+	}
+	if m := badValueRe.FindStringSubmatch(msg); m != nil {
+		line, value, typ := m[1], m[2], m[3]
+		switch typ {
+		case "time.Duration":
+			return fmt.Sprintf("строка %s: %q не является длительностью, ожидается например 30s, 5m или 1h", line, value)
+		case "int", "int64", "float64":
+			return fmt.Sprintf("строка %s: %q не является числом", line, value)
+		case "bool", "*bool":
+			return fmt.Sprintf("строка %s: %q - ожидается true или false", line, value)
+		}
+		return fmt.Sprintf("строка %s: значение %q нельзя использовать как %s", line, value, typ)
+	}
+	return msg
+}
+
+// configKeys возвращает ключи YAML по именам типов секций конфигурации
+// в том виде, в котором их называет yaml.v3 ("main.Config")
+func configKeys() map[string][]string {
+	keys := make(map[string][]string)
+	collectKeys(reflect.TypeFor[Config](), keys)
+	return keys
+}
+
+func collectKeys(t reflect.Type, keys map[string][]string) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	if _, seen := keys[t.String()]; seen {
+		return
+	}
+	keys[t.String()] = structKeys(t)
+	for i := range t.NumField() {
+		if f := t.Field(i); f.IsExported() {
+			collectKeys(f.Type, keys)
+		}
+	}
+}
+
+// structKeys возвращает ключи структуры вместе с ключами встроенных (inline) полей
+func structKeys(t reflect.Type) []string {
+	var names []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			if f.Type.Kind() == reflect.Struct {
+				names = append(names, structKeys(f.Type)...)
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// suggestKey возвращает ключ из keys, ближайший к key, или пустую
+// строку, если похожих нет
+func suggestKey(key string, keys []string) string {
+	best, bestDist := "", len(key)/3+2
+	for _, k := range keys {
+		if d := editDistance(key, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance возвращает расстояние Левенштейна между a и b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// validRequired проверяет параметры, без которых обработка невозможна.
+// Вызывается после применения флагов: ключ API можно передать и ими.
+func validRequired(c *Config) error {
+	if c.APIKey == "" && len(c.APIKeys) == 0 {
+		return errors.New("не задан ключ API: укажите api_key, переменную PHOTOROOM_API_KEY или флаг -api-key")
+	}
+	dirs := []struct{ key, value string }{
+		{"source_dir", c.SourceDir},
+		{"destination_dir", c.DestDir},
+		{"processed_dir", c.ProcessedDir},
+	}
+	for _, d := range dirs {
+		if d.value == "" {
+			return fmt.Errorf("не задан %s", d.key)
+		}
+	}
+	return nil
+}
+
+// runConfig выполняет действия с файлом конфигурации
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "ожидается действие: validate")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	var opts options
+	opts.register(fs)
+	fs.Parse(args[1:])
+
+	c, err := loadConfig(opts.configPath)
+	if err == nil && opts.apiKey != "" {
+		c.APIKey = opts.apiKey
+	}
+	if err == nil {
+		err = validRequired(c)
+	}
+	if err == nil {
+		err = setupWatches(c)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", opts.configPath, err)
+		return 1
+	}
+	fmt.Printf("%s: конфигурация корректна\n", opts.configPath)
+	return 0
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Настройки преобразования результата перед сохранением
+type Convert struct {
+	// Формат: jpeg, png или webp. Пустое значение сохраняет формат ответа API.
+	Format string `yaml:"format"`
+	// Качество JPEG и WebP, 1-100
+	Quality int `yaml:"quality"`
+	// Цвет фона для JPEG, который не поддерживает прозрачность, например "FFFFFF"
+	Background string `yaml:"background"`
+	// Путь к утилите cwebp, которой кодируется WebP
+	CWebP string `yaml:"cwebp"`
+	// Путь к утилите pngquant для квантования PNG в вариантах результата
+	PNGQuant string `yaml:"pngquant"`
+}
+
+// Расширения файлов для форматов ответа API
+var formatExts = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/webp": "webp",
+}
+
+// mediaType возвращает MIME-тип изображения по заголовку Content-Type,
+// а если он не указан или не является изображением - по содержимому
+func mediaType(contentType string, data []byte) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err == nil && strings.HasPrefix(mt, "image/") {
+		return mt
+	}
+	return http.DetectContentType(data)
+}
+
+// outputExt возвращает расширение результата без точки. Расширение исходного
+// файла сохраняется, если оно соответствует формату результата (jpeg и jpg).
+func outputExt(sourceExt, mt string) string {
+	sourceExt = strings.TrimPrefix(sourceExt, ".")
+	ext, ok := formatExts[mt]
+	if !ok {
+		return sourceExt
+	}
+	if mime.TypeByExtension("."+strings.ToLower(sourceExt)) == mt {
+		return sourceExt
+	}
+	return ext
+}
+
+func normalizeFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "":
+		return "", nil
+	case "jpeg", "jpg":
+		return "image/jpeg", nil
+	case "png":
+		return "image/png", nil
+	case "webp":
+		return "image/webp", nil
+	}
+	return "", fmt.Errorf("неизвестный формат %q, ожидается jpeg, png или webp", format)
+}
+
+// convertImage перекодирует изображение data типа mt в формат из настроек.
+// Возвращает новые данные и их MIME-тип.
+func convertImage(ctx context.Context, data []byte, mt string, cfg Convert) ([]byte, string, error) {
+	target, err := normalizeFormat(cfg.Format)
+	if err != nil || target == "" || target == mt {
+		return data, mt, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("не удалось декодировать результат: %w", err)
+	}
+	out, err := encodeImage(ctx, img, target, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, target, nil
+}
+
+// encodeImage кодирует изображение в формат target (MIME-тип)
+func encodeImage(ctx context.Context, img image.Image, target string, cfg Convert) ([]byte, error) {
+	quality := cfg.Quality
+	if quality <= 0 || quality > 100 {
+		quality = 90
+	}
+
+	var buf bytes.Buffer
+	switch target {
+	case "image/jpeg":
+		bg, err := parseHexColor(cfg.Background)
+		if err != nil {
+			return nil, err
+		}
+		err = jpeg.Encode(&buf, flatten(img, bg), &jpeg.Options{Quality: quality})
+		if err != nil {
+			return nil, err
+		}
+	case "image/png":
+		err := png.Encode(&buf, img)
+		if err != nil {
+			return nil, err
+		}
+	case "image/webp":
+		return encodeWebP(ctx, img, quality, cfg.CWebP)
+	default:
+		return nil, fmt.Errorf("неподдерживаемый формат %s", target)
+	}
+	return buf.Bytes(), nil
+}
+
+// flatten накладывает изображение на сплошной фон
+func flatten(img image.Image, bg color.Color) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// parseHexColor разбирает цвет вида "FFFFFF" или "#FFFFFF"; пустая строка - белый
+func parseHexColor(s string) (color.Color, error) {
+	s = strings.TrimPrefix(s, "#")
+	if s == "" {
+		return color.White, nil
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 6 {
+		return nil, fmt.Errorf("неверный цвет %q, ожидается RRGGBB", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// encodeWebP кодирует изображение утилитой cwebp: в стандартной
+// библиотеке и x/image нет кодировщика WebP
+func encodeWebP(ctx context.Context, img image.Image, quality int, cwebp string) ([]byte, error) {
+	if cwebp == "" {
+		cwebp = "cwebp"
+	}
+
+	dir, err := os.MkdirTemp("", "photoroom-webp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in.png")
+	out := filepath.Join(dir, "out.webp")
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(in, buf.Bytes(), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, cwebp, "-quiet", "-q", strconv.Itoa(quality), in, "-o", out)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка cwebp: %w: %s", err, bytes.TrimSpace(output))
+	}
+	return os.ReadFile(out)
+}
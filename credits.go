@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// Учет кредитов API
+type Credits struct {
+	// Заголовки ответа API с остатком кредитов; берется первый найденный
+	Headers []string `yaml:"headers"`
+	// Адрес сведений об аккаунте с остатком кредитов
+	AccountURL string `yaml:"account_url"`
+	// Как часто запрашивать остаток; 0 - не запрашивать
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Предупреждать, когда остаток меньше warn_below; 0 - не предупреждать
+	WarnBelow float64 `yaml:"warn_below"`
+	// Приостанавливать обработку, когда остаток меньше pause_below; 0 - не
+	// приостанавливать. Обработка продолжается, когда запрос остатка
+	// покажет, что кредитов снова достаточно.
+	PauseBelow float64 `yaml:"pause_below"`
+}
+
+func validCredits(c Credits) error {
+	if c.PauseBelow > 0 && c.PollInterval <= 0 {
+		return fmt.Errorf("credits: для pause_below нужен poll_interval, иначе обработка не продолжится")
+	}
+	return nil
+}
+
+// Текущий остаток кредитов. Расход с момента запуска
+// считается метрикой photoroom_credits_used_total.
+type creditTracker struct {
+	// Клиент агентства; пусто - основной аккаунт
+	tenant    string
+	mu        sync.Mutex
+	remaining float64
+	known     bool
+	warned    bool
+	// Закрывается при снятии паузы; nil, если обработка не приостановлена
+	resume chan struct{}
+}
+
+var credits creditTracker
+
+// observe учитывает успешный запрос в режиме mode. Остаток берется из
+// заголовков ответа, а если их нет - уменьшается на стоимость запроса.
+func (t *creditTracker) observe(mode string, header http.Header) {
+	cost := config.Report.Credits[mode]
+	if config.Sandbox {
+		cost = 0
+	}
+	metricCreditsUsed.add(t.tenant, cost)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if remaining, ok := remainingCredits(header); ok {
+		t.update(remaining)
+	} else if t.known {
+		t.update(t.remaining - cost)
+	}
+}
+
+// set задает остаток, полученный из сведений об аккаунте
+func (t *creditTracker) set(remaining float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.update(remaining)
+}
+
+func (t *creditTracker) update(remaining float64) {
+	t.remaining = remaining
+	t.known = true
+
+	cfg := config.Credits
+	log := slog.Default()
+	account := ""
+	if t.tenant != "" {
+		log = log.With("tenant", t.tenant)
+		account = " клиента " + t.tenant
+	}
+	switch {
+	case cfg.WarnBelow > 0 && remaining < cfg.WarnBelow && !t.warned:
+		t.warned = true
+		log.Warn("API credits running low", "remaining", remaining, "threshold", cfg.WarnBelow)
+		sendAlert(alertCredits, fmt.Sprintf("Заканчиваются кредиты API%s: осталось %g (порог %g)", account, remaining, cfg.WarnBelow))
+	case remaining >= cfg.WarnBelow:
+		t.warned = false
+	}
+
+	if cfg.PauseBelow <= 0 {
+		return
+	}
+	switch {
+	case remaining < cfg.PauseBelow && t.resume == nil:
+		t.resume = make(chan struct{})
+		log.Warn("API credits below threshold, pausing processing", "remaining", remaining, "threshold", cfg.PauseBelow)
+	case remaining >= cfg.PauseBelow && t.resume != nil:
+		close(t.resume)
+		t.resume = nil
+		log.Info("API credits replenished, resuming processing", "remaining", remaining)
+	}
+}
+
+// wait ждет снятия паузы из-за нехватки кредитов
+func (t *creditTracker) wait(ctx context.Context) error {
+	t.mu.Lock()
+	resume := t.resume
+	t.mu.Unlock()
+	if resume == nil {
+		return nil
+	}
+
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// value возвращает остаток кредитов; ok равен false, если он еще неизвестен
+func (t *creditTracker) value() (remaining float64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remaining, t.known
+}
+
+// remainingCredits ищет остаток кредитов в заголовках ответа API
+func remainingCredits(header http.Header) (float64, bool) {
+	for _, name := range config.Credits.Headers {
+		v := strings.TrimSpace(header.Get(name))
+		if v == "" {
+			continue
+		}
+		remaining, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			return remaining, true
+		}
+	}
+	return 0, false
+}
+
+// pollCredits запрашивает остаток кредитов аккаунта клиента c каждые interval
+func pollCredits(ctx context.Context, c *photoroom.Client, t *creditTracker, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		account, err := c.Account(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("failed to fetch API credits", "tenant", t.tenant, "error", err)
+		} else {
+			t.set(account.Credits.Available)
+			slog.Debug("API credits", "tenant", t.tenant, "remaining", account.Credits.Available)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package main
+
+// isCrossDevice на этой платформе не определяется
+func isCrossDevice(err error) bool {
+	return false
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isCrossDevice сообщает, что файл нельзя переименовать,
+// потому что пути на разных файловых системах
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ERROR_NOT_SAME_DEVICE
+const errNotSameDevice = syscall.Errno(17)
+
+// isCrossDevice сообщает, что файл нельзя переименовать,
+// потому что пути на разных томах
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errNotSameDevice)
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Сколько последних итогов обработки показывает панель
+const recentLimit = 50
+
+// Размер миниатюр на панели
+const thumbSize = 160
+
+// Итог обработки файла для панели
+type recentEntry struct {
+	ID int64 `json:"id"`
+	reportEntry
+	Time time.Time `json:"time"`
+	// Путь к исходнику на момент обработки
+	source string
+}
+
+// Последние итоги обработки, в отличие от отчетов собираются всегда
+type recentResults struct {
+	mu      sync.Mutex
+	nextID  int64
+	entries []recentEntry
+}
+
+var recent recentResults
+
+// add запоминает итог, вытесняя самый старый
+func (r *recentResults) add(filePath string, entry reportEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	r.entries = append(r.entries, recentEntry{ID: r.nextID, reportEntry: entry, Time: time.Now(), source: filePath})
+	if len(r.entries) > recentLimit {
+		r.entries = slices.Delete(r.entries, 0, len(r.entries)-recentLimit)
+	}
+}
+
+// list возвращает итоги, начиная с последнего
+func (r *recentResults) list() []recentEntry {
+	r.mu.Lock()
+	entries := slices.Clone(r.entries)
+	r.mu.Unlock()
+	slices.Reverse(entries)
+	return entries
+}
+
+func (r *recentResults) get(id int64) (recentEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return recentEntry{}, false
+}
+
+// registerDashboard добавляет веб-панель и ее API к служебному серверу.
+// Действия с файлами проверяются, как POST /pause, токеном token.
+func registerDashboard(mux *http.ServeMux, token string) {
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, dashboardPage)
+	})
+	mux.HandleFunc("GET /api/status", statusHandler)
+	mux.HandleFunc("GET /api/results", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, recent.list())
+	})
+	mux.HandleFunc("GET /api/thumbnail/{id}/{side}", thumbnailHandler)
+	mux.HandleFunc("GET /api/errors", errorsHandler)
+	mux.HandleFunc("POST /api/retry", adminAction(token, retryHandler))
+	mux.HandleFunc("GET /api/review", reviewListHandler)
+	mux.HandleFunc("POST /api/review/approve", adminAction(token, approveHandler))
+	mux.HandleFunc("POST /api/review/reject", adminAction(token, rejectHandler))
+	mux.HandleFunc("GET /api/config", configHandler)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusHandler возвращает состояние очереди и счетчики
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	status := map[string]any{
+		"paused":  intake.paused(),
+		"watcher": health.watcherAlive.Load(),
+	}
+	if jobs != nil {
+		status["queued"] = jobs.depth()
+		status["total"] = jobs.total.Load()
+		status["processed"] = jobs.processed.Load()
+		status["failed"] = jobs.failed.Load()
+		status["skipped"] = jobs.skipped.Load()
+	}
+	if remaining, ok := credits.value(); ok {
+		status["credits"] = remaining
+	}
+	if ns := health.lastSuccess.Load(); ns != 0 {
+		status["last_success"] = time.Unix(0, ns)
+	}
+	writeJSON(w, status)
+}
+
+// thumbnailHandler отдает миниатюру исходника (before) или результата (after)
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	entry, ok := recent.get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var path string
+	switch r.PathValue("side") {
+	case "before":
+		path = sourceLocation(entry.source, entry.Time)
+	case "after":
+		path = entry.Output
+	}
+	data, err := thumbnail(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write(data)
+}
+
+// sourceLocation ищет исходник, обработанный в момент t: после обработки
+// он перенесен в destination, failed или skipped
+func sourceLocation(filePath string, t time.Time) string {
+	w := watchFor(filePath)
+	rel := relPath(filePath)
+	for _, path := range []string{
+		filePath,
+		filepath.Join(archiveDir(w.DestDir, t), rel),
+		filepath.Join(w.FailedDir, rel),
+		filepath.Join(config.Filter.SkippedDir, rel),
+	} {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// thumbnail уменьшает изображение до размера миниатюры и кодирует в PNG
+func thumbnail(path string) ([]byte, error) {
+	if path == "" || strings.Contains(path, "://") {
+		return nil, errors.New("нет локального файла")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, fitWithin(img, thumbSize, thumbSize))
+	return buf.Bytes(), err
+}
+
+// Файл в failed с описанием ошибки
+type failedFile struct {
+	Watch string `json:"watch"`
+	// Путь относительно failed
+	Path string `json:"path"`
+	failureReport
+}
+
+// errorsHandler возвращает файлы из failed всех отслеживаемых директорий
+func errorsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, failedFiles())
+}
+
+// failedFiles возвращает файлы из failed всех отслеживаемых директорий,
+// от новых к старым
+func failedFiles() []failedFile {
+	var files []failedFile
+	for _, watch := range allWatches() {
+		if watch.FailedDir == "" {
+			continue
+		}
+		filepath.WalkDir(watch.FailedDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, ".error.json") {
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			f := failedFile{Watch: watch.Name}
+			if json.Unmarshal(data, &f.failureReport) != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(watch.FailedDir, strings.TrimSuffix(path, ".error.json"))
+			f.Path = filepath.ToSlash(rel)
+			files = append(files, f)
+			return nil
+		})
+	}
+	slices.SortFunc(files, func(a, b failedFile) int {
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+	return files
+}
+
+// Тело JSON запросов повтора и проверки из веб-панели
+type fileAction struct {
+	Watch   string `json:"watch"`
+	Path    string `json:"path"`
+	Profile string `json:"profile"`
+	// Параметры вида ключ=значение, как -param в командной строке
+	Params []string `json:"params"`
+}
+
+// readFileAction разбирает тело запроса и параметры из него
+func readFileAction(r *http.Request) (fileAction, map[string]string, error) {
+	var action fileAction
+	err := json.NewDecoder(r.Body).Decode(&action)
+	if err != nil {
+		return action, nil, fmt.Errorf("не удалось разобрать запрос: %w", err)
+	}
+	params, err := parseParams(action.Params)
+	return action, params, err
+}
+
+// retryHandler возвращает файл из failed в source и ставит в очередь,
+// при необходимости с профилем profile и параметрами params
+func retryHandler(w http.ResponseWriter, r *http.Request) {
+	action, params, err := readFileAction(r)
+	var target string
+	if err == nil {
+		target, err = retryFailed(action.Watch, action.Path, action.Profile, params)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if jobs != nil {
+		jobs.tryEnqueue(target)
+	}
+	writeJSON(w, map[string]string{"file": target})
+}
+
+// retryFailed переносит файл rel из failed отслеживаемой директории
+// watchName обратно в ее source вместе с sidecar, дополненным непустыми
+// profile и params, и удаляет описание ошибки
+func retryFailed(watchName, rel, profile string, params map[string]string) (string, error) {
+	rel = filepath.FromSlash(rel)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("неверный путь %q", rel)
+	}
+	var watch *Watch
+	for _, w := range allWatches() {
+		if w.Name == watchName {
+			watch = &w
+			break
+		}
+	}
+	if watch == nil || watch.FailedDir == "" {
+		return "", fmt.Errorf("неизвестная директория %q", watchName)
+	}
+
+	src := filepath.Join(watch.FailedDir, rel)
+	target := filepath.Join(watch.SourceDir, rel)
+	err := returnSource(src, target, profile, params)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("failed file returned to source", "file", target)
+	os.Remove(src + ".error.json")
+	return target, nil
+}
+
+// Ключи конфигурации, значения которых не показываются
+var secretKeys = []string{"api_key", "api_keys", "secret_key", "secret", "token", "password", "client_secret", "refresh_token", "bot_token", "webhook_url"}
+
+// configHandler возвращает действующую конфигурацию без секретов
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	profilesMu.RLock()
+	var node yaml.Node
+	err := node.Encode(config)
+	profilesMu.RUnlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	redact(&node)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	enc.Encode(&node)
+}
+
+// redact заменяет непустые значения секретных ключей и пароли в адресах
+func redact(node *yaml.Node) {
+	// Пароль может быть указан в адресе сервера или прокси
+	if node.Kind == yaml.ScalarNode {
+		if u, err := url.Parse(node.Value); err == nil && u.User != nil {
+			node.SetString(u.Redacted())
+		}
+	}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			// Значения дополнительных заголовков обычно несут токены шлюза
+			// или коллектора, как и в -debug-http
+			if slices.Contains(secretKeys, key.Value) || key.Value == "headers" && value.Kind == yaml.MappingNode {
+				hideValue(value)
+			}
+		}
+	}
+	for _, child := range node.Content {
+		redact(child)
+	}
+}
+
+func hideValue(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Value != "" {
+			node.SetString("***")
+		}
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			hideValue(child)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			hideValue(node.Content[i])
+		}
+	}
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PhotoRoom</title>
+<style>
+body { font-family: sans-serif; margin: 16px; }
+nav a { margin-right: 12px; }
+table { border-collapse: collapse; margin-top: 8px; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+img { max-width: 160px; max-height: 160px; background: repeating-conic-gradient(#eee 0 25%, #fff 0 50%) 0 0 / 16px 16px; }
+.failed { background: #fdd; }
+.skipped { background: #eee; }
+.counters span { display: inline-block; margin-right: 16px; }
+pre { background: #f6f6f6; padding: 8px; }
+</style>
+</head>
+<body>
+<h1>PhotoRoom</h1>
+<div class="counters" id="status"></div>
+<p>
+<button onclick="intake('pause')">Приостановить</button>
+<button onclick="intake('resume')">Возобновить</button>
+</p>
+
+<h2>Последние файлы</h2>
+<table id="results"></table>
+
+<h2>Ошибки</h2>
+<table id="errors"></table>
+
+<h2>Конфигурация</h2>
+<pre id="config"></pre>
+
+<script>
+function el(tag, text) {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  return e;
+}
+
+function row(table, cells, cls) {
+  const tr = el("tr");
+  if (cls) tr.className = cls;
+  for (const c of cells) {
+    const td = el("td");
+    if (c instanceof Node) td.appendChild(c); else td.textContent = c ?? "";
+    tr.appendChild(td);
+  }
+  table.appendChild(tr);
+}
+
+function header(table, names) {
+  table.replaceChildren();
+  const tr = el("tr");
+  for (const n of names) tr.appendChild(el("th", n));
+  table.appendChild(tr);
+}
+
+function thumb(id, side) {
+  const img = el("img");
+  img.src = "api/thumbnail/" + id + "/" + side;
+  img.alt = "";
+  img.onerror = () => img.remove();
+  return img;
+}
+
+async function loadStatus() {
+  const s = await (await fetch("api/status")).json();
+  const status = document.getElementById("status");
+  status.replaceChildren();
+  const items = [
+    ["в очереди", s.queued], ["обработано", s.processed], ["ошибок", s.failed],
+    ["пропущено", s.skipped], ["кредиты", s.credits],
+    ["прием", s.paused.length ? "приостановлен (" + s.paused.join(", ") + ")" : "работает"],
+  ];
+  for (const [name, value] of items) {
+    if (value !== undefined) status.appendChild(el("span", name + ": " + value));
+  }
+}
+
+let shownIDs;
+async function loadResults() {
+  const results = await (await fetch("api/results")).json();
+  // Миниатюры перерисовываем, только если список изменился
+  const ids = results.map(r => r.id).join();
+  if (ids === shownIDs) return;
+  shownIDs = ids;
+
+  const table = document.getElementById("results");
+  header(table, ["Время", "Файл", "Итог", "Профиль", "До", "После", "Ошибка", "Время, с"]);
+  for (const r of results) {
+    row(table, [new Date(r.time).toLocaleTimeString(), r.file, r.result, r.profile,
+      thumb(r.id, "before"), thumb(r.id, "after"), r.error, r.duration_seconds.toFixed(2)], r.result);
+  }
+}
+
+async function loadErrors() {
+  const files = await (await fetch("api/errors")).json() || [];
+  const table = document.getElementById("errors");
+  header(table, ["Время", "Файл", "Код", "Ошибка", ""]);
+  for (const f of files) {
+    const button = el("button", "Повторить");
+    button.onclick = () => retry(f.watch, f.path);
+    row(table, [new Date(f.timestamp).toLocaleString(), f.path, f.status_code, f.error, button], "failed");
+  }
+}
+
+async function loadConfig() {
+  document.getElementById("config").textContent = await (await fetch("api/config")).text();
+}
+
+// Действия отправляются в JSON с токеном admin.token, если он задан
+async function post(action, body) {
+  for (;;) {
+    const headers = {"Content-Type": "application/json"};
+    const token = localStorage.getItem("adminToken");
+    if (token) headers.Authorization = "Bearer " + token;
+    const res = await fetch(action, {method: "POST", headers, body: JSON.stringify(body || {})});
+    if (res.status === 401) {
+      const entered = prompt("Токен admin.token");
+      if (entered === null) return;
+      localStorage.setItem("adminToken", entered);
+      continue;
+    }
+    if (!res.ok) alert((await res.json()).error);
+    return;
+  }
+}
+
+async function retry(watch, path) {
+  await post("api/retry", {watch, path});
+  refresh();
+}
+
+async function intake(action) {
+  await post(action);
+  refresh();
+}
+
+function refresh() {
+  loadStatus();
+  loadResults();
+  loadErrors();
+}
+
+refresh();
+loadConfig();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Заголовки запроса, значения которых не выводятся
+var secretHeaders = []string{"X-Api-Key", "Authorization", "Proxy-Authorization", "Cookie"}
+
+// debugTransport выводит в лог запросы к API и ответы на них: заголовки
+// запроса без ключей, текстовые поля формы (вместо файлов - имя и размер)
+// и все заголовки ответа. Включается флагом -debug-http или http.debug.
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := req.Header.Clone()
+	// Дополнительные заголовки из http.headers обычно несут токены шлюза
+	for _, name := range append(slices.Collect(maps.Keys(config.HTTP.Headers)), secretHeaders...) {
+		if header.Get(name) != "" {
+			header.Set(name, "***")
+		}
+	}
+	attrs := []any{"method", req.Method, "url", req.URL.Redacted(), "headers", header}
+	if fields, err := formFields(req); err != nil {
+		attrs = append(attrs, "fields_error", err)
+	} else if fields != nil {
+		attrs = append(attrs, "fields", fields)
+	}
+	slog.Info("HTTP request", attrs...)
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		slog.Info("HTTP request failed", "url", req.URL.Redacted(), "duration", time.Since(start), "error", err)
+		return nil, err
+	}
+	slog.Info("HTTP response", "url", req.URL.Redacted(), "status", res.StatusCode,
+		"duration", time.Since(start), "headers", res.Header)
+	return res, nil
+}
+
+// formFields читает копию тела запроса multipart/form-data и возвращает
+// значения полей. Содержимое файлов не выводится.
+func formFields(req *http.Request) (map[string]string, error) {
+	mt, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/form-data" || req.GetBody == nil {
+		return nil, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	fields := make(map[string]string)
+	r := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			n, err := io.Copy(io.Discard, part)
+			if err != nil {
+				return nil, err
+			}
+			fields[part.FormName()] = fmt.Sprintf("<файл %s, %d байт>", part.FileName(), n)
+			continue
+		}
+		var value strings.Builder
+		_, err = io.Copy(&value, part)
+		if err != nil {
+			return nil, err
+		}
+		fields[part.FormName()] = value.String()
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+
+	"photoroom/photoroom"
+	"photoroom/storage"
+)
+
+// Режимы обработки повторно загруженных файлов
+const (
+	dedupOff  = "off"
+	dedupSkip = "skip"
+	dedupLink = "link"
+)
+
+// Настройки дедупликации по содержимому
+type Dedup struct {
+	// off - обрабатывать повторы заново, skip - не отправлять их в API,
+	// link - создавать в processed символическую ссылку на прежний результат.
+	// Индекс хешей хранится в state_file.
+	Mode string `yaml:"mode"`
+}
+
+var hashesBucket = []byte("hashes")
+
+// Запись индекса хешей
+type hashEntry struct {
+	Source      string    `json:"source"`
+	Output      string    `json:"output"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+func validDedupMode(mode string) error {
+	switch mode {
+	case "", dedupOff, dedupSkip, dedupLink:
+		return nil
+	}
+	return fmt.Errorf("неизвестный режим дедупликации %q", mode)
+}
+
+// contentHash возвращает SHA-256 содержимого файла вместе с параметрами
+// обработки: то же изображение с другим профилем повтором не считается
+func contentHash(filePath string, profile Profile) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	params, err := yaml.Marshal(profile)
+	if err != nil {
+		return "", err
+	}
+	h.Write(params)
+	// Фоновое изображение могли заменить, не меняя путь
+	if bg := profile.Edit.Background.Image; bg != "" && !strings.Contains(bg, "://") {
+		data, err := os.ReadFile(bg)
+		if err != nil {
+			return "", err
+		}
+		h.Write(data)
+	}
+	// Результат песочницы с водяным знаком не подменяет настоящий
+	if config.Sandbox {
+		h.Write([]byte(photoroom.SandboxPrefix))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// findDuplicate ищет прежний результат обработки такого же файла.
+// Возвращает хеш файла и запись индекса, если результат еще существует.
+func findDuplicate(filePath string, profile Profile) (string, *hashEntry) {
+	if states == nil || config.Dedup.Mode == "" || config.Dedup.Mode == dedupOff {
+		return "", nil
+	}
+
+	hash, err := contentHash(filePath, profile)
+	if err != nil {
+		slog.Warn("failed to hash file", "file", filePath, "error", err)
+		return "", nil
+	}
+
+	entry, ok := states.getHash(hash)
+	if !ok {
+		return hash, nil
+	}
+	if !strings.HasPrefix(entry.Output, "s3://") {
+		if _, err := os.Stat(entry.Output); err != nil {
+			return hash, nil
+		}
+	}
+	return hash, &entry
+}
+
+// reuseOutput использует прежний результат для повторно загруженного файла
+func reuseOutput(filePath, profile, variant string, entry *hashEntry) (string, error) {
+	slog.Info("duplicate file, reusing output", "file", filePath, "original", entry.Source, "output", entry.Output)
+	metricFilesDeduplicated.inc("")
+
+	if config.Dedup.Mode != dedupLink || strings.HasPrefix(entry.Output, "s3://") {
+		return entry.Output, nil
+	}
+
+	outName, err := outputName(filePath, profile, variant, "", strings.TrimPrefix(filepath.Ext(entry.Output), "."))
+	if err != nil {
+		return "", err
+	}
+	target, err := outputPath(processedDir(filePath), filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Занимаем свободное имя и заменяем файл ссылкой
+	out, target, err := storage.CreateUnique(filepath.Join(filepath.Dir(target), outName))
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+	os.Remove(target)
+
+	err = os.Symlink(absPath(entry.Output), target)
+	if err != nil {
+		return "", fmt.Errorf("не удалось создать ссылку на результат: %w", err)
+	}
+	return target, nil
+}
+
+// getHash возвращает запись индекса хешей
+func (s *stateStore) getHash(hash string) (entry hashEntry, ok bool) {
+	if s == nil {
+		return entry, false
+	}
+
+	s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(hashesBucket).Get([]byte(hash))
+		if data != nil {
+			ok = json.Unmarshal(data, &entry) == nil
+		}
+		return nil
+	})
+	return entry, ok
+}
+
+// putHash запоминает результат обработки файла с хешем hash
+func (s *stateStore) putHash(hash, filePath, output string) {
+	if s == nil || hash == "" {
+		return
+	}
+
+	data, err := json.Marshal(hashEntry{
+		Source:      relPath(filePath),
+		Output:      output,
+		ProcessedAt: time.Now(),
+	})
+	if err == nil {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(hashesBucket).Put([]byte(hash), data)
+		})
+	}
+	if err != nil {
+		slog.Error("failed to update hash index", "file", filePath, "error", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Причина приостановки приема при нехватке места на диске
+const pauseDiskSpace = "disk_space"
+
+// Защита от нехватки места для результатов и архива исходников
+type DiskSpace struct {
+	// Приостанавливать прием, когда на томе processed_dir или destination_dir
+	// свободно меньше min_free байт; 0 - не проверять
+	MinFree int64 `yaml:"min_free"`
+	// Интервал проверки
+	Interval time.Duration `yaml:"interval"`
+}
+
+// guardedDirs возвращает директории, в которые пишутся результаты и исходники
+func guardedDirs() []string {
+	var dirs []string
+	for _, w := range allWatches() {
+		dirs = append(dirs, absPath(w.ProcessedDir))
+		if config.Archive.Policy != archiveDelete {
+			dirs = append(dirs, absPath(w.DestDir))
+		}
+	}
+	slices.Sort(dirs)
+	return slices.Compact(dirs)
+}
+
+// checkDiskSpace приостанавливает прием, если хотя бы на одном томе
+// свободно меньше min_free, и возобновляет его, когда места снова достаточно
+func checkDiskSpace() {
+	minFree := uint64(config.DiskSpace.MinFree)
+	for _, dir := range guardedDirs() {
+		free, err := freeSpace(existingDir(dir))
+		if err != nil {
+			slog.Debug("failed to check free disk space", "dir", dir, "error", err)
+			continue
+		}
+		if free >= minFree {
+			continue
+		}
+		if intake.pause(pauseDiskSpace) {
+			slog.Error("low disk space, intake paused", "dir", dir, "free", free, "min_free", minFree)
+			sendAlert(alertDiskSpace, fmt.Sprintf("Мало места на диске: в %s свободно %s (порог %s), прием файлов приостановлен",
+				dir, formatBytes(float64(free)), formatBytes(float64(minFree))))
+		}
+		return
+	}
+	if intake.resume(pauseDiskSpace) {
+		slog.Info("disk space available, intake resumed", "queued", jobs.depth())
+		sendAlert(alertDiskSpace, "Место на диске освободилось, прием файлов возобновлен")
+	}
+}
+
+// existingDir возвращает dir или ближайшую существующую родительскую директорию
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// diskSpaceLoop проверяет свободное место с интервалом disk_space.interval
+// до отмены ctx. Первая проверка выполняется сразу, до начала обработки.
+func diskSpaceLoop(ctx context.Context) {
+	if config.DiskSpace.MinFree <= 0 {
+		return
+	}
+	checkDiskSpace()
+
+	go func() {
+		ticker := time.NewTicker(config.DiskSpace.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkDiskSpace()
+			}
+		}
+	}()
+}
+
+// validDiskSpace проверяет секцию disk_space при загрузке конфигурации
+func validDiskSpace(d DiskSpace) error {
+	if d.MinFree < 0 {
+		return fmt.Errorf("min_free не может быть отрицательным")
+	}
+	if d.MinFree > 0 && d.Interval <= 0 {
+		return fmt.Errorf("interval должен быть больше нуля")
+	}
+	return nil
+}
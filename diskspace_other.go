@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+// freeSpace на этой платформе не определяется
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("свободное место на этой платформе не проверяется")
+}
@@ -0,0 +1,236 @@
+// Пакет dropbox - минимальный клиент Dropbox API v2: список файлов,
+// скачивание, загрузка, перенос и удаление по путям.
+package dropbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"photoroom/oauth"
+)
+
+// Адреса API.
+const (
+	APIURL     = "https://api.dropboxapi.com/2"
+	ContentURL = "https://content.dropboxapi.com/2"
+	TokenURL   = "https://api.dropboxapi.com/oauth2/token"
+)
+
+// Entry - файл или папка.
+type Entry struct {
+	Name string
+	Dir  bool
+	Size int64
+}
+
+// Client выполняет запросы от имени пользователя, выдавшего токен.
+type Client struct {
+	tokens     *oauth.TokenSource
+	httpClient *http.Client
+	apiURL     string
+	contentURL string
+}
+
+// New создает клиент. Если hc равен nil, используется http.DefaultClient.
+func New(tokens *oauth.TokenSource, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{tokens: tokens, httpClient: hc, apiURL: APIURL, contentURL: ContentURL}
+}
+
+// Error - ответ API с ошибкой.
+type Error struct {
+	StatusCode int
+	Summary    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ошибка Dropbox (%d): %s", e.StatusCode, e.Summary)
+}
+
+// Conflict сообщает, что путь уже занят.
+func (e *Error) Conflict() bool {
+	return e.StatusCode == http.StatusConflict && strings.Contains(e.Summary, "conflict")
+}
+
+// apiPath приводит путь к виду API: корень - пустая строка
+func apiPath(p string) string {
+	if p == "/" || p == "." {
+		return ""
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "/" + p
+	}
+	return p
+}
+
+// do выполняет запрос. arg передается в заголовке Dropbox-API-Arg
+// для запросов к содержимому или телом для остальных.
+func (c *Client) do(ctx context.Context, base, endpoint string, arg any, body io.Reader) (*http.Response, error) {
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := "application/json"
+	if base == c.contentURL {
+		contentType = "application/octet-stream"
+	} else {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if base == c.contentURL {
+		req.Header.Set("Dropbox-API-Arg", asciiJSON(data))
+		if body == nil {
+			contentType = ""
+		}
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusUnauthorized {
+			c.tokens.Invalidate()
+		}
+		msg, _ := io.ReadAll(res.Body)
+		var apiErr struct {
+			Summary string `json:"error_summary"`
+		}
+		summary := strings.TrimSpace(string(msg))
+		if json.Unmarshal(msg, &apiErr) == nil && apiErr.Summary != "" {
+			summary = apiErr.Summary
+		}
+		return nil, &Error{StatusCode: res.StatusCode, Summary: summary}
+	}
+	return res, nil
+}
+
+// call выполняет запрос к API и разбирает ответ в out
+func (c *Client) call(ctx context.Context, endpoint string, arg, out any) error {
+	res, err := c.do(ctx, c.apiURL, endpoint, arg, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// asciiJSON экранирует символы вне ASCII: заголовок HTTP их не допускает
+func asciiJSON(data []byte) string {
+	var b strings.Builder
+	for _, r := range string(data) {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+			continue
+		}
+		if r > 0xFFFF {
+			r -= 0x10000
+			fmt.Fprintf(&b, `\u%04x\u%04x`, 0xD800+(r>>10), 0xDC00+(r&0x3FF))
+			continue
+		}
+		fmt.Fprintf(&b, `\u%04x`, r)
+	}
+	return b.String()
+}
+
+// List возвращает содержимое папки dir.
+func (c *Client) List(ctx context.Context, dir string) ([]Entry, error) {
+	type page struct {
+		Entries []struct {
+			Tag  string `json:".tag"`
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		} `json:"entries"`
+		Cursor  string `json:"cursor"`
+		HasMore bool   `json:"has_more"`
+	}
+
+	var entries []Entry
+	var p page
+	err := c.call(ctx, "/files/list_folder", map[string]any{"path": apiPath(dir)}, &p)
+	for err == nil {
+		for _, e := range p.Entries {
+			// Удаленные файлы (deleted) пропускаем
+			if e.Tag == "file" || e.Tag == "folder" {
+				entries = append(entries, Entry{Name: e.Name, Dir: e.Tag == "folder", Size: e.Size})
+			}
+		}
+		if !p.HasMore {
+			return entries, nil
+		}
+		cursor := p.Cursor
+		p = page{}
+		err = c.call(ctx, "/files/list_folder/continue", map[string]string{"cursor": cursor}, &p)
+	}
+	return nil, err
+}
+
+// Download скачивает файл name в w.
+func (c *Client) Download(ctx context.Context, name string, w io.Writer) error {
+	res, err := c.do(ctx, c.contentURL, "/files/download", map[string]string{"path": apiPath(name)}, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Upload загружает r в файл name, заменяя существующий. Файл появляется
+// в Dropbox только после загрузки целиком; недостающие папки создаются.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader) error {
+	arg := map[string]any{"path": apiPath(name), "mode": "overwrite", "mute": true}
+	res, err := c.do(ctx, c.contentURL, "/files/upload", arg, r)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Move переносит файл from в to; недостающие папки создаются.
+func (c *Client) Move(ctx context.Context, from, to string) error {
+	return c.call(ctx, "/files/move_v2", map[string]string{"from_path": apiPath(from), "to_path": apiPath(to)}, nil)
+}
+
+// Delete удаляет файл name.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	return c.call(ctx, "/files/delete_v2", map[string]string{"path": apiPath(name)}, nil)
+}
+
+// MakeDirAll создает папку dir вместе с родительскими, если ее нет.
+func (c *Client) MakeDirAll(ctx context.Context, dir string) error {
+	if apiPath(dir) == "" {
+		return nil
+	}
+	err := c.call(ctx, "/files/create_folder_v2", map[string]string{"path": apiPath(dir)}, nil)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Conflict() {
+		return nil
+	}
+	return err
+}
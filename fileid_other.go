@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package main
+
+// fileIdentity на этой платформе не поддерживается
+func fileIdentity(path string) (fileID, bool) {
+	return fileID{}, false
+}
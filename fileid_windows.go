@@ -0,0 +1,31 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// fileIdentity возвращает серийный номер тома и индекс файла
+func fileIdentity(path string) (fileID, bool) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return fileID{}, false
+	}
+	// Файл открывается без доступа к данным, чтобы не мешать записи в него
+	h, err := syscall.CreateFile(name, 0,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return fileID{}, false
+	}
+	defer syscall.CloseHandle(h)
+
+	var info syscall.ByHandleFileInformation
+	err = syscall.GetFileInformationByHandle(h, &info)
+	if err != nil {
+		return fileID{}, false
+	}
+	return fileID{
+		dev: uint64(info.VolumeSerialNumber),
+		ino: uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow),
+	}, true
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"photoroom/storage"
+)
+
+func createDirIfNotExists(dir string) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			fatal("failed to create directory", "dir", dir, "error", err)
+		}
+	}
+}
+
+func isDirectory(path string) bool {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		slog.Warn("failed to stat file", "file", path, "error", err)
+		return false
+	}
+	return fileInfo.IsDir()
+}
+
+// Дополнительные корневые директории, переданные команде process
+var (
+	rootsMu     sync.Mutex
+	sourceRoots []string
+)
+
+func addSourceRoot(dir string) {
+	rootsMu.Lock()
+	sourceRoots = append(sourceRoots, dir)
+	rootsMu.Unlock()
+}
+
+// relPath возвращает путь файла относительно отслеживаемой директории
+// (или другой корневой директории), чтобы повторить структуру
+// поддиректорий в выходных директориях. Для вложенных корневых
+// директорий выбирается самая глубокая.
+func relPath(filePath string) string {
+	var roots []string
+	for _, w := range allWatches() {
+		roots = append(roots, w.SourceDir)
+	}
+	rootsMu.Lock()
+	roots = append(roots, sourceRoots...)
+	rootsMu.Unlock()
+
+	best, bestLen := filepath.Base(filePath), -1
+	for _, root := range roots {
+		root = absPath(root)
+		rel, err := filepath.Rel(root, absPath(filePath))
+		if err == nil && filepath.IsLocal(rel) && len(root) > bestLen {
+			best, bestLen = rel, len(root)
+		}
+	}
+	return best
+}
+
+// Идентификатор файла, не зависящий от пути: устройство и inode
+// (на Windows - том и индекс файла)
+type fileID struct {
+	dev, ino uint64
+}
+
+// absPath возвращает абсолютный путь, чтобы один файл, найденный
+// по относительному и абсолютному пути, не считался двумя разными
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
+// outputPath возвращает путь в dir, повторяющий расположение файла в source,
+// и создает недостающие поддиректории
+func outputPath(dir, filePath string) (string, error) {
+	target := filepath.Join(dir, relPath(filePath))
+	err := os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// writeTemp записывает r во временный файл .tmp-<name>-* в dir
+// и возвращает его путь. При ошибке файл удаляется.
+func writeTemp(dir, name string, r io.Reader) (string, error) {
+	file, err := os.CreateTemp(dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Что делать, если в destination_dir, failed_dir или skipped_dir уже есть
+// файл с таким именем: version и overwrite - как в output_exists, dated -
+// перенести в поддиректорию с текущей датой (destination_dir/2024-06-01/)
+const destDated = "dated"
+
+func validDestinationExists(policy string) error {
+	switch policy {
+	case "", outputVersion, outputOverwrite, destDated:
+		return nil
+	}
+	return fmt.Errorf("неизвестное значение destination_exists %q, ожидается %s, %s или %s",
+		policy, outputVersion, outputOverwrite, destDated)
+}
+
+// placeFile переносит (при keep - копирует) файл src в destDir с сохранением
+// поддиректорий. Если файл с таким именем уже есть, поступает согласно
+// destination_exists. Возвращает путь результата.
+func placeFile(src, destDir string, keep bool) (string, error) {
+	transfer := renameFile
+	if keep {
+		transfer = copyFile
+	}
+	target, err := outputPath(destDir, src)
+	if err != nil {
+		return "", err
+	}
+
+	switch config.DestinationExists {
+	case outputOverwrite:
+		return target, transfer(src, target)
+	case destDated:
+		if _, err := os.Lstat(target); err == nil {
+			target, err = outputPath(filepath.Join(destDir, time.Now().Format(time.DateOnly)), src)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// Свободное имя занимается без перезаписи существующих файлов.
+	// Копия и перенос с другой файловой системы сначала пишутся во
+	// временный файл рядом с целью.
+	if !keep {
+		placed, err := storage.PlaceUnique(src, target)
+		if err == nil || !isCrossDevice(err) {
+			return placed, err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-"+filepath.Base(target)+"-*")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	err = copyFile(src, tmp.Name())
+	if err == nil {
+		target, err = storage.PlaceUnique(tmp.Name(), target)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if !keep {
+		os.Remove(src)
+	}
+	return target, nil
+}
+
+// moveFile переносит файл вместе с его sidecar-файлом в destDir
+// с сохранением поддиректорий и возвращает новый путь
+func moveFile(src string, destDir string) (string, error) {
+	sidecar := sidecarPath(src)
+
+	target, err := placeFile(src, destDir, false)
+	if err != nil {
+		slog.Error("failed to move file", "file", src, "destination", destDir, "error", err)
+		return "", err
+	}
+	slog.Info("file moved", "file", src, "destination", target)
+
+	if sidecar != "" {
+		err = renameFile(sidecar, target+filepath.Ext(sidecar))
+		if err != nil {
+			slog.Warn("failed to move sidecar file", "file", sidecar, "error", err)
+		}
+	}
+	return target, nil
+}
+
+// renameFile переносит файл src в dst. Если они на разных файловых системах
+// (например, destination на сетевом диске), файл копируется через copyFile,
+// после чего src удаляется.
+func renameFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	err = copyFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile копирует src в dst через временный файл рядом с dst,
+// сохраняя права и время изменения
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTemp(filepath.Dir(dst), filepath.Base(dst), in)
+	in.Close()
+	if err != nil {
+		return fmt.Errorf("не удалось скопировать %s: %w", src, err)
+	}
+
+	os.Chmod(tmp, info.Mode().Perm())
+	os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errSkipped - файл не подлежит обработке
+var errSkipped = errors.New("файл пропущен")
+
+// Настройки отбора файлов
+type Filter struct {
+	// Шаблоны имен в синтаксисе filepath.Match. Шаблон с "!" исключает файлы.
+	// Если есть хотя бы один включающий шаблон, обрабатываются только
+	// подходящие под него файлы. Шаблон с "/" сравнивается с путем
+	// относительно source, без "/" - с именем файла.
+	Patterns []string `yaml:"patterns"`
+	// Проверять по содержимому, что файл является изображением
+	SniffMIME bool `yaml:"sniff_mime"`
+	// Максимальный размер файла в байтах; 0 - без ограничения
+	MaxFileSize int64 `yaml:"max_file_size"`
+	// Куда переносить файлы, не прошедшие проверку содержимого.
+	// Если не задано, такие файлы остаются на месте.
+	SkippedDir string `yaml:"skipped_dir"`
+}
+
+// matchPatterns сообщает, проходит ли файл по шаблонам имен
+func matchPatterns(filePath string, patterns []string) bool {
+	rel := filepath.ToSlash(relPath(filePath))
+	name := filepath.Base(filePath)
+
+	included, hasInclude := false, false
+	for _, pattern := range patterns {
+		exclude := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		subject := name
+		if strings.Contains(pattern, "/") {
+			subject = rel
+		}
+		ok, err := filepath.Match(strings.ToLower(pattern), strings.ToLower(subject))
+		if err != nil {
+			slog.Warn("invalid filter pattern", "pattern", pattern, "error", err)
+			continue
+		}
+
+		if exclude {
+			if ok {
+				return false
+			}
+			continue
+		}
+		hasInclude = true
+		included = included || ok
+	}
+	return included || !hasInclude
+}
+
+// accepted сообщает, нужно ли ставить файл в очередь. Файлы,
+// отсеянные по имени (временные, служебные), просто игнорируются.
+// Задания с адресом изображения принимаются независимо от шаблонов.
+func accepted(filePath string) bool {
+	return !isSidecar(filePath) && !isBatchMarker(filePath) && (isURLJob(filePath) || matchPatterns(filePath, config.Filter.Patterns))
+}
+
+// checkContent проверяет размер файла и по первым байтам - что он является изображением
+func checkContent(filePath string) error {
+	if isURLJob(filePath) {
+		return nil
+	}
+	if limit := config.Filter.MaxFileSize; limit > 0 {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		if info.Size() > limit {
+			return fmt.Errorf("%w: файл слишком большой (%d байт, максимум %d)", errSkipped, info.Size(), limit)
+		}
+	}
+	// Форматы для преобразования проверяет сама утилита преобразования
+	if transcodeRule(filePath) != nil {
+		return nil
+	}
+
+	head, err := readHead(filePath, 512)
+	if err != nil {
+		return err
+	}
+	// TIFF, PSD и GIF API не принимает, но они сводятся в PNG
+	if format := localFormat(head); format != "" {
+		return checkLocalFormat(filePath, format)
+	}
+	if !config.Filter.SniffMIME {
+		return nil
+	}
+
+	contentType := http.DetectContentType(head)
+	if !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("%w: содержимое не является изображением (%s)", errSkipped, contentType)
+	}
+	return nil
+}
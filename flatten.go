@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"strings"
+
+	_ "golang.org/x/image/tiff"
+)
+
+// Что делать с исходниками TIFF, PSD и GIF, которые API не принимает
+type InputFormats struct {
+	// convert - свести в PNG перед отправкой, skip - перенести в skipped_dir
+	TIFF string `yaml:"tiff"`
+	PSD  string `yaml:"psd"`
+	GIF  string `yaml:"gif"`
+	// Анимированные GIF и многостраничные TIFF: first - обработать первый
+	// кадр, reject - перенести в skipped_dir, all - обработать каждый кадр
+	// GIF и собрать анимацию (у TIFF обрабатывается первая страница)
+	Frames string `yaml:"frames"`
+	// GIF с большим числом кадров при frames: all пропускается; 0 - без ограничения
+	MaxFrames int `yaml:"max_frames"`
+}
+
+const (
+	formatConvert = "convert"
+	formatSkip    = "skip"
+)
+
+// localFormat определяет по первым байтам файла TIFF, PSD или GIF
+func localFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif"
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "tiff"
+	case bytes.HasPrefix(head, []byte("8BPS")):
+		return "psd"
+	}
+	return ""
+}
+
+func (f InputFormats) policy(format string) string {
+	switch format {
+	case "psd":
+		return f.PSD
+	case "gif":
+		return f.GIF
+	}
+	return f.TIFF
+}
+
+// checkLocalFormat пропускает исходник TIFF, PSD или GIF, если его не нужно
+// сводить, а также анимацию согласно input_formats.frames
+func checkLocalFormat(filePath, format string) error {
+	if config.InputFormats.policy(format) == formatSkip {
+		return fmt.Errorf("%w: формат %s не поддерживается API", errSkipped, strings.ToUpper(format))
+	}
+	return checkFrames(filePath, format)
+}
+
+// flattenFormat возвращает формат исходника, если его нужно свести в PNG
+func flattenFormat(filePath string) (string, error) {
+	head, err := readHead(filePath, 6)
+	if err != nil {
+		return "", err
+	}
+	format := localFormat(head)
+	if format == "" || config.InputFormats.policy(format) != formatConvert {
+		return "", nil
+	}
+	return format, nil
+}
+
+// flattenSource сводит исходник в PNG с путем out.png, а анимированный
+// GIF при input_formats.frames: all - в PNG по кадрам. Возвращает контекст,
+// в котором uploadPath указывает на PNG (первый кадр).
+func flattenSource(ctx context.Context, filePath, format, out string) (context.Context, error) {
+	if format == "gif" && config.InputFormats.Frames == framesAll {
+		anim, err := extractFrames(filePath, out)
+		if err != nil {
+			return ctx, err
+		}
+		if anim != nil {
+			slog.Info("processing animation frame by frame", "file", filePath, "frames", len(anim.frames))
+			ctx = context.WithValue(ctx, framesKey{}, anim)
+			return context.WithValue(ctx, transcodedKey{}, anim.frames[0]), nil
+		}
+	}
+
+	out += ".png"
+	err := flattenImage(filePath, out)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, transcodedKey{}, out), nil
+}
+
+// flattenImage сводит TIFF (первую страницу), PSD или GIF (первый кадр)
+// и сохраняет в PNG
+func flattenImage(filePath, out string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+	return writePNG(out, img)
+}
+
+// validInputFormats проверяет секцию input_formats при загрузке конфигурации
+func validInputFormats(f InputFormats) error {
+	for _, policy := range []string{f.TIFF, f.PSD, f.GIF} {
+		if policy != formatConvert && policy != formatSkip {
+			return fmt.Errorf("неизвестное значение %q, ожидается %s или %s", policy, formatConvert, formatSkip)
+		}
+	}
+	switch f.Frames {
+	case framesFirst, framesReject, framesAll:
+	default:
+		return fmt.Errorf("неизвестное значение frames %q, ожидается %s, %s или %s", f.Frames, framesFirst, framesReject, framesAll)
+	}
+	if f.MaxFrames < 0 {
+		return fmt.Errorf("max_frames не может быть отрицательным")
+	}
+	return nil
+}
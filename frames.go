@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"photoroom/photoroom"
+)
+
+// Обработка анимированных GIF и многостраничных TIFF (input_formats.frames)
+const (
+	// Обработать первый кадр
+	framesFirst = "first"
+	// Пропустить файл
+	framesReject = "reject"
+	// Обработать каждый кадр GIF и собрать анимацию из результатов
+	framesAll = "all"
+)
+
+// Кадры анимированного GIF, сохраненные в PNG для отправки в API
+type animation struct {
+	frames []string
+	// Задержки кадров в сотых долях секунды и число повторов из исходника
+	delay     []int
+	loopCount int
+}
+
+type framesKey struct{}
+
+// sourceFrames возвращает кадры исходника, если каждый из них
+// отправляется в API отдельно
+func sourceFrames(ctx context.Context) *animation {
+	anim, _ := ctx.Value(framesKey{}).(*animation)
+	return anim
+}
+
+// checkFrames пропускает анимированный GIF или многостраничный TIFF
+// согласно input_formats.frames
+func checkFrames(filePath, format string) error {
+	f := config.InputFormats
+	if format == "psd" || f.Frames == framesFirst {
+		return nil
+	}
+	frames, err := countFrames(filePath, format)
+	if err != nil || frames <= 1 {
+		// Поврежденный файл отклонит сведение в PNG
+		return nil
+	}
+
+	switch {
+	case f.Frames == framesReject:
+		return fmt.Errorf("%w: %s из %d кадров, обрабатываются только одиночные изображения", errSkipped, strings.ToUpper(format), frames)
+	case format == "tiff":
+		slog.Warn("only the first page of a multi-page TIFF is processed", "file", filePath, "pages", frames)
+	case f.MaxFrames > 0 && frames > f.MaxFrames:
+		return fmt.Errorf("%w: %d кадров GIF, максимум %d", errSkipped, frames, f.MaxFrames)
+	}
+	return nil
+}
+
+// countFrames возвращает число кадров GIF или страниц TIFF
+func countFrames(filePath, format string) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if format == "tiff" {
+		return tiffPages(file)
+	}
+	g, err := gif.DecodeAll(file)
+	if err != nil {
+		return 0, err
+	}
+	return len(g.Image), nil
+}
+
+// tiffPages считает страницы TIFF по цепочке IFD
+func tiffPages(r io.ReaderAt) (int, error) {
+	var header [8]byte
+	_, err := r.ReadAt(header[:], 0)
+	if err != nil {
+		return 0, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if string(header[:2]) == "MM" {
+		order = binary.BigEndian
+	}
+
+	pages := 0
+	seen := make(map[uint32]bool)
+	for offset := order.Uint32(header[4:]); offset != 0; pages++ {
+		if seen[offset] || pages > 10000 {
+			return 0, errors.New("tiff: зацикленная цепочка страниц")
+		}
+		seen[offset] = true
+
+		var buf [4]byte
+		_, err = r.ReadAt(buf[:2], int64(offset))
+		if err != nil {
+			return 0, err
+		}
+		entries := int64(order.Uint16(buf[:2]))
+		_, err = r.ReadAt(buf[:], int64(offset)+2+entries*12)
+		if err != nil {
+			return 0, err
+		}
+		offset = order.Uint32(buf[:])
+	}
+	return pages, nil
+}
+
+// extractFrames сохраняет кадры анимированного GIF в PNG с путями
+// out-001.png, out-002.png и т.д. Кадры собираются на холсте с учетом
+// способа удаления предыдущего кадра, поэтому каждый PNG - полный кадр.
+// Для GIF из одного кадра возвращает nil.
+func extractFrames(filePath, out string) (*animation, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	g, err := gif.DecodeAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) <= 1 {
+		return nil, nil
+	}
+
+	anim := &animation{delay: g.Delay, loopCount: g.LoopCount}
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewNRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		path := fmt.Sprintf("%s-%03d.png", out, i+1)
+		err = writePNG(path, canvas)
+		if err != nil {
+			return nil, err
+		}
+		anim.frames = append(anim.frames, path)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return anim, nil
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, img)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sendFrames отправляет в API каждый кадр анимации и собирает из
+// результатов GIF с задержками и числом повторов исходника.
+// Каждый кадр - отдельный запрос и расход кредитов.
+func sendFrames(ctx context.Context, anim *animation, v variantProfile) (*photoroom.Result, error) {
+	images := make([]image.Image, len(anim.frames))
+	var header http.Header
+	credits := creditsFor(ctx)
+	for i, path := range anim.frames {
+		img, h, err := sendFrame(ctx, path, v)
+		if err != nil {
+			return nil, fmt.Errorf("кадр %d из %d: %w", i+1, len(anim.frames), err)
+		}
+		images[i], header = img, h
+		// Последний кадр учитывается вызывающим как обычный запрос
+		if i < len(anim.frames)-1 {
+			credits.observe(v.Mode, h)
+		}
+	}
+
+	data, err := assembleGIF(anim, images)
+	if err != nil {
+		return nil, err
+	}
+	return &photoroom.Result{ContentType: "image/gif", Image: data, Header: header}, nil
+}
+
+func sendFrame(ctx context.Context, path string, v variantProfile) (image.Image, http.Header, error) {
+	source, err := sourceImage(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file, ok := source.(io.Closer); ok {
+		defer file.Close()
+	}
+	result, err := v.send(ctx, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.File != "" {
+		defer os.Remove(result.File)
+	}
+	data, err := result.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errCorruptOutput, err)
+	}
+	return img, result.Header, nil
+}
+
+// Палитра кадров результата: прозрачный цвет и 255 цветов Plan 9
+var framePalette = append(color.Palette{color.Transparent}, palette.Plan9[:255]...)
+
+// assembleGIF собирает анимацию из результатов обработки кадров.
+// Кадры сводятся к палитре из 256 цветов с рассеиванием ошибки.
+// Каждый кадр полностью заменяет предыдущий, поэтому прозрачный
+// фон результата не накладывается на прежние кадры.
+func assembleGIF(anim *animation, images []image.Image) ([]byte, error) {
+	g := &gif.GIF{LoopCount: anim.loopCount}
+	for i, img := range images {
+		b := img.Bounds()
+		paletted := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), framePalette)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, b.Min)
+
+		g.Image = append(g.Image, paletted)
+		g.Delay = append(g.Delay, anim.delay[i])
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+		g.Config.Width = max(g.Config.Width, b.Dx())
+		g.Config.Height = max(g.Config.Height, b.Dy())
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, g)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось собрать GIF: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,411 @@
+// Пакет ftp - минимальный клиент FTP и FTPS (явный TLS, AUTH TLS):
+// список файлов, скачивание, загрузка, переименование и удаление
+// в пассивном режиме.
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config - параметры подключения к серверу.
+type Config struct {
+	// Адрес сервера host:port; без порта используется 21
+	Addr     string
+	User     string
+	Password string
+	// TLS включает шифрование управляющего соединения и передачи данных
+	TLS bool
+	// TLSConfig - настройки TLS; если nil, проверяется сертификат сервера
+	TLSConfig *tls.Config
+	// Timeout ограничивает установку соединений
+	Timeout time.Duration
+}
+
+// Entry - файл или директория на сервере.
+type Entry struct {
+	Name string
+	Dir  bool
+	Size int64
+}
+
+// Client - сеанс работы с сервером. Не безопасен для одновременного
+// использования из нескольких горутин.
+type Client struct {
+	cfg    Config
+	host   string
+	conn   net.Conn
+	text   *textproto.Conn
+	dialer net.Dialer
+}
+
+// Dial подключается к серверу и входит под пользователем из cfg.
+func Dial(ctx context.Context, cfg Config) (*Client, error) {
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		cfg.Addr = net.JoinHostPort(cfg.Addr, "21")
+	}
+	host, _, _ := net.SplitHostPort(cfg.Addr)
+	if cfg.User == "" {
+		cfg.User = "anonymous"
+	}
+	if cfg.TLS {
+		tlsConfig := &tls.Config{}
+		if cfg.TLSConfig != nil {
+			tlsConfig = cfg.TLSConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		// Многие серверы требуют, чтобы соединения данных продолжали
+		// TLS-сессию управляющего соединения
+		if tlsConfig.ClientSessionCache == nil {
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+		}
+		cfg.TLSConfig = tlsConfig
+	}
+
+	c := &Client{cfg: cfg, host: host, dialer: net.Dialer{Timeout: cfg.Timeout}}
+	conn, err := c.dialer.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c.setConn(conn)
+
+	err = c.login(ctx)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) setConn(conn net.Conn) {
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+}
+
+// login выполняет приветствие, включает TLS и входит на сервер
+func (c *Client) login(ctx context.Context) error {
+	stop := c.watch(ctx)
+	defer stop()
+
+	_, _, err := c.text.ReadResponse(220)
+	if err != nil {
+		return err
+	}
+
+	if c.cfg.TLS {
+		_, _, err = c.cmd(234, "AUTH TLS")
+		if err != nil {
+			return err
+		}
+		tlsConn := tls.Client(c.conn, c.cfg.TLSConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return err
+		}
+		c.setConn(tlsConn)
+	}
+
+	code, _, err := c.cmd(0, "USER %s", c.cfg.User)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		_, _, err = c.cmd(230, "PASS %s", c.cfg.Password)
+		if err != nil {
+			return err
+		}
+	} else if code != 230 {
+		return &textproto.Error{Code: code, Msg: "неожиданный ответ на USER"}
+	}
+
+	if c.cfg.TLS {
+		_, _, err = c.cmd(200, "PBSZ 0")
+		if err == nil {
+			_, _, err = c.cmd(200, "PROT P")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, _, err = c.cmd(200, "TYPE I")
+	return err
+}
+
+// watch прерывает операции с соединением при отмене ctx.
+// Возвращает функцию, которую нужно вызвать по окончании операции.
+func (c *Client) watch(ctx context.Context) func() {
+	conn := c.conn
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		stop()
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// cmd отправляет команду и читает ответ. expect - ожидаемый код ответа
+// (или его первая цифра); 0 принимает любой код. Аргументы с переводом
+// строки отклоняются: иначе они добавили бы на сервере лишние команды.
+func (c *Client) cmd(expect int, format string, args ...any) (int, string, error) {
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && strings.ContainsAny(s, "\r\n") {
+			return 0, "", fmt.Errorf("недопустимый перевод строки в аргументе %q", s)
+		}
+	}
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expect)
+}
+
+// dataConn открывает соединение для передачи данных в пассивном режиме
+// и отправляет команду, которая по нему передает данные. Отмену ctx
+// во время передачи вызывающий обрабатывает сам, закрывая соединение.
+func (c *Client) dataConn(ctx context.Context, format string, args ...any) (net.Conn, error) {
+	addr, err := c.passive()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = c.cmd(1, format, args...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.cfg.TLS {
+		tlsConn := tls.Client(conn, c.cfg.TLSConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// passive возвращает адрес для соединения данных. Адрес из ответа PASV
+// не используется: за NAT сервер часто сообщает внутренний адрес.
+func (c *Client) passive() (string, error) {
+	_, msg, err := c.cmd(229, "EPSV")
+	if err == nil {
+		// Entering Extended Passive Mode (|||6446|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start {
+			return "", fmt.Errorf("неверный ответ EPSV: %s", msg)
+		}
+		return net.JoinHostPort(c.host, msg[start+4:end]), nil
+	}
+
+	_, msg, err = c.cmd(227, "PASV")
+	if err != nil {
+		return "", err
+	}
+	// Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("неверный ответ PASV: %s", msg)
+	}
+	parts := strings.Split(msg[start+1:end], ",")
+	if len(parts) != 6 {
+		return "", fmt.Errorf("неверный ответ PASV: %s", msg)
+	}
+	p1, err1 := strconv.Atoi(parts[4])
+	p2, err2 := strconv.Atoi(parts[5])
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("неверный ответ PASV: %s", msg)
+	}
+	return net.JoinHostPort(c.host, strconv.Itoa(p1<<8|p2)), nil
+}
+
+// finish закрывает соединение данных и читает итог передачи
+func (c *Client) finish(conn net.Conn, err error) error {
+	closeErr := conn.Close()
+	_, _, respErr := c.text.ReadResponse(2)
+	return errors.Join(err, closeErr, respErr)
+}
+
+// List возвращает содержимое директории dir без "." и "..".
+func (c *Client) List(ctx context.Context, dir string) ([]Entry, error) {
+	stop := c.watch(ctx)
+	defer stop()
+
+	entries, err := c.list(ctx, "MLSD", dir, parseMLSD)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 && protoErr.Code <= 504 {
+		// Сервер без MLSD: разбираем вывод LIST в формате ls -l
+		entries, err = c.list(ctx, "LIST", dir, parseLIST)
+	}
+	return entries, err
+}
+
+func (c *Client) list(ctx context.Context, command, dir string, parse func(string) (Entry, bool)) ([]Entry, error) {
+	conn, err := c.dataConn(ctx, "%s %s", command, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		entry, ok := parse(strings.TrimRight(scanner.Text(), "\r"))
+		if ok && entry.Name != "." && entry.Name != ".." {
+			entries = append(entries, entry)
+		}
+	}
+	err = c.finish(conn, scanner.Err())
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseMLSD разбирает строку вида "type=file;size=123;modify=...; name"
+func parseMLSD(line string) (Entry, bool) {
+	facts, name, ok := strings.Cut(line, " ")
+	if !ok {
+		return Entry{}, false
+	}
+	entry := Entry{Name: path.Base(name)}
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, _ := strings.Cut(fact, "=")
+		switch strings.ToLower(key) {
+		case "type":
+			switch strings.ToLower(value) {
+			case "dir":
+				entry.Dir = true
+			case "file":
+			default:
+				// cdir, pdir и ссылки пропускаем
+				return Entry{}, false
+			}
+		case "size":
+			entry.Size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return entry, true
+}
+
+// parseLIST разбирает строку в формате ls -l:
+// "-rw-r--r--   1 owner group   1234 Jan 01 12:00 name"
+func parseLIST(line string) (Entry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 9 || (line[0] != '-' && line[0] != 'd') {
+		return Entry{}, false
+	}
+	// Имя может содержать пробелы: берем все после восьмого поля
+	rest := line
+	for range 8 {
+		rest = strings.TrimLeft(rest, " ")
+		rest = rest[strings.IndexByte(rest, ' '):]
+	}
+	size, _ := strconv.ParseInt(fields[4], 10, 64)
+	return Entry{Name: strings.TrimLeft(rest, " "), Dir: line[0] == 'd', Size: size}, true
+}
+
+// Retrieve скачивает файл name в w.
+func (c *Client) Retrieve(ctx context.Context, name string, w io.Writer) error {
+	stop := c.watch(ctx)
+	defer stop()
+
+	conn, err := c.dataConn(ctx, "RETR %s", name)
+	if err != nil {
+		return err
+	}
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+	_, err = io.Copy(w, conn)
+	return c.finish(conn, err)
+}
+
+// Store загружает r в файл name, перезаписывая его.
+func (c *Client) Store(ctx context.Context, name string, r io.Reader) error {
+	stop := c.watch(ctx)
+	defer stop()
+
+	conn, err := c.dataConn(ctx, "STOR %s", name)
+	if err != nil {
+		return err
+	}
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+	_, err = io.Copy(conn, r)
+	return c.finish(conn, err)
+}
+
+// Rename переименовывает файл from в to.
+func (c *Client) Rename(ctx context.Context, from, to string) error {
+	stop := c.watch(ctx)
+	defer stop()
+
+	_, _, err := c.cmd(350, "RNFR %s", from)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.cmd(250, "RNTO %s", to)
+	return err
+}
+
+// Delete удаляет файл name.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	stop := c.watch(ctx)
+	defer stop()
+
+	_, _, err := c.cmd(250, "DELE %s", name)
+	return err
+}
+
+// MakeDirAll создает директорию dir вместе с недостающими родительскими.
+// Ошибки для уже существующих директорий не возвращаются.
+func (c *Client) MakeDirAll(ctx context.Context, dir string) error {
+	stop := c.watch(ctx)
+	defer stop()
+
+	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		current = path.Join(current, part)
+		// Существующая директория дает ошибку 550, как и нехватка прав;
+		// во втором случае ошибку вернет загрузка файла
+		_, _, err := c.cmd(257, "MKD %s", current)
+		var protoErr *textproto.Error
+		if err != nil && !(errors.As(err, &protoErr) && protoErr.Code == 550) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close завершает сеанс.
+func (c *Client) Close() error {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c.cmd(0, "QUIT")
+	return c.conn.Close()
+}
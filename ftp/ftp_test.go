@@ -0,0 +1,85 @@
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient возвращает клиент, подключенный к серверу на другом конце
+// net.Pipe. Сервер принимает каждую команду и передает ее в канал.
+func newTestClient(t *testing.T) (*Client, <-chan string) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	lines := make(chan string, 16)
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines <- line
+			code := "250"
+			switch {
+			case strings.HasPrefix(line, "RNFR"):
+				code = "350"
+			case strings.HasPrefix(line, "MKD"):
+				code = "257"
+			}
+			server.Write([]byte(code + " OK\r\n"))
+		}
+	}()
+
+	c := &Client{}
+	c.setConn(client)
+	return c, lines
+}
+
+func TestCommandsRejectLineBreaks(t *testing.T) {
+	c, lines := newTestClient(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"DELE", func() error { return c.Delete(ctx, "a.jpg\r\nDELE important.jpg") }},
+		{"RNFR", func() error { return c.Rename(ctx, "a\njpg", "b.jpg") }},
+		{"RNTO", func() error { return c.Rename(ctx, "a.jpg", "b\r.jpg") }},
+		{"MKD", func() error { return c.MakeDirAll(ctx, "in/x\r\nSITE CHMOD 777 /") }},
+	}
+	for _, tt := range tests {
+		if err := tt.run(); err == nil || !strings.Contains(err.Error(), "перевод строки") {
+			t.Errorf("%s: err = %v, want line break error", tt.name, err)
+		}
+	}
+
+	err := c.Delete(ctx, "name with spaces.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Серверу ушли только команды с допустимыми аргументами: RNFR перед
+	// отклоненным RNTO и MKD родительской директории
+	want := []string{"RNFR a.jpg", "MKD in", "DELE name with spaces.jpg"}
+	for _, line := range want {
+		select {
+		case got := <-lines:
+			if got != line {
+				t.Errorf("command = %q, want %q", got, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("command %q not sent", line)
+		}
+	}
+}
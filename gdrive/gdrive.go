@@ -0,0 +1,385 @@
+// Пакет gdrive - минимальный клиент Google Drive API v3: список файлов,
+// скачивание, загрузка, перенос и удаление в корзину по путям от
+// корневой папки.
+package gdrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"photoroom/oauth"
+)
+
+// Адреса API.
+const (
+	APIURL    = "https://www.googleapis.com/drive/v3"
+	UploadURL = "https://www.googleapis.com/upload/drive/v3"
+	TokenURL  = "https://oauth2.googleapis.com/token"
+)
+
+// Тип папки; файлы Google Docs и других редакторов без содержимого
+// имеют типы с тем же префиксом
+const (
+	folderType   = "application/vnd.google-apps.folder"
+	nativePrefix = "application/vnd.google-apps."
+)
+
+// Entry - файл или папка.
+type Entry struct {
+	Name string
+	Dir  bool
+	Size int64
+}
+
+// Client работает с файлами внутри корневой папки. Пути разделяются
+// символом "/" и отсчитываются от нее. Не безопасен для одновременного
+// использования из нескольких горутин.
+type Client struct {
+	tokens     *oauth.TokenSource
+	httpClient *http.Client
+	apiURL     string
+	uploadURL  string
+	// Идентификаторы уже найденных папок по пути
+	folders map[string]string
+}
+
+// New создает клиент для папки с идентификатором root; пустой root -
+// корень "Моего диска". Если hc равен nil, используется http.DefaultClient.
+func New(tokens *oauth.TokenSource, root string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	if root == "" {
+		root = "root"
+	}
+	return &Client{
+		tokens:     tokens,
+		httpClient: hc,
+		apiURL:     APIURL,
+		uploadURL:  UploadURL,
+		folders:    map[string]string{"": root},
+	}
+}
+
+// Error - ответ API с ошибкой.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ошибка Google Drive (%d): %s", e.StatusCode, e.Message)
+}
+
+// Файл в ответах API
+type file struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	Size     string `json:"size"`
+}
+
+// do выполняет запрос и возвращает ответ с кодом 2xx
+func (c *Client) do(ctx context.Context, method, u string, contentType string, body io.Reader) (*http.Response, error) {
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusUnauthorized {
+			c.tokens.Invalidate()
+		}
+		msg, _ := io.ReadAll(res.Body)
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		text := strings.TrimSpace(string(msg))
+		if json.Unmarshal(msg, &apiErr) == nil && apiErr.Error.Message != "" {
+			text = apiErr.Error.Message
+		}
+		return nil, &Error{StatusCode: res.StatusCode, Message: text}
+	}
+	return res, nil
+}
+
+// call выполняет запрос с телом JSON и разбирает ответ в out
+func (c *Client) call(ctx context.Context, method, u string, in, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+	res, err := c.do(ctx, method, u, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// query экранирует строку для условия поиска q
+func query(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// children возвращает файлы папки с идентификатором id; если name
+// не пустое - только файлы с этим именем
+func (c *Client) children(ctx context.Context, id, name string) ([]file, error) {
+	q := query(id) + " in parents and trashed = false"
+	if name != "" {
+		q += " and name = " + query(name)
+	}
+
+	var files []file
+	pageToken := ""
+	for {
+		params := url.Values{
+			"q":                         {q},
+			"fields":                    {"nextPageToken,files(id,name,mimeType,size)"},
+			"pageSize":                  {"1000"},
+			"supportsAllDrives":         {"true"},
+			"includeItemsFromAllDrives": {"true"},
+		}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+		var page struct {
+			NextPageToken string `json:"nextPageToken"`
+			Files         []file `json:"files"`
+		}
+		err := c.call(ctx, http.MethodGet, c.apiURL+"/files?"+params.Encode(), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, page.Files...)
+		if page.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// clean приводит путь к виду без "/" по краям
+func clean(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// folder возвращает идентификатор папки по пути. При create
+// недостающие папки создаются.
+func (c *Client) folder(ctx context.Context, dir string, create bool) (string, error) {
+	dir = clean(dir)
+	if id, ok := c.folders[dir]; ok {
+		return id, nil
+	}
+
+	parent, err := c.folder(ctx, path.Dir(dir), create)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(dir)
+	files, err := c.children(ctx, parent, name)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if f.MimeType == folderType {
+			c.folders[dir] = f.ID
+			return f.ID, nil
+		}
+	}
+	if !create {
+		return "", &Error{StatusCode: http.StatusNotFound, Message: "папка не найдена: " + dir}
+	}
+
+	var created file
+	meta := map[string]any{"name": name, "mimeType": folderType, "parents": []string{parent}}
+	err = c.call(ctx, http.MethodPost, c.apiURL+"/files?supportsAllDrives=true", meta, &created)
+	if err != nil {
+		return "", err
+	}
+	c.folders[dir] = created.ID
+	return created.ID, nil
+}
+
+// lookup возвращает файл по пути
+func (c *Client) lookup(ctx context.Context, name string) (file, string, error) {
+	name = clean(name)
+	parent, err := c.folder(ctx, path.Dir(name), false)
+	if err != nil {
+		return file{}, "", err
+	}
+	files, err := c.children(ctx, parent, path.Base(name))
+	if err != nil {
+		return file{}, "", err
+	}
+	for _, f := range files {
+		if f.MimeType != folderType {
+			return f, parent, nil
+		}
+	}
+	return file{}, "", &Error{StatusCode: http.StatusNotFound, Message: "файл не найден: " + name}
+}
+
+// List возвращает содержимое папки dir. Документы Google без
+// содержимого пропускаются.
+func (c *Client) List(ctx context.Context, dir string) ([]Entry, error) {
+	id, err := c.folder(ctx, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.children(ctx, id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, f := range files {
+		isDir := f.MimeType == folderType
+		if !isDir && strings.HasPrefix(f.MimeType, nativePrefix) {
+			continue
+		}
+		size, _ := strconv.ParseInt(f.Size, 10, 64)
+		entries = append(entries, Entry{Name: f.Name, Dir: isDir, Size: size})
+	}
+	return entries, nil
+}
+
+// Download скачивает файл name в w.
+func (c *Client) Download(ctx context.Context, name string, w io.Writer) error {
+	f, _, err := c.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(ctx, http.MethodGet, c.apiURL+"/files/"+url.PathEscape(f.ID)+"?alt=media&supportsAllDrives=true", "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Upload загружает r в файл name: заменяет содержимое существующего файла
+// или создает новый вместе с недостающими папками.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader) error {
+	existing, _, err := c.lookup(ctx, name)
+	var apiErr *Error
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound) {
+		return err
+	}
+	if err == nil {
+		u := c.uploadURL + "/files/" + url.PathEscape(existing.ID) + "?uploadType=media&supportsAllDrives=true"
+		res, err := c.do(ctx, http.MethodPatch, u, "application/octet-stream", r)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+
+	parent, err := c.folder(ctx, path.Dir(clean(name)), true)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(map[string]any{"name": path.Base(name), "parents": []string{parent}})
+	if err != nil {
+		return err
+	}
+
+	// Тело multipart/related: метаданные и содержимое файла
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+		if err == nil {
+			_, err = part.Write(meta)
+		}
+		if err == nil {
+			part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}})
+		}
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	u := c.uploadURL + "/files?uploadType=multipart&supportsAllDrives=true"
+	res, err := c.do(ctx, http.MethodPost, u, "multipart/related; boundary="+mw.Boundary(), pr)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Move переносит файл from в to; недостающие папки создаются.
+func (c *Client) Move(ctx context.Context, from, to string) error {
+	f, parent, err := c.lookup(ctx, from)
+	if err != nil {
+		return err
+	}
+	target, err := c.folder(ctx, path.Dir(clean(to)), true)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{"supportsAllDrives": {"true"}}
+	if target != parent {
+		params.Set("addParents", target)
+		params.Set("removeParents", parent)
+	}
+	u := c.apiURL + "/files/" + url.PathEscape(f.ID) + "?" + params.Encode()
+	return c.call(ctx, http.MethodPatch, u, map[string]string{"name": path.Base(to)}, nil)
+}
+
+// Delete переносит файл name в корзину.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	f, _, err := c.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	u := c.apiURL + "/files/" + url.PathEscape(f.ID) + "?supportsAllDrives=true"
+	return c.call(ctx, http.MethodPatch, u, map[string]bool{"trashed": true}, nil)
+}
+
+// MakeDirAll создает папку dir вместе с родительскими, если ее нет.
+func (c *Client) MakeDirAll(ctx context.Context, dir string) error {
+	_, err := c.folder(ctx, dir, true)
+	return err
+}
@@ -4,7 +4,10 @@ go 1.24.1
 
 require (
 	github.com/fsnotify/fsnotify v1.9.0
+	github.com/kardianos/service v1.2.2
+	go.etcd.io/bbolt v1.4.0
+	golang.org/x/image v0.25.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.13.0 // indirect
+require golang.org/x/sys v0.29.0 // indirect
@@ -0,0 +1,262 @@
+// Пакет grpc - минимальный сервер gRPC поверх net/http: унарные методы
+// и методы с потоком сообщений от клиента. Сообщения protobuf кодирует
+// и разбирает вызывающий код (см. proto.go).
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Code - код состояния gRPC.
+type Code int
+
+// Коды состояния, используемые сервером.
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	Unauthenticated    Code = 16
+)
+
+// Error - ошибка вызова с кодом состояния.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ошибка gRPC (%d): %s", e.Code, e.Message)
+}
+
+// Errorf создает ошибку с кодом code.
+func Errorf(code Code, format string, args ...any) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Stream - входящие сообщения одного вызова.
+type Stream struct {
+	r       *http.Request
+	ctx     context.Context
+	maxSize int
+	gzip    bool
+}
+
+// Context возвращает контекст вызова; он отменяется при разрыве
+// соединения и по истечении grpc-timeout клиента.
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Metadata возвращает значение метаданных вызова (заголовка запроса).
+func (s *Stream) Metadata(key string) string {
+	return s.r.Header.Get(key)
+}
+
+// Recv читает следующее сообщение. В конце потока возвращает io.EOF.
+func (s *Stream) Recv() ([]byte, error) {
+	var prefix [5]byte
+	_, err := io.ReadFull(s.r.Body, prefix[:])
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, s.readError(err)
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if s.maxSize > 0 && int64(size) > int64(s.maxSize) {
+		return nil, Errorf(ResourceExhausted, "сообщение больше %d байт", s.maxSize)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(s.r.Body, data)
+	if err != nil {
+		return nil, s.readError(err)
+	}
+
+	if prefix[0] == 0 {
+		return data, nil
+	}
+	if !s.gzip {
+		return nil, Errorf(Unimplemented, "неподдерживаемое сжатие %q", s.r.Header.Get("Grpc-Encoding"))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, Errorf(InvalidArgument, "неверное сжатое сообщение: %v", err)
+	}
+	limit := int64(s.maxSize)
+	if limit <= 0 {
+		limit = 1<<63 - 1
+	}
+	data, err = io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, Errorf(InvalidArgument, "неверное сжатое сообщение: %v", err)
+	}
+	if s.maxSize > 0 && len(data) > s.maxSize {
+		return nil, Errorf(ResourceExhausted, "сообщение больше %d байт", s.maxSize)
+	}
+	return data, nil
+}
+
+func (s *Stream) readError(err error) error {
+	if ctxErr := s.ctx.Err(); ctxErr != nil {
+		return contextError(ctxErr)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return Errorf(InvalidArgument, "поток оборвался посреди сообщения")
+	}
+	return Errorf(Unavailable, "ошибка чтения запроса: %v", err)
+}
+
+// RecvOne читает единственное сообщение унарного вызова.
+func (s *Stream) RecvOne() ([]byte, error) {
+	data, err := s.Recv()
+	if errors.Is(err, io.EOF) {
+		return nil, Errorf(InvalidArgument, "нет сообщения запроса")
+	}
+	return data, err
+}
+
+// Handler обрабатывает вызов и возвращает сообщение ответа.
+type Handler func(s *Stream) ([]byte, error)
+
+// Server направляет вызовы обработчикам по имени метода.
+type Server struct {
+	handlers map[string]Handler
+	// MaxMessageSize ограничивает размер одного входящего сообщения; 0 - без ограничения
+	MaxMessageSize int
+}
+
+// NewServer создает сервер без методов.
+func NewServer() *Server {
+	return &Server{handlers: make(map[string]Handler)}
+}
+
+// Handle регистрирует обработчик метода "/пакет.Сервис/Метод".
+func (s *Server) Handle(method string, h Handler) {
+	s.handlers[method] = h
+}
+
+// ServeHTTP выполняет вызов. Ответ и состояние передаются по правилам
+// gRPC over HTTP/2: сообщение с префиксом длины и трейлеры grpc-status
+// и grpc-message.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC требует HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "ожидается запрос gRPC", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	h, ok := s.handlers[r.URL.Path]
+	if !ok {
+		writeStatus(w, Errorf(Unimplemented, "неизвестный метод %s", r.URL.Path))
+		return
+	}
+
+	ctx := r.Context()
+	if d, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	stream := &Stream{
+		r:       r,
+		ctx:     ctx,
+		maxSize: s.MaxMessageSize,
+		gzip:    r.Header.Get("Grpc-Encoding") == "gzip",
+	}
+
+	resp, err := h(stream)
+	if err == nil && ctx.Err() != nil {
+		err = contextError(ctx.Err())
+	}
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(resp)))
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prefix[:])
+	w.Write(resp)
+}
+
+// writeStatus завершает вызов ошибкой
+func writeStatus(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Code: Unknown, Message: err.Error()}
+	}
+	// Ответ без сообщений: состояние передается сразу в заголовках
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(e.Code)))
+	w.Header().Set("Grpc-Message", encodeMessage(e.Message))
+	w.WriteHeader(http.StatusOK)
+}
+
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Errorf(DeadlineExceeded, "истекло время вызова")
+	}
+	return Errorf(Canceled, "вызов отменен")
+}
+
+// encodeMessage кодирует grpc-message: процентное кодирование
+// непечатаемых и не-ASCII байтов
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// parseTimeout разбирает grpc-timeout: число и единица H, M, S, m, u или n
+func parseTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[v[len(v)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
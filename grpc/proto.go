@@ -0,0 +1,106 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Типы полей в кодировке protobuf
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Field - поле сообщения protobuf. Для varint и fixed заполняется Int,
+// для строк, байтов и вложенных сообщений - Bytes.
+type Field struct {
+	Num   int
+	Int   uint64
+	Bytes []byte
+}
+
+// ParseFields разбирает сообщение protobuf на поля в порядке следования.
+// Группы (устаревший тип полей) не поддерживаются.
+func ParseFields(data []byte) ([]Field, error) {
+	var fields []Field
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errMalformed
+		}
+		data = data[n:]
+
+		f := Field{Num: int(key >> 3)}
+		if f.Num <= 0 {
+			return nil, errMalformed
+		}
+		switch key & 7 {
+		case wireVarint:
+			f.Int, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errMalformed
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, errMalformed
+			}
+			f.Int = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, errMalformed
+			}
+			f.Int = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return nil, errMalformed
+			}
+			f.Bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return nil, errMalformed
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+var errMalformed = errors.New("неверное сообщение protobuf")
+
+// AppendBytes добавляет поле bytes, string или вложенное сообщение.
+// Пустые значения, как принято в proto3, не кодируются.
+func AppendBytes(b []byte, num int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// AppendString добавляет поле string.
+func AppendString(b []byte, num int, v string) []byte {
+	return AppendBytes(b, num, []byte(v))
+}
+
+// AppendVarint добавляет поле int64, uint64 или bool.
+func AppendVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// AppendDouble добавляет поле double. Нулевое значение тоже кодируется,
+// чтобы поле optional считалось заданным.
+func AppendDouble(b []byte, num int, v float64) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
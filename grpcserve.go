@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"photoroom/grpc"
+	"photoroom/photoroom"
+)
+
+// Настройки сервера gRPC (описание сервиса - в photoroom.proto)
+type GRPC struct {
+	// Адрес сервера, например ":9090". Пустой адрес отключает сервер.
+	Listen string `yaml:"listen"`
+	// Токен в метаданных authorization: Bearer <token>; пусто - без проверки
+	Token string `yaml:"token"`
+	// Максимальный размер изображения в байтах
+	MaxUploadSize int64 `yaml:"max_upload_size"`
+}
+
+// Методы сервиса photoroom.v1.Processor
+const (
+	grpcProcess   = "/photoroom.v1.Processor/Process"
+	grpcGetStatus = "/photoroom.v1.Processor/GetStatus"
+)
+
+// startGRPC запускает сервер gRPC (HTTP/2 без TLS) в режимах watch
+// и serve. Сервер останавливается при отмене ctx.
+func startGRPC(ctx context.Context, cfg GRPC) {
+	if cfg.Listen == "" {
+		return
+	}
+
+	s := grpc.NewServer()
+	// Запас на поля сообщения помимо части изображения
+	s.MaxMessageSize = int(cfg.MaxUploadSize) + 64<<10
+	s.Handle(grpcProcess, grpcAuth(cfg.Token, func(st *grpc.Stream) ([]byte, error) {
+		return grpcProcessImage(st, cfg.MaxUploadSize)
+	}))
+	s.Handle(grpcGetStatus, grpcAuth(cfg.Token, grpcStatus))
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           s,
+		Protocols:         &protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		slog.Info("gRPC server started", "listen", cfg.Listen)
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("gRPC server failed", "error", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+}
+
+func grpcAuth(token string, next grpc.Handler) grpc.Handler {
+	if token == "" {
+		return next
+	}
+	return func(st *grpc.Stream) ([]byte, error) {
+		got, ok := strings.CutPrefix(st.Metadata("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return nil, grpc.Errorf(grpc.Unauthenticated, "неверный токен")
+		}
+		return next(st)
+	}
+}
+
+// grpcProcessImage собирает изображение из частей ImageChunk, обрабатывает
+// его так же, как POST /process режима serve, и возвращает ProcessedImage
+func grpcProcessImage(st *grpc.Stream, maxSize int64) ([]byte, error) {
+	var image bytes.Buffer
+	var filename, params string
+	for {
+		msg, err := st.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields, err := grpc.ParseFields(msg)
+		if err != nil {
+			return nil, grpc.Errorf(grpc.InvalidArgument, "%v", err)
+		}
+		for _, f := range fields {
+			switch f.Num {
+			case 1:
+				image.Write(f.Bytes)
+			case 2:
+				filename = string(f.Bytes)
+			case 3:
+				params = string(f.Bytes)
+			}
+		}
+		if maxSize > 0 && int64(image.Len()) > maxSize {
+			return nil, grpc.Errorf(grpc.ResourceExhausted, "изображение больше %d байт", maxSize)
+		}
+	}
+	if image.Len() == 0 {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "не передано изображение")
+	}
+	if filename == "" {
+		filename = "image"
+	}
+
+	ctx := requestContext(st.Context(), st.Metadata(photoroom.RequestIDHeader))
+	data, mt, err := processUpload(ctx, bytes.NewReader(image.Bytes()), filename, params)
+	if err != nil {
+		return nil, grpc.Errorf(grpcCode(requestStatus(err)), "%v", err)
+	}
+
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filepath.Base(filename), ext) + "." + outputExt(ext, mt)
+	var resp []byte
+	resp = grpc.AppendBytes(resp, 1, data)
+	resp = grpc.AppendString(resp, 2, mt)
+	resp = grpc.AppendString(resp, 3, name)
+	return resp, nil
+}
+
+// grpcCode сопоставляет код HTTP-ответа режима serve коду состояния gRPC
+func grpcCode(status int) grpc.Code {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return grpc.InvalidArgument
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return grpc.Unavailable
+	}
+	return grpc.Internal
+}
+
+// grpcStatus возвращает Status: те же сведения, что /healthz,
+// и счетчики обработанных файлов
+func grpcStatus(st *grpc.Stream) ([]byte, error) {
+	_, err := st.RecvOne()
+	if err != nil {
+		return nil, err
+	}
+
+	status := "ok"
+	if health.watcherStarted.Load() && !health.watcherAlive.Load() {
+		status = "unavailable"
+	}
+	var resp []byte
+	resp = grpc.AppendString(resp, 1, status)
+	for _, reason := range intake.paused() {
+		resp = grpc.AppendString(resp, 2, reason)
+	}
+	if jobs != nil {
+		resp = grpc.AppendVarint(resp, 3, uint64(jobs.depth()))
+		resp = grpc.AppendVarint(resp, 4, uint64(jobs.processed.Load()))
+		resp = grpc.AppendVarint(resp, 5, uint64(jobs.failed.Load()))
+		resp = grpc.AppendVarint(resp, 6, uint64(jobs.skipped.Load()))
+	}
+	if ns := health.lastSuccess.Load(); ns != 0 {
+		resp = grpc.AppendVarint(resp, 7, uint64(time.Unix(0, ns).Unix()))
+	}
+	if remaining, ok := credits.value(); ok {
+		resp = grpc.AppendDouble(resp, 8, remaining)
+	}
+	return resp, nil
+}
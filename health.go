@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// Состояние сервиса для /healthz
+var health struct {
+	// Вотчер запущен в этом режиме и его цикл событий работает
+	watcherStarted atomic.Bool
+	watcherAlive   atomic.Bool
+	// Время последней успешной обработки, UnixNano
+	lastSuccess atomic.Int64
+
+	mu        sync.Mutex
+	apiOK     bool
+	apiError  string
+	apiPinged time.Time
+}
+
+// Ответ /healthz
+type healthReport struct {
+	Status      string     `json:"status"`
+	Watcher     string     `json:"watcher,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	QueueDepth  int        `json:"queue_depth"`
+	// Причины приостановки приема, см. POST /pause
+	Paused []string   `json:"paused,omitempty"`
+	API    *apiHealth `json:"api,omitempty"`
+}
+
+type apiHealth struct {
+	Reachable bool      `json:"reachable"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// healthHandler отвечает 503, если вотчер перестал работать
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "ok"}
+
+	if health.watcherStarted.Load() {
+		report.Watcher = "running"
+		if !health.watcherAlive.Load() {
+			report.Watcher = "stopped"
+			report.Status = "unavailable"
+		}
+	}
+	if ns := health.lastSuccess.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		report.LastSuccess = &t
+	}
+	if jobs != nil {
+		report.QueueDepth = jobs.depth()
+	}
+	report.Paused = intake.paused()
+
+	health.mu.Lock()
+	if !health.apiPinged.IsZero() {
+		report.API = &apiHealth{Reachable: health.apiOK, Error: health.apiError, CheckedAt: health.apiPinged}
+	}
+	health.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// pingAPI периодически проверяет, что сервер API отвечает.
+// Любой HTTP-ответ считается доступностью, ключ не проверяется.
+func pingAPI(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	url := config.APIUrl
+	if url == "" {
+		url = photoroom.DefaultEditURL
+	}
+	hc := &http.Client{Timeout: config.Timeouts.Connect + 5*time.Second, Transport: transport}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := ping(ctx, hc, url)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("API is unreachable", "url", url, "error", err)
+		}
+
+		health.mu.Lock()
+		health.apiOK = err == nil
+		health.apiError = ""
+		if err != nil {
+			health.apiError = err.Error()
+		}
+		health.apiPinged = time.Now()
+		health.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func ping(ctx context.Context, hc *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Внешние команды, запускаемые на этапах обработки файла
+type Hooks struct {
+	// Перед отправкой в API. Ненулевой код выхода отменяет обработку файла.
+	PreUpload []Hook `yaml:"pre_upload"`
+	// После успешной обработки
+	PostSuccess []Hook `yaml:"post_success"`
+	// После ошибки обработки
+	PostFailure []Hook `yaml:"post_failure"`
+}
+
+// Внешняя команда. Описание события передается в stdin в виде JSON
+// и в переменных окружения PHOTOROOM_EVENT, PHOTOROOM_JOB_ID, PHOTOROOM_FILE,
+// PHOTOROOM_SOURCE, PHOTOROOM_OUTPUT, PHOTOROOM_PROFILE и PHOTOROOM_ERROR.
+type Hook struct {
+	// Команда и ее аргументы, например ["/usr/local/bin/notify.sh", "--verbose"]
+	Command []string `yaml:"command"`
+	// Ограничение времени выполнения; 0 - 1 минута
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Событие перед отправкой в API
+const eventPreUpload = "pre_upload"
+
+// runPreUploadHooks запускает хуки pre_upload и возвращает ошибку
+// первого из них, завершившегося неудачно
+func runPreUploadHooks(ctx context.Context, filePath, profile string) error {
+	if len(config.Hooks.PreUpload) == 0 {
+		return nil
+	}
+
+	payload := eventPayload{
+		Event:     eventPreUpload,
+		File:      relPath(filePath),
+		Profile:   profile,
+		Timestamp: time.Now(),
+	}
+	for _, hook := range config.Hooks.PreUpload {
+		err := runHook(ctx, hook, filePath, payload)
+		if err != nil {
+			return fmt.Errorf("хук pre_upload отменил обработку: %w", err)
+		}
+	}
+	return nil
+}
+
+// runPostHooks запускает хуки post_success или post_failure.
+// Ошибки хуков только логируются.
+func runPostHooks(filePath string, res outcome, duration time.Duration, cause error) {
+	hooks := config.Hooks.PostSuccess
+	if cause != nil {
+		hooks = config.Hooks.PostFailure
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	payload, header := newEvent(filePath, res, duration, cause)
+	payload.APIHeaders = pickHeaders(header, nil)
+	for _, hook := range hooks {
+		err := runHook(context.Background(), hook, filePath, payload)
+		if err != nil {
+			slog.Error("hook failed", "command", hook.Command[0], "event", payload.Event, "file", filePath, "error", err)
+		}
+	}
+}
+
+func runHook(ctx context.Context, hook Hook, filePath string, payload eventPayload) error {
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(),
+		"PHOTOROOM_EVENT="+payload.Event,
+		"PHOTOROOM_JOB_ID="+payload.JobID,
+		"PHOTOROOM_FILE="+payload.File,
+		"PHOTOROOM_SOURCE="+absPath(filePath),
+		"PHOTOROOM_OUTPUT="+payload.Output,
+		"PHOTOROOM_PROFILE="+payload.Profile,
+		"PHOTOROOM_ERROR="+payload.Error,
+		"PHOTOROOM_DURATION="+strconv.FormatFloat(payload.Duration, 'f', 3, 64),
+	)
+
+	err = cmd.Run()
+	if output.Len() > 0 {
+		slog.Debug("hook output", "command", hook.Command[0], "output", output.String())
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
+
+// validHooks проверяет секцию hooks при загрузке конфигурации
+func validHooks(h Hooks) error {
+	for _, hooks := range [][]Hook{h.PreUpload, h.PostSuccess, h.PostFailure} {
+		for _, hook := range hooks {
+			if len(hook.Command) == 0 || hook.Command[0] == "" {
+				return fmt.Errorf("hooks: не указана команда")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// Ответы мастера init: значения, которые попадают в config.yaml
+type initAnswers struct {
+	APIKey     string
+	Mode       string
+	Prompt     string
+	OutputSize string
+	Source     string
+	Dest       string
+	Processed  string
+	Failed     string
+	Workers    int
+}
+
+// Шаблон config.yaml, создаваемого командой init. Остальные параметры
+// описаны в config_default.yaml.
+var initTemplate = template.Must(template.New("config").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`# Конфигурация создана командой init {{.Date}}.
+# Все параметры с описаниями - в config_default.yaml. Проверить файл после
+# изменений: photoroom config validate -config {{.Path}}
+#
+# Ключ API лучше передавать переменной окружения PHOTOROOM_API_KEY
+# и удалить его из файла.
+api_key: {{quote .APIKey}}
+
+# Режим: edit (Image Editing API v2, секция edit) или remove-bg
+# (Remove Background API v1, секция remove_bg)
+mode: {{.Mode}}
+
+# Новые изображения появляются в source_dir; исходники после обработки
+# переносятся в destination_dir, результаты сохраняются в processed_dir,
+# необработанные файлы - в failed_dir
+source_dir: {{quote .Source}}
+destination_dir: {{quote .Dest}}
+processed_dir: {{quote .Processed}}
+failed_dir: {{quote .Failed}}
+
+# Число одновременных запросов к API
+workers: {{.Workers}}
+
+edit:
+  background:
+    # Описание нового фона. Доступны {{"{{.Filename}}"}}, {{"{{.FolderName}}"}}
+    # и {{"{{.Profile}}"}}, например "{{"{{.FolderName}}"}} on a wooden table"
+    prompt: {{quote .Prompt}}
+    # color: FFFFFF
+  # Отступ от объекта до краев: доля стороны, проценты или пиксели
+  margin: "0.1"
+  # Размер результата: WxH, auto, originalImage или croppedSubject
+  output_size: {{quote .OutputSize}}
+  # shadow:
+  #   mode: ai.soft
+
+remove_bg:
+  format: png
+
+log:
+  level: info
+  format: text
+
+# Профили с параметрами для поддиректорий source:
+# profiles:
+#   white:
+#     background:
+#       color: FFFFFF
+# folders:
+#   catalog/white: white
+`))
+
+// runInit создает config.yaml и директории для обработки. Значения берутся
+// из флагов, а недостающие запрашиваются, если ввод - терминал.
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	path := fs.String("config", "config.yaml", "путь к создаваемому файлу конфигурации")
+	a := initAnswers{APIKey: os.Getenv(envPrefix + "API_KEY")}
+	fs.StringVar(&a.APIKey, "api-key", a.APIKey, "ключ API (PHOTOROOM_API_KEY)")
+	fs.StringVar(&a.Mode, "mode", modeEdit, "режим обработки: edit или remove-bg")
+	fs.StringVar(&a.Prompt, "prompt", "", "описание фона для режима edit")
+	fs.StringVar(&a.OutputSize, "output-size", "2016x1512", "размер результата: WxH, auto, originalImage или croppedSubject")
+	fs.StringVar(&a.Source, "source", "./source", "директория с исходными файлами")
+	fs.StringVar(&a.Dest, "destination", "./destination", "директория для обработанных исходников")
+	fs.StringVar(&a.Processed, "processed", "./processed", "директория для результатов")
+	fs.StringVar(&a.Failed, "failed", "./failed", "директория для необработанных файлов")
+	fs.IntVar(&a.Workers, "workers", 4, "число одновременных запросов к API")
+	accountURL := fs.String("account-url", photoroom.DefaultAccountURL, "адрес проверки ключа")
+	noInput := fs.Bool("no-input", false, "ничего не спрашивать, брать значения из флагов")
+	skipCheck := fs.Bool("skip-check", false, "не проверять ключ запросом к API")
+	force := fs.Bool("force", false, "перезаписать существующий файл")
+	fs.Parse(args)
+
+	if _, err := os.Stat(*path); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s уже существует; чтобы перезаписать его, укажите -force\n", *path)
+		return 1
+	}
+
+	// Спрашиваем только то, что не задано флагами
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	interactive := !*noInput && isTerminal(os.Stdin)
+	in := bufio.NewReader(os.Stdin)
+	ask := func(flagName, question string, value *string) {
+		if interactive && !set[flagName] {
+			*value = prompt(in, question, *value)
+		}
+	}
+
+	for {
+		ask("api-key", "Ключ API", &a.APIKey)
+		if a.APIKey == "" {
+			fmt.Fprintln(os.Stderr, "не задан ключ API: укажите -api-key или PHOTOROOM_API_KEY")
+			if interactive {
+				continue
+			}
+			return 1
+		}
+		if *skipCheck {
+			break
+		}
+		err := checkAPIKey(a.APIKey, *accountURL)
+		if err == nil {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "ключ не прошел проверку:", err)
+		if !interactive || set["api-key"] {
+			return 1
+		}
+		a.APIKey = ""
+	}
+
+	for {
+		ask("mode", "Режим (edit или remove-bg)", &a.Mode)
+		err := validMode(a.Mode)
+		if err == nil && a.Mode != "" {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "неизвестный режим:", a.Mode)
+		if !interactive || set["mode"] {
+			return 1
+		}
+		a.Mode = modeEdit
+	}
+	if a.Mode == modeEdit {
+		ask("prompt", "Описание фона (пусто - без генерации фона)", &a.Prompt)
+		for {
+			ask("output-size", "Размер результата", &a.OutputSize)
+			err := validLayout(photoroom.EditParams{OutputSize: a.OutputSize})
+			if err == nil {
+				break
+			}
+			fmt.Fprintln(os.Stderr, err)
+			if !interactive || set["output-size"] {
+				return 1
+			}
+			a.OutputSize = "2016x1512"
+		}
+	}
+	ask("source", "Директория с исходными файлами", &a.Source)
+	ask("destination", "Директория для обработанных исходников", &a.Dest)
+	ask("processed", "Директория для результатов", &a.Processed)
+	ask("failed", "Директория для необработанных файлов", &a.Failed)
+
+	err := writeInitConfig(*path, a)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "не удалось создать конфигурацию:", err)
+		return 1
+	}
+	for _, dir := range []string{a.Source, a.Dest, a.Processed, a.Failed} {
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "не удалось создать директорию:", err)
+			return 1
+		}
+	}
+
+	fmt.Printf("Создан %s и директории %s, %s, %s, %s.\n", *path, a.Source, a.Dest, a.Processed, a.Failed)
+	fmt.Printf("Запуск: %s watch -config %s\n", filepath.Base(os.Args[0]), *path)
+	return 0
+}
+
+// prompt задает вопрос и возвращает ответ или def, если ответ пустой
+func prompt(in *bufio.Reader, question, def string) string {
+	if def != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", question)
+	}
+	line, err := in.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" || err != nil && !errors.Is(err, io.EOF) {
+		return def
+	}
+	return line
+}
+
+// checkAPIKey проверяет ключ запросом сведений об аккаунте:
+// он не расходует кредиты
+func checkAPIKey(key, accountURL string) error {
+	c := photoroom.NewClient(key,
+		photoroom.WithAccountURL(accountURL),
+		photoroom.WithHTTPClient(&http.Client{Timeout: 30 * time.Second}),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	account, err := c.Account(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Ключ действителен, доступно кредитов: %g\n", account.Credits.Available)
+	return nil
+}
+
+// writeInitConfig записывает конфигурацию и проверяет, что она читается.
+// Файл доступен только владельцу: в нем ключ API.
+func writeInitConfig(path string, a initAnswers) error {
+	var buf strings.Builder
+	err := initTemplate.Execute(&buf, struct {
+		initAnswers
+		Path string
+		Date string
+	}{a, path, time.Now().Format(time.DateOnly)})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, []byte(buf.String()), 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = loadConfig(path)
+	if err != nil {
+		return fmt.Errorf("созданный файл не прошел проверку: %w", err)
+	}
+	return nil
+}
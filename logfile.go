@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Формат метки времени в имени старого файла логов
+const logBackupFormat = "2006-01-02T15-04-05"
+
+// rotatingFile - файл логов с ротацией по размеру и раз в сутки.
+// Старый файл переименовывается в <имя>-<время>.<расширение>, лишние
+// и устаревшие старые файлы удаляются.
+type rotatingFile struct {
+	cfg Log
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Файл логов, общий для всех вызовов setupLogger
+var logFile *rotatingFile
+
+func openRotatingFile(cfg Log) (*rotatingFile, error) {
+	if dir := filepath.Dir(cfg.File); dir != "" {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f := &rotatingFile{cfg: cfg}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	f.prune()
+	return f, nil
+}
+
+// open открывает файл для дописывания. Дата существующего файла
+// берется из времени его изменения, чтобы ротация раз в сутки
+// срабатывала и после перезапуска.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	if info.Size() > 0 {
+		f.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.needsRotation(len(p)) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "не удалось выполнить ротацию логов:", err)
+		}
+	}
+	if f.file == nil {
+		return len(p), nil
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) needsRotation(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if max := int64(f.cfg.MaxSize) << 20; max > 0 && f.size+int64(n) > max {
+		return true
+	}
+	if f.cfg.Daily {
+		y1, m1, d1 := f.opened.Date()
+		y2, m2, d2 := time.Now().Date()
+		return y1 != y2 || m1 != m2 || d1 != d2
+	}
+	return false
+}
+
+// rotate переименовывает текущий файл и открывает новый
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	ext := filepath.Ext(f.cfg.File)
+	base := strings.TrimSuffix(f.cfg.File, ext)
+	backup := base + "-" + time.Now().Format(logBackupFormat) + ext
+	err := os.Rename(f.cfg.File, backup)
+	if err != nil && !os.IsNotExist(err) {
+		// Продолжаем писать в прежний файл
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	go f.prune()
+	return nil
+}
+
+// prune удаляет старые файлы сверх max_backups и старше max_age дней
+func (f *rotatingFile) prune() {
+	if f.cfg.MaxBackups <= 0 && f.cfg.MaxAge <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(f.cfg.File)
+	base := strings.TrimSuffix(f.cfg.File, ext)
+	matches, err := filepath.Glob(globEscape(base) + "-*" + globEscape(ext))
+	if err != nil {
+		return
+	}
+
+	// Метка времени в имени сортируется как строка; новые файлы - в начале
+	type backup struct {
+		name string
+		time time.Time
+	}
+	var backups []backup
+	for _, name := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, base+"-"), ext)
+		if t, err := time.ParseInLocation(logBackupFormat, stamp, time.Local); err == nil {
+			backups = append(backups, backup{name, t})
+		}
+	}
+	slices.SortFunc(backups, func(a, b backup) int { return strings.Compare(b.name, a.name) })
+
+	cutoff := time.Now().AddDate(0, 0, -f.cfg.MaxAge)
+	for i, b := range backups {
+		if (f.cfg.MaxBackups > 0 && i >= f.cfg.MaxBackups) || (f.cfg.MaxAge > 0 && b.time.Before(cutoff)) {
+			os.Remove(b.name)
+		}
+	}
+}
+
+// globEscape экранирует спецсимволы filepath.Match в пути
+func globEscape(s string) string {
+	if filepath.Separator == '\\' {
+		// На Windows "\" - разделитель путей, экранировать им нельзя
+		return strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]").Replace(s)
+	}
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(s)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Настройки логирования
+type Log struct {
+	// Уровень: debug, info, warn, error
+	Level string `yaml:"level"`
+	// Формат: text или json
+	Format string `yaml:"format"`
+	// Файл, в который логи пишутся вместе с stderr; пустой - только stderr
+	File string `yaml:"file"`
+	// Ротация файла: по размеру в мегабайтах (0 - без ограничения)
+	// и раз в сутки
+	MaxSize int  `yaml:"max_size"`
+	Daily   bool `yaml:"daily"`
+	// Сколько хранить старых файлов: штук и дней; 0 - без ограничения
+	MaxBackups int `yaml:"max_backups"`
+	MaxAge     int `yaml:"max_age"`
+}
+
+// setupLogger настраивает логгер по умолчанию. Если задан log.file,
+// записи дублируются в файл.
+func setupLogger(w io.Writer, cfg Log) error {
+	level, err := logLevel(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.File != "" && logFile == nil {
+		logFile, err = openRotatingFile(cfg)
+		if err != nil {
+			return fmt.Errorf("не удалось открыть файл логов: %w", err)
+		}
+	}
+	if logFile != nil {
+		w = io.MultiWriter(w, logFile)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("неизвестный формат логов %q", cfg.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func logLevel(cfg Log) (slog.Level, error) {
+	var level slog.Level
+	if cfg.Level != "" {
+		err := level.UnmarshalText([]byte(cfg.Level))
+		if err != nil {
+			return level, fmt.Errorf("неизвестный уровень логирования %q", cfg.Level)
+		}
+	}
+	return level, nil
+}
+
+// fatal логирует ошибку и завершает программу
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// fatalConfig сообщает об ошибке в конфигурации или флагах и завершает
+// программу с кодом exitConfig
+func fatalConfig(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(exitConfig)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"photoroom/storage"
+)
+
+// Строка манифеста: исходное изображение, имя результата и параметры
+// обработки с теми же ключами, что в sidecar-файле
+type manifestRow struct {
+	// Номер строки CSV или записи JSON для сообщений об ошибках
+	line int
+	// Путь к файлу (относительно манифеста) или адрес http(s)
+	input string
+	// Имя результата без расширения; может содержать поддиректории
+	output string
+	params map[string]any
+}
+
+// Короткие названия столбцов манифеста и соответствующие им ключи параметров
+var manifestAliases = map[string]string{
+	"prompt":          "background.prompt",
+	"negative_prompt": "background.negative_prompt",
+	"color":           "background.color",
+	"size":            "output_size",
+}
+
+// loadManifest читает манифест CSV или JSON (по расширению файла)
+// и проверяет все строки, прежде чем что-либо обрабатывать
+func loadManifest(manifestPath string) ([]manifestRow, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	// Excel сохраняет CSV в UTF-8 с BOM
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	var records []map[string]any
+	var lines []int
+	unit := "строка"
+	if strings.EqualFold(filepath.Ext(manifestPath), ".json") {
+		unit = "запись"
+		err = json.Unmarshal(data, &records)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось разобрать манифест: %w", err)
+		}
+		for i := range records {
+			lines = append(lines, i+1)
+		}
+	} else {
+		records, lines, err = readCSVManifest(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	base := filepath.Dir(manifestPath)
+	var rows []manifestRow
+	var errs []error
+	for i, record := range records {
+		row, err := newManifestRow(lines[i], record, base)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %d: %w", unit, lines[i], err))
+			continue
+		}
+		rows = append(rows, row)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return rows, nil
+}
+
+// readCSVManifest читает CSV с заголовком. Разделитель - запятая или точка
+// с запятой, как в CSV из Excel с русской локалью. Пустые ячейки пропускаются.
+func readCSVManifest(data []byte) ([]map[string]any, []int, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	header, _, _ := bytes.Cut(data, []byte("\n"))
+	if bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+		r.Comma = ';'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	columns, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("не удалось прочитать заголовок манифеста: %w", err)
+	}
+	for i := range columns {
+		columns[i] = strings.ToLower(strings.TrimSpace(columns[i]))
+	}
+	if !slices.Contains(columns, "input") {
+		return nil, nil, errors.New("в манифесте нет столбца input")
+	}
+
+	var records []map[string]any
+	var lines []int
+	for {
+		cells, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("не удалось прочитать манифест: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+
+		record := make(map[string]any)
+		for i, cell := range cells {
+			cell = strings.TrimSpace(cell)
+			if i < len(columns) && columns[i] != "" && cell != "" {
+				record[columns[i]] = csvValue(cell)
+			}
+		}
+		if len(record) == 0 {
+			continue
+		}
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+	return records, lines, nil
+}
+
+// csvValue возвращает значение ячейки CSV: логические значения и числа
+// передаются как есть, чтобы их можно было указать в числовых параметрах.
+// Числа, которые изменились бы при записи ("007", "0.10"), остаются строками.
+func csvValue(cell string) any {
+	switch cell {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if f, err := strconv.ParseFloat(cell, 64); err == nil && strconv.FormatFloat(f, 'f', -1, 64) == cell {
+		return f
+	}
+	return cell
+}
+
+// newManifestRow разбирает запись манифеста. Ключи с точкой
+// ("background.color") задают вложенные параметры.
+func newManifestRow(line int, record map[string]any, base string) (manifestRow, error) {
+	row := manifestRow{line: line, params: make(map[string]any)}
+	for key, value := range record {
+		switch key {
+		case "input":
+			row.input = fmt.Sprint(value)
+		case "output":
+			row.output = fmt.Sprint(value)
+		default:
+			if alias, ok := manifestAliases[key]; ok {
+				key = alias
+			}
+			setParam(row.params, paramKeys(key), value)
+		}
+	}
+
+	if row.input == "" {
+		return row, errors.New("не указан input")
+	}
+	if !isURL(row.input) && !filepath.IsAbs(row.input) {
+		row.input = filepath.Join(base, row.input)
+	}
+	if row.output != "" {
+		row.output = strings.TrimSuffix(row.output, path.Ext(row.output))
+		if !filepath.IsLocal(row.output) {
+			return row, fmt.Errorf("недопустимое имя результата %q", row.output)
+		}
+	}
+
+	// Параметры проверяются так же, как параметры sidecar-файла
+	data, err := json.Marshal(row.params)
+	if err != nil {
+		return row, err
+	}
+	var params profileParams
+	err = yaml.Unmarshal(data, &params)
+	if err == nil {
+		params.Overrides, err = confineOverrides(params.Overrides)
+	}
+	if err == nil {
+		_, err = buildProfile(params.Profile, params.Overrides)
+	}
+	if err != nil {
+		return row, err
+	}
+	return row, nil
+}
+
+// paramKeys разбивает ключ параметра по точкам. Имя дополнительного поля
+// формы после extra_fields остается целым: background.guidance.scale.
+func paramKeys(key string) []string {
+	keys := strings.Split(key, ".")
+	for i, k := range keys[:len(keys)-1] {
+		if k == "extra_fields" {
+			return append(keys[:i+1], strings.Join(keys[i+1:], "."))
+		}
+	}
+	return keys
+}
+
+// setParam записывает value в params по пути keys, создавая вложенные секции
+func setParam(params map[string]any, keys []string, value any) {
+	for _, key := range keys[:len(keys)-1] {
+		sub, ok := params[key].(map[string]any)
+		if !ok {
+			sub = make(map[string]any)
+			params[key] = sub
+		}
+		params = sub
+	}
+	params[keys[len(keys)-1]] = value
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// stageManifest копирует или скачивает изображения манифеста во временную
+// директорию рядом с destination и ставит их в очередь. Файл называется
+// по имени результата, а параметры строки записываются в его sidecar-файл,
+// поэтому дальше он обрабатывается как обычный. Сами исходные файлы
+// манифеста остаются на месте. Возвращает временную директорию.
+func stageManifest(ctx context.Context, rows []manifestRow) (string, error) {
+	err := os.MkdirAll(config.DestDir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(config.DestDir, ".manifest-*")
+	if err != nil {
+		return "", err
+	}
+	// Поддиректории в именах результатов повторяются в выходных директориях
+	addSourceRoot(dir)
+
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			break
+		}
+		target, err := stageRow(ctx, dir, row)
+		if err != nil {
+			slog.Error("failed to stage manifest row", "line", row.line, "input", row.input, "error", err)
+			continue
+		}
+		if !jobs.enqueue(target) {
+			break
+		}
+	}
+	return dir, nil
+}
+
+// stageRow сохраняет изображение строки в dir и возвращает его путь
+func stageRow(ctx context.Context, dir string, row manifestRow) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".manifest-*.part")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	var name, contentType string
+	urlJob := isURL(row.input) && directURLs()
+	switch {
+	case urlJob:
+		// Изображение скачает сам API
+		_, err = io.WriteString(tmp, row.input)
+	case isURL(row.input):
+		contentType, err = downloadURL(ctx, row.input, tmp)
+	default:
+		name = filepath.Base(row.input)
+		var src *os.File
+		src, err = os.Open(row.input)
+		if err == nil {
+			_, err = io.Copy(tmp, src)
+			src.Close()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if isURL(row.input) {
+		if u, err := url.Parse(row.input); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "row" + strconv.Itoa(row.line)
+	}
+	if row.output != "" {
+		name = row.output + path.Ext(name)
+	}
+	if urlJob {
+		name = urlJobName(name)
+	}
+	name = withImageExt(filepath.FromSlash(name), contentType, tmp.Name())
+
+	target := filepath.Join(dir, name)
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	placeholder, target, err := storage.CreateUnique(target)
+	if err != nil {
+		return "", err
+	}
+	placeholder.Close()
+
+	if len(row.params) > 0 {
+		data, err := json.Marshal(row.params)
+		if err == nil {
+			err = os.WriteFile(target+".json", data, 0644)
+		}
+		if err != nil {
+			os.Remove(target)
+			return "", err
+		}
+	}
+	err = os.Rename(tmp.Name(), target)
+	if err != nil {
+		os.Remove(target + ".json")
+		os.Remove(target)
+		return "", err
+	}
+	return target, nil
+}
+
+// removeEmptyDirs удаляет dir и его поддиректории, в которых не осталось
+// файлов. Файлы, отложенные для повтора, остаются на месте.
+func removeEmptyDirs(dir string) {
+	var dirs []string
+	filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err == nil && e.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// Вложенные директории удаляются раньше родительских
+	for _, d := range slices.Backward(dirs) {
+		os.Remove(d)
+	}
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// Настройки переноса метаданных исходника в результат. API не сохраняет
+// EXIF, XMP и цветовой профиль, поэтому они копируются из исходника
+// после получения ответа. Поддерживаются JPEG, PNG и WebP.
+type Metadata struct {
+	// Какие метаданные переносить: exif, xmp, icc; пусто - не переносить
+	Copy []string `yaml:"copy"`
+}
+
+// Виды метаданных
+const (
+	metaEXIF = "exif"
+	metaXMP  = "xmp"
+	metaICC  = "icc"
+)
+
+func validMetadata(cfg Metadata) error {
+	for _, kind := range cfg.Copy {
+		if kind != metaEXIF && kind != metaXMP && kind != metaICC {
+			return fmt.Errorf("неизвестный вид метаданных %q, ожидается exif, xmp или icc", kind)
+		}
+	}
+	return nil
+}
+
+// Метаданные изображения: EXIF - заголовок TIFF без префикса "Exif\0\0",
+// XMP - пакет XML, ICC - несжатый цветовой профиль
+type imageMeta struct {
+	exif, xmp, icc []byte
+}
+
+func (m imageMeta) empty() bool {
+	return m.exif == nil && m.xmp == nil && m.icc == nil
+}
+
+// only оставляет виды метаданных из kinds
+func (m imageMeta) only(kinds []string) imageMeta {
+	if !slices.Contains(kinds, metaEXIF) {
+		m.exif = nil
+	}
+	if !slices.Contains(kinds, metaXMP) {
+		m.xmp = nil
+	}
+	if !slices.Contains(kinds, metaICC) {
+		m.icc = nil
+	}
+	return m
+}
+
+// copyMetadata переносит метаданные исходника в варианты результата,
+// а при preprocess.srgb помечает их профилем sRGB. Ошибка не прерывает
+// обработку: результат сохраняется без метаданных.
+func copyMetadata(filePath string, outputs []rendered) []rendered {
+	kinds := config.Metadata.Copy
+	if len(kinds) == 0 && !config.Preprocess.SRGB {
+		return outputs
+	}
+
+	var meta imageMeta
+	var err error
+	if len(kinds) > 0 {
+		var src []byte
+		src, err = os.ReadFile(filePath)
+		if err != nil {
+			slog.Warn("failed to read source metadata", "file", filePath, "error", err)
+			return outputs
+		}
+		meta = readMetadata(src).only(kinds)
+	}
+	if meta.exif != nil {
+		// Ориентация исходника уже учтена в результате
+		meta.exif = resetOrientation(bytes.Clone(meta.exif))
+	}
+	if config.Preprocess.SRGB {
+		// Исходник переведен в sRGB, его профиль к результату не относится
+		meta.icc = srgbProfile
+	}
+	if meta.empty() {
+		return outputs
+	}
+
+	for i, out := range outputs {
+		data := out.data
+		if out.file != "" {
+			data, err = os.ReadFile(out.file)
+			if err != nil {
+				slog.Warn("failed to copy metadata", "file", filePath, "error", err)
+				continue
+			}
+		}
+		data, err = writeMetadata(data, out.mt, meta)
+		if err != nil {
+			slog.Warn("failed to copy metadata", "file", filePath, "format", out.mt, "error", err)
+			continue
+		}
+		// Результат с метаданными записывается заново из памяти
+		outputs[i].data, outputs[i].file = data, ""
+	}
+	return outputs
+}
+
+// readMetadata извлекает метаданные из JPEG, PNG или WebP.
+// Для других форматов и при ошибке разбора возвращает пустой результат.
+func readMetadata(data []byte) imageMeta {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return jpegMetadata(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return pngMetadata(data)
+	case isWebP(data):
+		return webpMetadata(data)
+	}
+	return imageMeta{}
+}
+
+// writeMetadata заменяет в изображении формата mt метаданные тех видов,
+// которые заданы в m. Остальные метаданные результата не меняются.
+func writeMetadata(data []byte, mt string, m imageMeta) ([]byte, error) {
+	switch mt {
+	case "image/jpeg":
+		return jpegWithMetadata(data, m)
+	case "image/png":
+		return pngWithMetadata(data, m)
+	case "image/webp":
+		return webpWithMetadata(data, m)
+	}
+	return nil, fmt.Errorf("формат %s не поддерживает перенос метаданных", mt)
+}
+
+var errMalformedImage = errors.New("неверная структура изображения")
+
+// JPEG: EXIF и XMP хранятся в сегментах APP1, ICC - в APP2, разбитый
+// на части не больше 64 КБ
+
+var (
+	jpegEXIF = []byte("Exif\x00\x00")
+	jpegXMP  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegICC  = []byte("ICC_PROFILE\x00")
+)
+
+// Наибольший размер данных сегмента JPEG
+const maxSegment = 0xFFFF - 2
+
+// jpegSegment - сегмент JPEG до начала данных изображения (SOS)
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// jpegSegments разбирает сегменты после SOI. Возвращает сегменты
+// и остаток файла, начиная с первого сегмента после метаданных.
+func jpegSegments(data []byte) ([]jpegSegment, []byte, error) {
+	var segments []jpegSegment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, nil, errMalformedImage
+		}
+		marker := data[pos+1]
+		// Метаданные идут до начала данных изображения (SOS)
+		if marker == 0xDA || marker == 0xD9 {
+			return segments, data[pos:], nil
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			return nil, nil, errMalformedImage
+		}
+		segments = append(segments, jpegSegment{marker, data[pos+4 : pos+2+size]})
+		pos += 2 + size
+	}
+	return nil, nil, errMalformedImage
+}
+
+func jpegMetadata(data []byte) imageMeta {
+	var m imageMeta
+	segments, _, err := jpegSegments(data)
+	if err != nil {
+		return m
+	}
+
+	// Части профиля ICC нумеруются с единицы
+	var icc [][]byte
+	for _, s := range segments {
+		switch {
+		case s.marker == 0xE1 && bytes.HasPrefix(s.data, jpegEXIF) && m.exif == nil:
+			m.exif = s.data[len(jpegEXIF):]
+		case s.marker == 0xE1 && bytes.HasPrefix(s.data, jpegXMP) && m.xmp == nil:
+			m.xmp = s.data[len(jpegXMP):]
+		case s.marker == 0xE2 && bytes.HasPrefix(s.data, jpegICC) && len(s.data) > len(jpegICC)+2:
+			seq, count := int(s.data[len(jpegICC)]), int(s.data[len(jpegICC)+1])
+			if seq < 1 || seq > count {
+				continue
+			}
+			if icc == nil {
+				icc = make([][]byte, count)
+			}
+			if seq <= len(icc) {
+				icc[seq-1] = s.data[len(jpegICC)+2:]
+			}
+		}
+	}
+	if icc != nil && !slices.ContainsFunc(icc, func(part []byte) bool { return part == nil }) {
+		m.icc = bytes.Join(icc, nil)
+	}
+	return m
+}
+
+func jpegWithMetadata(data []byte, m imageMeta) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return nil, errMalformedImage
+	}
+	segments, rest, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var add []jpegSegment
+	if m.exif != nil {
+		if len(jpegEXIF)+len(m.exif) > maxSegment {
+			return nil, fmt.Errorf("EXIF больше %d байт", maxSegment)
+		}
+		add = append(add, jpegSegment{0xE1, slices.Concat(jpegEXIF, m.exif)})
+	}
+	if m.xmp != nil {
+		if len(jpegXMP)+len(m.xmp) > maxSegment {
+			return nil, fmt.Errorf("XMP больше %d байт", maxSegment)
+		}
+		add = append(add, jpegSegment{0xE1, slices.Concat(jpegXMP, m.xmp)})
+	}
+	if m.icc != nil {
+		chunk := maxSegment - len(jpegICC) - 2
+		count := (len(m.icc) + chunk - 1) / chunk
+		if count > 255 {
+			return nil, errors.New("слишком большой профиль ICC")
+		}
+		for i := range count {
+			part := m.icc[i*chunk : min((i+1)*chunk, len(m.icc))]
+			add = append(add, jpegSegment{0xE2, slices.Concat(jpegICC, []byte{byte(i + 1), byte(count)}, part)})
+		}
+	}
+
+	// Новые сегменты идут после JFIF (APP0), заменяемые удаляются
+	out := []byte{0xFF, 0xD8}
+	inserted := false
+	for _, s := range segments {
+		replaced := s.marker == 0xE1 && m.exif != nil && bytes.HasPrefix(s.data, jpegEXIF) ||
+			s.marker == 0xE1 && m.xmp != nil && bytes.HasPrefix(s.data, jpegXMP) ||
+			s.marker == 0xE2 && m.icc != nil && bytes.HasPrefix(s.data, jpegICC)
+		if replaced {
+			continue
+		}
+		if !inserted && s.marker != 0xE0 {
+			out = appendSegments(out, add)
+			inserted = true
+		}
+		out = appendSegments(out, []jpegSegment{s})
+	}
+	if !inserted {
+		out = appendSegments(out, add)
+	}
+	return append(out, rest...), nil
+}
+
+func appendSegments(b []byte, segments []jpegSegment) []byte {
+	for _, s := range segments {
+		b = append(b, 0xFF, s.marker)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s.data)+2))
+		b = append(b, s.data...)
+	}
+	return b
+}
+
+// PNG: EXIF хранится в чанке eXIf, XMP - в iTXt с ключом XML:com.adobe.xmp,
+// ICC - в iCCP в сжатом виде
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+const pngXMPKey = "XML:com.adobe.xmp"
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+func pngChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errMalformedImage
+	}
+	var chunks []pngChunk
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if size < 0 || pos+12+size > len(data) {
+			return nil, errMalformedImage
+		}
+		c := pngChunk{string(data[pos+4 : pos+8]), data[pos+8 : pos+8+size]}
+		chunks = append(chunks, c)
+		pos += 12 + size
+		if c.typ == "IEND" {
+			return chunks, nil
+		}
+	}
+	return nil, errMalformedImage
+}
+
+func pngMetadata(data []byte) imageMeta {
+	var m imageMeta
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return m
+	}
+	for _, c := range chunks {
+		switch c.typ {
+		case "eXIf":
+			m.exif = c.data
+		case "iCCP":
+			// Имя профиля, метод сжатия и данные zlib
+			i := bytes.IndexByte(c.data, 0)
+			if i < 0 || i+2 > len(c.data) {
+				continue
+			}
+			m.icc, _ = inflate(c.data[i+2:])
+		case "iTXt":
+			if xmp, ok := pngXMP(c.data); ok {
+				m.xmp = xmp
+			}
+		}
+	}
+	return m
+}
+
+// pngXMP возвращает текст чанка iTXt с ключом XML:com.adobe.xmp
+func pngXMP(data []byte) ([]byte, bool) {
+	key, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok || string(key) != pngXMPKey || len(rest) < 2 {
+		return nil, false
+	}
+	compressed := rest[0] == 1
+	// Язык и переведенный ключ
+	_, rest, ok = bytes.Cut(rest[2:], []byte{0})
+	if ok {
+		_, rest, ok = bytes.Cut(rest, []byte{0})
+	}
+	if !ok {
+		return nil, false
+	}
+	if compressed {
+		text, err := inflate(rest)
+		return text, err == nil
+	}
+	return rest, true
+}
+
+func pngWithMetadata(data []byte, m imageMeta) ([]byte, error) {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var add []pngChunk
+	if m.icc != nil {
+		var buf bytes.Buffer
+		buf.WriteString("ICC Profile\x00\x00")
+		zw := zlib.NewWriter(&buf)
+		zw.Write(m.icc)
+		zw.Close()
+		add = append(add, pngChunk{"iCCP", buf.Bytes()})
+	}
+	if m.exif != nil {
+		add = append(add, pngChunk{"eXIf", m.exif})
+	}
+	if m.xmp != nil {
+		// Без сжатия, без языка и перевода ключа
+		add = append(add, pngChunk{"iTXt", slices.Concat([]byte(pngXMPKey+"\x00\x00\x00\x00\x00"), m.xmp)})
+	}
+
+	// Новые чанки идут сразу после IHDR: iCCP должен предшествовать PLTE и IDAT
+	out := slices.Clone(pngSignature)
+	for _, c := range chunks {
+		_, isXMP := pngXMP(c.data)
+		replaced := m.icc != nil && (c.typ == "iCCP" || c.typ == "sRGB") ||
+			m.exif != nil && c.typ == "eXIf" ||
+			m.xmp != nil && c.typ == "iTXt" && isXMP
+		if replaced {
+			continue
+		}
+		out = appendPNGChunk(out, c)
+		if c.typ == "IHDR" {
+			for _, a := range add {
+				out = appendPNGChunk(out, a)
+			}
+		}
+	}
+	return out, nil
+}
+
+func appendPNGChunk(b []byte, c pngChunk) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(c.data)))
+	start := len(b)
+	b = append(b, c.typ...)
+	b = append(b, c.data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+}
+
+func inflate(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// WebP: метаданные хранятся в чанках ICCP, EXIF и XMP расширенного
+// формата, о наличии которых сообщают флаги чанка VP8X
+
+// Флаги чанка VP8X
+const (
+	vp8xICC   = 0x20
+	vp8xAlpha = 0x10
+	vp8xEXIF  = 0x08
+	vp8xXMP   = 0x04
+)
+
+type webpChunk struct {
+	fourcc string
+	data   []byte
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+func webpChunks(data []byte) ([]webpChunk, error) {
+	if !isWebP(data) {
+		return nil, errMalformedImage
+	}
+	var chunks []webpChunk
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			return nil, errMalformedImage
+		}
+		chunks = append(chunks, webpChunk{string(data[pos : pos+4]), data[pos+8 : pos+8+size]})
+		pos += 8 + size + size&1
+	}
+	if len(chunks) == 0 {
+		return nil, errMalformedImage
+	}
+	return chunks, nil
+}
+
+func webpMetadata(data []byte) imageMeta {
+	var m imageMeta
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return m
+	}
+	for _, c := range chunks {
+		switch c.fourcc {
+		case "EXIF":
+			// Некоторые программы записывают EXIF с префиксом, как в JPEG
+			m.exif = bytes.TrimPrefix(c.data, jpegEXIF)
+		case "XMP ":
+			m.xmp = c.data
+		case "ICCP":
+			m.icc = c.data
+		}
+	}
+	return m
+}
+
+func webpWithMetadata(data []byte, m imageMeta) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Простой формат (только VP8 или VP8L) переводится в расширенный
+	vp8x := chunks[0]
+	if vp8x.fourcc == "VP8X" {
+		if len(vp8x.data) < 10 {
+			return nil, errMalformedImage
+		}
+		vp8x.data = bytes.Clone(vp8x.data)
+		chunks = chunks[1:]
+	} else {
+		width, height, alpha, err := webpSize(chunks[0])
+		if err != nil {
+			return nil, err
+		}
+		vp8x = webpChunk{"VP8X", make([]byte, 10)}
+		if alpha {
+			vp8x.data[0] |= vp8xAlpha
+		}
+		putUint24(vp8x.data[4:], width-1)
+		putUint24(vp8x.data[7:], height-1)
+	}
+
+	// Порядок чанков: VP8X, ICCP, данные изображения, EXIF, XMP
+	var icc, exif, xmp *webpChunk
+	var body []webpChunk
+	for _, c := range chunks {
+		switch c.fourcc {
+		case "ICCP":
+			icc = &c
+		case "EXIF":
+			exif = &c
+		case "XMP ":
+			xmp = &c
+		default:
+			body = append(body, c)
+		}
+	}
+	if m.icc != nil {
+		icc = &webpChunk{"ICCP", m.icc}
+	}
+	if m.exif != nil {
+		exif = &webpChunk{"EXIF", m.exif}
+	}
+	if m.xmp != nil {
+		xmp = &webpChunk{"XMP ", m.xmp}
+	}
+
+	flags := vp8x.data[0] &^ (vp8xICC | vp8xEXIF | vp8xXMP)
+	ordered := []webpChunk{vp8x}
+	if icc != nil {
+		flags |= vp8xICC
+		ordered = append(ordered, *icc)
+	}
+	ordered = append(ordered, body...)
+	if exif != nil {
+		flags |= vp8xEXIF
+		ordered = append(ordered, *exif)
+	}
+	if xmp != nil {
+		flags |= vp8xXMP
+		ordered = append(ordered, *xmp)
+	}
+	vp8x.data[0] = flags
+
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range ordered {
+		out = append(out, c.fourcc...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(c.data)))
+		out = append(out, c.data...)
+		if len(c.data)&1 == 1 {
+			out = append(out, 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// webpSize возвращает размеры и наличие прозрачности по чанку VP8 или VP8L
+func webpSize(c webpChunk) (int, int, bool, error) {
+	switch c.fourcc {
+	case "VP8 ":
+		// Тег кадра, стартовый код 9d 01 2a, затем 14-битные ширина и высота
+		if len(c.data) < 10 || !bytes.Equal(c.data[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, false, errMalformedImage
+		}
+		width := int(binary.LittleEndian.Uint16(c.data[6:]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(c.data[8:]) & 0x3fff)
+		return width, height, false, nil
+	case "VP8L":
+		// Сигнатура 0x2f, затем ширина-1 и высота-1 по 14 бит и флаг прозрачности
+		if len(c.data) < 5 || c.data[0] != 0x2f {
+			return 0, 0, false, errMalformedImage
+		}
+		bits := binary.LittleEndian.Uint32(c.data[1:])
+		width := int(bits&0x3fff) + 1
+		height := int(bits>>14&0x3fff) + 1
+		return width, height, bits>>28&1 == 1, nil
+	}
+	return 0, 0, false, errMalformedImage
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// resetOrientation записывает в тег Orientation (0x0112) первого IFD
+// значение 1, если тег есть
+func resetOrientation(t []byte) []byte {
+	if len(t) < 8 {
+		return t
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return t
+	}
+
+	offset := int(order.Uint32(t[4:]))
+	if offset < 8 || offset+2 > len(t) {
+		return t
+	}
+	count := int(order.Uint16(t[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(t) {
+			return t
+		}
+		if order.Uint16(t[entry:]) == 0x0112 {
+			order.PutUint16(t[entry+8:], 1)
+			return t
+		}
+	}
+	return t
+}
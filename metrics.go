@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"photoroom/otlp"
+)
+
+// Метрики в текстовом формате Prometheus. Набор небольшой,
+// поэтому обходимся без клиентской библиотеки.
+var (
+	metricFilesProcessed    = newCounter("photoroom_files_processed_total", "Files processed successfully.", "")
+	metricFilesFailed       = newCounter("photoroom_files_failed_total", "Files that failed processing, by API status code.", "status")
+	metricFilesSkipped      = newCounter("photoroom_files_skipped_total", "Files skipped by filters.", "")
+	metricFilesDeduplicated = newCounter("photoroom_files_deduplicated_total", "Files not sent to the API because an identical file was already processed.", "")
+	metricCacheHits         = newCounter("photoroom_cache_hits_total", "API responses served from the result cache.", "")
+	metricFilesFlagged      = newCounter("photoroom_files_flagged_for_review_total", "API results that failed the QA check and were copied for manual review.", "")
+	metricAPIRequests       = newCounter("photoroom_api_requests_total", "API requests, by status code.", "status")
+	metricAPILatency        = newHistogram("photoroom_api_request_duration_seconds", "API request latency.",
+		[]float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120})
+	metricBytesUploaded   = newCounter("photoroom_uploaded_bytes_total", "Bytes sent to the API.", "")
+	metricBytesDownloaded = newCounter("photoroom_downloaded_bytes_total", "Bytes received from the API.", "")
+	metricQueueDepth      = &gaugeFunc{name: "photoroom_queue_depth", help: "Files waiting in the queue."}
+	metricCreditsUsed     = newCounter("photoroom_credits_used_total", "Estimated API credits spent since start, by tenant.", "tenant")
+	metricCreditsLeft     = &gaugeFunc{name: "photoroom_credits_remaining", help: "API credits remaining, as last reported by the API.", fn: func() float64 {
+		remaining, _ := credits.value()
+		return remaining
+	}}
+	metricPolledDirs = &gaugeFunc{name: "photoroom_polled_directories", help: "Source directories polled because the watch limit was reached.", fn: func() float64 {
+		return float64(watchFallback.len())
+	}}
+
+	metrics = []metric{
+		metricFilesProcessed, metricFilesFailed, metricFilesSkipped, metricFilesDeduplicated, metricCacheHits, metricFilesFlagged,
+		metricAPIRequests, metricAPILatency,
+		metricBytesUploaded, metricBytesDownloaded,
+		metricQueueDepth, metricPolledDirs,
+		metricCreditsUsed, metricCreditsLeft,
+	}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Счетчик с не более чем одной меткой
+type counter struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help, label string) *counter {
+	return &counter{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counter) add(labelValue string, v float64) {
+	c.mu.Lock()
+	c.values[labelValue] += v
+	c.mu.Unlock()
+}
+
+func (c *counter) value(labelValue string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *counter) inc(labelValue string) {
+	c.add(labelValue, 1)
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", c.name, c.label, k, formatFloat(c.values[k]))
+	}
+}
+
+// Значение, вычисляемое в момент сбора метрик
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	v := 0.0
+	if g.fn != nil {
+		v = g.fn()
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(v))
+}
+
+type histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatFloat(h.sum), h.name, h.count)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// instrumentedTransport собирает метрики запросов к API
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	_, upload := startSpan(req.Context(), "upload", otlp.WithKind(otlp.KindClient),
+		otlp.WithAttributes(otlp.String("http.request.method", req.Method), otlp.String("url.full", req.URL.String())))
+	res, err := t.next.RoundTrip(req)
+	metricAPILatency.observe(time.Since(start).Seconds())
+	if req.ContentLength > 0 {
+		metricBytesUploaded.add("", float64(req.ContentLength))
+		upload.SetAttributes(otlp.Int("http.request.body.size", req.ContentLength))
+	}
+	if err != nil {
+		metricAPIRequests.inc("error")
+		endSpan(upload, err)
+		return nil, err
+	}
+
+	metricAPIRequests.inc(strconv.Itoa(res.StatusCode))
+	upload.SetAttributes(otlp.Int("http.response.status_code", int64(res.StatusCode)))
+	upload.End()
+	res.Body = &countingReader{ReadCloser: res.Body, counter: metricBytesDownloaded}
+	if _, download := startSpan(req.Context(), "download", otlp.WithKind(otlp.KindClient)); download != nil {
+		res.Body = &tracedBody{ReadCloser: res.Body, span: download}
+	}
+	return res, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	counter *counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.add("", float64(n))
+	return n, err
+}
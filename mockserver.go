@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Ответы локального сервера вместо результата обработки
+const (
+	// Исходное изображение без изменений
+	mockInput = "input"
+	// Прозрачный PNG размером с исходное изображение
+	mockStub = "stub"
+)
+
+// Локальный сервер с эндпоинтами API для проверки конфигурации, хуков
+// и конвейеров без ключа API и расхода кредитов
+type mockServer struct {
+	response string
+	delay    time.Duration
+	failRate float64
+
+	mu      sync.Mutex
+	credits float64
+}
+
+// runMockServer запускает локальный сервер, повторяющий эндпоинты
+// Image Editing API (/v2/edit), Remove Background API (/v1/segment)
+// и сведений об аккаунте (/v1/account). Подходит любой непустой ключ.
+func runMockServer(args []string) int {
+	fs := flag.NewFlagSet("mock-server", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8700", "адрес сервера")
+	m := &mockServer{}
+	fs.StringVar(&m.response, "response", mockInput, "ответ: input - исходное изображение, stub - прозрачный PNG того же размера")
+	fs.DurationVar(&m.delay, "delay", 0, "задержка перед ответом, как у настоящей обработки")
+	fs.Float64Var(&m.failRate, "fail-rate", 0, "доля запросов, на которые отвечать ошибкой 500 (от 0 до 1), для проверки повторов")
+	fs.Float64Var(&m.credits, "credits", 1000, "начальный остаток кредитов; каждый запрос расходует один, при нуле - ответ 402")
+	fs.Parse(args)
+
+	if m.response != mockInput && m.response != mockStub {
+		fmt.Fprintf(os.Stderr, "неизвестный ответ %q, ожидается %s или %s\n", m.response, mockInput, mockStub)
+		return exitConfig
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v2/edit", m.handleImage("imageFile"))
+	mux.HandleFunc("POST /v1/segment", m.handleImage("image_file"))
+	mux.HandleFunc("GET /v1/account", m.handleAccount)
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	base := "http://" + *listen
+	fmt.Fprintf(os.Stderr, "Параметры config.yaml для работы с локальным сервером:\n"+
+		"  api_key: mock\n  api_url: %[1]s/v2/edit\n  remove_bg_url: %[1]s/v1/segment\n"+
+		"  credits:\n    account_url: %[1]s/v1/account\n", base)
+	slog.Info("mock server started", "listen", *listen, "response", m.response)
+	err := srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("mock server failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// handleImage отвечает на запрос обработки изображения из поля fileField
+// или по адресу из поля imageUrl
+func (m *mockServer) handleImage(fileField string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") == "" {
+			mockError(w, http.StatusUnauthorized, "Missing API key")
+			return
+		}
+		err := r.ParseMultipartForm(32 << 20)
+		if err != nil {
+			mockError(w, http.StatusBadRequest, "Invalid multipart body: "+err.Error())
+			return
+		}
+
+		data, err := mockImage(r, fileField)
+		if err != nil {
+			mockError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("mock request", "path", r.URL.Path, "bytes", len(data), "fields", len(r.MultipartForm.Value),
+			"request_id", r.Header.Get("X-Request-ID"))
+
+		select {
+		case <-time.After(m.delay):
+		case <-r.Context().Done():
+			return
+		}
+		if m.failRate > 0 && rand.Float64() < m.failRate {
+			mockError(w, http.StatusInternalServerError, "Simulated failure")
+			return
+		}
+
+		remaining, ok := m.spend()
+		if !ok {
+			mockError(w, http.StatusPaymentRequired, "No credits left")
+			return
+		}
+
+		if m.response == mockStub {
+			data, err = stubImage(data)
+			if err != nil {
+				mockError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("X-Credits-Remaining", strconv.FormatFloat(remaining, 'f', -1, 64))
+		w.Write(data)
+	}
+}
+
+func (m *mockServer) handleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("x-api-key") == "" {
+		mockError(w, http.StatusUnauthorized, "Missing API key")
+		return
+	}
+	m.mu.Lock()
+	credits := m.credits
+	m.mu.Unlock()
+
+	var account struct {
+		Credits struct {
+			Available    float64 `json:"available"`
+			Subscription float64 `json:"subscription"`
+		} `json:"credits"`
+	}
+	account.Credits.Available = credits
+	writeJSON(w, account)
+}
+
+// spend списывает кредит за запрос и возвращает остаток
+func (m *mockServer) spend() (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.credits < 1 {
+		return m.credits, false
+	}
+	m.credits--
+	return m.credits, true
+}
+
+// mockImage возвращает изображение запроса: из поля fileField или скачанное
+// по адресу imageUrl
+func mockImage(r *http.Request, fileField string) ([]byte, error) {
+	if imageURL := r.FormValue("imageUrl"); imageURL != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to download imageUrl: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Failed to download imageUrl: %s", resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+
+	file, _, err := r.FormFile(fileField)
+	if err != nil {
+		return nil, fmt.Errorf("Missing %s", fileField)
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// stubImage возвращает прозрачный PNG размером с изображение data
+func stubImage(data []byte) ([]byte, error) {
+	width, height := 64, 64
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		width, height = min(cfg.Width, 8192), min(cfg.Height, 8192)
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height)))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mockError отвечает ошибкой в формате API
+func mockError(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"detail": detail})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"photoroom/storage"
+)
+
+// Шаблон имени результата по умолчанию - имя исходного файла
+const defaultOutputName = "{{.Name}}.{{.Ext}}"
+
+// Что делать, если результат с таким именем уже есть в processed
+const (
+	// Добавить к имени номер: photo_1.png
+	outputVersion = "version"
+	// Заменить прежний результат
+	outputOverwrite = "overwrite"
+	// Не обрабатывать файл и перенести его в skipped_dir
+	outputSkip = "skip"
+	// Считать файл необработанным
+	outputFail = "fail"
+)
+
+// errOutputExists - результат с таким именем уже существует
+var errOutputExists = errors.New("результат уже существует")
+
+func validOutputExists(policy string) error {
+	switch policy {
+	case "", outputVersion, outputOverwrite, outputSkip, outputFail:
+		return nil
+	}
+	return fmt.Errorf("неизвестное значение output_exists %q, ожидается %s, %s, %s или %s",
+		policy, outputVersion, outputOverwrite, outputSkip, outputFail)
+}
+
+// outputConflict возвращает действие при сохранении результата под занятым именем
+func outputConflict() storage.Conflict {
+	switch config.OutputExists {
+	case outputOverwrite:
+		return storage.Replace
+	case outputSkip, outputFail:
+		return storage.Keep
+	}
+	return storage.Rename
+}
+
+// outputExistsError возвращает ошибку для занятого имени результата path:
+// при skip файл считается пропущенным, при fail - необработанным
+func outputExistsError(path string) error {
+	if config.OutputExists == outputSkip {
+		return fmt.Errorf("%w: результат %s уже существует", errSkipped, path)
+	}
+	return fmt.Errorf("%w: %s", errOutputExists, path)
+}
+
+// checkExistingOutput при output_exists: skip или fail проверяет до запроса
+// к API, что результата файла с параметрами набора variant еще нет в processed.
+// Формат ответа API заранее неизвестен, поэтому проверяются имена со всеми
+// расширениями, которые может получить результат.
+func checkExistingOutput(filePath, profile, variant string) error {
+	if config.OutputExists != outputSkip && config.OutputExists != outputFail {
+		return nil
+	}
+
+	dir := filepath.Join(processedDir(filePath), filepath.Dir(relPath(filePath)))
+	renditions := []string{""}
+	if len(config.Renditions) > 0 {
+		renditions = renditions[:0]
+		for _, r := range config.Renditions {
+			renditions = append(renditions, r.Name)
+		}
+	}
+	exts := []string{strings.TrimPrefix(filepath.Ext(filePath), ".")}
+	for _, ext := range formatExts {
+		exts = append(exts, ext)
+	}
+
+	for _, rendition := range renditions {
+		for _, ext := range exts {
+			name, err := outputName(filePath, profile, variant, rendition, ext)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(dir, name)
+			if _, err := os.Lstat(path); err == nil {
+				return outputExistsError(path)
+			}
+		}
+	}
+	return nil
+}
+
+// Данные, доступные в шаблоне имени результата
+type nameData struct {
+	// Имя исходного файла без расширения
+	Name string
+	// Расширение результата без точки, соответствующее его формату
+	Ext string
+	// Имя профиля или "default"
+	Profile string
+	// Имя набора параметров из variants; пустое без них
+	Variant string
+	// Имя варианта результата; пустое для основного
+	Rendition string
+	// Время обработки в формате 20060102-150405
+	Timestamp string
+}
+
+func parseOutputName(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultOutputName
+	}
+	tmpl, err := template.New("output_name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("неверный шаблон output_name: %w", err)
+	}
+
+	// Проверяем шаблон на тестовых данных, чтобы ошибки всплыли при запуске
+	_, err = renderName(tmpl, nameData{Name: "photo", Ext: "jpg", Profile: "default", Variant: "v1", Rendition: "thumb", Timestamp: "20060102-150405"})
+	if err != nil {
+		return nil, fmt.Errorf("неверный шаблон output_name: %w", err)
+	}
+	return tmpl, nil
+}
+
+func renderName(tmpl *template.Template, data nameData) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSpace(buf.String())
+	if name == "" || !filepath.IsLocal(name) || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("недопустимое имя файла %q", name)
+	}
+	return name, nil
+}
+
+// outputName возвращает имя результата для исходного файла по шаблону output_name.
+// ext - расширение результата без точки. Если шаблон не использует {{.Variant}}
+// и {{.Rendition}}, имена набора и варианта добавляются перед расширением:
+// photo_v1_thumb.jpg. В песочнице последним добавляется _sandbox.
+func outputName(filePath, profile, variant, rendition, ext string) (string, error) {
+	base := filepath.Base(filePath)
+	if profile == "" {
+		profile = "default"
+	}
+
+	name, err := renderName(config.outputName, nameData{
+		Name:      strings.TrimSuffix(base, filepath.Ext(base)),
+		Ext:       ext,
+		Profile:   profile,
+		Variant:   variant,
+		Rendition: rendition,
+		Timestamp: time.Now().Format("20060102-150405"),
+	})
+	if err != nil {
+		return "", err
+	}
+	if variant != "" && !strings.Contains(config.OutputName, ".Variant") {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + "_" + variant + filepath.Ext(name)
+	}
+	if rendition != "" && !strings.Contains(config.OutputName, ".Rendition") {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + "_" + rendition + filepath.Ext(name)
+	}
+	// Результаты с водяным знаком песочницы не должны попасть в каталог
+	if config.Sandbox {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + "_sandbox" + filepath.Ext(name)
+	}
+	return name, nil
+}
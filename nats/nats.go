@@ -0,0 +1,382 @@
+// Пакет nats - минимальный клиент NATS (core, без JetStream):
+// подключение с авторизацией, подписка с группой очередей и публикация.
+package nats
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config - параметры подключения к серверу.
+type Config struct {
+	// Адрес сервера: nats://[user:password@]host:4222 или tls://host:4222
+	URL string `yaml:"url"`
+	// Токен авторизации, если сервер настроен на авторизацию по токену
+	Token string `yaml:"token"`
+	// Имя клиента, видимое в мониторинге сервера
+	Name string `yaml:"name"`
+}
+
+// Msg - полученное сообщение.
+type Msg struct {
+	Subject string
+	// Тема для ответа, если отправитель ждет ответ
+	Reply string
+	Data  []byte
+}
+
+// Conn - подключение к серверу. Сообщения читаются в отдельной горутине.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]chan Msg
+	sid  int
+	pong chan struct{}
+	err  error
+	done chan struct{}
+
+	closeOnce sync.Once
+	quit      chan struct{}
+}
+
+// Максимальный размер строки протокола (не сообщения)
+const maxLine = 64 * 1024
+
+// Dial подключается к серверу и проходит авторизацию.
+func Dial(ctx context.Context, cfg Config) (*Conn, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("неверный адрес сервера NATS %q", cfg.URL)
+	}
+	useTLS := false
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		useTLS = true
+	default:
+		return nil, fmt.Errorf("неподдерживаемая схема %q, ожидается nats или tls", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	// Рукопожатие не должно зависать, если сервер не отвечает
+	deadline := time.Now().Add(10 * time.Second)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	return connect(conn, u, cfg, useTLS, deadline)
+}
+
+// connect проходит рукопожатие по установленному соединению conn
+// и запускает чтение команд сервера
+func connect(conn net.Conn, u *url.URL, cfg Config, useTLS bool, deadline time.Time) (*Conn, error) {
+	conn.SetDeadline(deadline)
+	c := &Conn{
+		conn: conn,
+		r:    bufio.NewReaderSize(conn, maxLine),
+		subs: make(map[string]chan Msg),
+		pong: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		quit: make(chan struct{}),
+	}
+	err := c.handshake(u, cfg, useTLS)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	c.conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Conn) handshake(u *url.URL, cfg Config, useTLS bool) error {
+	line, err := c.readLine()
+	if err != nil {
+		return fmt.Errorf("сервер NATS не ответил: %w", err)
+	}
+	op, args, _ := strings.Cut(line, " ")
+	if strings.ToUpper(op) != "INFO" {
+		return fmt.Errorf("неожиданный ответ сервера NATS: %q", line)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(args), &info)
+
+	if useTLS || info.TLSRequired {
+		tc := tls.Client(c.conn, &tls.Config{ServerName: u.Hostname()})
+		err = tc.Handshake()
+		if err != nil {
+			return err
+		}
+		c.conn = tc
+		c.r = bufio.NewReaderSize(tc, maxLine)
+	}
+
+	opts := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"lang":     "go",
+		"version":  "1.0",
+		"protocol": 1,
+	}
+	if cfg.Name != "" {
+		opts["name"] = cfg.Name
+	}
+	if u.User != nil {
+		opts["user"] = u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			opts["pass"] = pass
+		}
+	}
+	if cfg.Token != "" {
+		opts["auth_token"] = cfg.Token
+	}
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+
+	// Ответ на PING подтверждает, что CONNECT принят
+	_, err = fmt.Fprintf(c.conn, "CONNECT %s\r\nPING\r\n", data)
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch op, args, _ := strings.Cut(line, " "); strings.ToUpper(op) {
+		case "PONG":
+			return nil
+		case "-ERR":
+			return serverError(args)
+		}
+	}
+}
+
+// Error - ошибка, присланная сервером.
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "ошибка NATS: " + e.Message
+}
+
+func serverError(args string) error {
+	return &Error{Message: strings.Trim(strings.TrimSpace(args), "'")}
+}
+
+func (c *Conn) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("слишком длинная строка протокола")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// readLoop читает команды сервера до закрытия подключения
+func (c *Conn) readLoop() {
+	err := c.read()
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	for sid, ch := range c.subs {
+		close(ch)
+		delete(c.subs, sid)
+	}
+	c.mu.Unlock()
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *Conn) read() error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "MSG":
+			err = c.readMsg(strings.Fields(args))
+			if err != nil {
+				return err
+			}
+		case "PING":
+			err = c.write([]byte("PONG\r\n"))
+			if err != nil {
+				return err
+			}
+		case "PONG":
+			select {
+			case c.pong <- struct{}{}:
+			default:
+			}
+		case "-ERR":
+			return serverError(args)
+		}
+	}
+}
+
+// readMsg читает сообщение "MSG <subject> <sid> [reply] <size>"
+func (c *Conn) readMsg(fields []string) error {
+	if len(fields) != 3 && len(fields) != 4 {
+		return fmt.Errorf("неверная команда MSG: %v", fields)
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 {
+		return fmt.Errorf("неверный размер сообщения: %v", fields)
+	}
+	data := make([]byte, size+2)
+	_, err = io.ReadFull(c.r, data)
+	if err != nil {
+		return err
+	}
+
+	msg := Msg{Subject: fields[0], Data: data[:size]}
+	if len(fields) == 4 {
+		msg.Reply = fields[2]
+	}
+
+	c.mu.Lock()
+	ch := c.subs[fields[1]]
+	c.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	// Медленный получатель задерживает чтение, а не теряет сообщения
+	select {
+	case ch <- msg:
+		return nil
+	case <-c.quit:
+		return net.ErrClosed
+	}
+}
+
+func (c *Conn) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// Subscribe подписывается на тему subject. Если queue не пусто, сообщения
+// распределяются между подписчиками группы. Канал закрывается вместе
+// с подключением.
+func (c *Conn) Subscribe(subject, queue string) (<-chan Msg, error) {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("неверная тема %q", subject)
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.sid++
+	sid := strconv.Itoa(c.sid)
+	ch := make(chan Msg)
+	c.subs[sid] = ch
+	c.mu.Unlock()
+
+	cmd := "SUB " + subject + " " + sid + "\r\n"
+	if queue != "" {
+		cmd = "SUB " + subject + " " + queue + " " + sid + "\r\n"
+	}
+	err := c.write([]byte(cmd))
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Publish отправляет data в тему subject.
+func (c *Conn) Publish(subject string, data []byte) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("неверная тема %q", subject)
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, len(subject)+len(data)+32)
+	buf = fmt.Appendf(buf, "PUB %s %d\r\n", subject, len(data))
+	buf = append(buf, data...)
+	buf = append(buf, "\r\n"...)
+	return c.write(buf)
+}
+
+// Flush дожидается, пока сервер обработает отправленные команды.
+func (c *Conn) Flush(ctx context.Context) error {
+	// Ответ на прежний PING мог прийти с опозданием
+	select {
+	case <-c.pong:
+	default:
+	}
+	err := c.write([]byte("PING\r\n"))
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.pong:
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done закрывается при разрыве подключения.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err возвращает причину разрыва подключения.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close закрывает подключение.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.mu.Unlock()
+	c.closeOnce.Do(func() { close(c.quit) })
+	return c.conn.Close()
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Поводы для уведомлений
+const (
+	alertBatch     = "batch"
+	alertErrorRate = "error_rate"
+	alertCredits   = "credits"
+	alertDiskSpace = "disk_space"
+)
+
+// Типы каналов уведомлений
+const (
+	channelSlack    = "slack"
+	channelTelegram = "telegram"
+	channelEmail    = "email"
+)
+
+// Адрес Bot API Telegram
+var telegramAPI = "https://api.telegram.org"
+
+// Уведомления о завершении пачки файлов, доле ошибок и остатке кредитов
+type Notifications struct {
+	Channels []NotifyChannel `yaml:"channels"`
+	// Пачка считается завершенной, когда очередь пуста и файлы
+	// не обрабатываются batch_idle
+	BatchIdle time.Duration `yaml:"batch_idle"`
+	// Уведомлять, когда доля ошибок среди файлов за window больше
+	// error_rate (при числе файлов не меньше min_files); 0 - не уведомлять
+	ErrorRate float64       `yaml:"error_rate"`
+	Window    time.Duration `yaml:"window"`
+	MinFiles  int           `yaml:"min_files"`
+}
+
+// Канал уведомлений
+type NotifyChannel struct {
+	// slack, telegram или email
+	Type string `yaml:"type"`
+	// Поводы: batch, error_rate, credits, disk_space; пусто - все
+	Events []string `yaml:"events"`
+	// Slack: адрес входящего вебхука
+	WebhookURL string `yaml:"webhook_url"`
+	// Telegram: токен бота и чат
+	BotToken string `yaml:"bot_token"`
+	ChatID   string `yaml:"chat_id"`
+	// Email: сервер SMTP host:port (порт 465 - TLS, иначе STARTTLS,
+	// если сервер его поддерживает), учетная запись и адреса
+	SMTP     string   `yaml:"smtp"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+func validNotifications(n Notifications) error {
+	for i, ch := range n.Channels {
+		for _, event := range ch.Events {
+			if event != alertBatch && event != alertErrorRate && event != alertCredits && event != alertDiskSpace {
+				return fmt.Errorf("канал %d: неизвестный повод %q", i+1, event)
+			}
+		}
+		switch ch.Type {
+		case channelSlack:
+			if ch.WebhookURL == "" {
+				return fmt.Errorf("канал %d: для slack нужен webhook_url", i+1)
+			}
+		case channelTelegram:
+			if ch.BotToken == "" || ch.ChatID == "" {
+				return fmt.Errorf("канал %d: для telegram нужны bot_token и chat_id", i+1)
+			}
+		case channelEmail:
+			if _, _, err := net.SplitHostPort(ch.SMTP); err != nil {
+				return fmt.Errorf("канал %d: неверный адрес smtp %q", i+1, ch.SMTP)
+			}
+			if ch.From == "" || len(ch.To) == 0 {
+				return fmt.Errorf("канал %d: для email нужны from и to", i+1)
+			}
+		default:
+			return fmt.Errorf("канал %d: неизвестный тип %q, ожидается slack, telegram или email", i+1, ch.Type)
+		}
+	}
+	if n.ErrorRate < 0 || n.ErrorRate > 1 {
+		return fmt.Errorf("error_rate должен быть от 0 до 1")
+	}
+	if n.BatchIdle <= 0 || (n.ErrorRate > 0 && n.Window <= 0) {
+		return fmt.Errorf("batch_idle и window должны быть больше нуля")
+	}
+	return nil
+}
+
+// Итоги текущей пачки и недавние итоги для доли ошибок
+type notifier struct {
+	mu sync.Mutex
+	// Итоги по видам с начала пачки
+	batch        map[string]int
+	batchStarted time.Time
+	lastActivity time.Time
+	// Время и итог файлов за окно error_rate
+	recent      []notifyResult
+	rateAlerted time.Time
+}
+
+type notifyResult struct {
+	time   time.Time
+	failed bool
+}
+
+var notifications = &notifier{batch: make(map[string]int)}
+
+// observe учитывает итог обработки файла
+func (n *notifier) observe(result string) {
+	if len(config.Notifications.Channels) == 0 {
+		return
+	}
+
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.batch) == 0 {
+		n.batchStarted = now
+	}
+	n.batch[result]++
+	n.lastActivity = now
+
+	cfg := config.Notifications
+	if cfg.ErrorRate <= 0 || result == resultSkipped {
+		return
+	}
+	n.recent = append(n.recent, notifyResult{now, result == resultFailed})
+	cutoff := now.Add(-cfg.Window)
+	i := 0
+	for i < len(n.recent) && n.recent[i].time.Before(cutoff) {
+		i++
+	}
+	n.recent = n.recent[i:]
+
+	failed := 0
+	for _, r := range n.recent {
+		if r.failed {
+			failed++
+		}
+	}
+	rate := float64(failed) / float64(len(n.recent))
+	// Не чаще раза за окно
+	if len(n.recent) < cfg.MinFiles || rate <= cfg.ErrorRate || now.Sub(n.rateAlerted) < cfg.Window {
+		return
+	}
+	n.rateAlerted = now
+	sendAlert(alertErrorRate, fmt.Sprintf("Много ошибок обработки: %d из %d файлов за %s (%.0f%%, порог %.0f%%)",
+		failed, len(n.recent), cfg.Window, rate*100, cfg.ErrorRate*100))
+}
+
+// flushBatch отправляет итоги пачки, если в ней были файлы
+func (n *notifier) flushBatch() {
+	n.mu.Lock()
+	batch, started := n.batch, n.batchStarted
+	n.batch = make(map[string]int)
+	n.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("Обработка завершена за %s: обработано %d, повторов %d, ошибок %d, пропущено %d",
+		time.Since(started).Round(time.Second), batch[resultProcessed], batch[resultReused],
+		batch[resultFailed], batch[resultSkipped])
+	if remaining, ok := credits.value(); ok {
+		msg += fmt.Sprintf(", остаток кредитов %g", remaining)
+	}
+	sendAlert(alertBatch, msg)
+}
+
+// notifyLoop в режиме watch отправляет итоги пачки, когда очередь
+// пуста batch_idle, до отмены ctx
+func notifyLoop(ctx context.Context) {
+	if len(config.Notifications.Channels) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(min(config.Notifications.BatchIdle, 10*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		notifications.mu.Lock()
+		idle := len(notifications.batch) > 0 && time.Since(notifications.lastActivity) >= config.Notifications.BatchIdle
+		notifications.mu.Unlock()
+		if idle && jobs.active() == 0 {
+			notifications.flushBatch()
+		}
+	}
+}
+
+// sendAlert отправляет сообщение в фоне во все каналы, подписанные на повод
+func sendAlert(event, msg string) {
+	for _, ch := range config.Notifications.Channels {
+		if len(ch.Events) > 0 && !slices.Contains(ch.Events, event) {
+			continue
+		}
+		webhooksWG.Add(1)
+		go func() {
+			defer webhooksWG.Done()
+			err := ch.send(msg)
+			if err != nil {
+				slog.Error("notification delivery failed", "channel", ch.Type, "event", event, "error", err)
+			}
+		}()
+	}
+}
+
+func (ch NotifyChannel) send(msg string) error {
+	switch ch.Type {
+	case channelSlack:
+		body, _ := json.Marshal(map[string]string{"text": msg})
+		return postNotification(ch.WebhookURL, "application/json", body)
+	case channelTelegram:
+		form := url.Values{"chat_id": {ch.ChatID}, "text": {msg}}
+		u := telegramAPI + "/bot" + ch.BotToken + "/sendMessage"
+		return postNotification(u, "application/x-www-form-urlencoded", []byte(form.Encode()))
+	case channelEmail:
+		return ch.sendMail(msg)
+	}
+	return nil
+}
+
+func postNotification(u, contentType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		// Ошибка содержит адрес, а в нем может быть токен
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("сервер вернул код %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (ch NotifyChannel) sendMail(msg string) error {
+	host, port, _ := net.SplitHostPort(ch.SMTP)
+	subject := "PhotoRoom: " + strings.SplitN(msg, ":", 2)[0]
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\n", ch.From, strings.Join(ch.To, ", "))
+	fmt.Fprintf(&body, "Subject: =?utf-8?B?%s?=\r\n", base64.StdEncoding.EncodeToString([]byte(subject)))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	body.WriteString(msg + "\r\n")
+
+	var auth smtp.Auth
+	if ch.Username != "" {
+		auth = smtp.PlainAuth("", ch.Username, ch.Password, host)
+	}
+	if port != "465" {
+		return smtp.SendMail(ch.SMTP, auth, ch.From, ch.To, body.Bytes())
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", ch.SMTP, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(ch.From); err != nil {
+		return err
+	}
+	for _, to := range ch.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
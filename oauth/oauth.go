@@ -0,0 +1,98 @@
+// Пакет oauth получает токены доступа OAuth 2.0 по токену обновления
+// (refresh token), выданному пользователем приложению заранее.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config - приложение и токен обновления.
+type Config struct {
+	// TokenURL - адрес выдачи токенов сервиса
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+}
+
+// TokenSource выдает токен доступа и обновляет его незадолго до истечения.
+type TokenSource struct {
+	cfg        Config
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// New создает TokenSource. Если hc равен nil, используется http.DefaultClient.
+func New(cfg Config, hc *http.Client) *TokenSource {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &TokenSource{cfg: cfg, httpClient: hc}
+}
+
+// Token возвращает действующий токен доступа.
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Запас в минуту, чтобы токен не истек во время запроса
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expires) {
+		return s.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.cfg.RefreshToken},
+		"client_id":     {s.cfg.ClientID},
+	}
+	if s.cfg.ClientSecret != "" {
+		form.Set("client_secret", s.cfg.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("не удалось обновить токен OAuth (%d): %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.Unmarshal(body, &token)
+	if err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("неверный ответ сервера токенов: %s", strings.TrimSpace(string(body)))
+	}
+	s.token = token.AccessToken
+	s.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// Invalidate сбрасывает токен, например после ответа 401.
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
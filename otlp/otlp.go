@@ -0,0 +1,446 @@
+// Пакет otlp - минимальная трассировка в формате OpenTelemetry: спаны
+// с идентификаторами W3C Trace Context и их экспорт пакетами по OTLP/HTTP
+// в кодировке JSON (коллектор OpenTelemetry, Jaeger, Tempo принимают ее
+// на /v1/traces).
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultEndpoint - адрес приема трасс коллектором OpenTelemetry по умолчанию.
+const DefaultEndpoint = "http://localhost:4318/v1/traces"
+
+// Config - настройки Tracer.
+type Config struct {
+	// Адрес приема трасс по OTLP/HTTP
+	Endpoint string
+	// Дополнительные заголовки запросов, например авторизация
+	Headers map[string]string
+	// Атрибут service.name ресурса
+	ServiceName string
+	// Атрибут service.version ресурса
+	ServiceVersion string
+	// Доля записываемых трасс от 0 до 1
+	SampleRatio float64
+	// Сколько спанов отправлять одним запросом; 0 - 512
+	BatchSize int
+	// Как часто отправлять накопленные спаны; 0 - 5 секунд
+	Interval time.Duration
+	// Клиент HTTP для отправки; nil - http.DefaultClient
+	HTTPClient *http.Client
+	// Вызывается при ошибке отправки или потере спанов
+	OnError func(error)
+}
+
+// Tracer создает спаны и отправляет завершенные в коллектор.
+type Tracer struct {
+	cfg      Config
+	resource []Attr
+
+	mu      sync.Mutex
+	pending []*Span
+	dropped int
+
+	// Сигнал о заполненном пакете
+	full chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewTracer создает Tracer и запускает отправку спанов.
+// Shutdown отправляет оставшиеся спаны и останавливает ее.
+func NewTracer(cfg Config) *Tracer {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = DefaultEndpoint
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	t := &Tracer{
+		cfg:      cfg,
+		resource: []Attr{String("service.name", cfg.ServiceName)},
+		full:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if cfg.ServiceVersion != "" {
+		t.resource = append(t.resource, String("service.version", cfg.ServiceVersion))
+	}
+	go t.loop()
+	return t
+}
+
+// Kind - вид спана.
+type Kind int
+
+// Виды спанов OTLP.
+const (
+	KindInternal Kind = 1
+	KindClient   Kind = 3
+)
+
+// Attr - атрибут спана.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// String возвращает строковый атрибут.
+func String(key, value string) Attr { return Attr{key, value} }
+
+// Int возвращает целочисленный атрибут.
+func Int(key string, value int64) Attr { return Attr{key, value} }
+
+// Bool возвращает логический атрибут.
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+// Span - операция трассы. Методы nil-спана ничего не делают, поэтому
+// вызывающему коду не нужно проверять, включена ли трассировка.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	// Спаны трассы, не попавшей в выборку, не записываются,
+	// но передают идентификатор трассы дочерним
+	sampled bool
+
+	name  string
+	kind  Kind
+	start time.Time
+
+	mu      sync.Mutex
+	end     time.Time
+	attrs   []Attr
+	failed  bool
+	message string
+}
+
+// StartOption настраивает новый спан.
+type StartOption func(*Span)
+
+// WithStartTime задает время начала спана, если операция началась
+// раньше, чем спан был создан.
+func WithStartTime(t time.Time) StartOption {
+	return func(s *Span) {
+		if !t.IsZero() {
+			s.start = t
+		}
+	}
+}
+
+// WithKind задает вид спана.
+func WithKind(kind Kind) StartOption {
+	return func(s *Span) { s.kind = kind }
+}
+
+// WithAttributes добавляет атрибуты спана.
+func WithAttributes(attrs ...Attr) StartOption {
+	return func(s *Span) { s.attrs = append(s.attrs, attrs...) }
+}
+
+type spanKey struct{}
+
+// SpanFromContext возвращает текущий спан контекста или nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start создает спан, дочерний для спана из ctx, или корневой спан новой
+// трассы. Возвращает контекст с новым спаном. Для nil-трассировщика
+// возвращает ctx без изменений и nil-спан.
+func (t *Tracer) Start(ctx context.Context, name string, opts ...StartOption) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: KindInternal, start: time.Now()}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = t.sample(s.traceID)
+	}
+	rand.Read(s.spanID[:])
+	for _, opt := range opts {
+		opt(s)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample решает по идентификатору трассы, записывать ли ее, чтобы
+// все процессы с той же долей выборки решали одинаково
+func (t *Tracer) sample(traceID [16]byte) bool {
+	ratio := t.cfg.SampleRatio
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	v := binary.BigEndian.Uint64(traceID[8:]) >> 1
+	return float64(v) < ratio*float64(uint64(1)<<63)
+}
+
+// TraceID возвращает идентификатор трассы в hex или пустую строку,
+// если трасса не записывается.
+func (s *Span) TraceID() string {
+	if s == nil || !s.sampled {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetAttributes добавляет атрибуты спана.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// SetError отмечает спан ошибкой err; nil ничего не меняет.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed, s.message = true, err.Error()
+	s.mu.Unlock()
+}
+
+// End завершает спан. Повторные вызовы ничего не делают.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt завершает спан в момент t, если операция закончилась раньше.
+func (s *Span) EndAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = t
+	}
+	s.mu.Unlock()
+	if !ended && s.sampled {
+		s.tracer.add(s)
+	}
+}
+
+func (t *Tracer) add(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Пока коллектор недоступен, спаны копятся до предела, затем теряются
+	if len(t.pending) >= 4*t.cfg.BatchSize {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+	if len(t.pending) >= t.cfg.BatchSize {
+		select {
+		case t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-ticker.C:
+		case <-t.full:
+		}
+		t.flush(context.Background())
+	}
+}
+
+// Shutdown отправляет оставшиеся спаны и останавливает отправку.
+// Спаны, завершенные после Shutdown, не отправляются.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	close(t.quit)
+	<-t.done
+	return t.flush(ctx)
+}
+
+// flush отправляет накопленные спаны пакетами по BatchSize
+func (t *Tracer) flush(ctx context.Context) error {
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.report(fmt.Errorf("otlp: потеряно спанов: %d", dropped))
+	}
+	for len(spans) > 0 {
+		n := min(len(spans), t.cfg.BatchSize)
+		err := t.export(ctx, spans[:n])
+		if err != nil {
+			t.report(err)
+			return err
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+func (t *Tracer) report(err error) {
+	if t.cfg.OnError != nil {
+		t.cfg.OnError(err)
+	}
+}
+
+// export отправляет спаны одним запросом ExportTraceServiceRequest
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(t.encodeRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := t.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: коллектор ответил %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Сообщения OTLP в кодировке JSON: идентификаторы - в hex,
+// 64-битные числа - строками
+type (
+	jsonRequest struct {
+		ResourceSpans []jsonResourceSpans `json:"resourceSpans"`
+	}
+	jsonResourceSpans struct {
+		Resource   jsonResource     `json:"resource"`
+		ScopeSpans []jsonScopeSpans `json:"scopeSpans"`
+	}
+	jsonResource struct {
+		Attributes []jsonAttr `json:"attributes"`
+	}
+	jsonScopeSpans struct {
+		Scope jsonScope  `json:"scope"`
+		Spans []jsonSpan `json:"spans"`
+	}
+	jsonScope struct {
+		Name string `json:"name"`
+	}
+	jsonSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         Kind       `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []jsonAttr `json:"attributes,omitempty"`
+		Status       jsonStatus `json:"status"`
+	}
+	jsonStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	jsonAttr struct {
+		Key   string    `json:"key"`
+		Value jsonValue `json:"value"`
+	}
+	jsonValue struct {
+		String *string `json:"stringValue,omitempty"`
+		Int    *string `json:"intValue,omitempty"`
+		Bool   *bool   `json:"boolValue,omitempty"`
+	}
+)
+
+// Коды состояния спана
+const statusError = 2
+
+func (t *Tracer) encodeRequest(spans []*Span) jsonRequest {
+	scope := jsonScopeSpans{Scope: jsonScope{Name: t.cfg.ServiceName}}
+	for _, s := range spans {
+		s.mu.Lock()
+		js := jsonSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: encodeAttrs(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			js.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			js.Status = jsonStatus{Code: statusError, Message: s.message}
+		}
+		s.mu.Unlock()
+		scope.Spans = append(scope.Spans, js)
+	}
+	return jsonRequest{ResourceSpans: []jsonResourceSpans{{
+		Resource:   jsonResource{Attributes: encodeAttrs(t.resource)},
+		ScopeSpans: []jsonScopeSpans{scope},
+	}}}
+}
+
+func encodeAttrs(attrs []Attr) []jsonAttr {
+	out := make([]jsonAttr, 0, len(attrs))
+	for _, a := range attrs {
+		var v jsonValue
+		switch value := a.Value.(type) {
+		case string:
+			v.String = &value
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.Int = &s
+		case bool:
+			v.Bool = &value
+		default:
+			s := fmt.Sprint(value)
+			v.String = &s
+		}
+		out = append(out, jsonAttr{Key: a.Key, Value: v})
+	}
+	return out
+}
@@ -0,0 +1,140 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector принимает запросы экспорта и хранит полученные спаны
+type collector struct {
+	mu      sync.Mutex
+	spans   []jsonSpan
+	headers http.Header
+	service string
+}
+
+func newCollector(t *testing.T) (*collector, *httptest.Server) {
+	c := &collector{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req jsonRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = r.Header
+		for _, rs := range req.ResourceSpans {
+			for _, a := range rs.Resource.Attributes {
+				if a.Key == "service.name" && a.Value.String != nil {
+					c.service = *a.Value.String
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+func TestExport(t *testing.T) {
+	c, srv := newCollector(t)
+	tracer := NewTracer(Config{
+		Endpoint:    srv.URL,
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		ServiceName: "test",
+		SampleRatio: 1,
+	})
+
+	started := time.Now().Add(-time.Second)
+	ctx, root := tracer.Start(context.Background(), "file", WithStartTime(started), WithAttributes(String("file.path", "a.png")))
+	_, child := tracer.Start(ctx, "upload", WithKind(KindClient))
+	child.SetAttributes(Int("http.response.status_code", 500))
+	child.SetError(errors.New("boom"))
+	child.End()
+	child.End()
+	root.End()
+
+	err := tracer.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.spans) != 2 {
+		t.Fatalf("spans = %+v", c.spans)
+	}
+	if c.service != "test" || c.headers.Get("Authorization") != "Bearer token" {
+		t.Errorf("service = %q, headers = %v", c.service, c.headers)
+	}
+	upload, file := c.spans[0], c.spans[1]
+	if upload.TraceID != file.TraceID || upload.ParentSpanID != file.SpanID || file.ParentSpanID != "" {
+		t.Errorf("upload %+v is not a child of file %+v", upload, file)
+	}
+	if len(file.TraceID) != 32 || len(file.SpanID) != 16 || file.TraceID != root.TraceID() {
+		t.Errorf("ids: trace %q, span %q", file.TraceID, file.SpanID)
+	}
+	if upload.Kind != KindClient || upload.Status.Code != statusError || upload.Status.Message != "boom" {
+		t.Errorf("upload = %+v", upload)
+	}
+	if len(upload.Attributes) != 1 || upload.Attributes[0].Value.Int == nil || *upload.Attributes[0].Value.Int != "500" {
+		t.Errorf("upload attributes = %+v", upload.Attributes)
+	}
+	if file.Attributes[0].Key != "file.path" || *file.Attributes[0].Value.String != "a.png" {
+		t.Errorf("file attributes = %+v", file.Attributes)
+	}
+	if want := strconv.FormatInt(started.UnixNano(), 10); file.Start != want {
+		t.Errorf("file start = %s, want %s", file.Start, want)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	c, srv := newCollector(t)
+	tracer := NewTracer(Config{Endpoint: srv.URL, ServiceName: "test", SampleRatio: 0})
+
+	ctx, root := tracer.Start(context.Background(), "file")
+	_, child := tracer.Start(ctx, "upload")
+	// Дочерний спан наследует решение и трассу корневого
+	if child.traceID != root.traceID || child.sampled {
+		t.Errorf("child sampled = %v", child.sampled)
+	}
+	child.End()
+	root.End()
+	if root.TraceID() != "" {
+		t.Errorf("TraceID of unsampled span = %q", root.TraceID())
+	}
+
+	err := tracer.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.spans) != 0 {
+		t.Errorf("exported unsampled spans: %+v", c.spans)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "file")
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatal("nil tracer created a span")
+	}
+	span.SetAttributes(String("k", "v"))
+	span.SetError(errors.New("boom"))
+	span.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
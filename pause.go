@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Причины приостановки приема файлов
+const pauseOperator = "operator"
+
+// Прием файлов в обработку. Пока он приостановлен, файлы продолжают
+// ставиться в очередь, но воркеры не берут новые; текущие загрузки
+// завершаются.
+type intakeGate struct {
+	mu sync.Mutex
+	// Причины приостановки; прием возобновляется, когда их не остается
+	reasons map[string]bool
+	// Закрывается при возобновлении; nil, если прием не приостановлен
+	resumed chan struct{}
+}
+
+var intake intakeGate
+
+// pause приостанавливает прием по причине reason.
+// Возвращает false, если по этой причине он уже приостановлен.
+func (g *intakeGate) pause(reason string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reasons[reason] {
+		return false
+	}
+	if g.reasons == nil {
+		g.reasons = make(map[string]bool)
+	}
+	g.reasons[reason] = true
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+	return true
+}
+
+// resume снимает приостановку по причине reason.
+// Возвращает false, если по этой причине прием не приостанавливался.
+func (g *intakeGate) resume(reason string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.reasons[reason] {
+		return false
+	}
+	delete(g.reasons, reason)
+	if len(g.reasons) == 0 {
+		close(g.resumed)
+		g.resumed = nil
+	}
+	return true
+}
+
+// paused возвращает причины приостановки
+func (g *intakeGate) paused() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	reasons := make([]string, 0, len(g.reasons))
+	for reason := range g.reasons {
+		reasons = append(reasons, reason)
+	}
+	slices.Sort(reasons)
+	return reasons
+}
+
+// wait ждет возобновления приема. Возвращает false, если раньше закрылся quit.
+func (g *intakeGate) wait(quit <-chan struct{}) bool {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed == nil {
+		return true
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// pauseIntake приостанавливает прием по команде оператора
+func pauseIntake() {
+	if intake.pause(pauseOperator) {
+		slog.Info("intake paused", "queued", jobs.depth())
+	}
+}
+
+// resumeIntake перечитывает параметры обработки из файла конфигурации,
+// чтобы изменения, сделанные во время паузы, применились к очереди,
+// и возобновляет прием
+func resumeIntake() error {
+	if slices.Contains(intake.paused(), pauseOperator) {
+		err := reloadProfiles()
+		if err != nil {
+			return fmt.Errorf("прием не возобновлен: %w", err)
+		}
+	}
+	if intake.resume(pauseOperator) {
+		slog.Info("intake resumed", "queued", jobs.depth())
+	}
+	return nil
+}
+
+// intakeHandler приостанавливает (POST /pause) и возобновляет
+// (POST /resume) прием и возвращает его состояние
+func intakeHandler(action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := action()
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		reasons := intake.paused()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"paused":  len(reasons) > 0,
+			"reasons": reasons,
+			"queued":  jobs.depth(),
+		})
+	}
+}
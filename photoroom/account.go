@@ -0,0 +1,64 @@
+package photoroom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DefaultAccountURL - сведения об аккаунте и остатке кредитов.
+const DefaultAccountURL = "https://image-api.photoroom.com/v1/account"
+
+// Account - сведения об аккаунте, которому принадлежит ключ.
+type Account struct {
+	Credits struct {
+		// Available - оставшиеся кредиты.
+		Available float64 `json:"available"`
+		// Subscription - кредиты, начисляемые по подписке за период.
+		Subscription float64 `json:"subscription"`
+	} `json:"credits"`
+}
+
+// WithAccountURL задает адрес эндпоинта сведений об аккаунте.
+func WithAccountURL(url string) Option {
+	return func(c *Client) {
+		if url != "" {
+			c.accountURL = url
+		}
+	}
+}
+
+// Account запрашивает сведения об аккаунте для ключа, который будет
+// использован в следующем запросе. Запрос не повторяется при ошибках.
+func (c *Client) Account(ctx context.Context) (*Account, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.accountURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, key := c.keys.pick()
+	c.setHeaders(req)
+	req.Header.Set("x-api-key", key)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при ReadAll: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, newAPIError(res.StatusCode, body, res.Header)
+	}
+
+	var account Account
+	err = json.Unmarshal(body, &account)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось разобрать ответ: %w", err)
+	}
+	return &account, nil
+}
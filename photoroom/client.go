@@ -0,0 +1,311 @@
+// Пакет photoroom содержит клиент для PhotoRoom API:
+// Image Editing API v2 и Remove Background API v1.
+package photoroom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Адреса эндпоинтов по умолчанию.
+const (
+	// DefaultEditURL - Image Editing API v2.
+	DefaultEditURL = "https://image-api.photoroom.com/v2/edit"
+	// DefaultSegmentURL - Remove Background API v1.
+	DefaultSegmentURL = "https://sdk.photoroom.com/v1/segment"
+)
+
+// Client выполняет запросы к PhotoRoom API.
+type Client struct {
+	keys       keyring
+	editURL    string
+	segmentURL string
+	accountURL string
+	httpClient *http.Client
+	retry      RetryPolicy
+	limiter    limiter
+	// Места для одновременных запросов; nil - без ограничения
+	slots chan struct{}
+	// Таймаут одной попытки запроса
+	timeout time.Duration
+	// Директория для временных файлов с ответами; пусто - ответ читается в память
+	tempDir string
+	// Дополнительные заголовки запросов
+	header http.Header
+}
+
+// Option настраивает Client.
+type Option func(*Client)
+
+// WithEditURL задает адрес эндпоинта редактирования.
+func WithEditURL(url string) Option {
+	return func(c *Client) {
+		if url != "" {
+			c.editURL = url
+		}
+	}
+}
+
+// WithSegmentURL задает адрес эндпоинта удаления фона.
+func WithSegmentURL(url string) Option {
+	return func(c *Client) {
+		if url != "" {
+			c.segmentURL = url
+		}
+	}
+}
+
+// WithHTTPClient задает http.Client, через который выполняются запросы.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		if hc != nil {
+			c.httpClient = hc
+		}
+	}
+}
+
+// WithRequestTimeout ограничивает время одной попытки запроса,
+// включая отправку изображения и чтение ответа.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithTempDir задает директорию, в которую ответ API записывается по мере
+// получения, а не читается в память. Путь к файлу передается в Result.File.
+func WithTempDir(dir string) Option {
+	return func(c *Client) {
+		c.tempDir = dir
+	}
+}
+
+// WithUserAgent задает заголовок User-Agent запросов.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) {
+		if ua != "" {
+			c.header.Set("User-Agent", ua)
+		}
+	}
+}
+
+// WithHeaders добавляет заголовки ко всем запросам, например для
+// авторизации на шлюзе. Заголовки с ключом API и типом содержимого
+// клиент задает сам, их значения из h не используются.
+func WithHeaders(h map[string]string) Option {
+	return func(c *Client) {
+		for k, v := range h {
+			c.header.Set(k, v)
+		}
+	}
+}
+
+// NewClient создает клиент с ключом apiKey.
+func NewClient(apiKey string, opts ...Option) *Client {
+	c := &Client{
+		editURL:    DefaultEditURL,
+		segmentURL: DefaultSegmentURL,
+		accountURL: DefaultAccountURL,
+		httpClient: &http.Client{Transport: NewTransport(TransportOptions{})},
+		header:     make(http.Header),
+	}
+	c.keys.add(apiKey)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Result - ответ API с обработанным изображением.
+type Result struct {
+	ContentType string
+	// Image - изображение, если клиент создан без WithTempDir.
+	Image []byte
+	// File - временный файл с изображением, если клиент создан с WithTempDir.
+	// Файл удаляет или переносит вызывающий.
+	File string
+	// Header - заголовки ответа, например со сведениями о списанных кредитах.
+	Header http.Header
+}
+
+// Bytes возвращает изображение, при необходимости читая его из File.
+func (r *Result) Bytes() ([]byte, error) {
+	if r.File == "" {
+		return r.Image, nil
+	}
+	return os.ReadFile(r.File)
+}
+
+// send отправляет изображение и поля формы на url, повторяя запрос
+// при временных ошибках. Файл изображения читается при отправке,
+// а не копируется в память. Дополнительные файлы files добавляются
+// в форму после полей.
+func (c *Client) send(ctx context.Context, url, fileField string, image io.Reader, fields [][2]string, files ...formFile) (*Result, error) {
+	body, err := newMultipartBody(fileField, image, fields, files)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *Result
+	err = c.retry.do(ctx, func() error {
+		for {
+			var err error
+			result, err = c.post(ctx, url, body)
+			// После перехода на другой ключ повторяем запрос сразу
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || !apiErr.rotated {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// post выполняет одну попытку запроса с готовым телом формы.
+func (c *Client) post(ctx context.Context, url string, body *multipartBody) (*Result, error) {
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	err = c.limiter.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body.reader())
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = body.length()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return body.reader(), nil
+	}
+	keyIndex, key := c.keys.pick()
+	c.setHeaders(req)
+	req.Header.Set("Content-Type", body.contentType)
+	req.Header.Set("x-api-key", key)
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK && c.tempDir != "" {
+		path, n, err := saveTemp(c.tempDir, res.Body)
+		if err != nil {
+			return nil, err
+		}
+		err = checkLength(res, n)
+		if err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+		return &Result{
+			ContentType: res.Header.Get("Content-Type"),
+			File:        path,
+			Header:      res.Header,
+		}, nil
+	}
+
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при ReadAll: %w", incomplete(err))
+	}
+
+	if res.StatusCode != http.StatusOK {
+		apiErr := newAPIError(res.StatusCode, respBody, res.Header)
+		if res.StatusCode == http.StatusTooManyRequests {
+			apiErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+		}
+		apiErr.rotated = c.keys.exhaust(keyIndex, res.StatusCode, apiErr.RetryAfter)
+		// Если другого ключа нет, приостанавливаем все запросы
+		if !apiErr.rotated && apiErr.RetryAfter > 0 {
+			c.limiter.pause(apiErr.RetryAfter)
+		}
+		return nil, apiErr
+	}
+
+	err = checkLength(res, int64(len(respBody)))
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		ContentType: res.Header.Get("Content-Type"),
+		Image:       respBody,
+		Header:      res.Header,
+	}, nil
+}
+
+// incomplete отмечает обрыв тела ответа раньше Content-Length
+// как неполный ответ, чтобы запрос был повторен
+func incomplete(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrIncompleteResponse, err)
+	}
+	return err
+}
+
+// checkLength сверяет число полученных байт с Content-Length ответа.
+// Если длина не указана (например, при сжатии), проверка пропускается.
+func checkLength(res *http.Response, n int64) error {
+	if res.ContentLength >= 0 && n != res.ContentLength {
+		return fmt.Errorf("%w: получено %d байт из %d", ErrIncompleteResponse, n, res.ContentLength)
+	}
+	return nil
+}
+
+// saveTemp записывает r во временный файл в dir. Имя начинается с точки,
+// чтобы недописанный файл не приняли за результат. При ошибке файл удаляется.
+func saveTemp(dir string, r io.Reader) (string, int64, error) {
+	file, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("не удалось создать временный файл: %w", err)
+	}
+
+	n, err := io.Copy(file, r)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, fmt.Errorf("ошибка при чтении ответа: %w", incomplete(err))
+	}
+	return file.Name(), n, nil
+}
+
+func fileName(r io.Reader) string {
+	if n, ok := r.(interface{ Name() string }); ok {
+		return filepath.Base(n.Name())
+	}
+	return "image"
+}
+
+// setHeaders добавляет к запросу заголовки из WithUserAgent и WithHeaders
+func (c *Client) setHeaders(req *http.Request) {
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+}
@@ -0,0 +1,384 @@
+package photoroom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testImage = []byte("\x89PNG\r\n\x1a\n test image")
+
+// newTestClient возвращает клиент, отправляющий запросы на тестовый сервер
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	opts = append([]Option{
+		WithEditURL(srv.URL + "/v2/edit"),
+		WithSegmentURL(srv.URL + "/v1/segment"),
+		WithAccountURL(srv.URL + "/v1/account"),
+		WithHTTPClient(srv.Client()),
+	}, opts...)
+	return NewClient("test-key", opts...)
+}
+
+func writeImage(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(testImage)
+}
+
+func TestEditMultipartFields(t *testing.T) {
+	bgPath := filepath.Join(t.TempDir(), "bg.jpg")
+	err := os.WriteFile(bgPath, []byte("background"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *http.Request
+	var image, background []byte
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		got = r
+		image = readFormFile(t, r, "imageFile")
+		background = readFormFile(t, r, "background.imageFile")
+		writeImage(w)
+	})
+
+	removeBG := false
+	res, err := c.Edit(context.Background(), bytes.NewReader(testImage), EditParams{
+		Background:       Background{Prompt: "on a table", Image: bgPath},
+		Margin:           "0.1",
+		OutputSize:       "1000x1000",
+		RemoveBackground: &removeBG,
+		Shadow:           Shadow{Mode: "ai.soft"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Image, testImage) {
+		t.Errorf("result image = %q, want %q", res.Image, testImage)
+	}
+
+	if got.URL.Path != "/v2/edit" || got.Method != http.MethodPost {
+		t.Errorf("request = %s %s, want POST /v2/edit", got.Method, got.URL.Path)
+	}
+	if key := got.Header.Get("x-api-key"); key != "test-key" {
+		t.Errorf("x-api-key = %q, want test-key", key)
+	}
+	if !bytes.Equal(image, testImage) {
+		t.Errorf("imageFile = %q, want %q", image, testImage)
+	}
+	if string(background) != "background" {
+		t.Errorf("background.imageFile = %q, want background", background)
+	}
+	want := map[string]string{
+		"margin":           "0.1",
+		"outputSize":       "1000x1000",
+		"removeBackground": "false",
+		"shadow.mode":      "ai.soft",
+		// Описание фона не отправляется вместе с фоновым изображением
+		"background.prompt": "",
+	}
+	for field, value := range want {
+		if v := got.FormValue(field); v != value {
+			t.Errorf("field %s = %q, want %q", field, v, value)
+		}
+	}
+}
+
+func TestEditURLSendsAddressInsteadOfFile(t *testing.T) {
+	var got *http.Request
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		got = r
+		writeImage(w)
+	})
+
+	_, err := c.EditURL(context.Background(), "https://example.com/shoe.jpg", EditParams{OutputSize: "auto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := got.FormValue("imageUrl"); v != "https://example.com/shoe.jpg" {
+		t.Errorf("imageUrl = %q", v)
+	}
+	if len(got.MultipartForm.File) != 0 {
+		t.Errorf("unexpected file parts: %v", got.MultipartForm.File)
+	}
+}
+
+func TestRemoveBackgroundFields(t *testing.T) {
+	var got *http.Request
+	var image []byte
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		got = r
+		image = readFormFile(t, r, "image_file")
+		writeImage(w)
+	})
+
+	crop := true
+	_, err := c.RemoveBackground(context.Background(), bytes.NewReader(testImage), RemoveBackgroundParams{
+		Format: "webp",
+		Crop:   &crop,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.Path != "/v1/segment" {
+		t.Errorf("path = %s, want /v1/segment", got.URL.Path)
+	}
+	if !bytes.Equal(image, testImage) {
+		t.Errorf("image_file = %q, want %q", image, testImage)
+	}
+	if got.FormValue("format") != "webp" || got.FormValue("crop") != "true" {
+		t.Errorf("fields = %v", got.MultipartForm.Value)
+	}
+	if _, ok := got.MultipartForm.Value["bg_color"]; ok {
+		t.Error("empty bg_color must not be sent")
+	}
+}
+
+func TestAPIErrorBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantDetail string
+		wantKind   error
+	}{
+		{"detail", http.StatusBadRequest, `{"detail": "Image file is corrupted", "type": "invalid_image"}`,
+			"Image file is corrupted", ErrUnsupportedImage},
+		{"parameter", http.StatusBadRequest, `{"detail": "outputSize is invalid"}`,
+			"outputSize is invalid", nil},
+		{"validation list", http.StatusUnprocessableEntity, `{"detail": [{"loc": ["margin"]}]}`,
+			`[{"loc":["margin"]}]`, nil},
+		{"nested error", http.StatusUnauthorized, `{"error": {"message": "Invalid API key"}}`,
+			"Invalid API key", ErrInvalidAPIKey},
+		{"quota", http.StatusPaymentRequired, `{"message": "Out of credits"}`,
+			"Out of credits", ErrQuotaExceeded},
+		{"plain text", http.StatusRequestEntityTooLarge, "Request Entity Too Large\n",
+			"Request Entity Too Large", ErrUnsupportedImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+
+			_, err := c.Edit(context.Background(), bytes.NewReader(testImage), EditParams{})
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %v, want *APIError", err)
+			}
+			if apiErr.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", apiErr.StatusCode, tt.status)
+			}
+			if apiErr.Detail != tt.wantDetail {
+				t.Errorf("detail = %q, want %q", apiErr.Detail, tt.wantDetail)
+			}
+			for _, kind := range []error{ErrInvalidAPIKey, ErrQuotaExceeded, ErrUnsupportedImage} {
+				if errors.Is(err, kind) != (kind == tt.wantKind) {
+					t.Errorf("errors.Is(err, %v) = %v", kind, !(kind == tt.wantKind))
+				}
+			}
+			if IsTemporary(err) {
+				t.Error("4xx error must not be temporary")
+			}
+		})
+	}
+}
+
+func TestRetryTemporaryErrors(t *testing.T) {
+	var attempts atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// Каждая попытка отправляет изображение целиком
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		if image := readFormFile(t, r, "imageFile"); !bytes.Equal(image, testImage) {
+			t.Errorf("attempt %d: imageFile = %q", attempts.Load()+1, image)
+		}
+		switch attempts.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			writeImage(w)
+		}
+	}, WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+
+	res, err := c.Edit(context.Background(), bytes.NewReader(testImage), EditParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("attempts = %d, want 3", attempts.Load())
+	}
+	if !bytes.Equal(res.Image, testImage) {
+		t.Errorf("result image = %q", res.Image)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var attempts atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, WithRetry(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}))
+
+	_, err := c.Edit(context.Background(), bytes.NewReader(testImage), EditParams{})
+	if !IsTemporary(err) {
+		t.Errorf("err = %v, want temporary error", err)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("attempts = %d, want 2", attempts.Load())
+	}
+}
+
+func TestRetryCancelledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var attempts atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		// Отмена приходит во время паузы перед второй попыткой
+		time.AfterFunc(20*time.Millisecond, cancel)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}))
+
+	_, err := c.Edit(ctx, bytes.NewReader(testImage), EditParams{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("attempts = %d, want 1", attempts.Load())
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	var attempts atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"detail": "bad margin"}`)
+	}, WithRetry(RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond}))
+
+	_, err := c.Edit(context.Background(), bytes.NewReader(testImage), EditParams{})
+	if err == nil || !strings.Contains(err.Error(), "bad margin") {
+		t.Errorf("err = %v, want API error with detail", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("attempts = %d, want 1", attempts.Load())
+	}
+}
+
+func TestResultWrittenToTempDir(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeImage(w)
+	}, WithTempDir(dir))
+
+	res, err := c.Edit(context.Background(), bytes.NewReader(testImage), EditParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.File == "" || filepath.Dir(res.File) != dir {
+		t.Fatalf("result file = %q, want file in %s", res.File, dir)
+	}
+	data, err := res.Bytes()
+	if err != nil || !bytes.Equal(data, testImage) {
+		t.Errorf("result = %q, %v", data, err)
+	}
+}
+
+// readFormFile возвращает содержимое файла из поля field формы
+func readFormFile(t *testing.T, r *http.Request, field string) []byte {
+	t.Helper()
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Errorf("read %s: %v", field, err)
+	}
+	return data
+}
+
+func TestCustomHeaders(t *testing.T) {
+	var got http.Header
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		writeImage(w)
+	},
+		WithUserAgent("studio-sync/2.1"),
+		WithHeaders(map[string]string{"X-Gateway-Token": "secret", "x-api-key": "ignored"}),
+	)
+
+	_, err := c.Edit(context.Background(), bytes.NewReader(testImage), EditParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"User-Agent":      "studio-sync/2.1",
+		"X-Gateway-Token": "secret",
+		"X-Api-Key":       "test-key",
+	}
+	for name, value := range want {
+		if v := got.Get(name); v != value {
+			t.Errorf("%s = %q, want %q", name, v, value)
+		}
+	}
+	if !strings.HasPrefix(got.Get("Content-Type"), "multipart/form-data") {
+		t.Errorf("Content-Type = %q", got.Get("Content-Type"))
+	}
+}
+
+func TestExtraFields(t *testing.T) {
+	base := EditParams{
+		OutputSize:  "1000x1000",
+		Shadow:      Shadow{Mode: "ai.soft"},
+		ExtraFields: map[string]string{"lighting.strength": "0.5", "outputSize": "800x800"},
+	}
+	// Поля объединяются по ключам, пустое значение убирает поле
+	params := base.Merge(EditParams{ExtraFields: map[string]string{"shadow.mode": "", "seed.new": "7"}})
+	if len(base.ExtraFields) != 2 {
+		t.Errorf("Merge changed the base fields: %v", base.ExtraFields)
+	}
+
+	want := [][2]string{
+		{"outputSize", "800x800"},
+		{"lighting.strength", "0.5"},
+		{"seed.new", "7"},
+	}
+	got := params.fields()
+	if len(got) != len(want) {
+		t.Fatalf("fields = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("fields = %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package photoroom
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// EditParams - параметры запроса к эндпоинту редактирования.
+// Пустые значения не отправляются, и API применяет свои значения по умолчанию.
+// Описание параметров: https://docs.photoroom.com/image-editing-api-plus-plan
+type EditParams struct {
+	Background Background `yaml:"background"`
+
+	// Отступы от объекта до краев изображения, например "0.1" или "30px"
+	Margin       string `yaml:"margin"`
+	MarginTop    string `yaml:"margin_top"`
+	MarginBottom string `yaml:"margin_bottom"`
+	MarginLeft   string `yaml:"margin_left"`
+	MarginRight  string `yaml:"margin_right"`
+
+	Padding       string `yaml:"padding"`
+	PaddingTop    string `yaml:"padding_top"`
+	PaddingBottom string `yaml:"padding_bottom"`
+	PaddingLeft   string `yaml:"padding_left"`
+	PaddingRight  string `yaml:"padding_right"`
+
+	// Размер результата: "WxH", "auto", "originalImage" или "croppedSubject"
+	OutputSize string `yaml:"output_size"`
+	MaxWidth   string `yaml:"max_width"`
+	MaxHeight  string `yaml:"max_height"`
+
+	// Масштабирование объекта: "fit" или "fill"
+	Scaling string `yaml:"scaling"`
+	// Положение объекта на холсте
+	HorizontalAlignment string `yaml:"horizontal_alignment"`
+	VerticalAlignment   string `yaml:"vertical_alignment"`
+	// Рамка, относительно которой считаются отступы: "subjectBox" или "originalImage"
+	ReferenceBox string `yaml:"reference_box"`
+
+	// RemoveBackground отключает удаление фона, если равен false
+	RemoveBackground *bool `yaml:"remove_background"`
+
+	Shadow   Shadow   `yaml:"shadow"`
+	Lighting Lighting `yaml:"lighting"`
+	Export   Export   `yaml:"export"`
+
+	TextRemoval TextRemoval `yaml:"text_removal"`
+	Upscale     Upscale     `yaml:"upscale"`
+
+	// Дополнительные поля формы, например параметры API, которые еще
+	// не поддерживаются клиентом. Заменяют одноименные поля; пустое
+	// значение не отправляет поле.
+	ExtraFields map[string]string `yaml:"extra_fields"`
+}
+
+// Background - параметры нового фона.
+type Background struct {
+	Prompt         string `yaml:"prompt"`
+	NegativePrompt string `yaml:"negative_prompt"`
+	Color          string `yaml:"color"`
+	ImageURL       string `yaml:"image_url"`
+	// Фоновое изображение: путь к файлу, который загружается в поле
+	// background.imageFile, или адрес http(s), передаваемый как image_url.
+	// Заданное изображение заменяет фон, сгенерированный по prompt.
+	Image string `yaml:"image"`
+	// Transparent оставляет фон прозрачным: параметры фона не передаются,
+	// а формат результата по умолчанию - PNG
+	Transparent *bool `yaml:"transparent"`
+	// Масштабирование фонового изображения: "fit" или "fill"
+	Scaling string `yaml:"scaling"`
+	Seed    string `yaml:"seed"`
+}
+
+// ModeNone отключает тень или освещение, заданные в параметрах, с которыми
+// объединяются текущие (см. Merge). В запрос не передается.
+const ModeNone = "none"
+
+// Shadow - параметры тени: Mode "ai.soft", "ai.hard", "ai.floating" или ModeNone.
+type Shadow struct {
+	Mode string `yaml:"mode"`
+}
+
+// Lighting - параметры освещения: Mode "ai.auto",
+// "ai.preserve-hue-and-saturation" или ModeNone.
+type Lighting struct {
+	Mode string `yaml:"mode"`
+}
+
+// TextRemoval - удаление текста и водяных знаков: Mode "ai.artificial"
+// (наложенный текст), "ai.natural" (текст на предметах), "ai.all" или ModeNone.
+type TextRemoval struct {
+	Mode string `yaml:"mode"`
+}
+
+// Upscale - увеличение разрешения: Mode "ai.fast", "ai.slow" или ModeNone.
+type Upscale struct {
+	Mode string `yaml:"mode"`
+}
+
+// effectMode возвращает режим для запроса: ModeNone не передается
+func effectMode(mode string) string {
+	if mode == ModeNone {
+		return ""
+	}
+	return mode
+}
+
+// Export - параметры выходного файла.
+type Export struct {
+	// Формат результата: "png", "jpeg" ("jpg") или "webp"
+	Format string `yaml:"format"`
+	DPI    string `yaml:"dpi"`
+}
+
+// isURL сообщает, что путь к фоновому изображению является адресом
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// fields возвращает поля формы в порядке отправки; пустые значения пропускаются.
+func (p EditParams) fields() [][2]string {
+	bg := p.Background
+	if isURL(bg.Image) {
+		bg.ImageURL = bg.Image
+	}
+	// Описание фона из параметров по умолчанию не должно конкурировать
+	// с готовым фоновым изображением
+	if bg.ImageURL != "" || bg.Image != "" {
+		bg.Prompt, bg.NegativePrompt = "", ""
+	}
+	export := p.Export
+	if p.transparent() {
+		bg = Background{}
+		if export.Format == "" {
+			export.Format = "png"
+		}
+	}
+
+	all := [][2]string{
+		{"background.prompt", bg.Prompt},
+		{"background.negativePrompt", bg.NegativePrompt},
+		{"background.color", bg.Color},
+		{"background.imageUrl", bg.ImageURL},
+		{"background.scaling", bg.Scaling},
+		{"background.seed", bg.Seed},
+		{"margin", p.Margin},
+		{"marginTop", p.MarginTop},
+		{"marginBottom", p.MarginBottom},
+		{"marginLeft", p.MarginLeft},
+		{"marginRight", p.MarginRight},
+		{"padding", p.Padding},
+		{"paddingTop", p.PaddingTop},
+		{"paddingBottom", p.PaddingBottom},
+		{"paddingLeft", p.PaddingLeft},
+		{"paddingRight", p.PaddingRight},
+		{"outputSize", p.OutputSize},
+		{"maxWidth", p.MaxWidth},
+		{"maxHeight", p.MaxHeight},
+		{"scaling", p.Scaling},
+		{"horizontalAlignment", p.HorizontalAlignment},
+		{"verticalAlignment", p.VerticalAlignment},
+		{"referenceBox", p.ReferenceBox},
+		{"shadow.mode", effectMode(p.Shadow.Mode)},
+		{"lighting.mode", effectMode(p.Lighting.Mode)},
+		{"textRemoval.mode", effectMode(p.TextRemoval.Mode)},
+		{"upscale.mode", effectMode(p.Upscale.Mode)},
+		{"export.format", export.Format},
+		{"export.dpi", export.DPI},
+	}
+	if p.RemoveBackground != nil {
+		all = append(all, [2]string{"removeBackground", strconv.FormatBool(*p.RemoveBackground)})
+	}
+	return withExtraFields(all, p.ExtraFields)
+}
+
+// withExtraFields заменяет поля all одноименными дополнительными полями extra,
+// остальные дополнительные поля добавляет по алфавиту и пропускает пустые значения
+func withExtraFields(all [][2]string, extra map[string]string) [][2]string {
+	for i, f := range all {
+		if v, ok := extra[f[0]]; ok {
+			all[i][1] = v
+		}
+	}
+	known := len(all)
+	for _, name := range slices.Sorted(maps.Keys(extra)) {
+		if !slices.ContainsFunc(all[:known], func(f [2]string) bool { return f[0] == name }) {
+			all = append(all, [2]string{name, extra[name]})
+		}
+	}
+
+	fields := all[:0]
+	for _, f := range all {
+		if f[1] != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// Edit отправляет изображение в эндпоинт редактирования и возвращает результат.
+// Если image реализует Name() string (как *os.File), это имя используется
+// в качестве имени файла в форме.
+func (c *Client) Edit(ctx context.Context, image io.Reader, params EditParams) (*Result, error) {
+	files, err := params.files()
+	if err != nil {
+		return nil, err
+	}
+	return c.send(ctx, c.editURL, "imageFile", image, params.fields(), files...)
+}
+
+// EditURL отправляет в эндпоинт редактирования адрес изображения (поле
+// imageUrl) вместо самого изображения: API скачивает его сам.
+func (c *Client) EditURL(ctx context.Context, imageURL string, params EditParams) (*Result, error) {
+	files, err := params.files()
+	if err != nil {
+		return nil, err
+	}
+	fields := append([][2]string{{"imageUrl", imageURL}}, params.fields()...)
+	return c.send(ctx, c.editURL, "", nil, fields, files...)
+}
+
+// transparent сообщает, что фон результата должен остаться прозрачным
+func (p EditParams) transparent() bool {
+	return p.Background.Transparent != nil && *p.Background.Transparent
+}
+
+// files читает файлы, отправляемые в форме вместе с изображением
+func (p EditParams) files() ([]formFile, error) {
+	path := p.Background.Image
+	if path == "" || isURL(path) || p.transparent() {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать фоновое изображение: %w", err)
+	}
+	return []formFile{{field: "background.imageFile", name: filepath.Base(path), data: data}}, nil
+}
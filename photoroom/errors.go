@@ -0,0 +1,142 @@
+package photoroom
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Виды ошибок API. Проверяются через errors.Is:
+//
+//	if errors.Is(err, photoroom.ErrQuotaExceeded) { ... }
+var (
+	// ErrInvalidAPIKey - ключ не указан, неверен или отозван (401, 403).
+	ErrInvalidAPIKey = errors.New("неверный ключ API")
+	// ErrQuotaExceeded - закончились кредиты (402).
+	ErrQuotaExceeded = errors.New("закончились кредиты API")
+	// ErrUnsupportedImage - API не может обработать изображение:
+	// слишком большое, неподдерживаемого формата или поврежденное.
+	ErrUnsupportedImage = errors.New("изображение не поддерживается API")
+	// ErrIncompleteResponse - получено меньше или больше байт, чем указано
+	// в Content-Length ответа. Запрос повторяется как при сетевом сбое.
+	ErrIncompleteResponse = errors.New("ответ API получен не полностью")
+)
+
+// APIError - ответ API с кодом, отличным от 200.
+type APIError struct {
+	StatusCode int
+	Body       string
+	// Detail - описание ошибки из JSON-тела ответа.
+	Detail string
+	// Type - тип ошибки из JSON-тела ответа, если API его сообщает.
+	Type string
+	// RetryAfter - задержка из заголовка Retry-After ответа 429.
+	RetryAfter time.Duration
+	// Header - заголовки ответа.
+	Header http.Header
+	// Клиент перешел на другой ключ, и запрос можно повторить сразу
+	rotated bool
+}
+
+// newAPIError разбирает ответ с ошибкой. Тело ответа API имеет вид
+// {"detail": "...", "type": "..."} или {"error": {"message": "..."}};
+// если это не JSON, описанием считается тело целиком.
+func newAPIError(status int, body []byte, header http.Header) *APIError {
+	e := &APIError{StatusCode: status, Body: string(body), Header: header}
+
+	var parsed struct {
+		Detail  any    `json:"detail"`
+		Type    string `json:"type"`
+		Message string `json:"message"`
+		Error   struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) != nil {
+		e.Detail = strings.TrimSpace(string(body))
+		return e
+	}
+
+	switch detail := parsed.Detail.(type) {
+	case string:
+		e.Detail = detail
+	case nil:
+	default:
+		// Ошибки валидации приходят списком
+		if data, err := json.Marshal(detail); err == nil {
+			e.Detail = string(data)
+		}
+	}
+	e.Detail = cmp.Or(e.Detail, parsed.Message, parsed.Error.Message)
+	e.Type = cmp.Or(parsed.Type, parsed.Error.Type)
+	return e
+}
+
+func (e *APIError) Error() string {
+	msg := cmp.Or(e.Detail, e.Body)
+	if e.Type != "" {
+		return fmt.Sprintf("ошибка API (%d, %s): %s", e.StatusCode, e.Type, msg)
+	}
+	return fmt.Sprintf("ошибка API (%d): %s", e.StatusCode, msg)
+}
+
+// Is сопоставляет ошибку с видами ErrInvalidAPIKey,
+// ErrQuotaExceeded и ErrUnsupportedImage.
+func (e *APIError) Is(target error) bool {
+	kind := e.kind()
+	return kind != nil && kind == target
+}
+
+func (e *APIError) kind() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrInvalidAPIKey
+	case http.StatusPaymentRequired:
+		return ErrQuotaExceeded
+	case http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return ErrUnsupportedImage
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		// Ошибки в параметрах запроса тоже приходят с кодом 400,
+		// поэтому к изображению относим только ошибки, которые его упоминают
+		text := strings.ToLower(e.Type + " " + e.Detail)
+		if strings.Contains(text, "image") || strings.Contains(text, "file") {
+			return ErrUnsupportedImage
+		}
+	}
+	return nil
+}
+
+// Temporary сообщает, имеет ли смысл повторить запрос:
+// 429 и 5xx считаются временными, остальные 4xx - нет.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// IsTemporary сообщает, является ли ошибка запроса временной:
+// временная ошибка API, таймаут, сетевой сбой или неполный ответ.
+func IsTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrIncompleteResponse) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
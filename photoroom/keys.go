@@ -0,0 +1,151 @@
+package photoroom
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyStrategy задает порядок использования нескольких ключей API.
+type KeyStrategy int
+
+const (
+	// Failover использует текущий ключ, пока у него не кончится квота
+	// (ответ 402 или 429), после чего переходит к следующему.
+	Failover KeyStrategy = iota
+	// RoundRobin чередует ключи в каждом запросе.
+	RoundRobin
+)
+
+// Сколько ключ считается исчерпанным после ответа 402 и после ответа 429
+// без Retry-After.
+const (
+	paymentCooldown   = time.Hour
+	rateLimitCooldown = time.Minute
+)
+
+// SandboxPrefix - префикс ключа песочницы: запросы с ним не расходуют
+// кредиты, а результаты помечаются водяным знаком.
+const SandboxPrefix = "sandbox_"
+
+// SandboxKey возвращает ключ песочницы для ключа key.
+func SandboxKey(key string) string {
+	if key == "" || strings.HasPrefix(key, SandboxPrefix) {
+		return key
+	}
+	return SandboxPrefix + key
+}
+
+// WithAPIKeys добавляет ключи к ключу, переданному в NewClient.
+// Пустые и повторяющиеся ключи пропускаются.
+func WithAPIKeys(keys []string, strategy KeyStrategy) Option {
+	return func(c *Client) {
+		for _, key := range keys {
+			c.keys.add(key)
+		}
+		c.keys.strategy = strategy
+	}
+}
+
+// WithKeyRotationHook задает функцию, вызываемую при переходе на другой ключ
+// после ответа status. Ключи передаются номерами в порядке добавления.
+func WithKeyRotationHook(fn func(from, to, status int)) Option {
+	return func(c *Client) {
+		c.keys.onRotate = fn
+	}
+}
+
+// keyring выбирает ключ для запроса и пропускает ключи,
+// исчерпавшие квоту, до истечения их паузы.
+type keyring struct {
+	strategy KeyStrategy
+	onRotate func(from, to, status int)
+
+	mu      sync.Mutex
+	keys    []string
+	until   []time.Time
+	current int
+}
+
+func (k *keyring) add(key string) {
+	if key == "" {
+		return
+	}
+	for _, existing := range k.keys {
+		if existing == key {
+			return
+		}
+	}
+	k.keys = append(k.keys, key)
+	k.until = append(k.until, time.Time{})
+}
+
+// pick возвращает номер и значение ключа для следующего запроса.
+// Если исчерпаны все ключи, возвращается тот, чья пауза закончится раньше.
+func (k *keyring) pick() (int, string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.keys) == 0 {
+		return 0, ""
+	}
+	i := k.available(k.current)
+	if k.strategy == RoundRobin {
+		k.current = (i + 1) % len(k.keys)
+	} else {
+		k.current = i
+	}
+	return i, k.keys[i]
+}
+
+// available возвращает первый доступный ключ, начиная с from.
+// Вызывается под mu.
+func (k *keyring) available(from int) int {
+	now := time.Now()
+	best := from
+	for n := range k.keys {
+		i := (from + n) % len(k.keys)
+		if !now.Before(k.until[i]) {
+			return i
+		}
+		if k.until[i].Before(k.until[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// exhaust отмечает, что ключ i получил ответ status, и сообщает,
+// есть ли другой доступный ключ для немедленного повтора.
+func (k *keyring) exhaust(i, status int, retryAfter time.Duration) bool {
+	if status != http.StatusPaymentRequired && status != http.StatusTooManyRequests {
+		return false
+	}
+
+	k.mu.Lock()
+	if len(k.keys) < 2 {
+		k.mu.Unlock()
+		return false
+	}
+
+	cooldown := retryAfter
+	if status == http.StatusPaymentRequired {
+		cooldown = paymentCooldown
+	} else if cooldown <= 0 {
+		cooldown = rateLimitCooldown
+	}
+	k.until[i] = time.Now().Add(cooldown)
+
+	next := k.available((i + 1) % len(k.keys))
+	ok := !time.Now().Before(k.until[next])
+	if ok {
+		k.current = next
+	}
+	k.mu.Unlock()
+
+	if ok && k.onRotate != nil {
+		k.onRotate(i, next, status)
+	}
+	return ok
+}
@@ -0,0 +1,39 @@
+package photoroom
+
+import "reflect"
+
+// Merge возвращает копию p, в которой непустые поля override
+// заменяют соответствующие поля p. Вложенные структуры и map объединяются
+// по полям и ключам.
+func (p EditParams) Merge(override EditParams) EditParams {
+	merged := p
+	mergeValue(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(override))
+	return merged
+}
+
+func mergeValue(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		sf, df := src.Field(i), dst.Field(i)
+		if !df.CanSet() {
+			continue
+		}
+		if sf.Kind() == reflect.Struct {
+			mergeValue(df, sf)
+			continue
+		}
+		// Map копируется, чтобы не менять map параметров, с которыми объединяют
+		if sf.Kind() == reflect.Map && sf.Len() > 0 {
+			merged := reflect.MakeMapWithSize(sf.Type(), df.Len()+sf.Len())
+			for _, m := range []reflect.Value{df, sf} {
+				for it := m.MapRange(); it.Next(); {
+					merged.SetMapIndex(it.Key(), it.Value())
+				}
+			}
+			df.Set(merged)
+			continue
+		}
+		if !sf.IsZero() {
+			df.Set(sf)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package photoroom
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+)
+
+// Дополнительный файл формы, например фоновое изображение
+type formFile struct {
+	field, name string
+	data        []byte
+}
+
+// Тело запроса multipart/form-data с изображением. Изображение не копируется
+// в память: каждая попытка запроса заново читает его из источника, поэтому
+// размер тела известен заранее, а повтор запроса не требует буфера.
+type multipartBody struct {
+	contentType string
+	// Заголовок части с изображением и остальные поля формы
+	prefix, suffix []byte
+	image          io.ReaderAt
+	offset, size   int64
+}
+
+// newMultipartBody готовит тело формы с изображением в поле fileField
+// и дополнительными файлами files. Изображение, которое нельзя читать
+// с произвольного места (io.ReaderAt и io.Seeker), читается в память целиком.
+// При пустом fileField изображение не передается (например, вместо него
+// указан адрес в полях формы).
+func newMultipartBody(fileField string, image io.Reader, fields [][2]string, files []formFile) (*multipartBody, error) {
+	body := &multipartBody{image: bytes.NewReader(nil)}
+
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	body.contentType = writer.FormDataContentType()
+
+	if fileField != "" {
+		ra, offset, size, err := readerAt(image)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при чтении данных файла: %w", err)
+		}
+		body.image, body.offset, body.size = ra, offset, size
+
+		_, err = writer.CreateFormFile(fileField, fileName(image))
+		if err != nil {
+			return nil, fmt.Errorf("не удалось создать форм-дату часть: %w", err)
+		}
+		body.prefix = bytes.Clone(buf.Bytes())
+		buf.Reset()
+	}
+
+	var err error
+
+	for _, f := range fields {
+		err = writer.WriteField(f[0], f[1])
+		if err != nil {
+			return nil, fmt.Errorf("не удалось записать поле %s: %w", f[0], err)
+		}
+	}
+	for _, f := range files {
+		part, err := writer.CreateFormFile(f.field, f.name)
+		if err == nil {
+			_, err = part.Write(f.data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("не удалось записать поле %s: %w", f.field, err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	body.suffix = bytes.Clone(buf.Bytes())
+	return body, nil
+}
+
+// length возвращает размер тела в байтах
+func (b *multipartBody) length() int64 {
+	return int64(len(b.prefix)) + b.size + int64(len(b.suffix))
+}
+
+// reader возвращает тело для одной попытки запроса. Попытки читают
+// изображение независимо друг от друга.
+func (b *multipartBody) reader() io.ReadCloser {
+	return io.NopCloser(io.MultiReader(
+		bytes.NewReader(b.prefix),
+		io.NewSectionReader(b.image, b.offset, b.size),
+		bytes.NewReader(b.suffix),
+	))
+}
+
+// readerAt возвращает источник для чтения изображения с произвольного места,
+// смещение его текущей позиции и размер оставшихся данных
+func readerAt(image io.Reader) (io.ReaderAt, int64, int64, error) {
+	if r, ok := image.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		_, err = r.Seek(offset, io.SeekStart)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return r, offset, end - offset, nil
+	}
+
+	data, err := io.ReadAll(image)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return bytes.NewReader(data), 0, int64(len(data)), nil
+}
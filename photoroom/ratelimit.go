@@ -0,0 +1,106 @@
+package photoroom
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WithRateLimit ограничивает частоту запросов: не более requests запросов
+// за период per, равномерно распределенных по времени.
+func WithRateLimit(requests int, per time.Duration) Option {
+	return func(c *Client) {
+		if requests > 0 && per > 0 {
+			c.limiter.interval = per / time.Duration(requests)
+		}
+	}
+}
+
+// WithConcurrency ограничивает число одновременных запросов клиента.
+// Запросы сверх n ждут, пока завершится один из выполняющихся.
+func WithConcurrency(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.slots = make(chan struct{}, n)
+		}
+	}
+}
+
+// acquire занимает место для запроса и возвращает функцию, освобождающую его.
+func (c *Client) acquire(ctx context.Context) (func(), error) {
+	if c.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return func() { <-c.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// limiter выдает разрешения на запросы не чаще interval и приостанавливает
+// все запросы клиента после ответа 429 на время из Retry-After.
+type limiter struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	next  time.Time
+	until time.Time
+}
+
+// wait ждет, пока можно будет отправить запрос.
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := now
+	if l.until.After(at) {
+		at = l.until
+	}
+	if l.interval > 0 {
+		if l.next.After(at) {
+			at = l.next
+		}
+		l.next = at.Add(l.interval)
+	}
+	l.mu.Unlock()
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pause откладывает все следующие запросы на d.
+func (l *limiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.until) {
+		l.until = until
+	}
+}
+
+// parseRetryAfter разбирает заголовок Retry-After: число секунд или дату.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
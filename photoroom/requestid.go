@@ -0,0 +1,20 @@
+package photoroom
+
+import "context"
+
+// RequestIDHeader - заголовок запроса к API с идентификатором задания.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID возвращает контекст, запросы с которым передают id
+// в заголовке X-Request-ID. Повторные попытки передают тот же id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID возвращает идентификатор, заданный WithRequestID.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
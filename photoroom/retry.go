@@ -0,0 +1,66 @@
+package photoroom
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy задает повтор запросов с экспоненциальной задержкой.
+// Нулевое значение отключает повторы.
+type RetryPolicy struct {
+	// MaxAttempts - максимальное число попыток, включая первую.
+	MaxAttempts int
+	// InitialBackoff - задержка перед второй попыткой.
+	InitialBackoff time.Duration
+	// MaxBackoff - верхняя граница задержки.
+	MaxBackoff time.Duration
+}
+
+// WithRetry включает повтор запросов при временных ошибках.
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// backoff возвращает задержку перед попыткой attempt (начиная с 1)
+// с "полным" джиттером: случайное значение в [0, min(max, initial*2^(attempt-1))].
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	if d <= 0 {
+		d = time.Second
+	}
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return rand.N(d) + 1
+}
+
+// do выполняет fn, повторяя ее при временных ошибках согласно политике.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	attempts := max(p.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= attempts || !IsTemporary(err) {
+			return err
+		}
+
+		// При 429 с Retry-After следующая попытка все равно дождется
+		// паузы в limiter, поэтому здесь достаточно обычной задержки
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			// Отмена важнее ошибки предыдущей попытки
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
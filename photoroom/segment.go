@@ -0,0 +1,53 @@
+package photoroom
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// RemoveBackgroundParams - параметры запроса к эндпоинту удаления фона.
+// Пустые значения не отправляются.
+// Описание параметров: https://docs.photoroom.com/remove-background-api-basic-plan
+type RemoveBackgroundParams struct {
+	// Формат результата: "png", "jpg" или "webp"
+	Format string `yaml:"format"`
+	// Каналы результата: "rgba" или "alpha"
+	Channels string `yaml:"channels"`
+	// Цвет фона вместо прозрачности, например "FFFFFF" или "red"
+	BgColor string `yaml:"bg_color"`
+	// Размер результата: "preview", "medium", "hd" или "full"
+	Size string `yaml:"size"`
+	// Crop обрезает пустые поля вокруг объекта
+	Crop *bool `yaml:"crop"`
+	// Дополнительные поля формы, как в EditParams.ExtraFields
+	ExtraFields map[string]string `yaml:"extra_fields"`
+}
+
+func (p RemoveBackgroundParams) fields() [][2]string {
+	all := [][2]string{
+		{"format", p.Format},
+		{"channels", p.Channels},
+		{"bg_color", p.BgColor},
+		{"size", p.Size},
+	}
+	if p.Crop != nil {
+		all = append(all, [2]string{"crop", strconv.FormatBool(*p.Crop)})
+	}
+	return withExtraFields(all, p.ExtraFields)
+}
+
+// Merge возвращает копию p, в которой непустые поля override
+// заменяют соответствующие поля p.
+func (p RemoveBackgroundParams) Merge(override RemoveBackgroundParams) RemoveBackgroundParams {
+	merged := p
+	mergeValue(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(override))
+	return merged
+}
+
+// RemoveBackground отправляет изображение в эндпоинт удаления фона
+// и возвращает результат.
+func (c *Client) RemoveBackground(ctx context.Context, image io.Reader, params RemoveBackgroundParams) (*Result, error) {
+	return c.send(ctx, c.segmentURL, "image_file", image, params.fields())
+}
@@ -0,0 +1,48 @@
+package photoroom
+
+import (
+	"net/http"
+	"time"
+)
+
+// TransportOptions - настройки пула соединений транспорта.
+type TransportOptions struct {
+	// MaxIdleConns - сколько неактивных соединений хранить всего; 0 - 100.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost - сколько неактивных соединений хранить для одного
+	// хоста; 0 - 16. Должно быть не меньше числа параллельных запросов,
+	// иначе лишние соединения закрываются после каждого запроса.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost ограничивает число соединений с одним хостом; 0 - без ограничения.
+	MaxConnsPerHost int
+	// IdleConnTimeout - через сколько закрывать неактивное соединение; 0 - 90 секунд.
+	IdleConnTimeout time.Duration
+	// DisableHTTP2 отключает HTTP/2, запросы выполняются по HTTP/1.1.
+	DisableHTTP2 bool
+}
+
+// NewTransport создает транспорт на основе http.DefaultTransport с пулом
+// соединений по opts. Транспорт нужно создавать один раз и использовать
+// во всех запросах, чтобы соединения переиспользовались.
+func NewTransport(opts TransportOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 100
+	if opts.MaxIdleConns > 0 {
+		t.MaxIdleConns = opts.MaxIdleConns
+	}
+	t.MaxIdleConnsPerHost = 16
+	if opts.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	t.MaxConnsPerHost = opts.MaxConnsPerHost
+	t.IdleConnTimeout = 90 * time.Second
+	if opts.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = opts.IdleConnTimeout
+	}
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(!opts.DisableHTTP2)
+	t.Protocols = &protocols
+	return t
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Вариант результата, например миниатюра рядом с полноразмерным изображением
+type Rendition struct {
+	// Имя варианта, добавляется к имени файла: photo_thumb.jpg.
+	// Пустое имя - основной вариант без суффикса.
+	Name string `yaml:"name"`
+	// Уменьшать, чтобы изображение помещалось в width x height; 0 - без ограничения
+	Width  int `yaml:"width"`
+	Height int `yaml:"height"`
+	// Холст точного размера "WxH": изображение уменьшается до него
+	// и размещается по центру на фоне background (для PNG и WebP без
+	// background фон прозрачный)
+	Canvas string `yaml:"canvas"`
+	// Формат, качество и фон; пустые значения берутся из секции convert
+	Convert Convert `yaml:",inline"`
+	// Число цветов палитры PNG (квантование утилитой pngquant); 0 - без квантования
+	Colors int `yaml:"colors"`
+}
+
+// Закодированный вариант результата
+type rendered struct {
+	name string
+	data []byte
+	// Временный файл с результатом вместо data
+	file string
+	mt   string
+}
+
+// renderOutputs возвращает варианты результата для ответа API.
+// Без секции renditions это один основной вариант с учетом convert.
+func renderOutputs(ctx context.Context, data []byte, mt string) ([]rendered, error) {
+	if len(config.Renditions) == 0 {
+		out, outMT, err := convertImage(ctx, data, mt, config.Convert)
+		if err != nil {
+			return nil, err
+		}
+		return []rendered{{data: out, mt: outMT}}, nil
+	}
+
+	outputs := make([]rendered, 0, len(config.Renditions))
+	for _, r := range config.Renditions {
+		out, outMT, err := renderRendition(ctx, data, mt, r)
+		if err != nil {
+			return nil, fmt.Errorf("вариант %q: %w", r.Name, err)
+		}
+		outputs = append(outputs, rendered{name: r.Name, data: out, mt: outMT})
+	}
+	return outputs, nil
+}
+
+func renderRendition(ctx context.Context, data []byte, mt string, r Rendition) ([]byte, string, error) {
+	cfg := r.Convert
+	if cfg.Format == "" {
+		cfg.Format = config.Convert.Format
+	}
+	if cfg.Quality == 0 {
+		cfg.Quality = config.Convert.Quality
+	}
+	if cfg.CWebP == "" {
+		cfg.CWebP = config.Convert.CWebP
+	}
+	if cfg.PNGQuant == "" {
+		cfg.PNGQuant = config.Convert.PNGQuant
+	}
+	// Фон варианта без холста наследуется, на холсте пустой фон - прозрачность
+	if cfg.Background == "" && r.Canvas == "" {
+		cfg.Background = config.Convert.Background
+	}
+
+	if r.Width == 0 && r.Height == 0 && r.Canvas == "" && r.Colors == 0 {
+		return convertImage(ctx, data, mt, cfg)
+	}
+
+	target, err := normalizeFormat(cfg.Format)
+	if err != nil {
+		return nil, "", err
+	}
+	if target == "" {
+		target = mt
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("не удалось декодировать результат: %w", err)
+	}
+	img = fitWithin(img, r.Width, r.Height)
+	if r.Canvas != "" {
+		w, h, _ := parseSize(r.Canvas)
+		img, err = padCanvas(img, w, h, cfg.Background)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	out, err := encodeImage(ctx, img, target, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	if r.Colors > 0 && target == "image/png" {
+		out, err = quantizePNG(ctx, out, r.Colors, cfg.PNGQuant)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return out, target, nil
+}
+
+// fitWithin уменьшает изображение с сохранением пропорций, чтобы оно
+// помещалось в w x h; нулевой размер не ограничивает
+func fitWithin(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	scale := 1.0
+	if w > 0 && b.Dx() > w {
+		scale = float64(w) / float64(b.Dx())
+	}
+	if h > 0 && float64(b.Dy())*scale > float64(h) {
+		scale = float64(h) / float64(b.Dy())
+	}
+	if scale >= 1 {
+		return img
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, max(int(float64(b.Dx())*scale), 1), max(int(float64(b.Dy())*scale), 1)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// padCanvas размещает изображение по центру холста w x h.
+// Пустой background дает прозрачный фон.
+func padCanvas(img image.Image, w, h int, background string) (image.Image, error) {
+	img = fitWithin(img, w, h)
+
+	var bg color.Color = color.Transparent
+	if background != "" {
+		var err error
+		bg, err = parseHexColor(background)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	b := img.Bounds()
+	offset := image.Pt((w-b.Dx())/2, (h-b.Dy())/2)
+	draw.Draw(dst, b.Sub(b.Min).Add(offset), img, b.Min, draw.Over)
+	return dst, nil
+}
+
+// parseSize разбирает размер вида "1600x1600"
+func parseSize(s string) (int, int, error) {
+	ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+	w, errW := strconv.Atoi(ws)
+	h, errH := strconv.Atoi(hs)
+	if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("неверный размер %q, ожидается WxH", s)
+	}
+	return w, h, nil
+}
+
+// quantizePNG уменьшает палитру PNG утилитой pngquant
+func quantizePNG(ctx context.Context, data []byte, colors int, pngquant string) ([]byte, error) {
+	if pngquant == "" {
+		pngquant = "pngquant"
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pngquant, "--force", strconv.Itoa(colors), "-")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка pngquant: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out.Bytes(), nil
+}
+
+// validRenditions проверяет секцию renditions при загрузке конфигурации
+func validRenditions(renditions []Rendition) error {
+	names := make(map[string]bool)
+	for _, r := range renditions {
+		if names[r.Name] {
+			return fmt.Errorf("вариант %q указан дважды", r.Name)
+		}
+		names[r.Name] = true
+
+		if strings.ContainsAny(r.Name, `/\`) {
+			return fmt.Errorf("недопустимое имя варианта %q", r.Name)
+		}
+		if _, err := normalizeFormat(r.Convert.Format); err != nil {
+			return fmt.Errorf("вариант %q: %w", r.Name, err)
+		}
+		if r.Canvas != "" {
+			if _, _, err := parseSize(r.Canvas); err != nil {
+				return fmt.Errorf("вариант %q: %w", r.Name, err)
+			}
+		}
+		if r.Colors < 0 || r.Colors > 256 {
+			return fmt.Errorf("вариант %q: colors должно быть от 0 до 256", r.Name)
+		}
+	}
+	return nil
+}
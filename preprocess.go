@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Настройки подготовки изображения перед отправкой в API
+type Preprocess struct {
+	// Уменьшать изображение, чтобы большая сторона не превышала max_dimension; 0 - не уменьшать
+	MaxDimension int `yaml:"max_dimension"`
+	// Поворачивать изображение по тегу Orientation из EXIF
+	AutoRotate bool `yaml:"auto_rotate"`
+	// Удалять метаданные (EXIF, ICC и т.п.) перекодированием
+	StripMetadata bool `yaml:"strip_metadata"`
+	// Качество JPEG при перекодировании, 1-100
+	Quality int `yaml:"quality"`
+	// Переводить изображения с профилем AdobeRGB, ProPhoto и т.п. в sRGB
+	// и помечать результаты профилем sRGB
+	SRGB bool `yaml:"srgb"`
+}
+
+func (p Preprocess) enabled() bool {
+	return p.MaxDimension > 0 || p.AutoRotate || p.StripMetadata || p.SRGB
+}
+
+// sourceImage возвращает содержимое файла для отправки в API,
+// при необходимости подготовленное согласно настройкам preprocess
+func sourceImage(filePath string) (io.Reader, error) {
+	if !config.Preprocess.enabled() {
+		return os.Open(filePath)
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	out, format, err := preprocessImage(data, config.Preprocess)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось подготовить изображение: %w", err)
+	}
+
+	// Имя файла в форме должно соответствовать новому формату
+	name := filepath.Base(filePath)
+	if format == "png" && !strings.EqualFold(filepath.Ext(name), ".png") {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".png"
+	}
+	return namedReader{bytes.NewReader(out), name}, nil
+}
+
+// preprocessImage уменьшает, поворачивает, переводит в sRGB и перекодирует
+// изображение. Если изменений не требуется, возвращает исходные данные. JPEG
+// перекодируется в JPEG, остальные форматы - в PNG, чтобы сохранить прозрачность.
+func preprocessImage(data []byte, cfg Preprocess) ([]byte, string, error) {
+	cfgImg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = exifOrientation(data)
+	}
+	var profile *iccProfile
+	if cfg.SRGB {
+		profile = sourceProfile(data)
+	}
+	resize := cfg.MaxDimension > 0 && max(cfgImg.Width, cfgImg.Height) > cfg.MaxDimension
+	if !resize && !cfg.StripMetadata && (!cfg.AutoRotate || orientation == 1) && profile == nil {
+		return data, format, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if resize {
+		img = downscale(img, cfg.MaxDimension)
+	}
+	// После перекодирования EXIF теряется, поэтому поворот применяется
+	// всегда, иначе изображение окажется повернутым неверно
+	img = orient(img, orientation)
+	if profile != nil {
+		img = profile.toSRGB(img)
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		quality := cfg.Quality
+		if quality <= 0 || quality > 100 {
+			quality = 90
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		format = "png"
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), format, nil
+}
+
+// sourceProfile возвращает встроенный профиль изображения, если
+// изображение нужно перевести в sRGB. Профиль sRGB и отсутствие профиля
+// не требуют перевода, неподдерживаемый профиль оставляется как есть.
+func sourceProfile(data []byte) *iccProfile {
+	icc := readMetadata(data).icc
+	if icc == nil {
+		return nil
+	}
+	profile, err := parseICC(icc)
+	if err != nil {
+		slog.Warn("color profile not converted to sRGB", "error", err)
+		return nil
+	}
+	if profile.isSRGB() {
+		return nil
+	}
+	slog.Debug("converting color profile to sRGB", "profile", profile.desc)
+	return profile
+}
+
+// downscale уменьшает изображение с сохранением пропорций так,
+// чтобы большая сторона была равна maxDim
+func downscale(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w >= h {
+		w, h = maxDim, max(h*maxDim/w, 1)
+	} else {
+		w, h = max(w*maxDim/h, 1), maxDim
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// orient приводит изображение к нормальной ориентации по значению
+// тега EXIF Orientation (1-8)
+func orient(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // отражение по горизонтали
+				dx, dy = w-1-x, y
+			case 3: // поворот на 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // отражение по вертикали
+				dx, dy = x, h-1-y
+			case 5: // транспонирование
+				dx, dy = y, x
+			case 6: // поворот на 90 по часовой
+				dx, dy = h-1-y, x
+			case 7: // транспонирование по побочной диагонали
+				dx, dy = h-1-y, w-1-x
+			case 8: // поворот на 90 против часовой
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// exifOrientation возвращает значение тега Orientation из EXIF
+// в JPEG или 1, если тега нет
+func exifOrientation(data []byte) int {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return 1
+	}
+	return tiffOrientation(jpegMetadata(data).exif)
+}
+
+// tiffOrientation ищет тег Orientation (0x0112) в первом IFD заголовка TIFF
+func tiffOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(t[4:]))
+	if offset < 8 || offset+2 > len(t) {
+		return 1
+	}
+	count := int(order.Uint16(t[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(t) {
+			return 1
+		}
+		if order.Uint16(t[entry:]) == 0x0112 {
+			v := int(order.Uint16(t[entry+8:]))
+			if v < 1 || v > 8 {
+				return 1
+			}
+			return v
+		}
+	}
+	return 1
+}
@@ -0,0 +1,19 @@
+package main
+
+// Срочные файлы, которые обрабатываются раньше остальных,
+// например раньше массовой загрузки архива
+type Priority struct {
+	// Шаблоны имен в синтаксисе секции filter: шаблон с "/" сравнивается
+	// с путем относительно source (rush/*), без "/" - с именем файла (urgent_*)
+	Patterns []string `yaml:"patterns"`
+}
+
+// isUrgent сообщает, нужно ли ставить файл в срочную очередь: он лежит
+// в директории из watches с high_priority или подходит под priority.patterns
+func isUrgent(filePath string) bool {
+	if watchFor(filePath).HighPriority {
+		return true
+	}
+	patterns := config.Priority.Patterns
+	return len(patterns) > 0 && matchPatterns(filePath, patterns)
+}
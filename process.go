@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"photoroom/otlp"
+	"photoroom/photoroom"
+	"photoroom/storage"
+)
+
+// Итог обработки файла
+type outcome struct {
+	// Идентификатор задания, переданный в API в заголовке X-Request-ID
+	JobID string
+	// Путь к результату или адрес объекта в S3
+	Location string
+	// Все варианты результата, первый совпадает с Location
+	Outputs []string
+	Profile string
+	Mode    string
+	// Использован прежний результат, запрос к API не выполнялся
+	Reused bool
+	// Заголовки ответа API
+	Header http.Header
+	// Замечания проверки результатов, отправленных на ручную проверку
+	Review []string
+}
+
+// newJobID возвращает случайный UUID версии 4 - идентификатор задания
+// для сопоставления логов, отчетов и запросов к API
+func newJobID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// processFile отправляет файл в API и сохраняет результат.
+// При заданной секции variants файл обрабатывается с каждым набором.
+// Профиль в итоге заполняется и при ошибке.
+func processFile(ctx context.Context, filePath string) (outcome, error) {
+	name, variants, err := resolveProfile(filePath)
+	res := outcome{Profile: name, JobID: photoroom.RequestID(ctx)}
+	if err != nil {
+		return res, err
+	}
+	res.Mode = variants[0].Mode
+	ctx = withTenant(ctx, filePath)
+	ctx, review := withReview(ctx)
+
+	for _, v := range variants {
+		err = checkExistingOutput(filePath, name, v.name)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	// Изображение по адресу недоступно до запроса к API
+	if !isURLJob(filePath) {
+		var cleanup func()
+		ctx, cleanup, err = transcodeSource(ctx, filePath)
+		if err != nil {
+			return res, err
+		}
+		defer cleanup()
+		err = validateImage(uploadPath(ctx, filePath), config.Validate)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	// Хуки запускаются один раз перед первым запросом к API
+	sent := false
+	// Был ли запрос к API: результаты из дедупликации и кэша его не требуют
+	requested := false
+	for _, v := range variants {
+		// Такой же файл уже обрабатывался с теми же параметрами
+		hash, dup := findDuplicate(filePath, v.Profile)
+		if dup != nil {
+			location, err := reuseOutput(filePath, name, v.name, dup)
+			if err != nil {
+				return res, err
+			}
+			res.Outputs = append(res.Outputs, location)
+			continue
+		}
+
+		if !sent {
+			err = runPreUploadHooks(ctx, filePath, name)
+			if err != nil {
+				return res, err
+			}
+			sent = true
+		}
+		outputs, header, cached, err := processVariant(ctx, filePath, name, v)
+		if err != nil {
+			return res, err
+		}
+		requested = requested || !cached
+		if res.Header == nil {
+			res.Header = header
+		}
+		// До одобрения результат может быть отклонен
+		if !config.Review.Enabled {
+			states.putHash(hash, filePath, outputs[0])
+		}
+		res.Outputs = append(res.Outputs, outputs...)
+	}
+
+	// Основным результатом считается первый вариант
+	res.Location = res.Outputs[0]
+	res.Reused = !requested
+	res.Review = review.reasons
+	return res, nil
+}
+
+// processVariant отправляет файл в API с параметрами набора v
+// и сохраняет все варианты результата. cached сообщает, что ответ API
+// взят из кэша.
+func processVariant(ctx context.Context, filePath, name string, v variantProfile) ([]string, http.Header, bool, error) {
+	attrs := []any{"file", filePath, "profile", name, "mode", v.Mode}
+	if v.name != "" {
+		attrs = append(attrs, "variant", v.name)
+	}
+	slog.Info("processing file", attrs...)
+
+	result, cached, err := requestResult(ctx, filePath, v)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if result.File != "" {
+		// Файл остается, только если результат не удалось сохранить
+		defer os.Remove(result.File)
+	}
+	checkResult(ctx, filePath, name, v, result)
+
+	// Формат результата определяем по ответу и при необходимости перекодируем
+	outputs, err := resultOutputs(ctx, result)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if !isURLJob(filePath) {
+		outputs = copyMetadata(uploadPath(ctx, filePath), outputs)
+	}
+
+	var locations []string
+	for _, out := range outputs {
+		outName, err := outputName(filePath, name, v.name, out.name, outputExt(filepath.Ext(filePath), out.mt))
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		writeCtx, span := startSpan(ctx, "write", otlp.WithAttributes(otlp.String("output.name", outName)))
+		target, err := saveOutput(writeCtx, filePath, outName, out)
+		endSpan(span, err)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		// Результат, ожидающий проверки, выгружается после одобрения
+		if config.Review.Enabled {
+			locations = append(locations, target)
+			continue
+		}
+		target, err = deliverOutput(ctx, filePath, target, out.mt)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		locations = append(locations, target)
+	}
+	return locations, result.Header, cached, nil
+}
+
+// requestResult возвращает ответ API для файла с параметрами набора v:
+// из кэша, если такой запрос уже выполнялся, иначе отправляет файл в API
+func requestResult(ctx context.Context, filePath string, v variantProfile) (*photoroom.Result, bool, error) {
+	key := cacheKey(filePath, v.Profile)
+	if result := cachedResult(key); result != nil {
+		slog.Info("using cached result", "file", filePath)
+		metricCacheHits.inc("")
+		return result, true, nil
+	}
+
+	var send func() (*photoroom.Result, error)
+	if isURLJob(filePath) {
+		imageURL, err := readURLJob(filePath)
+		if err != nil {
+			return nil, false, err
+		}
+		send = func() (*photoroom.Result, error) { return v.sendURL(ctx, imageURL) }
+	} else if anim := sourceFrames(ctx); anim != nil {
+		send = func() (*photoroom.Result, error) { return sendFrames(ctx, anim, v) }
+	} else {
+		image, err := sourceImage(uploadPath(ctx, filePath))
+		if err != nil {
+			return nil, false, fmt.Errorf("не удалось открыть файл: %w", err)
+		}
+		if file, ok := image.(io.Closer); ok {
+			defer file.Close()
+		}
+		send = func() (*photoroom.Result, error) { return v.send(ctx, image) }
+	}
+
+	// При нехватке кредитов ждем их пополнения
+	credits := creditsFor(ctx)
+	err := credits.wait(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	result, err := send()
+	if errors.Is(err, photoroom.ErrQuotaExceeded) {
+		credits.set(0)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	credits.observe(v.Mode, result.Header)
+	storeResult(key, result)
+	return result, false, nil
+}
+
+// resultOutputs возвращает варианты результата для ответа API. Ответ,
+// сохраненный во временный файл и не требующий обработки, не читается в память.
+func resultOutputs(ctx context.Context, result *photoroom.Result) ([]rendered, error) {
+	head := result.Image
+	if result.File != "" {
+		var err error
+		head, err = readHead(result.File, 512)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mt := mediaType(result.ContentType, head)
+
+	if result.File != "" && len(config.Renditions) == 0 {
+		target, err := normalizeFormat(config.Convert.Format)
+		if err == nil && (target == "" || target == mt) {
+			return []rendered{{file: result.File, mt: mt}}, nil
+		}
+	}
+
+	data, err := result.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	// Анимация, собранная из кадров, сохраняется без преобразований
+	if mt == "image/gif" {
+		return []rendered{{data: data, mt: mt}}, nil
+	}
+	return renderOutputs(ctx, data, mt)
+}
+
+// readHead читает первые n байт файла
+func readHead(path string, n int) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, n)
+	n, err = io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// saveOutput сохраняет результат в processed (или в директорию ручной
+// проверки) под именем outName,
+// повторяя структуру поддиректорий source. Результат пишется во временный
+// файл .tmp-<имя> и появляется под своим именем только целиком и после
+// проверки, чтобы следящие за processed не подхватили недописанный файл.
+func saveOutput(ctx context.Context, filePath, outName string, out rendered) (string, error) {
+	processed := storage.Dir{Root: outputRoot(filePath), Conflict: outputConflict()}
+	name := filepath.Join(filepath.Dir(relPath(filePath)), outName)
+	dir := filepath.Dir(filepath.Join(processed.Root, name))
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", fmt.Errorf("не удалось создать директорию: %w", err)
+	}
+
+	tmp := out.file
+	if tmp == "" {
+		tmp, err = writeTemp(dir, outName, bytes.NewReader(out.data))
+		if err != nil {
+			return "", fmt.Errorf("Ошибка при записи в файл: %w", err)
+		}
+	}
+	defer os.Remove(tmp)
+
+	err = verifyOutput(tmp, config.Validate.Output)
+	if err != nil {
+		keepCorruptOutput(filePath, tmp, filepath.Ext(outName))
+		return "", err
+	}
+
+	// Занятое имя обрабатывается согласно output_exists
+	placed, err := processed.Put(ctx, tmp, filepath.ToSlash(name), out.mt)
+	if errors.Is(err, fs.ErrExist) {
+		return "", outputExistsError(filepath.Join(processed.Root, name))
+	}
+	if err != nil {
+		return "", fmt.Errorf("не удалось сохранить результат: %w", err)
+	}
+	return placed, nil
+}
+
+// verifyOutput проверяет, что результат - изображение с читаемым заголовком,
+// а при full - что оно декодируется целиком, а не оборвано или повреждено
+func verifyOutput(path string, full bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if full {
+		_, _, err = image.Decode(file)
+	} else {
+		_, _, err = image.DecodeConfig(file)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errCorruptOutput, err)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"photoroom/photoroom"
+)
+
+// Режимы обработки
+const (
+	modeEdit     = "edit"
+	modeRemoveBG = "remove-bg"
+)
+
+// Профиль обработки: режим и параметры запроса для него.
+// Параметры редактирования указываются прямо в профиле.
+type Profile struct {
+	// Режим: edit (Image Editing API v2) или remove-bg (Remove Background API v1)
+	Mode     string                           `yaml:"mode"`
+	Edit     photoroom.EditParams             `yaml:",inline"`
+	RemoveBG photoroom.RemoveBackgroundParams `yaml:"remove_bg"`
+}
+
+// Имя профиля и параметры, дополняющие его, для одного файла или запроса.
+// Ключи совпадают с ключами профиля в конфигурации.
+type profileParams struct {
+	Profile   string  `yaml:"profile"`
+	Overrides Profile `yaml:",inline"`
+	// Остальные поля, доступные в описании фона через {{.SidecarField "имя"}}
+	Fields map[string]any `yaml:",inline"`
+}
+
+// merge возвращает профиль p, дополненный непустыми значениями o
+func (p Profile) merge(o Profile) Profile {
+	if o.Mode != "" {
+		p.Mode = o.Mode
+	}
+	p.Edit = p.Edit.Merge(o.Edit)
+	p.RemoveBG = p.RemoveBG.Merge(o.RemoveBG)
+	return p
+}
+
+func validMode(mode string) error {
+	switch mode {
+	case "", modeEdit, modeRemoveBG:
+		return nil
+	}
+	return fmt.Errorf("неизвестный режим %q, ожидается %s или %s", mode, modeEdit, modeRemoveBG)
+}
+
+// Режимы теней, освещения, удаления текста и увеличения Image Editing API
+var (
+	shadowModes      = []string{"ai.soft", "ai.hard", "ai.floating", photoroom.ModeNone}
+	lightingModes    = []string{"ai.auto", "ai.preserve-hue-and-saturation", photoroom.ModeNone}
+	textRemovalModes = []string{"ai.artificial", "ai.natural", "ai.all", photoroom.ModeNone}
+	upscaleModes     = []string{"ai.fast", "ai.slow", photoroom.ModeNone}
+)
+
+// Именованные размеры результата, масштабирование и рамки отступов
+var (
+	outputSizes    = []string{"auto", "originalImage", "croppedSubject"}
+	scalingModes   = []string{"fit", "fill"}
+	referenceBoxes = []string{"subjectBox", "originalImage"}
+)
+
+// Отступ: доля стороны ("0.1"), проценты ("10%") или пиксели ("30px")
+var lengthRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(%|px)?$`)
+
+// Размер результата "WxH"
+var sizeRe = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+
+// validLayout проверяет размеры и отступы параметров редактирования
+func validLayout(e photoroom.EditParams) error {
+	if s := e.OutputSize; s != "" && !slices.Contains(outputSizes, s) && !sizeRe.MatchString(s) {
+		return fmt.Errorf("output_size %q: ожидается WxH, например 2016x1512, или один из %s", s, strings.Join(outputSizes, ", "))
+	}
+	lengths := []struct{ key, value string }{
+		{"margin", e.Margin},
+		{"margin_top", e.MarginTop},
+		{"margin_bottom", e.MarginBottom},
+		{"margin_left", e.MarginLeft},
+		{"margin_right", e.MarginRight},
+		{"padding", e.Padding},
+		{"padding_top", e.PaddingTop},
+		{"padding_bottom", e.PaddingBottom},
+		{"padding_left", e.PaddingLeft},
+		{"padding_right", e.PaddingRight},
+	}
+	for _, l := range lengths {
+		if l.value != "" && !lengthRe.MatchString(l.value) {
+			return fmt.Errorf("%s %q: ожидается доля (0.1), проценты (10%%) или пиксели (30px)", l.key, l.value)
+		}
+	}
+	for _, d := range []struct{ key, value string }{{"max_width", e.MaxWidth}, {"max_height", e.MaxHeight}} {
+		if n, err := strconv.Atoi(d.value); d.value != "" && (err != nil || n <= 0) {
+			return fmt.Errorf("%s %q: ожидается положительное число пикселей", d.key, d.value)
+		}
+	}
+	if s := e.Scaling; s != "" && !slices.Contains(scalingModes, s) {
+		return fmt.Errorf("scaling %q: ожидается один из %s", s, strings.Join(scalingModes, ", "))
+	}
+	if s := e.Background.Scaling; s != "" && !slices.Contains(scalingModes, s) {
+		return fmt.Errorf("background.scaling %q: ожидается один из %s", s, strings.Join(scalingModes, ", "))
+	}
+	if b := e.ReferenceBox; b != "" && !slices.Contains(referenceBoxes, b) {
+		return fmt.Errorf("reference_box %q: ожидается один из %s", b, strings.Join(referenceBoxes, ", "))
+	}
+	return nil
+}
+
+// validEditParams проверяет режимы эффектов, размеры, отступы
+// и формат результата профиля
+func validEditParams(p Profile) error {
+	err := validLayout(p.Edit)
+	if err != nil {
+		return err
+	}
+	if mode := p.Edit.Shadow.Mode; mode != "" && !slices.Contains(shadowModes, mode) {
+		return fmt.Errorf("неизвестный режим тени %q, ожидается один из %s", mode, strings.Join(shadowModes, ", "))
+	}
+	if mode := p.Edit.Lighting.Mode; mode != "" && !slices.Contains(lightingModes, mode) {
+		return fmt.Errorf("неизвестный режим освещения %q, ожидается один из %s", mode, strings.Join(lightingModes, ", "))
+	}
+	if mode := p.Edit.TextRemoval.Mode; mode != "" && !slices.Contains(textRemovalModes, mode) {
+		return fmt.Errorf("неизвестный режим удаления текста %q, ожидается один из %s", mode, strings.Join(textRemovalModes, ", "))
+	}
+	if mode := p.Edit.Upscale.Mode; mode != "" && !slices.Contains(upscaleModes, mode) {
+		return fmt.Errorf("неизвестный режим увеличения %q, ожидается один из %s", mode, strings.Join(upscaleModes, ", "))
+	}
+
+	format, err := normalizeFormat(p.Edit.Export.Format)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	// JPEG не поддерживает прозрачность, фон стал бы сплошным
+	if transparent(p) && format == "image/jpeg" {
+		return fmt.Errorf("прозрачный фон несовместим с export.format %s", p.Edit.Export.Format)
+	}
+	return nil
+}
+
+func transparent(p Profile) bool {
+	t := p.Edit.Background.Transparent
+	return t != nil && *t
+}
+
+// validTransparency проверяет, что результаты с прозрачным фоном
+// не перекодируются в JPEG
+func validTransparency(c *Config) error {
+	if format, _ := normalizeFormat(c.Convert.Format); format != "image/jpeg" {
+		return nil
+	}
+	profiles := []Profile{{Edit: c.Edit}}
+	for _, p := range c.Profiles {
+		profiles = append(profiles, p)
+	}
+	for _, w := range c.Watches {
+		profiles = append(profiles, w.Overrides)
+	}
+	for _, v := range c.Variants {
+		profiles = append(profiles, v.Overrides)
+	}
+	if slices.ContainsFunc(profiles, transparent) {
+		return fmt.Errorf("прозрачный фон несовместим с convert.format %s", c.Convert.Format)
+	}
+	return nil
+}
+
+// send отправляет изображение в API в соответствии с режимом профиля
+func (p Profile) send(ctx context.Context, image io.Reader) (*photoroom.Result, error) {
+	if p.Mode == modeRemoveBG {
+		return apiClient(ctx).RemoveBackground(ctx, image, p.RemoveBG)
+	}
+	return apiClient(ctx).Edit(ctx, image, p.Edit)
+}
+
+// sendURL отправляет в API адрес изображения. Remove Background API
+// принимает только файлы.
+func (p Profile) sendURL(ctx context.Context, imageURL string) (*photoroom.Result, error) {
+	if p.Mode == modeRemoveBG {
+		return nil, fmt.Errorf("режим %s не принимает изображения по адресу, укажите image_urls: %s", modeRemoveBG, imageURLsDownload)
+	}
+	return apiClient(ctx).EditURL(ctx, imageURL, p.Edit)
+}
+
+// Защищает параметры обработки, которые перечитываются при возобновлении
+// приема: mode, edit, remove_bg, profiles и folders
+var profilesMu sync.RWMutex
+
+// reloadProfiles перечитывает параметры обработки из файла конфигурации.
+// Остальные параметры применяются только при перезапуске.
+func reloadProfiles() error {
+	c, err := loadConfig(startOptions.configPath)
+	if err != nil {
+		return err
+	}
+	for _, w := range config.Watches {
+		if _, ok := c.Profiles[w.Profile]; w.Profile != "" && !ok {
+			return fmt.Errorf("watches: %s: неизвестный профиль %s", w.Name, w.Profile)
+		}
+	}
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	// Режим из флага -mode сохраняется
+	if startOptions.mode == "" {
+		config.Mode = c.Mode
+	}
+	config.Edit = c.Edit
+	config.RemoveBG = c.RemoveBG
+	config.Profiles = c.Profiles
+	config.Folders = c.Folders
+	slog.Info("processing settings reloaded", "path", startOptions.configPath)
+	return nil
+}
+
+// profileFor возвращает имя профиля для файла по его поддиректории в source.
+// Сначала ищется самое длинное совпадение в секции folders, затем профиль,
+// имя которого совпадает с первой поддиректорией. Пустое имя - профиль по умолчанию.
+func profileFor(filePath string) string {
+	dir := filepath.ToSlash(filepath.Dir(relPath(filePath)))
+	if dir == "." {
+		return ""
+	}
+
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	best, bestLen := "", -1
+	for folder, profile := range config.Folders {
+		folder = strings.Trim(filepath.ToSlash(filepath.Clean(folder)), "/")
+		if (dir == folder || strings.HasPrefix(dir, folder+"/")) && len(folder) > bestLen {
+			best, bestLen = profile, len(folder)
+		}
+	}
+	if bestLen >= 0 {
+		return best
+	}
+
+	first, _, _ := strings.Cut(dir, "/")
+	if _, ok := config.Profiles[first]; ok {
+		return first
+	}
+	return ""
+}
+
+// buildProfile возвращает настройки верхнего уровня, дополненные
+// профилем name (если он задан) и параметрами overrides
+func buildProfile(name string, overrides Profile) (Profile, error) {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	profile := Profile{
+		Mode:     config.Mode,
+		Edit:     config.Edit,
+		RemoveBG: config.RemoveBG,
+	}
+	if name != "" {
+		p, ok := config.Profiles[name]
+		if !ok {
+			return Profile{}, fmt.Errorf("неизвестный профиль %s", name)
+		}
+		profile = profile.merge(p)
+	}
+	profile = profile.merge(overrides)
+
+	err := validMode(profile.Mode)
+	if err == nil {
+		// Режимы могли прийти из sidecar-файла
+		err = validEditParams(profile)
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	return profile, nil
+}
+
+// confineOverrides проверяет фоновое изображение в параметрах, пришедших
+// извне: из sidecar-файла, манифеста, запроса или задания очереди. Файл
+// ищется только в backgrounds_dir, иначе клиент мог бы отправить в API
+// любой файл, доступный программе. Профили и watches из config.yaml
+// не ограничиваются.
+func confineOverrides(o Profile) (Profile, error) {
+	bg := o.Edit.Background.Image
+	if bg == "" || isURL(bg) {
+		return o, nil
+	}
+	if config.BackgroundsDir == "" {
+		return o, fmt.Errorf("background.image %q: допускается только адрес http(s), файл - при заданном backgrounds_dir", bg)
+	}
+	bg = filepath.FromSlash(bg)
+	if !filepath.IsLocal(bg) {
+		return o, fmt.Errorf("background.image %q: ожидается путь внутри backgrounds_dir", o.Edit.Background.Image)
+	}
+	o.Edit.Background.Image = filepath.Join(config.BackgroundsDir, bg)
+	return o, nil
+}
+
+// resolveProfile возвращает имя профиля для файла и параметры обработки
+// для каждого набора из variants. Профиль определяется по поддиректории,
+// а sidecar-файл рядом с изображением может указать другой профиль
+// и дополнить параметры. Для директорий из секции watches используются
+// их профиль и параметры. В описание фона подставляются данные файла
+// и поля sidecar.
+func resolveProfile(filePath string) (string, []variantProfile, error) {
+	params, err := loadSidecar(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Параметры отслеживаемой директории дополняются параметрами sidecar
+	watch := watchFor(filePath)
+	name := params.Profile
+	if name == "" {
+		name = profileFor(filePath)
+	}
+	if name == "" {
+		name = watch.Profile
+	}
+	profile, err := buildProfile(name, watch.Overrides.merge(params.Overrides))
+	if err != nil {
+		return name, nil, err
+	}
+
+	variants := applyVariants(profile)
+	data := newPromptData(relPath(filePath), name, params.Fields)
+	for i := range variants {
+		err = variants[i].expandPrompts(data)
+		if err != nil {
+			return name, nil, err
+		}
+	}
+	return name, variants, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Показывать индикатор выполнения в командах once и process.
+// Включается, только если stderr - терминал и логи в текстовом формате.
+var progressEnabled bool
+
+// isTerminal сообщает, подключен ли файл к терминалу
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Индикатор выполнения в последней строке терминала. Логи пишутся
+// через него, чтобы строка индикатора перерисовывалась под ними.
+type progressBar struct {
+	w     io.Writer
+	start time.Time
+
+	mu   sync.Mutex
+	line string
+	quit chan struct{}
+	done chan struct{}
+}
+
+// startProgress запускает индикатор, если он включен; иначе возвращает nil
+func startProgress() *progressBar {
+	if !progressEnabled {
+		return nil
+	}
+
+	b := &progressBar{
+		w:     os.Stderr,
+		start: time.Now(),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	setupLogger(b, config.Log)
+
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			b.render()
+			select {
+			case <-b.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return b
+}
+
+// stop выводит итоговое состояние индикатора и возвращает логи в stderr
+func (b *progressBar) stop() {
+	if b == nil {
+		return
+	}
+	close(b.quit)
+	<-b.done
+
+	b.render()
+	b.mu.Lock()
+	fmt.Fprintln(b.w)
+	b.line = ""
+	b.mu.Unlock()
+	setupLogger(os.Stderr, config.Log)
+}
+
+// Write выводит строку лога над индикатором
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fmt.Fprint(b.w, "\r\033[K")
+	n, err := b.w.Write(p)
+	fmt.Fprint(b.w, b.line)
+	return n, err
+}
+
+func (b *progressBar) render() {
+	processed, failed, skipped := jobs.processed.Load(), jobs.failed.Load(), jobs.skipped.Load()
+	done := processed + failed + skipped
+	total := max(jobs.total.Load(), done)
+	elapsed := time.Since(b.start)
+
+	const width = 30
+	filled := width
+	percent := 100.0
+	if total > 0 {
+		filled = int(done * width / total)
+		percent = float64(done) * 100 / float64(total)
+	}
+
+	line := fmt.Sprintf("[%s%s] %d/%d %3.0f%% ok %d err %d skip %d  %s/s",
+		strings.Repeat("#", filled), strings.Repeat(".", width-filled),
+		done, total, percent, processed, failed, skipped,
+		formatBytes(metricBytesUploaded.value("")/elapsed.Seconds()))
+	if done > 0 && done < total {
+		eta := elapsed / time.Duration(done) * time.Duration(total-done)
+		line += "  ETA " + eta.Round(time.Second).String()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.line = line
+	fmt.Fprint(b.w, "\r\033[K"+line)
+}
+
+// formatBytes форматирует размер в байтах с единицами измерения
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
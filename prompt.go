@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Данные, доступные в шаблонах background.prompt и background.negative_prompt
+type promptData struct {
+	// Имя исходного файла без расширения
+	Filename string
+	// Имя директории, в которой лежит файл
+	FolderName string
+	// Имя профиля или "default"
+	Profile string
+
+	fields map[string]any
+}
+
+// SidecarField возвращает значение поля name из sidecar-файла изображения
+// или пустую строку, если поля нет
+func (d promptData) SidecarField(name string) string {
+	v, ok := d.fields[name]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// newPromptData собирает данные шаблона описания фона для файла
+func newPromptData(filePath, profile string, fields map[string]any) promptData {
+	base := filepath.Base(filePath)
+	if profile == "" {
+		profile = "default"
+	}
+
+	folder := ""
+	if dir := filepath.Dir(filePath); dir != "." {
+		folder = filepath.Base(dir)
+	}
+	return promptData{
+		Filename:   strings.TrimSuffix(base, filepath.Ext(base)),
+		FolderName: folder,
+		Profile:    profile,
+		fields:     fields,
+	}
+}
+
+// renderPrompt подставляет данные файла в шаблон описания фона.
+// Текст без {{ возвращается как есть.
+func renderPrompt(text string, data promptData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("prompt").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("неверный шаблон описания фона: %w", err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("неверный шаблон описания фона: %w", err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// expandPrompts подставляет данные файла в описания фона профиля
+func (p *Profile) expandPrompts(data promptData) error {
+	var err error
+	p.Edit.Background.Prompt, err = renderPrompt(p.Edit.Background.Prompt, data)
+	if err != nil {
+		return err
+	}
+	p.Edit.Background.NegativePrompt, err = renderPrompt(p.Edit.Background.NegativePrompt, data)
+	return err
+}
+
+// validPrompts проверяет шаблоны описаний фона на тестовых данных
+// и наличие файла фонового изображения, чтобы ошибки всплыли при запуске
+func validPrompts(p Profile) error {
+	data := newPromptData("catalog/photo.jpg", "default", map[string]any{"scene": "studio"})
+	err := p.expandPrompts(data)
+	if err != nil {
+		return err
+	}
+	// Фоновое изображение проверяется здесь же: оно задается рядом с описанием
+	if bg := p.Edit.Background.Image; bg != "" && !strings.Contains(bg, "://") {
+		if _, err := os.Stat(bg); err != nil {
+			return fmt.Errorf("фоновое изображение: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Декодер сведенного изображения PSD. Photoshop сохраняет его после слоев
+// (при включенной «Максимальной совместимости»); сами слои не разбираются.
+// Поддерживаются режимы Grayscale, RGB и CMYK с глубиной 8 и 16 бит,
+// дополнительные каналы (прозрачность, альфа-каналы) не учитываются.
+func init() {
+	image.RegisterFormat("psd", "8BPS", decodePSD, decodePSDConfig)
+}
+
+// Цветовые режимы PSD
+const (
+	psdGray = 1
+	psdRGB  = 3
+	psdCMYK = 4
+)
+
+type psdHeader struct {
+	Signature [4]byte
+	Version   uint16
+	Reserved  [6]byte
+	Channels  uint16
+	Height    uint32
+	Width     uint32
+	Depth     uint16
+	Mode      uint16
+}
+
+// colorChannels возвращает число цветовых каналов режима
+func (h psdHeader) colorChannels() int {
+	switch h.Mode {
+	case psdGray:
+		return 1
+	case psdRGB:
+		return 3
+	}
+	return 4
+}
+
+func readPSDHeader(r io.Reader) (psdHeader, error) {
+	var h psdHeader
+	err := binary.Read(r, binary.BigEndian, &h)
+	if err != nil {
+		return h, fmt.Errorf("psd: %w", err)
+	}
+	if string(h.Signature[:]) != "8BPS" {
+		return h, errors.New("psd: неверная сигнатура")
+	}
+	if h.Version != 1 {
+		return h, fmt.Errorf("psd: версия %d (PSB) не поддерживается", h.Version)
+	}
+	if h.Mode != psdGray && h.Mode != psdRGB && h.Mode != psdCMYK {
+		return h, fmt.Errorf("psd: цветовой режим %d не поддерживается", h.Mode)
+	}
+	if h.Depth != 8 && h.Depth != 16 {
+		return h, fmt.Errorf("psd: глубина цвета %d бит не поддерживается", h.Depth)
+	}
+	if int(h.Channels) < h.colorChannels() {
+		return h, fmt.Errorf("psd: %d каналов для режима %d", h.Channels, h.Mode)
+	}
+	if h.Width == 0 || h.Height == 0 || h.Width > 30000 || h.Height > 30000 {
+		return h, fmt.Errorf("psd: размер %dx%d", h.Width, h.Height)
+	}
+	return h, nil
+}
+
+func decodePSDConfig(r io.Reader) (image.Config, error) {
+	h, err := readPSDHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	model := color.NRGBAModel
+	if h.Depth == 16 {
+		model = color.NRGBA64Model
+	}
+	return image.Config{ColorModel: model, Width: int(h.Width), Height: int(h.Height)}, nil
+}
+
+func decodePSD(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readPSDHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// Данные цветового режима, ресурсы изображения, слои и маски
+	for range 3 {
+		var n uint32
+		err = binary.Read(br, binary.BigEndian, &n)
+		if err == nil {
+			_, err = br.Discard(int(n))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("psd: %w", err)
+		}
+	}
+
+	var compression uint16
+	err = binary.Read(br, binary.BigEndian, &compression)
+	if err != nil {
+		return nil, fmt.Errorf("psd: %w", err)
+	}
+
+	width, height := int(h.Width), int(h.Height)
+	rowLen := width * int(h.Depth/8)
+	planes := make([][]byte, h.colorChannels())
+	switch compression {
+	case 0:
+		for c := range planes {
+			planes[c] = make([]byte, rowLen*height)
+			_, err = io.ReadFull(br, planes[c])
+			if err != nil {
+				return nil, fmt.Errorf("psd: %w", err)
+			}
+		}
+	case 1:
+		// Длины сжатых строк всех каналов, затем строки канал за каналом
+		counts := make([]uint16, int(h.Channels)*height)
+		err = binary.Read(br, binary.BigEndian, counts)
+		if err != nil {
+			return nil, fmt.Errorf("psd: %w", err)
+		}
+		var packed []byte
+		for c := range planes {
+			planes[c] = make([]byte, rowLen*height)
+			for y := 0; y < height; y++ {
+				n := int(counts[c*height+y])
+				if cap(packed) < n {
+					packed = make([]byte, n)
+				}
+				packed = packed[:n]
+				_, err = io.ReadFull(br, packed)
+				if err != nil {
+					return nil, fmt.Errorf("psd: %w", err)
+				}
+				err = unpackBits(planes[c][y*rowLen:(y+1)*rowLen], packed)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("psd: сжатие %d не поддерживается", compression)
+	}
+	return composePSD(h, planes), nil
+}
+
+// unpackBits распаковывает строку, сжатую PackBits, в dst
+func unpackBits(dst, src []byte) error {
+	i, j := 0, 0
+	for i < len(src) && j < len(dst) {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			n++
+			if i+n > len(src) || j+n > len(dst) {
+				return errors.New("psd: поврежденная строка RLE")
+			}
+			copy(dst[j:], src[i:i+n])
+			i += n
+			j += n
+		case n > -128:
+			n = 1 - n
+			if i >= len(src) || j+n > len(dst) {
+				return errors.New("psd: поврежденная строка RLE")
+			}
+			for k := range n {
+				dst[j+k] = src[i]
+			}
+			i++
+			j += n
+		}
+	}
+	if j != len(dst) {
+		return errors.New("psd: неполная строка RLE")
+	}
+	return nil
+}
+
+// composePSD собирает изображение из цветовых каналов
+func composePSD(h psdHeader, planes [][]byte) image.Image {
+	width, height := int(h.Width), int(h.Height)
+	sample := func(c, i int) uint32 {
+		if h.Depth == 16 {
+			return uint32(binary.BigEndian.Uint16(planes[c][2*i:]))
+		}
+		return uint32(planes[c][i]) * 0x101
+	}
+
+	rect := image.Rect(0, 0, width, height)
+	var img interface {
+		image.Image
+		Set(x, y int, c color.Color)
+	}
+	if h.Depth == 16 {
+		img = image.NewNRGBA64(rect)
+	} else {
+		img = image.NewNRGBA(rect)
+	}
+	for i := 0; i < width*height; i++ {
+		var r, g, b uint32
+		switch h.Mode {
+		case psdGray:
+			r = sample(0, i)
+			g, b = r, r
+		case psdRGB:
+			r, g, b = sample(0, i), sample(1, i), sample(2, i)
+		case psdCMYK:
+			// Значения CMYK хранятся инвертированными: 0xffff - отсутствие краски
+			k := sample(3, i)
+			r, g, b = sample(0, i)*k/0xffff, sample(1, i)*k/0xffff, sample(2, i)*k/0xffff
+		}
+		img.Set(i%width, i/width, color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: 0xffff})
+	}
+	return img
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// buildPSD собирает PSD из каналов channels (строки подряд) без сжатия
+// или со сжатием RLE, где каждая строка записана одним повтором
+// первого байта и литералом остальных
+func buildPSD(t *testing.T, mode, depth uint16, width, height int, rle bool, channels [][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	write := func(v any) {
+		err := binary.Write(&buf, binary.BigEndian, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(psdHeader{
+		Signature: [4]byte{'8', 'B', 'P', 'S'},
+		Version:   1,
+		Channels:  uint16(len(channels)),
+		Height:    uint32(height),
+		Width:     uint32(width),
+		Depth:     depth,
+		Mode:      mode,
+	})
+	// Пустые данные цветового режима, непустые ресурсы, пустые слои
+	write(uint32(0))
+	write(uint32(3))
+	buf.WriteString("res")
+	write(uint32(0))
+
+	rowLen := width * int(depth/8)
+	if !rle {
+		write(uint16(0))
+		for _, ch := range channels {
+			buf.Write(ch)
+		}
+		return buf.Bytes()
+	}
+
+	write(uint16(1))
+	var rows [][]byte
+	for _, ch := range channels {
+		for y := 0; y < height; y++ {
+			row := ch[y*rowLen : (y+1)*rowLen]
+			// Повтор первого байта дважды, затем литерал с третьего байта
+			packed := []byte{byte(0xff), row[0]}
+			if rowLen > 2 {
+				packed = append(packed, byte(rowLen-3))
+				packed = append(packed, row[2:]...)
+			}
+			rows = append(rows, packed)
+		}
+	}
+	for _, row := range rows {
+		write(uint16(len(row)))
+	}
+	for _, row := range rows {
+		buf.Write(row)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodePSD(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     uint16
+		depth    uint16
+		rle      bool
+		channels [][]byte
+		want     []color.NRGBA64
+	}{
+		{"rgb raw", psdRGB, 8, false,
+			[][]byte{{10, 20, 30, 40}, {50, 60, 70, 80}, {90, 100, 110, 120}},
+			[]color.NRGBA64{{0x0a0a, 0x3232, 0x5a5a, 0xffff}, {0x1414, 0x3c3c, 0x6464, 0xffff},
+				{0x1e1e, 0x4646, 0x6e6e, 0xffff}, {0x2828, 0x5050, 0x7878, 0xffff}}},
+		// Строка 2x1 пикселя: повтор первого байта дает два одинаковых пикселя
+		{"rgb rle with alpha", psdRGB, 8, true,
+			[][]byte{{10, 10, 30, 30}, {50, 50, 70, 70}, {90, 90, 110, 110}, {0, 0, 0, 0}},
+			[]color.NRGBA64{{0x0a0a, 0x3232, 0x5a5a, 0xffff}, {0x0a0a, 0x3232, 0x5a5a, 0xffff},
+				{0x1e1e, 0x4646, 0x6e6e, 0xffff}, {0x1e1e, 0x4646, 0x6e6e, 0xffff}}},
+		{"gray 16 bit", psdGray, 16, false,
+			[][]byte{{0x12, 0x34, 0xff, 0xff, 0, 0, 0x80, 0}},
+			[]color.NRGBA64{{0x1234, 0x1234, 0x1234, 0xffff}, {0xffff, 0xffff, 0xffff, 0xffff},
+				{0, 0, 0, 0xffff}, {0x8000, 0x8000, 0x8000, 0xffff}}},
+		// Инвертированные значения: 255 - без краски, 0 - полная краска
+		{"cmyk", psdCMYK, 8, false,
+			[][]byte{{255, 0, 255, 255}, {255, 255, 0, 255}, {255, 255, 255, 255}, {255, 255, 255, 0}},
+			[]color.NRGBA64{{0xffff, 0xffff, 0xffff, 0xffff}, {0, 0xffff, 0xffff, 0xffff},
+				{0xffff, 0, 0xffff, 0xffff}, {0, 0, 0, 0xffff}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildPSD(t, tt.mode, tt.depth, 2, 2, tt.rle, tt.channels)
+
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil || format != "psd" || cfg.Width != 2 || cfg.Height != 2 {
+				t.Fatalf("DecodeConfig = %+v, %q, %v", cfg, format, err)
+			}
+			img, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.want {
+				got := color.NRGBA64Model.Convert(img.At(i%2, i/2)).(color.NRGBA64)
+				if got != want {
+					t.Errorf("pixel %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePSDUnsupported(t *testing.T) {
+	rgb := [][]byte{{0, 0, 0, 0}, {0, 0, 0, 0}, {0, 0, 0, 0}}
+	data := buildPSD(t, psdRGB, 8, 2, 2, false, rgb)
+
+	psb := bytes.Clone(data)
+	psb[5] = 2
+	lab := buildPSD(t, 9, 8, 2, 2, false, rgb)
+	truncated := data[:len(data)-1]
+	for name, data := range map[string][]byte{"psb": psb, "lab": lab, "truncated": truncated} {
+		_, _, err := image.Decode(bytes.NewReader(data))
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
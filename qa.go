@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// Проверка результата API после загрузки. Результат, не прошедший ее,
+// сохраняется как обычно, а его копия с описанием замечаний попадает
+// в review_dir для ручной проверки.
+type QA struct {
+	Enabled bool `yaml:"enabled"`
+	// Директория результатов для ручной проверки
+	ReviewDir string `yaml:"review_dir"`
+	// Искать объект на результате: объект не найден, слишком мал
+	// или касается края изображения, то есть, возможно, обрезан
+	Subject bool `yaml:"subject"`
+	// Минимальная доля площади изображения, занятая объектом, от 0 до 1
+	MinSubjectArea float64 `yaml:"min_subject_area"`
+}
+
+func validQA(q QA) error {
+	if q.MinSubjectArea < 0 || q.MinSubjectArea > 1 {
+		return fmt.Errorf("min_subject_area должен быть от 0 до 1")
+	}
+	if q.Enabled && q.ReviewDir == "" {
+		return fmt.Errorf("не задан review_dir")
+	}
+	return nil
+}
+
+type reviewKey struct{}
+
+// Замечания проверки ко всем результатам файла
+type reviewNotes struct {
+	reasons []string
+}
+
+// withReview добавляет в контекст накопитель замечаний проверки результатов
+func withReview(ctx context.Context) (context.Context, *reviewNotes) {
+	notes := &reviewNotes{}
+	return context.WithValue(ctx, reviewKey{}, notes), notes
+}
+
+// checkResult проверяет результат API для файла, обработанного с параметрами
+// набора v, и при замечаниях копирует его в review_dir
+func checkResult(ctx context.Context, filePath, profile string, v variantProfile, result *photoroom.Result) {
+	if !config.QA.Enabled {
+		return
+	}
+	reasons, err := inspectResult(ctx, filePath, v, result)
+	if err != nil {
+		slog.Warn("failed to check result", "file", filePath, "error", err)
+		return
+	}
+	if len(reasons) == 0 {
+		return
+	}
+
+	slog.Warn("result flagged for review", "file", filePath, "variant", v.name, "reasons", reasons)
+	metricFilesFlagged.inc("")
+	if notes, ok := ctx.Value(reviewKey{}).(*reviewNotes); ok {
+		notes.reasons = append(notes.reasons, reasons...)
+	}
+	// При ручной проверке замечания сохраняются вместе с результатом
+	if config.Review.Enabled {
+		return
+	}
+	err = keepForReview(filePath, profile, v, result, reasons)
+	if err != nil {
+		slog.Error("failed to keep result for review", "file", filePath, "error", err)
+	}
+}
+
+// inspectResult возвращает замечания к результату: он не декодируется,
+// его размер не совпадает с запрошенным или объект на нем выглядит
+// обрезанным
+func inspectResult(ctx context.Context, filePath string, v variantProfile, result *photoroom.Result) ([]string, error) {
+	var r io.Reader = bytes.NewReader(result.Image)
+	if result.File != "" {
+		file, err := os.Open(result.File)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return []string{fmt.Sprintf("результат не декодируется: %v", err)}, nil
+	}
+
+	var reasons []string
+	b := img.Bounds()
+	if w, h, ok := requestedSize(ctx, filePath, v); ok && (b.Dx() != w || b.Dy() != h) {
+		reasons = append(reasons, fmt.Sprintf("размер %dx%d вместо запрошенного %dx%d", b.Dx(), b.Dy(), w, h))
+	}
+	if config.QA.Subject {
+		reasons = append(reasons, inspectSubject(img, v)...)
+	}
+	return reasons, nil
+}
+
+// requestedSize возвращает размер результата, заданный в output_size
+// режима edit. Для originalImage это размер исходника, если он не
+// уменьшался перед отправкой и не увеличивается в API.
+func requestedSize(ctx context.Context, filePath string, v variantProfile) (int, int, bool) {
+	if v.Mode != modeEdit {
+		return 0, 0, false
+	}
+	size := v.Edit.OutputSize
+	if sizeRe.MatchString(size) {
+		w, h, err := parseSize(size)
+		return w, h, err == nil
+	}
+	if size != "originalImage" || isURLJob(filePath) || sourceFrames(ctx) != nil || config.Preprocess.enabled() {
+		return 0, 0, false
+	}
+	if mode := v.Edit.Upscale.Mode; mode != "" && mode != photoroom.ModeNone {
+		return 0, 0, false
+	}
+
+	file, err := os.Open(uploadPath(ctx, filePath))
+	if err != nil {
+		return 0, 0, false
+	}
+	defer file.Close()
+	ic, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ic.Width, ic.Height, true
+}
+
+// Сколько точек по большей стороне проверяется при поиске объекта
+// и насколько цвет объекта должен отличаться от фона
+const (
+	subjectSamples   = 512
+	subjectTolerance = 24
+)
+
+// inspectSubject проверяет, что объект найден, не слишком мал и не касается
+// краев изображения. Края не проверяются, если объект обрезан по запросу.
+func inspectSubject(img image.Image, v variantProfile) []string {
+	box, area, ok := subjectBox(img)
+	if !ok {
+		return nil
+	}
+	if box.Empty() {
+		return []string{"объект не найден"}
+	}
+
+	var reasons []string
+	if area < config.QA.MinSubjectArea {
+		reasons = append(reasons, fmt.Sprintf("объект занимает %.1f%% площади, меньше %.1f%%", area*100, config.QA.MinSubjectArea*100))
+	}
+	cropped := v.Edit.OutputSize == "croppedSubject"
+	if v.Mode == modeRemoveBG {
+		cropped = v.RemoveBG.Crop != nil && *v.RemoveBG.Crop
+	}
+	if cropped {
+		return reasons
+	}
+
+	b := img.Bounds()
+	step := sampleStep(b)
+	var edges []string
+	if box.Min.Y-b.Min.Y < step {
+		edges = append(edges, "сверху")
+	}
+	if b.Max.Y-box.Max.Y < step {
+		edges = append(edges, "снизу")
+	}
+	if box.Min.X-b.Min.X < step {
+		edges = append(edges, "слева")
+	}
+	if b.Max.X-box.Max.X < step {
+		edges = append(edges, "справа")
+	}
+	if len(edges) > 0 {
+		reasons = append(reasons, "объект касается края изображения: "+strings.Join(edges, ", "))
+	}
+	return reasons
+}
+
+// sampleStep возвращает шаг между проверяемыми точками изображения
+func sampleStep(b image.Rectangle) int {
+	return max(1, max(b.Dx(), b.Dy())/subjectSamples)
+}
+
+// subjectBox возвращает рамку объекта и долю площади, которую он занимает.
+// Объект - непрозрачные точки, а на непрозрачном изображении - точки,
+// отличающиеся от фона цвета углов. Если углы разного цвета, фон
+// определить нельзя и ok = false.
+func subjectBox(img image.Image) (box image.Rectangle, area float64, ok bool) {
+	b := img.Bounds()
+	step := sampleStep(b)
+
+	transparent := false
+	for y := b.Min.Y; y < b.Max.Y && !transparent; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			if _, _, _, a := img.At(x, y).RGBA(); a < 0x8000 {
+				transparent = true
+				break
+			}
+		}
+	}
+
+	var subject func(x, y int) bool
+	if transparent {
+		subject = func(x, y int) bool {
+			_, _, _, a := img.At(x, y).RGBA()
+			return a >= 0x8000
+		}
+	} else {
+		bg := img.At(b.Min.X, b.Min.Y)
+		for _, p := range []image.Point{{b.Max.X - 1, b.Min.Y}, {b.Min.X, b.Max.Y - 1}, {b.Max.X - 1, b.Max.Y - 1}} {
+			if !similarColor(img.At(p.X, p.Y), bg) {
+				return image.Rectangle{}, 0, false
+			}
+		}
+		subject = func(x, y int) bool { return !similarColor(img.At(x, y), bg) }
+	}
+
+	found, total := 0, 0
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			total++
+			if !subject(x, y) {
+				continue
+			}
+			found++
+			box = box.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	return box, float64(found) / float64(total), true
+}
+
+// similarColor сообщает, что цвета отличаются не больше чем на
+// subjectTolerance по каждому каналу
+func similarColor(c1, c2 color.Color) bool {
+	r1, g1, b1, _ := c1.RGBA()
+	r2, g2, b2, _ := c2.RGBA()
+	for _, d := range [][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}} {
+		diff := int(d[0]>>8) - int(d[1]>>8)
+		if diff < -subjectTolerance || diff > subjectTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// Замечания к результату, сохраняемые рядом с его копией в review_dir
+type reviewReport struct {
+	File      string    `json:"file"`
+	Profile   string    `json:"profile,omitempty"`
+	Variant   string    `json:"variant,omitempty"`
+	Reasons   []string  `json:"reasons"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// keepForReview копирует результат в review_dir, повторяя структуру
+// поддиректорий source, и сохраняет рядом <имя>.review.json
+func keepForReview(filePath, profile string, v variantProfile, result *photoroom.Result, reasons []string) error {
+	head := result.Image
+	if result.File != "" {
+		var err error
+		head, err = readHead(result.File, 512)
+		if err != nil {
+			return err
+		}
+	}
+	mt := mediaType(result.ContentType, head)
+	outName, err := outputName(filePath, profile, v.name, "", outputExt(filepath.Ext(filePath), mt))
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(config.QA.ReviewDir, filepath.Dir(relPath(filePath)), outName)
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if result.File != "" {
+		err = copyFile(result.File, target)
+	} else {
+		err = os.WriteFile(target, result.Image, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	report := reviewReport{
+		File:      relPath(filePath),
+		Profile:   profile,
+		Variant:   v.name,
+		Reasons:   reasons,
+		Timestamp: time.Now(),
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(target+".review.json", data, 0644)
+}
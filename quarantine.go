@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// Отчет об ошибке, сохраняемый рядом с файлом в failed
+type failureReport struct {
+	File         string    `json:"file"`
+	Error        string    `json:"error"`
+	StatusCode   int       `json:"status_code,omitempty"`
+	ErrorType    string    `json:"error_type,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// quarantine переносит файл, который не удалось обработать, в failed
+// и сохраняет рядом <имя>.error.json с описанием ошибки
+func quarantine(filePath string, cause error) {
+	failedDir := watchFor(filePath).FailedDir
+	if failedDir == "" {
+		return
+	}
+
+	target, err := moveFile(filePath, failedDir)
+	if err != nil {
+		return
+	}
+
+	report := failureReport{
+		File:      relPath(filePath),
+		Error:     cause.Error(),
+		Timestamp: time.Now(),
+	}
+	var apiErr *photoroom.APIError
+	if errors.As(cause, &apiErr) {
+		report.StatusCode = apiErr.StatusCode
+		report.ErrorType = apiErr.Type
+		report.ResponseBody = apiErr.Body
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(target+".error.json", data, 0644)
+	}
+	if err != nil {
+		slog.Error("failed to write error report", "file", target, "error", err)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"photoroom/nats"
+	"photoroom/storage"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Настройки получения заданий из очереди сообщений NATS.
+// RabbitMQ и Kafka подключаются через мост в NATS.
+type QueueInput struct {
+	nats.Config `yaml:",inline"`
+	// Тема, из которой читаются задания
+	Subject string `yaml:"subject"`
+	// Группа очереди: задания распределяются между экземплярами программы
+	QueueGroup string `yaml:"queue_group"`
+	// Тема для результатов заданий без адреса ответа (reply)
+	ResultSubject string `yaml:"result_subject"`
+	// Передавать в результате само изображение (base64)
+	IncludeImage bool `yaml:"include_image"`
+	// Поддиректория source, в которую сохраняются изображения заданий
+	Dir string `yaml:"dir"`
+}
+
+// Задание из очереди: изображение по адресу или в теле сообщения (base64)
+// и параметры обработки с теми же ключами, что в sidecar-файле
+type queueJob struct {
+	ID       string         `json:"id"`
+	ImageURL string         `json:"image_url"`
+	Image    []byte         `json:"image"`
+	Filename string         `json:"filename"`
+	Profile  string         `json:"profile"`
+	Params   map[string]any `json:"params"`
+}
+
+// Результат задания, публикуемый в очередь
+type queueResult struct {
+	ID      string   `json:"id,omitempty"`
+	JobID   string   `json:"job_id,omitempty"`
+	Status  string   `json:"status"`
+	File    string   `json:"file,omitempty"`
+	Output  string   `json:"output,omitempty"`
+	Outputs []string `json:"outputs,omitempty"`
+	Profile string   `json:"profile,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Image   []byte   `json:"image,omitempty"`
+}
+
+// Откуда пришло задание и куда отвечать. Сохраняется в sidecar-файле
+// изображения под ключом queue_job, чтобы ответить и после перезапуска.
+type queueOrigin struct {
+	ID    string `json:"id"`
+	Reply string `json:"reply,omitempty"`
+}
+
+const queueJobKey = "queue_job"
+
+var (
+	queueMu   sync.Mutex
+	queueConn *nats.Conn
+	// Файлы в source, сохраненные из заданий, по абсолютному пути.
+	// Заполняется при приеме задания и из sidecar-файла при обработке.
+	queueJobs = make(map[string]queueOrigin)
+)
+
+func validQueueInput(q QueueInput) error {
+	if q.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(q.URL)
+	if err != nil {
+		return fmt.Errorf("неверный адрес %q", q.URL)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+	case "amqp", "amqps", "kafka":
+		return fmt.Errorf("брокер %s напрямую не поддерживается, подключите его к NATS через мост", u.Scheme)
+	default:
+		return fmt.Errorf("неподдерживаемая схема %q, ожидается nats или tls", u.Scheme)
+	}
+	if q.Subject == "" {
+		return fmt.Errorf("не указана тема subject")
+	}
+	if q.Dir != "" && !filepath.IsLocal(q.Dir) {
+		return fmt.Errorf("dir должна быть поддиректорией source")
+	}
+	return nil
+}
+
+// pollQueueInput читает задания из очереди до отмены ctx,
+// переподключаясь при разрыве соединения
+func pollQueueInput(ctx context.Context) {
+	if config.QueueInput.URL == "" {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		connected, err := consumeQueue(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = time.Second
+		}
+		slog.Error("queue input disconnected", "subject", config.QueueInput.Subject, "error", err, "retry_in", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// consumeQueue подключается к серверу и обрабатывает задания
+// до разрыва соединения или отмены ctx
+func consumeQueue(ctx context.Context) (bool, error) {
+	cfg := config.QueueInput
+	if cfg.Name == "" {
+		cfg.Name = "photoroom"
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	conn, err := nats.Dial(dialCtx, cfg.Config)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	msgs, err := conn.Subscribe(cfg.Subject, cfg.QueueGroup)
+	if err != nil {
+		return false, err
+	}
+	queueMu.Lock()
+	queueConn = conn
+	queueMu.Unlock()
+	defer func() {
+		queueMu.Lock()
+		queueConn = nil
+		queueMu.Unlock()
+	}()
+	slog.Info("queue input connected", "subject", cfg.Subject, "queue_group", cfg.QueueGroup)
+
+	// Задания принимаются в отдельных горутинах: скачивание изображения
+	// может занять минуты, а чтение подключения не должно останавливаться,
+	// иначе сервер не получит ответ на PING и разорвет соединение
+	accepting := make(chan struct{}, max(config.Workers, 1))
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case msg, ok := <-msgs:
+			if !ok {
+				return true, conn.Err()
+			}
+			go func() {
+				accepting <- struct{}{}
+				defer func() { <-accepting }()
+				acceptQueueJob(ctx, msg)
+			}()
+		}
+	}
+}
+
+// acceptQueueJob сохраняет изображение задания в source, откуда его
+// обрабатывает обычный конвейер. Если задание не удалось принять,
+// сразу публикуется результат с ошибкой.
+func acceptQueueJob(ctx context.Context, msg nats.Msg) {
+	var job queueJob
+	err := json.Unmarshal(msg.Data, &job)
+	if err == nil {
+		err = saveQueueJob(ctx, job, msg.Reply)
+	}
+	if err != nil {
+		slog.Error("failed to accept queue job", "id", job.ID, "subject", msg.Subject, "error", err)
+		publishQueueResult(queueOrigin{ID: job.ID, Reply: msg.Reply}, queueResult{
+			Status: eventFailed,
+			Error:  err.Error(),
+		})
+	}
+}
+
+func saveQueueJob(ctx context.Context, job queueJob, reply string) error {
+	if (job.ImageURL == "") == (len(job.Image) == 0) {
+		return fmt.Errorf("в задании нужно указать image_url или image")
+	}
+	name, err := queueFileName(job)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(config.SourceDir, config.QueueInput.Dir)
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".queue-*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	var contentType string
+	switch {
+	case job.ImageURL != "" && directURLs():
+		// Изображение скачает сам API
+		_, err = io.WriteString(tmp, job.ImageURL)
+		name = urlJobName(name)
+	case job.ImageURL != "":
+		contentType, err = downloadURL(ctx, job.ImageURL, tmp)
+	default:
+		_, err = tmp.Write(job.Image)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	name = withImageExt(name, contentType, tmp.Name())
+
+	placeholder, target, err := storage.CreateUnique(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	placeholder.Close()
+
+	// Sidecar появляется раньше изображения, чтобы обработка его учла
+	origin := queueOrigin{ID: job.ID, Reply: reply}
+	err = writeQueueSidecar(target, job, origin)
+	if err == nil {
+		queueMu.Lock()
+		queueJobs[absPath(target)] = origin
+		queueMu.Unlock()
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		queueMu.Lock()
+		delete(queueJobs, absPath(target))
+		queueMu.Unlock()
+		os.Remove(target + ".json")
+		os.Remove(target)
+		return err
+	}
+	slog.Info("queue job accepted", "id", job.ID, "file", target)
+	return nil
+}
+
+// queueFileName возвращает имя файла задания: filename, имя из адреса
+// изображения или идентификатор задания
+func queueFileName(job queueJob) (string, error) {
+	name := job.Filename
+	if name == "" && job.ImageURL != "" {
+		if u, err := url.Parse(job.ImageURL); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	if name == "" || name == "." || name == "/" {
+		name = job.ID
+	}
+	if name == "" {
+		name = "image"
+	}
+	if filepath.Base(name) != name || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("недопустимое имя файла %q", name)
+	}
+	return name, nil
+}
+
+// downloadURL скачивает изображение задания в w и возвращает его Content-Type
+func downloadURL(ctx context.Context, rawURL string, w io.Writer) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("неверный адрес изображения %q", rawURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := (&http.Client{Transport: transport, Timeout: 5 * time.Minute}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("ошибка при скачивании: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ошибка при скачивании: код ответа %d", res.StatusCode)
+	}
+	_, err = io.Copy(w, res.Body)
+	if err != nil {
+		return "", fmt.Errorf("ошибка при скачивании: %w", err)
+	}
+	return res.Header.Get("Content-Type"), nil
+}
+
+// withImageExt добавляет к name расширение по типу изображения в файле
+// path, если его нет: без расширения файл не прошел бы шаблоны filter.patterns
+func withImageExt(name, contentType, path string) string {
+	if ext := outputExt("", mediaType(contentType, fileHead(path))); filepath.Ext(name) == "" && ext != "" {
+		name += "." + ext
+	}
+	return name
+}
+
+// fileHead возвращает первые байты файла для определения его типа
+func fileHead(path string) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return head[:n]
+}
+
+// writeQueueSidecar сохраняет в sidecar-файл профиль и параметры задания
+// и то, куда отвечать
+func writeQueueSidecar(target string, job queueJob, origin queueOrigin) error {
+	params := make(map[string]any, len(job.Params)+2)
+	for k, v := range job.Params {
+		params[k] = v
+	}
+	if job.Profile != "" {
+		params["profile"] = job.Profile
+	}
+	params[queueJobKey] = origin
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	// Фон из задания проверяется сразу, чтобы ошибка вернулась отправителю
+	var checked profileParams
+	err = yaml.Unmarshal(data, &checked)
+	if err == nil {
+		_, err = confineOverrides(checked.Overrides)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(target+".json", data, 0644)
+}
+
+// recallQueueJob восстанавливает из sidecar-файла, откуда пришло задание,
+// если файл принят до перезапуска программы
+func recallQueueJob(filePath string) {
+	if config.QueueInput.URL == "" {
+		return
+	}
+	key := absPath(filePath)
+	queueMu.Lock()
+	_, ok := queueJobs[key]
+	queueMu.Unlock()
+	if ok {
+		return
+	}
+
+	params, err := loadSidecar(filePath)
+	if err != nil || params.Fields[queueJobKey] == nil {
+		return
+	}
+	var origin queueOrigin
+	data, err := json.Marshal(params.Fields[queueJobKey])
+	if err == nil {
+		err = json.Unmarshal(data, &origin)
+	}
+	if err != nil {
+		slog.Warn("invalid queue job in sidecar", "file", filePath, "error", err)
+		return
+	}
+	queueMu.Lock()
+	queueJobs[key] = origin
+	queueMu.Unlock()
+}
+
+// queueDone публикует результат обработки файла, если он пришел из очереди
+func queueDone(filePath string, res outcome, cause error) {
+	key := absPath(filePath)
+	queueMu.Lock()
+	origin, ok := queueJobs[key]
+	delete(queueJobs, key)
+	queueMu.Unlock()
+	if !ok {
+		return
+	}
+
+	result := queueResult{
+		Status:  eventCompleted,
+		JobID:   res.JobID,
+		File:    relPath(filePath),
+		Output:  res.Location,
+		Outputs: res.Outputs,
+		Profile: res.Profile,
+	}
+	switch {
+	case errors.Is(cause, errSkipped):
+		result.Status = "skipped"
+		result.Error = cause.Error()
+	case cause != nil:
+		result.Status = eventFailed
+		result.Error = cause.Error()
+	case config.QueueInput.IncludeImage:
+		// Результат, выгруженный в S3, передается только адресом
+		if data, err := os.ReadFile(res.Location); err == nil {
+			result.Image = data
+		}
+	}
+	publishQueueResult(origin, result)
+}
+
+// publishQueueResult отправляет результат в тему ответа задания
+// или в result_subject
+func publishQueueResult(origin queueOrigin, result queueResult) {
+	subject := origin.Reply
+	if subject == "" {
+		subject = config.QueueInput.ResultSubject
+	}
+	if subject == "" {
+		return
+	}
+	result.ID = origin.ID
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		slog.Error("failed to encode queue result", "error", err)
+		return
+	}
+	queueMu.Lock()
+	conn := queueConn
+	queueMu.Unlock()
+	if conn == nil {
+		slog.Warn("queue disconnected, result dropped", "id", origin.ID, "subject", subject)
+		return
+	}
+	err = conn.Publish(subject, body)
+	if err != nil {
+		slog.Error("failed to publish queue result", "id", origin.ID, "subject", subject, "error", err)
+		return
+	}
+	slog.Debug("queue result published", "id", origin.ID, "subject", subject, "status", result.Status)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"photoroom/dropbox"
+	"photoroom/ftp"
+	"photoroom/gdrive"
+	"photoroom/oauth"
+	"photoroom/sftp"
+	"photoroom/storage"
+)
+
+// Директория на сервере FTP, FTPS, SFTP или папка в Google Drive и Dropbox
+type Remote struct {
+	// Адрес вида sftp://user@host:22/incoming, ftp://user@host/incoming,
+	// ftps://user@host/incoming (FTP с явным TLS), dropbox:///Clients/incoming
+	// или gdrive://<id папки>/incoming (без id - от корня "Моего диска").
+	// Пустой адрес отключает директорию.
+	URL string `yaml:"url"`
+	// Пароль FTP; для SFTP вход выполняется по ключу
+	Password string `yaml:"password"`
+	// Закрытый ключ и файл известных ключей серверов для SFTP
+	KeyFile        string `yaml:"key_file"`
+	KnownHostsFile string `yaml:"known_hosts_file"`
+	// Приложение OAuth и токен обновления для Google Drive и Dropbox
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+	// Интервал опроса входящей директории
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Куда на сервере переносить забранные файлы. Пустое значение - удалять их.
+	ArchiveDir string `yaml:"archive_dir"`
+}
+
+// validRemote проверяет адрес удаленной директории
+func validRemote(r Remote) error {
+	if r.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return fmt.Errorf("неверный адрес %q", r.URL)
+	}
+	switch u.Scheme {
+	case "ftp", "ftps", "sftp":
+		if u.Host == "" {
+			return fmt.Errorf("в адресе %q не указан сервер", r.URL)
+		}
+		if _, err := exec.LookPath("sftp"); u.Scheme == "sftp" && err != nil {
+			return fmt.Errorf("для %s нужна утилита sftp из OpenSSH", r.URL)
+		}
+	case "dropbox", "gdrive":
+		if r.ClientID == "" || r.RefreshToken == "" {
+			return fmt.Errorf("для %s нужны client_id и refresh_token", r.URL)
+		}
+	default:
+		return fmt.Errorf("неизвестный протокол %q, ожидается ftp, ftps, sftp, dropbox или gdrive", u.Scheme)
+	}
+	return nil
+}
+
+// openRemote подключается к серверу и возвращает сеанс
+// и путь директории на сервере
+func openRemote(ctx context.Context, r Remote) (storage.Conn, string, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+
+	switch u.Scheme {
+	case "dropbox":
+		// Путь можно указать и без третьей косой черты: dropbox://Clients
+		dir = path.Join("/", u.Host, u.Path)
+		return dropboxConn{dropbox.New(r.tokens(dropbox.TokenURL), &http.Client{Transport: transport})}, dir, nil
+	case "gdrive":
+		// Пути отсчитываются от папки из адреса
+		dir = strings.TrimPrefix(dir, "/")
+		return gdriveConn{gdrive.New(r.tokens(gdrive.TokenURL), u.Host, &http.Client{Transport: transport})}, dir, nil
+	case "sftp":
+		client := sftp.New(sftp.Config{
+			Addr:           u.Host,
+			User:           u.User.Username(),
+			KeyFile:        r.KeyFile,
+			KnownHostsFile: r.KnownHostsFile,
+			Timeout:        config.Timeouts.Connect,
+		})
+		return sftpConn{client}, dir, nil
+	}
+
+	cfg := ftp.Config{
+		Addr:     u.Host,
+		User:     u.User.Username(),
+		Password: r.Password,
+		TLS:      u.Scheme == "ftps",
+		Timeout:  config.Timeouts.Connect,
+	}
+	if password, ok := u.User.Password(); ok && cfg.Password == "" {
+		cfg.Password = password
+	}
+	if transport != nil {
+		cfg.TLSConfig = transport.TLSClientConfig
+	}
+	client, err := ftp.Dial(ctx, cfg)
+	if err != nil {
+		return nil, "", fmt.Errorf("не удалось подключиться к %s: %w", u.Redacted(), err)
+	}
+	return ftpConn{client}, dir, nil
+}
+
+type ftpConn struct {
+	c *ftp.Client
+}
+
+func (f ftpConn) List(ctx context.Context, dir string) ([]storage.Entry, error) {
+	entries, err := f.c.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, storage.Entry{Name: e.Name, Dir: e.Dir, Size: e.Size})
+	}
+	return res, nil
+}
+
+func (f ftpConn) Get(ctx context.Context, name, local string) error {
+	file, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	err = f.c.Retrieve(ctx, name, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (f ftpConn) Put(ctx context.Context, local, name string) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tmp := path.Join(path.Dir(name), ".tmp-"+path.Base(name))
+	err = f.c.Store(ctx, tmp, file)
+	if err != nil {
+		return err
+	}
+	// Не все серверы заменяют существующий файл при переименовании
+	f.c.Delete(ctx, name)
+	return f.c.Rename(ctx, tmp, name)
+}
+
+func (f ftpConn) Rename(ctx context.Context, from, to string) error {
+	return f.c.Rename(ctx, from, to)
+}
+
+func (f ftpConn) Remove(ctx context.Context, name string) error {
+	return f.c.Delete(ctx, name)
+}
+
+func (f ftpConn) MkdirAll(ctx context.Context, dir string) error {
+	return f.c.MakeDirAll(ctx, dir)
+}
+
+func (f ftpConn) Close() error {
+	return f.c.Close()
+}
+
+type sftpConn struct {
+	c *sftp.Client
+}
+
+func (s sftpConn) List(ctx context.Context, dir string) ([]storage.Entry, error) {
+	entries, err := s.c.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, storage.Entry{Name: e.Name, Dir: e.Dir, Size: e.Size})
+	}
+	return res, nil
+}
+
+func (s sftpConn) Get(ctx context.Context, name, local string) error {
+	return s.c.Retrieve(ctx, name, local)
+}
+
+func (s sftpConn) Put(ctx context.Context, local, name string) error {
+	return s.c.Store(ctx, local, name)
+}
+
+func (s sftpConn) Rename(ctx context.Context, from, to string) error {
+	return s.c.Rename(ctx, from, to)
+}
+
+func (s sftpConn) Remove(ctx context.Context, name string) error {
+	return s.c.Delete(ctx, name)
+}
+
+func (s sftpConn) MkdirAll(ctx context.Context, dir string) error {
+	return s.c.MakeDirAll(ctx, dir)
+}
+
+func (s sftpConn) Close() error {
+	return nil
+}
+
+// Токены OAuth по токену обновления: сеанс открывается при каждом
+// опросе, а токен доступа действует около часа
+var (
+	remoteTokensMu sync.Mutex
+	remoteTokens   = make(map[string]*oauth.TokenSource)
+)
+
+func (r Remote) tokens(tokenURL string) *oauth.TokenSource {
+	remoteTokensMu.Lock()
+	defer remoteTokensMu.Unlock()
+	key := tokenURL + " " + r.ClientID + " " + r.RefreshToken
+	if s, ok := remoteTokens[key]; ok {
+		return s
+	}
+	s := oauth.New(oauth.Config{
+		TokenURL:     tokenURL,
+		ClientID:     r.ClientID,
+		ClientSecret: r.ClientSecret,
+		RefreshToken: r.RefreshToken,
+	}, &http.Client{Timeout: config.Timeouts.Connect + 30*time.Second, Transport: transport})
+	remoteTokens[key] = s
+	return s
+}
+
+type dropboxConn struct {
+	c *dropbox.Client
+}
+
+func (d dropboxConn) List(ctx context.Context, dir string) ([]storage.Entry, error) {
+	entries, err := d.c.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, storage.Entry{Name: e.Name, Dir: e.Dir, Size: e.Size})
+	}
+	return res, nil
+}
+
+func (d dropboxConn) Get(ctx context.Context, name, local string) error {
+	file, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	err = d.c.Download(ctx, name, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (d dropboxConn) Put(ctx context.Context, local, name string) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Dropbox показывает файл только после загрузки целиком
+	return d.c.Upload(ctx, name, file)
+}
+
+func (d dropboxConn) Rename(ctx context.Context, from, to string) error {
+	return d.c.Move(ctx, from, to)
+}
+
+func (d dropboxConn) Remove(ctx context.Context, name string) error {
+	return d.c.Delete(ctx, name)
+}
+
+func (d dropboxConn) MkdirAll(ctx context.Context, dir string) error {
+	return d.c.MakeDirAll(ctx, dir)
+}
+
+func (d dropboxConn) Close() error {
+	return nil
+}
+
+type gdriveConn struct {
+	c *gdrive.Client
+}
+
+func (g gdriveConn) List(ctx context.Context, dir string) ([]storage.Entry, error) {
+	entries, err := g.c.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, storage.Entry{Name: e.Name, Dir: e.Dir, Size: e.Size})
+	}
+	return res, nil
+}
+
+func (g gdriveConn) Get(ctx context.Context, name, local string) error {
+	file, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	err = g.c.Download(ctx, name, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (g gdriveConn) Put(ctx context.Context, local, name string) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return g.c.Upload(ctx, name, file)
+}
+
+func (g gdriveConn) Rename(ctx context.Context, from, to string) error {
+	return g.c.Move(ctx, from, to)
+}
+
+// Remove переносит файл в корзину Google Drive
+func (g gdriveConn) Remove(ctx context.Context, name string) error {
+	return g.c.Delete(ctx, name)
+}
+
+func (g gdriveConn) MkdirAll(ctx context.Context, dir string) error {
+	return g.c.MakeDirAll(ctx, dir)
+}
+
+func (g gdriveConn) Close() error {
+	return nil
+}
+
+// pollRemoteInputs периодически забирает новые файлы с серверов
+// отслеживаемых директорий до отмены ctx
+func pollRemoteInputs(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, w := range allWatches() {
+		if w.RemoteInput.URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pollRemoteInput(ctx, w)
+		}()
+	}
+	wg.Wait()
+}
+
+func pollRemoteInput(ctx context.Context, w Watch) {
+	interval := w.RemoteInput.PollInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fetchRemoteInput(ctx, w)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchRemoteInputs однократно забирает файлы со всех серверов
+func fetchRemoteInputs(ctx context.Context) {
+	for _, w := range allWatches() {
+		if w.RemoteInput.URL != "" {
+			fetchRemoteInput(ctx, w)
+		}
+	}
+}
+
+// fetchRemoteInput скачивает в source директории w все файлы из ее
+// удаленной директории. Путь относительно удаленной директории становится
+// путем относительно source, поэтому профили по поддиректориям работают
+// и для сервера.
+func fetchRemoteInput(ctx context.Context, w Watch) {
+	cfg := w.RemoteInput
+	conn, dir, err := openRemote(ctx, cfg)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to connect to remote input", "watch", w.Name, "error", err)
+		}
+		return
+	}
+
+	src := &storage.Remote{Conn: conn, Dir: dir, ArchiveDir: cfg.ArchiveDir}
+	fetchSource(ctx, src, redactURL(cfg.URL), w.SourceDir)
+}
+
+// remoteSink выгружает результаты в удаленную директорию,
+// подключаясь к серверу для каждого файла
+type remoteSink struct {
+	r Remote
+}
+
+func (s remoteSink) Put(ctx context.Context, local, name, contentType string) (string, error) {
+	conn, dir, err := openRemote(ctx, s.r)
+	if err != nil {
+		return "", err
+	}
+	dst := &storage.Remote{Conn: conn, Dir: dir}
+	defer dst.Close()
+	return dst.Put(ctx, local, name, contentType)
+}
+
+// redactURL скрывает пароль в адресе для логов
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Настройки сводных отчетов об обработке
+type Report struct {
+	// Директория отчетов; пустое значение отключает их
+	Dir string `yaml:"dir"`
+	// Форматы: json, csv, html
+	Formats []string `yaml:"formats"`
+	// Интервал отчетов в режиме watch; 0 - только при остановке
+	Interval time.Duration `yaml:"interval"`
+	// Оценка расхода кредитов на одно изображение по режимам обработки
+	Credits map[string]float64 `yaml:"credits"`
+}
+
+// Итоги обработки файлов
+const (
+	resultProcessed = "processed"
+	resultReused    = "reused"
+	resultFailed    = "failed"
+	resultSkipped   = "skipped"
+)
+
+// Запись отчета об одном файле
+type reportEntry struct {
+	JobID    string  `json:"job_id,omitempty"`
+	Tenant   string  `json:"tenant,omitempty"`
+	File     string  `json:"file"`
+	Result   string  `json:"result"`
+	Profile  string  `json:"profile,omitempty"`
+	Mode     string  `json:"mode,omitempty"`
+	Output   string  `json:"output,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Review   string  `json:"review,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// Сводный отчет
+type batchReport struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Counts   map[string]int `json:"counts"`
+	APISecs  float64        `json:"api_time_seconds"`
+	Credits  float64        `json:"estimated_credits"`
+	// Файлы обработаны в песочнице: кредиты не расходовались
+	Sandbox bool          `json:"sandbox,omitempty"`
+	Files   []reportEntry `json:"files"`
+}
+
+// Накопитель записей для следующего отчета
+type reportCollector struct {
+	mu      sync.Mutex
+	started time.Time
+	entries []reportEntry
+}
+
+var reports = &reportCollector{started: time.Now()}
+
+// add записывает итог обработки файла
+func (c *reportCollector) add(filePath string, res outcome, duration time.Duration, err error) {
+	entry := reportEntry{
+		JobID:    res.JobID,
+		Tenant:   watchFor(filePath).Tenant,
+		File:     relPath(filePath),
+		Result:   resultProcessed,
+		Profile:  res.Profile,
+		Mode:     res.Mode,
+		Output:   res.Location,
+		Review:   strings.Join(res.Review, "; "),
+		Duration: duration.Seconds(),
+	}
+	switch {
+	case errors.Is(err, errSkipped):
+		entry.Result = resultSkipped
+		entry.Error = err.Error()
+	case err != nil:
+		entry.Result = resultFailed
+		entry.Error = err.Error()
+	case res.Reused:
+		entry.Result = resultReused
+	}
+
+	recent.add(filePath, entry)
+	notifications.observe(entry.Result)
+	batches.record(filePath, entry)
+	if config.Report.Dir == "" {
+		return
+	}
+
+	c.mu.Lock()
+	c.entries = append(c.entries, entry)
+	c.mu.Unlock()
+}
+
+// flush забирает накопленные записи и начинает новый отчет
+func (c *reportCollector) flush() *batchReport {
+	c.mu.Lock()
+	entries, started := c.entries, c.started
+	c.entries, c.started = nil, time.Now()
+	c.mu.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+	return newBatchReport(started, entries)
+}
+
+// newBatchReport подводит итоги по записям отчета
+func newBatchReport(started time.Time, entries []reportEntry) *batchReport {
+	r := &batchReport{
+		Started:  started,
+		Finished: time.Now(),
+		Counts:   make(map[string]int),
+		Sandbox:  config.Sandbox,
+		Files:    entries,
+	}
+	for _, e := range entries {
+		r.Counts[e.Result]++
+		// Время и кредиты учитываются только для запросов к API
+		if e.Result == resultProcessed || e.Result == resultFailed {
+			r.APISecs += e.Duration
+		}
+		if e.Result == resultProcessed && !r.Sandbox {
+			r.Credits += config.Report.Credits[e.Mode]
+		}
+	}
+	return r
+}
+
+// writeReport сохраняет отчет по файлам, обработанным с прошлого отчета.
+// Клиенты агентства получают в свои директории отчеты только по своим файлам.
+func writeReport() {
+	if config.Report.Dir == "" {
+		return
+	}
+	r := reports.flush()
+	if r == nil {
+		return
+	}
+	writeReportFiles(config.Report.Dir, r)
+
+	byTenant := make(map[string][]reportEntry)
+	for _, e := range r.Files {
+		if e.Tenant != "" {
+			byTenant[e.Tenant] = append(byTenant[e.Tenant], e)
+		}
+	}
+	for tenant, entries := range byTenant {
+		tr := newBatchReport(r.Started, entries)
+		tr.Finished = r.Finished
+		writeReportFiles(tenantReportDir(tenant), tr)
+	}
+}
+
+// writeReportFiles сохраняет отчет в директорию dir в форматах report.formats
+func writeReportFiles(dir string, r *batchReport) {
+	createDirIfNotExists(dir)
+	base := filepath.Join(dir, "report-"+r.Finished.Format("20060102-150405"))
+	for _, format := range config.Report.Formats {
+		path := base + "." + format
+		err := writeReportFile(path, format, r)
+		if err != nil {
+			slog.Error("failed to write report", "path", path, "error", err)
+			continue
+		}
+		slog.Info("report written", "path", path)
+	}
+}
+
+func writeReportFile(path, format string, r *batchReport) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	case "csv":
+		err = writeReportCSV(file, r)
+	case "html":
+		err = reportTemplate.Execute(file, r)
+	default:
+		err = fmt.Errorf("неизвестный формат отчета %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func writeReportCSV(w io.Writer, r *batchReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"job_id", "file", "result", "profile", "mode", "output", "error", "duration_seconds", "tenant", "review"})
+	for _, e := range r.Files {
+		cw.Write([]string{e.JobID, e.File, e.Result, e.Profile, e.Mode, e.Output, e.Error,
+			strconv.FormatFloat(e.Duration, 'f', 3, 64), e.Tenant, e.Review})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Отчет об обработке {{.Finished.Format "2006-01-02 15:04:05"}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.failed { background: #fdd; }
+.skipped { background: #eee; }
+.review { background: #ffd; }
+</style>
+</head>
+<body>
+<h1>Отчет об обработке{{if .Sandbox}} (песочница){{end}}</h1>
+<p>{{.Started.Format "2006-01-02 15:04:05"}} - {{.Finished.Format "2006-01-02 15:04:05"}}</p>
+<ul>
+{{range $result, $count := .Counts}}<li>{{$result}}: {{$count}}</li>
+{{end}}<li>время API, с: {{printf "%.1f" .APISecs}}</li>
+<li>кредиты (оценка): {{.Credits}}</li>
+</ul>
+<table>
+<tr><th>Задание</th><th>Клиент</th><th>Файл</th><th>Итог</th><th>Профиль</th><th>Результат</th><th>Ошибка</th><th>Проверка</th><th>Время, с</th></tr>
+{{range .Files}}<tr class="{{.Result}}{{if .Review}} review{{end}}"><td>{{.JobID}}</td><td>{{.Tenant}}</td><td>{{.File}}</td><td>{{.Result}}</td><td>{{.Profile}}</td><td>{{.Output}}</td><td>{{.Error}}</td><td>{{.Review}}</td><td>{{printf "%.2f" .Duration}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// reportLoop пишет отчеты с интервалом Report.Interval до отмены ctx
+func reportLoop(ctx context.Context) {
+	if config.Report.Dir == "" || config.Report.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(config.Report.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			writeReport()
+		}
+	}
+}
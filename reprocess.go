@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runRetry возвращает в обработку файлы из failed_dir и отложенные файлы
+// из базы состояния. Они обрабатываются с текущей конфигурацией, профиль
+// и параметры можно заменить флагами. Сами файлы обрабатывает запущенная
+// служба или следующий запуск once.
+func runRetry(args []string) int {
+	fs := flag.NewFlagSet("retry", flag.ExitOnError)
+	var opts options
+	opts.register(fs)
+	all := fs.Bool("failed", false, "вернуть все файлы из failed_dir и сбросить отложенные повторы")
+	var files listFlag
+	fs.Var(&files, "file", "файл в failed_dir или отложенный файл в source (можно несколько)")
+	profile := fs.String("profile", "", "профиль повторной обработки")
+	var paramList listFlag
+	fs.Var(&paramList, "param", "параметр повторной обработки ключ=значение, например prompt=\"on a marble table\" (можно несколько)")
+	fs.Parse(args)
+	params, err := parseParams(paramList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConfig
+	}
+	if !*all && len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "ожидается -failed или -file")
+		return exitConfig
+	}
+	// Базу состояния может держать запущенная служба, она открывается,
+	// только если нужна
+	opts.skipState = true
+	setup(opts)
+
+	code := 0
+	fail := func(name string, err error) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		code = exitFailures
+	}
+	if *all {
+		for _, f := range failedFiles() {
+			target, err := retryFailed(f.Watch, f.Path, *profile, params)
+			if err != nil {
+				fail(f.Path, err)
+				continue
+			}
+			fmt.Println(target)
+		}
+		err = resetDeferred(*profile, params)
+		if err != nil {
+			slog.Warn("deferred files were not reset", "error", err)
+		}
+	}
+	for _, file := range files {
+		target, err := retryFile(file, *profile, params)
+		if err != nil {
+			fail(file, err)
+			continue
+		}
+		fmt.Println(target)
+	}
+	states.close()
+	return code
+}
+
+// retryFile возвращает в обработку файл из failed_dir или отложенный
+// файл в source
+func retryFile(filePath, profile string, params map[string]string) (string, error) {
+	for _, w := range allWatches() {
+		if w.FailedDir == "" {
+			continue
+		}
+		rel, err := filepath.Rel(absPath(w.FailedDir), absPath(filePath))
+		if err == nil && filepath.IsLocal(rel) {
+			return retryFailed(w.Name, rel, profile, params)
+		}
+	}
+
+	rel, err := filepath.Rel(absPath(watchFor(filePath).SourceDir), absPath(filePath))
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", errors.New("файл не находится в failed_dir или source_dir")
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		return "", err
+	}
+	err = openRetryState()
+	if err != nil {
+		return "", err
+	}
+	err = retrySource(filePath, profile, params)
+	if err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// resetDeferred возвращает в обработку все файлы source, отложенные
+// или не обработанные по данным базы состояния
+func resetDeferred(profile string, params map[string]string) error {
+	if config.StateFile == "" {
+		return nil
+	}
+	err := openRetryState()
+	if err != nil {
+		return err
+	}
+
+	// Записи меняются после обхода: изменения внутри него заблокируют базу
+	var paths []string
+	err = states.each(func(filePath string, st fileState) {
+		if st.Status != statusRetry && st.Status != statusFailed {
+			return
+		}
+		if _, err := os.Stat(filePath); err == nil {
+			paths = append(paths, filePath)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, filePath := range paths {
+		err = retrySource(filePath, profile, params)
+		if err != nil {
+			slog.Error("failed to reset deferred file", "file", filePath, "error", err)
+			continue
+		}
+		fmt.Println(filePath)
+	}
+	return nil
+}
+
+// openRetryState открывает базу состояния, если она задана и еще не открыта
+func openRetryState() error {
+	if states != nil || config.StateFile == "" {
+		return nil
+	}
+	var err error
+	states, err = openState(config.StateFile)
+	if err != nil {
+		return fmt.Errorf("база состояния %s недоступна, возможно, служба запущена: %w", config.StateFile, err)
+	}
+	return nil
+}
+
+// retrySource сбрасывает счетчики повторов файла в source и дополняет его
+// sidecar-файл. Новое время изменения показывает вотчеру, что файл нужно
+// обработать.
+func retrySource(filePath, profile string, params map[string]string) error {
+	states.update(filePath, func(st *fileState) {
+		st.Status = statusPending
+		st.Error = ""
+		st.Retries = 0
+		st.FirstFailure = time.Time{}
+		st.NextAttempt = time.Time{}
+	})
+	return returnSource(filePath, filePath, profile, params)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// errDeferred - файл не обработан из-за временной ошибки и ждет повтора
+var errDeferred = errors.New("обработка отложена")
+
+// deferRetry откладывает повтор файла, который не удалось обработать из-за
+// недоступности API или сети. Пауза между повторами удваивается от
+// retry.defer_interval до retry.defer_max_interval. Возвращает false, если
+// ошибка постоянная, отложенные повторы выключены или файл повторяется
+// дольше retry.max_age: тогда он считается необработанным.
+func deferRetry(filePath string, cause error) bool {
+	cfg := config.Retry
+	if states == nil || cfg.DeferInterval <= 0 || !photoroom.IsTemporary(cause) {
+		return false
+	}
+
+	now := time.Now()
+	var deferred fileState
+	states.update(filePath, func(st *fileState) {
+		if st.FirstFailure.IsZero() {
+			st.FirstFailure = now
+		}
+		if cfg.MaxAge > 0 && now.Sub(st.FirstFailure) >= cfg.MaxAge {
+			return
+		}
+		st.Retries++
+		delay := cfg.DeferInterval << min(st.Retries-1, 16)
+		if cfg.DeferMaxInterval > 0 && delay > cfg.DeferMaxInterval {
+			delay = cfg.DeferMaxInterval
+		}
+		st.Status = statusRetry
+		st.Error = cause.Error()
+		st.NextAttempt = now.Add(delay)
+		deferred = *st
+	})
+	if deferred.Status != statusRetry {
+		return false
+	}
+	slog.Warn("file deferred for retry", "file", filePath, "retries", deferred.Retries, "retry_at", deferred.NextAttempt, "error", cause)
+	return true
+}
+
+// retryPending сообщает, что повтор файла запланирован на более позднее время
+func retryPending(st fileState) bool {
+	return st.Status == statusRetry && time.Now().Before(st.NextAttempt)
+}
+
+// retryLoop ставит в очередь отложенные файлы, время повтора которых
+// наступило, до отмены ctx
+func retryLoop(ctx context.Context) {
+	interval := config.Retry.DeferInterval
+	if states == nil || interval <= 0 {
+		return
+	}
+	interval = min(interval, time.Minute)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		retryDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func retryDue() {
+	var paths []string
+	err := states.each(func(filePath string, st fileState) {
+		if st.Status != statusRetry || retryPending(st) {
+			return
+		}
+		if _, err := os.Stat(filePath); err == nil {
+			paths = append(paths, filePath)
+		}
+	})
+	if err != nil {
+		slog.Error("failed to read state database", "error", err)
+		return
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	slog.Info("retrying deferred files", "count", len(paths))
+	for _, filePath := range paths {
+		// Остальные файлы будут поставлены в очередь в следующий раз
+		if !jobs.tryEnqueue(filePath) {
+			return
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"photoroom/storage"
+)
+
+// Ручная проверка результатов. Результаты сохраняются в dir и попадают
+// в processed и внешние хранилища только после одобрения. Отклоненный
+// результат удаляется, а исходник возвращается в source, при необходимости
+// с другими параметрами в sidecar-файле, и обрабатывается заново.
+type Review struct {
+	Enabled bool `yaml:"enabled"`
+	// Директория результатов, ожидающих проверки: <dir>/<путь в source>,
+	// для директорий из секции watches - <dir>/<имя>/<путь в source>
+	Dir string `yaml:"dir"`
+}
+
+func validReview(r Review, archivePolicy string) error {
+	if !r.Enabled {
+		return nil
+	}
+	if r.Dir == "" {
+		return errors.New("не задан dir")
+	}
+	// Отклоненный файл обрабатывается заново из исходника
+	if archivePolicy == archiveDelete || archivePolicy == archiveZip {
+		return fmt.Errorf("исходник нельзя вернуть в source при archive.policy %s", archivePolicy)
+	}
+	return nil
+}
+
+// outputRoot возвращает директорию, в которую сохраняются результаты файла:
+// директорию проверки или processed
+func outputRoot(filePath string) string {
+	if config.Review.Enabled {
+		return filepath.Join(config.Review.Dir, watchFor(filePath).Name)
+	}
+	return processedDir(filePath)
+}
+
+// Результаты файла, ожидающие проверки. Хранится в директории проверки
+// как <путь исходника>.pending.json.
+type pendingReview struct {
+	// Путь исходника в source на момент обработки
+	Source string `json:"source"`
+	// Путь исходника после архивирования с учетом destination_exists
+	Archived string `json:"archived,omitempty"`
+	Watch    string `json:"watch"`
+	// Директория, в которую результаты переносятся после одобрения
+	ProcessedDir string `json:"processed_dir"`
+	// Результаты относительно директории проверки
+	Outputs []string `json:"outputs"`
+	Profile string   `json:"profile,omitempty"`
+	// Замечания проверки qa
+	Reasons   []string  `json:"reasons,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// holdForReview записывает, что результаты файла ждут проверки, и путь,
+// по которому исходник убран. Результаты, взятые из дедупликации, уже лежат
+// в processed и не проверяются.
+func holdForReview(filePath, archived string, res outcome) {
+	if !config.Review.Enabled {
+		return
+	}
+	w := watchFor(filePath)
+	root := filepath.Join(config.Review.Dir, w.Name)
+	rec := pendingReview{
+		Source:       absPath(filePath),
+		Watch:        w.Name,
+		ProcessedDir: processedDir(filePath),
+		Profile:      res.Profile,
+		Reasons:      res.Review,
+		Timestamp:    time.Now(),
+	}
+	if archived != "" {
+		rec.Archived = absPath(archived)
+	}
+	for _, out := range res.Outputs {
+		rel, err := filepath.Rel(root, out)
+		if err == nil && filepath.IsLocal(rel) {
+			rec.Outputs = append(rec.Outputs, filepath.ToSlash(rel))
+		}
+	}
+	if len(rec.Outputs) == 0 {
+		return
+	}
+
+	path := filepath.Join(root, relPath(filePath)) + ".pending.json"
+	err := savePending(path, rec)
+	if err != nil {
+		slog.Error("failed to record pending review", "file", filePath, "error", err)
+		return
+	}
+	slog.Info("output awaiting review", "file", filePath, "review", filepath.Join(w.Name, relPath(filePath)))
+}
+
+func savePending(path string, rec pendingReview) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Файл, ожидающий проверки
+type pendingFile struct {
+	// Путь относительно директории проверки
+	Path string `json:"path"`
+	pendingReview
+}
+
+// listPending возвращает файлы, ожидающие проверки, от старых к новым
+func listPending() []pendingFile {
+	var files []pendingFile
+	filepath.WalkDir(config.Review.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".pending.json") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var f pendingFile
+		if json.Unmarshal(data, &f.pendingReview) != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(config.Review.Dir, strings.TrimSuffix(path, ".pending.json"))
+		f.Path = filepath.ToSlash(rel)
+		files = append(files, f)
+		return nil
+	})
+	slices.SortFunc(files, func(a, b pendingFile) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	return files
+}
+
+// loadPending читает запись о файле rel из списка listPending
+func loadPending(rel string) (string, pendingReview, error) {
+	rel = filepath.FromSlash(rel)
+	if !filepath.IsLocal(rel) {
+		return "", pendingReview{}, fmt.Errorf("неверный путь %q", rel)
+	}
+	path := filepath.Join(config.Review.Dir, rel) + ".pending.json"
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", pendingReview{}, fmt.Errorf("%s не ожидает проверки", filepath.ToSlash(rel))
+	}
+	if err != nil {
+		return "", pendingReview{}, err
+	}
+	var rec pendingReview
+	err = json.Unmarshal(data, &rec)
+	if err != nil {
+		return "", pendingReview{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return path, rec, nil
+}
+
+// approveReview переносит результаты файла rel в processed и передает
+// во внешние хранилища. Возвращает адреса результатов.
+func approveReview(ctx context.Context, rel string) ([]string, error) {
+	path, rec, err := loadPending(rel)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Join(config.Review.Dir, rec.Watch)
+	processed := storage.Dir{Root: rec.ProcessedDir, Conflict: outputConflict()}
+
+	if len(rec.Outputs) == 0 {
+		os.Remove(path)
+	}
+	var locations []string
+	for len(rec.Outputs) > 0 {
+		out := rec.Outputs[0]
+		local := filepath.Join(root, filepath.FromSlash(out))
+		head, err := readHead(local, 512)
+		if err != nil {
+			return locations, err
+		}
+		mt := mediaType("", head)
+
+		placed, err := processed.Put(ctx, local, out, mt)
+		if errors.Is(err, fs.ErrExist) {
+			return locations, outputExistsError(filepath.Join(processed.Root, filepath.FromSlash(out)))
+		}
+		if err != nil {
+			return locations, fmt.Errorf("не удалось перенести результат: %w", err)
+		}
+		// Перенесенный результат больше не ждет проверки, даже если
+		// выгрузить его не удастся
+		rec.Outputs = rec.Outputs[1:]
+		if len(rec.Outputs) > 0 {
+			savePending(path, rec)
+		} else {
+			os.Remove(path)
+		}
+		location, err := deliverOutput(ctx, rec.Source, placed, mt)
+		if err != nil {
+			return locations, err
+		}
+		locations = append(locations, location)
+	}
+	slog.Info("output approved", "file", rec.Source, "outputs", locations)
+	return locations, nil
+}
+
+// rejectReview удаляет результаты файла rel и возвращает исходник в source.
+// Непустые profile и params записываются в его sidecar-файл: ключи params
+// совпадают с ключами профиля, вложенные разделяются точкой, например
+// background.prompt. Возвращает путь исходника.
+func rejectReview(rel, profile string, params map[string]string) (string, error) {
+	path, rec, err := loadPending(rel)
+	if err != nil {
+		return "", err
+	}
+	// Исходник, который не удалось убрать сразу, переносится позже
+	// без записи нового пути
+	src := rec.Archived
+	if info, err := os.Stat(src); src == "" || err != nil || !info.Mode().IsRegular() {
+		src = sourceLocation(rec.Source, rec.Timestamp)
+	}
+	if src == "" {
+		return "", fmt.Errorf("исходник %s не найден в source и destination: повторная обработка невозможна", rec.Source)
+	}
+
+	err = returnSource(src, rec.Source, profile, params)
+	if err != nil {
+		return "", err
+	}
+
+	root := filepath.Join(config.Review.Dir, rec.Watch)
+	for _, out := range rec.Outputs {
+		os.Remove(filepath.Join(root, filepath.FromSlash(out)))
+	}
+	os.Remove(path)
+	slog.Info("output rejected, source returned", "file", rec.Source, "profile", profile, "params", params)
+	return rec.Source, nil
+}
+
+// parseParams разбирает параметры вида ключ=значение
+func parseParams(list []string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, p := range list {
+		key, value, ok := strings.Cut(p, "=")
+		if !ok || slices.Contains(strings.Split(key, "."), "") {
+			return nil, fmt.Errorf("неверный параметр %q, ожидается ключ=значение", p)
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
+// reviewListHandler возвращает файлы, ожидающие проверки
+func reviewListHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, listPending())
+}
+
+// approveHandler одобряет результаты файла path
+func approveHandler(w http.ResponseWriter, r *http.Request) {
+	action, _, err := readFileAction(r)
+	var locations []string
+	if err == nil {
+		locations, err = approveReview(r.Context(), action.Path)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, map[string][]string{"outputs": locations})
+}
+
+// rejectHandler отклоняет результаты файла path и ставит исходник в очередь
+// с профилем profile и параметрами params
+func rejectHandler(w http.ResponseWriter, r *http.Request) {
+	action, params, err := readFileAction(r)
+	if err == nil {
+		var target string
+		target, err = rejectReview(action.Path, action.Profile, params)
+		if err == nil {
+			if jobs != nil {
+				jobs.tryEnqueue(target)
+			}
+			writeJSON(w, map[string]string{"file": target})
+			return
+		}
+	}
+	writeError(w, http.StatusBadRequest, err)
+}
+
+// Повторяемый флаг со списком значений
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runReview выполняет действия с результатами, ожидающими проверки
+func runReview(args []string) int {
+	if len(args) == 0 || !slices.Contains([]string{"list", "approve", "reject"}, args[0]) {
+		fmt.Fprintln(os.Stderr, "ожидается действие: list, approve или reject")
+		return exitConfig
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("review "+action, flag.ExitOnError)
+	var opts options
+	opts.register(fs)
+	profile := fs.String("profile", "", "профиль повторной обработки (reject)")
+	var paramList listFlag
+	fs.Var(&paramList, "param", "параметр повторной обработки ключ=значение, например background.prompt=\"on a marble table\" (reject, можно несколько)")
+	fs.Parse(args[1:])
+	params, err := parseParams(paramList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConfig
+	}
+	// Базу состояния держит запущенная служба
+	opts.skipState = true
+	setup(opts)
+	if !config.Review.Enabled {
+		fmt.Fprintln(os.Stderr, "ручная проверка не включена: review.enabled")
+		return exitConfig
+	}
+
+	if action == "list" {
+		for _, f := range listPending() {
+			line := f.Path + "\t" + f.Timestamp.Format(time.DateTime) + "\t" + f.Profile
+			if len(f.Reasons) > 0 {
+				line += "\t" + strings.Join(f.Reasons, "; ")
+			}
+			fmt.Println(line)
+		}
+		return 0
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "не указаны файлы")
+		return exitConfig
+	}
+	code := 0
+	for _, rel := range fs.Args() {
+		if action == "approve" {
+			_, err = approveReview(context.Background(), rel)
+		} else {
+			_, err = rejectReview(rel, *profile, params)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rel, err)
+			code = exitFailures
+		}
+	}
+	return code
+}
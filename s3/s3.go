@@ -0,0 +1,348 @@
+// Пакет s3 - минимальный клиент S3-совместимых хранилищ (AWS S3, MinIO):
+// загрузка, скачивание, копирование, удаление и список объектов
+// с подписью запросов AWS Signature V4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config - параметры подключения к хранилищу.
+type Config struct {
+	// Адрес хранилища, например "https://s3.amazonaws.com" или "http://minio:9000"
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// PathStyle включает адресацию вида endpoint/bucket/key (нужна для MinIO)
+	PathStyle bool `yaml:"path_style"`
+}
+
+// Client выполняет запросы к одному бакету.
+type Client struct {
+	cfg        Config
+	endpoint   *url.URL
+	httpClient *http.Client
+}
+
+// New создает клиент. Если hc равен nil, используется http.DefaultClient.
+func New(cfg Config, hc *http.Client) (*Client, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("не указан бакет")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3.amazonaws.com"
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("неверный адрес хранилища %q", cfg.Endpoint)
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{cfg: cfg, endpoint: u, httpClient: hc}, nil
+}
+
+// Error - ответ хранилища с кодом ошибки.
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ошибка S3 (%d): %s", e.StatusCode, e.Body)
+}
+
+// PutObject сохраняет содержимое body под ключом key. Данные читаются
+// дважды: для подписи и при отправке, поэтому в памяти не накапливаются.
+func (c *Client) PutObject(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.do(ctx, http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// objectURL возвращает адрес объекта key (или бакета, если key пустой).
+func (c *Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	path := "/" + key
+	if c.cfg.PathStyle {
+		path = "/" + c.cfg.Bucket + path
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+	}
+	// RawPath закодирован по правилам S3, он же используется при подписи
+	base := strings.TrimSuffix(u.Path, "/")
+	u.Path = base + path
+	u.RawPath = escapePath(base + path)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do подписывает и выполняет запрос с телом body (nil - без тела).
+// Ответы с кодом не 2xx возвращаются как *Error.
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.ReadSeeker) (*http.Response, error) {
+	u := c.objectURL(key, query)
+
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	// Подпись включает хеш тела, поэтому тело читается заранее
+	h := sha256.New()
+	size, err := io.Copy(h, body)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), io.NopCloser(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	} else {
+		// Тело отправляется повторно при перенаправлении и повторе запроса
+		req.GetBody = func() (io.ReadCloser, error) {
+			_, err := body.Seek(0, io.SeekStart)
+			return io.NopCloser(body), err
+		}
+	}
+	c.sign(req, u, hex.EncodeToString(h.Sum(nil)), time.Now().UTC())
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+		return nil, &Error{StatusCode: res.StatusCode, Body: string(data)}
+	}
+	return res, nil
+}
+
+// sign добавляет к запросу подпись AWS Signature V4. payloadHash -
+// SHA-256 тела в шестнадцатеричном виде.
+func (c *Client) sign(req *http.Request, u *url.URL, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", u.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Подписываем host, content-type и все x-amz-* заголовки
+	var names []string
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "host" || lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		u.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.cfg.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretKey), date)
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKey, scope, signedHeaders, signature))
+	req.Host = u.Host
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath кодирует ключ объекта по правилам S3: все, кроме
+// незарезервированных символов и "/", заменяется на %XX.
+func escapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		if isUnreserved(ch) || ch == '/' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func isUnreserved(ch byte) bool {
+	return 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+		ch == '-' || ch == '_' || ch == '.' || ch == '~'
+}
+
+// canonicalQuery кодирует параметры запроса в каноническом для подписи виде.
+func canonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := slices.Clone(query[k])
+		slices.Sort(values)
+		for _, v := range values {
+			parts = append(parts, escapeQuery(k)+"="+escapeQuery(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escapeQuery(s string) string {
+	return strings.ReplaceAll(escapePath(s), "/", "%2F")
+}
+
+// Object - описание объекта в бакете.
+type Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type listResult struct {
+	Contents              []Object `xml:"Contents"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+// ListObjects возвращает все объекты с ключами, начинающимися с prefix.
+func (c *Client) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("не удалось разобрать список объектов: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// GetObject возвращает содержимое объекта key. Вызывающий должен закрыть его.
+func (c *Client) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// CopyObject копирует объект src в dst внутри бакета.
+func (c *Client) CopyObject(ctx context.Context, src, dst string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+c.cfg.Bucket+"/"+escapePath(src))
+
+	res, err := c.do(ctx, http.MethodPut, dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// DeleteObject удаляет объект key.
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	res, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Bucket возвращает имя бакета клиента.
+func (c *Client) Bucket() string {
+	return c.cfg.Bucket
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"photoroom/s3"
+	"photoroom/storage"
+)
+
+// Настройки получения исходных файлов из S3-совместимого хранилища
+type S3Input struct {
+	s3.Config `yaml:",inline"`
+	// Префикс ключей, из которого забираются изображения
+	Prefix string `yaml:"prefix"`
+	// Интервал опроса бакета
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Куда переносить забранные объекты. Пустое значение - удалять их.
+	ArchivePrefix string `yaml:"archive_prefix"`
+}
+
+func validS3Input(cfg S3Input) error {
+	if cfg.Bucket == "" || cfg.ArchivePrefix == "" {
+		return nil
+	}
+	// Ключи перенесенных объектов - archive_prefix/имя, а prefix
+	// сравнивается с ключами как строка
+	archive := path.Join(cfg.ArchivePrefix, "")
+	if strings.HasPrefix(archive+"/", cfg.Prefix) || strings.HasPrefix(cfg.Prefix, archive+"/") || cfg.Prefix == archive {
+		return fmt.Errorf("archive_prefix %q пересекается с prefix %q", cfg.ArchivePrefix, cfg.Prefix)
+	}
+	return nil
+}
+
+// Клиент бакета с исходными файлами; nil, если опрос выключен
+var s3Source *s3.Client
+
+func setupS3Input(cfg S3Input) error {
+	if cfg.Bucket == "" {
+		return nil
+	}
+
+	var err error
+	s3Source, err = s3.New(cfg.Config, &http.Client{Transport: transport})
+	return err
+}
+
+// pollS3Input периодически забирает новые объекты из бакета в source,
+// откуда их обрабатывает обычный конвейер, до отмены ctx
+func pollS3Input(ctx context.Context) {
+	if s3Source == nil {
+		return
+	}
+
+	interval := config.S3Input.PollInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fetchS3Input(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchS3Input скачивает в source все объекты из префикса бакета.
+// Ключ относительно префикса становится путем относительно source,
+// поэтому профили по поддиректориям работают и для бакета.
+func fetchS3Input(ctx context.Context) {
+	if s3Source == nil {
+		return
+	}
+
+	cfg := config.S3Input
+	src := &storage.S3{Client: s3Source, Prefix: cfg.Prefix, ArchivePrefix: cfg.ArchivePrefix}
+	fetchSource(ctx, src, "s3://"+path.Join(cfg.Bucket, cfg.Prefix), config.SourceDir)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Настройки обхода директорий в командах once и process
+type Scan struct {
+	// Сколько директорий читается одновременно
+	Workers int `yaml:"workers"`
+	// Сколько записей директории читается за раз: огромные директории
+	// не загружаются в память целиком
+	Batch int `yaml:"batch"`
+}
+
+// Директории, файлы которых уже обработаны в прерванном обходе,
+// по корню обхода и пути относительно него
+var scanBucket = []byte("scan")
+
+// Обход прерван остановкой пула
+var errScanStopped = errors.New("обход прерван")
+
+// scanTree ставит в очередь файлы root и его поддиректорий. Директории
+// читаются параллельно и порциями, а постановка в очередь ждет свободного
+// места, поэтому память не зависит от числа файлов. С базой состояния
+// обход можно продолжить после прерывания: директории, все файлы которых
+// уже обработаны, пропускаются до завершения полного обхода (см. finishScans).
+func scanTree(ctx context.Context, root string) error {
+	workers := max(config.Scan.Workers, 1)
+	batch := config.Scan.Batch
+	if batch <= 0 {
+		batch = 1000
+	}
+
+	s := &treeScan{root: root, batch: batch}
+	s.cond = sync.NewCond(&s.mu)
+	s.dirs = []string{root}
+	scans.addRoot(root)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := s.next()
+				if !ok {
+					return
+				}
+				err := s.scanDir(ctx, dir)
+				if errors.Is(err, errScanStopped) || ctx.Err() != nil {
+					s.stop()
+				} else if err != nil {
+					slog.Error("failed to scan directory", "dir", dir, "error", err)
+				}
+				s.done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.stopped {
+		return errScanStopped
+	}
+	return nil
+}
+
+// Состояние одного обхода: стек непрочитанных директорий
+type treeScan struct {
+	root  string
+	batch int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    []string
+	busy    int
+	stopped bool
+}
+
+// next возвращает следующую директорию или false, когда обход закончен
+func (s *treeScan) next() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.dirs) == 0 && s.busy > 0 && !s.stopped {
+		s.cond.Wait()
+	}
+	if len(s.dirs) == 0 || s.stopped {
+		return "", false
+	}
+	dir := s.dirs[len(s.dirs)-1]
+	s.dirs = s.dirs[:len(s.dirs)-1]
+	s.busy++
+	return dir, true
+}
+
+func (s *treeScan) push(dir string) {
+	s.mu.Lock()
+	s.dirs = append(s.dirs, dir)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *treeScan) done() {
+	s.mu.Lock()
+	s.busy--
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *treeScan) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// scanDir ставит в очередь файлы директории и добавляет в стек поддиректории
+func (s *treeScan) scanDir(ctx context.Context, dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rel, _ := filepath.Rel(s.root, dir)
+	key := scanKey(s.root, rel)
+	skip := states.scanned(key)
+	progress := &dirProgress{key: key}
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		entries, err := f.ReadDir(s.batch)
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			if e.IsDir() {
+				s.push(path)
+				continue
+			}
+			if skip || !accepted(path) {
+				continue
+			}
+			scans.add(progress, path)
+			if !jobs.enqueue(path) {
+				return errScanStopped
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			if !skip {
+				scans.listed(progress)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Директории обходов текущего запуска, файлы которых еще обрабатываются
+type scanProgress struct {
+	mu    sync.Mutex
+	roots []string
+	// Директория по пути поставленного в очередь файла
+	files map[string]*dirProgress
+}
+
+var scans = &scanProgress{files: make(map[string]*dirProgress)}
+
+// Директория, файлы которой поставлены в очередь
+type dirProgress struct {
+	key []byte
+	// Файлы в очереди и в обработке; директория пройдена, когда
+	// она прочитана до конца и счетчик обнулился
+	remaining int
+	listed    bool
+}
+
+// scanKey возвращает ключ директории rel обхода root; ключ с пустым rel -
+// префикс всех директорий обхода
+func scanKey(root, rel string) []byte {
+	return []byte(absPath(root) + "\x00" + filepath.ToSlash(rel))
+}
+
+func (c *scanProgress) addRoot(root string) {
+	c.mu.Lock()
+	c.roots = append(c.roots, root)
+	c.mu.Unlock()
+}
+
+func (c *scanProgress) add(d *dirProgress, filePath string) {
+	c.mu.Lock()
+	d.remaining++
+	c.files[absPath(filePath)] = d
+	c.mu.Unlock()
+}
+
+// listed отмечает, что директория прочитана до конца
+func (c *scanProgress) listed(d *dirProgress) {
+	c.mu.Lock()
+	d.listed = true
+	finished := d.remaining == 0
+	c.mu.Unlock()
+	if finished {
+		states.markScanned(d.key)
+	}
+}
+
+// release учитывает окончание обработки файла (по абсолютному пути)
+func (c *scanProgress) release(key string) {
+	c.mu.Lock()
+	d, ok := c.files[key]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.files, key)
+	d.remaining--
+	finished := d.listed && d.remaining == 0
+	c.mu.Unlock()
+	if finished {
+		states.markScanned(d.key)
+	}
+}
+
+// finishScans забывает пройденные директории после полного обхода, чтобы
+// следующий запуск снова просматривал их целиком
+func finishScans() {
+	scans.mu.Lock()
+	roots := scans.roots
+	scans.roots = nil
+	scans.mu.Unlock()
+
+	for _, root := range roots {
+		states.resetScan(scanKey(root, ""))
+	}
+}
+
+// scanned сообщает, что файлы директории обработаны в прерванном обходе
+func (s *stateStore) scanned(key []byte) bool {
+	if s == nil {
+		return false
+	}
+
+	done := false
+	s.db.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket(scanBucket).Get(key) != nil
+		return nil
+	})
+	return done
+}
+
+// markScanned запоминает, что файлы директории обработаны
+func (s *stateStore) markScanned(key []byte) {
+	if s == nil {
+		return
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(scanBucket).Put(key, []byte{1})
+	})
+	if err != nil {
+		slog.Error("failed to save scan progress", "error", err)
+	}
+}
+
+// resetScan удаляет пройденные директории с ключами, начинающимися с prefix
+func (s *stateStore) resetScan(prefix []byte) {
+	if s == nil {
+		return
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(scanBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to reset scan progress", "error", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"photoroom/photoroom"
+)
+
+// Настройки режима serve
+type Serve struct {
+	// Адрес HTTP-сервера, например ":8080"
+	Listen string `yaml:"listen"`
+	// Токен для заголовка Authorization: Bearer <token>; пусто - без проверки
+	Token string `yaml:"token"`
+	// Максимальный размер запроса в байтах
+	MaxUploadSize int64 `yaml:"max_upload_size"`
+}
+
+// serveMux возвращает обработчики режима serve
+func serveMux(cfg Serve) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /process", requireToken(cfg.Token, func(w http.ResponseWriter, r *http.Request) {
+		handleProcess(w, r, cfg.MaxUploadSize)
+	}))
+	return mux
+}
+
+// runServe принимает изображения по HTTP, обрабатывает их через API
+// и возвращает результат в ответе
+func runServe(ctx context.Context, cfg Serve) error {
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           serveMux(cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("server started", "listen", cfg.Listen)
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("неверный токен"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleProcess обрабатывает multipart-запрос с полем image (изображение)
+// и необязательным полем params (JSON с параметрами обработки)
+func handleProcess(w http.ResponseWriter, r *http.Request, maxSize int64) {
+	if maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("не удалось прочитать поле image: %w", err))
+		return
+	}
+	defer file.Close()
+
+	ctx := requestContext(r.Context(), r.Header.Get(photoroom.RequestIDHeader))
+	w.Header().Set(photoroom.RequestIDHeader, photoroom.RequestID(ctx))
+	data, mt, err := processUpload(ctx, file, header.Filename, r.FormValue("params"))
+	if err != nil {
+		writeError(w, requestStatus(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", mt)
+	w.Write(data)
+}
+
+// requestContext задает идентификатор задания запроса: переданный
+// клиентом или новый
+func requestContext(ctx context.Context, id string) context.Context {
+	if id == "" {
+		id = newJobID()
+	}
+	return photoroom.WithRequestID(ctx, id)
+}
+
+// Ошибка обработки запроса с кодом HTTP-ответа
+type requestError struct {
+	status int
+	err    error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// requestStatus возвращает код HTTP-ответа для ошибки processUpload
+func requestStatus(err error) int {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.status
+	}
+	return http.StatusInternalServerError
+}
+
+// processUpload обрабатывает загруженное изображение с параметрами params
+// и возвращает результат и его MIME-тип. Ошибка содержит код HTTP-ответа.
+func processUpload(ctx context.Context, file readSeekerAt, filename, params string) ([]byte, string, error) {
+	start := time.Now()
+	if config.Validate.Enabled {
+		err := checkImage(file, config.Validate)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return nil, "", &requestError{http.StatusUnprocessableEntity, err}
+		}
+	}
+
+	name, profile, err := requestProfile(params, filename)
+	if err != nil {
+		return nil, "", &requestError{http.StatusBadRequest, err}
+	}
+
+	result, err := profile.send(ctx, namedReader{file, filename})
+	if err != nil {
+		slog.Error("request processing failed", "job_id", photoroom.RequestID(ctx), "file", filename, "profile", name, "error", err)
+		// Проблемы с ключом или кредитами - не ошибка клиента
+		if errors.Is(err, photoroom.ErrInvalidAPIKey) || errors.Is(err, photoroom.ErrQuotaExceeded) {
+			return nil, "", &requestError{http.StatusServiceUnavailable, err}
+		}
+		var apiErr *photoroom.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode < 500 && apiErr.StatusCode != http.StatusTooManyRequests {
+			return nil, "", &requestError{http.StatusUnprocessableEntity, err}
+		}
+		return nil, "", &requestError{http.StatusBadGateway, err}
+	}
+
+	credits.observe(profile.Mode, result.Header)
+
+	data, err := result.Bytes()
+	if result.File != "" {
+		os.Remove(result.File)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	mt := mediaType(result.ContentType, data)
+	data, mt, err = convertImage(ctx, data, mt, config.Convert)
+	if err != nil {
+		return nil, "", err
+	}
+
+	slog.Info("request processed", "file", filename, "profile", name, "duration", time.Since(start))
+	return data, mt, nil
+}
+
+// requestProfile собирает профиль по полю params запроса. Остальные поля
+// params доступны в описании фона так же, как поля sidecar-файла.
+func requestProfile(raw, filename string) (string, Profile, error) {
+	var params profileParams
+	if raw != "" {
+		// JSON является подмножеством YAML, поэтому используются те же теги
+		err := yaml.Unmarshal([]byte(raw), &params)
+		if err != nil {
+			return "", Profile{}, fmt.Errorf("не удалось разобрать params: %w", err)
+		}
+	}
+
+	overrides, err := confineOverrides(params.Overrides)
+	if err != nil {
+		return params.Profile, Profile{}, err
+	}
+	profile, err := buildProfile(params.Profile, overrides)
+	if err != nil {
+		return params.Profile, profile, err
+	}
+	err = profile.expandPrompts(newPromptData(filepath.Base(filename), params.Profile, params.Fields))
+	return params.Profile, profile, err
+}
+
+// Данные изображения, которые клиент API может читать с произвольного
+// места, не копируя их в память
+type readSeekerAt interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// namedReader передает в API имя загруженного файла
+type namedReader struct {
+	readSeekerAt
+	name string
+}
+
+func (r namedReader) Name() string {
+	return r.name
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+
+	"github.com/kardianos/service"
+)
+
+// Программа, запускаемая системным менеджером служб
+// (служба Windows, systemd, launchd и т.п.)
+type serviceProgram struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (p *serviceProgram) Start(s service.Service) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+
+	// Start не должен блокироваться
+	go func() {
+		defer close(p.done)
+		watch(ctx, cancel)
+	}()
+	return nil
+}
+
+func (p *serviceProgram) Stop(s service.Service) error {
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+// Действия команды service
+var serviceActions = []string{"install", "uninstall", "start", "stop", "restart", "status", "run"}
+
+func runService(args []string) int {
+	if len(args) == 0 || !slices.Contains(serviceActions, args[0]) {
+		fmt.Fprintf(os.Stderr, "ожидается действие: %v\n", serviceActions)
+		return 2
+	}
+	action, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("service "+action, flag.ExitOnError)
+	var opts options
+	opts.register(fs)
+	name := fs.String("name", "photoroom", "имя службы")
+	workDir := fs.String("workdir", "", "рабочая директория службы")
+	fs.Parse(args)
+	dir := absPath(".")
+	if *workDir != "" {
+		dir = absPath(*workDir)
+	}
+
+	cfg := &service.Config{
+		Name:        *name,
+		DisplayName: "PhotoRoom image processor",
+		Description: "Обрабатывает изображения из директории source через PhotoRoom API.",
+		// Служба запускается с теми же флагами, абсолютным путем к конфигурации
+		// и текущей директорией: относительные source_dir и другие пути
+		// указывают туда же, где их проверили при установке. WorkingDirectory
+		// учитывается не везде, в Windows служба запускается в System32.
+		Arguments:        append(append([]string{"service", "run"}, args...), "-config", absPath(opts.configPath), "-workdir", dir),
+		WorkingDirectory: dir,
+	}
+	// Зависимости в этом виде понимает только systemd; в Windows они стали
+	// бы именами служб, без которых служба не запустится
+	if service.ChosenSystem().String() == "linux-systemd" {
+		cfg.Dependencies = []string{"After=network-online.target", "Wants=network-online.target"}
+	}
+
+	prg := &serviceProgram{}
+	svc, err := service.New(prg, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "не удалось создать службу:", err)
+		return 1
+	}
+
+	switch action {
+	case "run":
+		if *workDir != "" {
+			err = os.Chdir(*workDir)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "не удалось перейти в рабочую директорию:", err)
+				return 1
+			}
+		}
+		setup(opts)
+		if runtime.GOOS == "windows" && !service.Interactive() {
+			err = logToService(svc)
+			if err != nil {
+				slog.Warn("failed to open service log, keeping stderr", "error", err)
+			}
+		}
+		err = svc.Run()
+		if err != nil {
+			slog.Error("service failed", "error", err)
+			return 1
+		}
+		return 0
+	case "status":
+		status, err := svc.Status()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "не удалось получить состояние службы:", err)
+			return 1
+		}
+		switch status {
+		case service.StatusRunning:
+			fmt.Println("running")
+		case service.StatusStopped:
+			fmt.Println("stopped")
+		default:
+			fmt.Println("unknown")
+		}
+		return 0
+	}
+
+	err = service.Control(svc, action)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("служба %s: %s выполнено (%s)\n", *name, action, svc.Platform())
+	return 0
+}
+
+// logToService направляет логи в журнал службы (Event Log в Windows).
+// В systemd вывод в stderr и так попадает в journal.
+func logToService(svc service.Service) error {
+	logger, err := svc.Logger(nil)
+	if err != nil {
+		return err
+	}
+	level, err := logLevel(config.Log)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(&serviceLogHandler{logger: logger, level: level}))
+	return nil
+}
+
+// Обработчик slog, пишущий записи в журнал службы
+type serviceLogHandler struct {
+	logger service.Logger
+	level  slog.Level
+	attrs  []slog.Attr
+}
+
+func (h *serviceLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *serviceLogHandler) Handle(_ context.Context, r slog.Record) error {
+	msg := r.Message
+	write := func(a slog.Attr) bool {
+		msg += fmt.Sprintf(" %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.logger.Error(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.logger.Warning(msg)
+	default:
+		return h.logger.Info(msg)
+	}
+}
+
+func (h *serviceLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &serviceLogHandler{logger: h.logger, level: h.level, attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+// Группы атрибутов в программе не используются
+func (h *serviceLogHandler) WithGroup(string) slog.Handler {
+	return h
+}
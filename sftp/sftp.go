@@ -0,0 +1,206 @@
+// Пакет sftp работает с файлами на SFTP-сервере через утилиту sftp
+// из OpenSSH в пакетном режиме. Вход выполняется только по ключу:
+// пакетный режим не позволяет ввести пароль.
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Config - параметры подключения к серверу.
+type Config struct {
+	// Адрес сервера host:port; без порта используется 22
+	Addr string
+	User string
+	// Закрытый ключ; если не задан, используются ключи и агент пользователя
+	KeyFile string
+	// Файл известных ключей серверов; если не задан - ~/.ssh/known_hosts
+	KnownHostsFile string
+	// Timeout ограничивает установку соединения
+	Timeout time.Duration
+	// Command - путь к утилите sftp; по умолчанию ищется в PATH
+	Command string
+}
+
+// Entry - файл или директория на сервере.
+type Entry struct {
+	Name string
+	Dir  bool
+	Size int64
+}
+
+// Client выполняет операции, запуская sftp для каждой.
+type Client struct {
+	cfg Config
+}
+
+// New создает клиент.
+func New(cfg Config) *Client {
+	if cfg.Command == "" {
+		cfg.Command = "sftp"
+	}
+	return &Client{cfg: cfg}
+}
+
+// run выполняет команды sftp и возвращает их вывод без эха команд.
+// Команды с префиксом "-" не прерывают выполнение при ошибке. Каждая
+// команда - строка пакетного файла, поэтому управляющие символы в путях
+// отклоняются: перевод строки начал бы новую команду.
+func (c *Client) run(ctx context.Context, commands ...string) (string, error) {
+	for _, command := range commands {
+		if strings.ContainsFunc(command, unicode.IsControl) {
+			return "", fmt.Errorf("недопустимый управляющий символ в команде %q", command)
+		}
+	}
+	host, port := c.cfg.Addr, "22"
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		host, port = host[:i], host[i+1:]
+	}
+	host = strings.Trim(host, "[]")
+	if c.cfg.User != "" {
+		host = c.cfg.User + "@" + host
+	}
+
+	args := []string{"-b", "-", "-P", port, "-o", "BatchMode=yes"}
+	if c.cfg.KeyFile != "" {
+		args = append(args, "-i", c.cfg.KeyFile)
+	}
+	if c.cfg.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+c.cfg.KnownHostsFile)
+	}
+	if c.cfg.Timeout > 0 {
+		args = append(args, "-o", "ConnectTimeout="+strconv.Itoa(int(c.cfg.Timeout.Seconds())))
+	}
+	args = append(args, host)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.cfg.Command, args...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", fmt.Errorf("ошибка sftp: %w", err)
+		}
+		return "", fmt.Errorf("ошибка sftp: %s", msg)
+	}
+
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(stdout.String(), "\n") {
+		if !strings.HasPrefix(line, "sftp> ") {
+			out.WriteString(line)
+		}
+	}
+	return out.String(), nil
+}
+
+// quote заключает путь в кавычки для пакетного файла sftp
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// quoteGlob заключает в кавычки путь для команд, раскрывающих шаблоны
+// (ls, get, put, rm), экранируя символы шаблона. Обратная косая черта
+// снимается дважды: при разборе строки и при раскрытии шаблона.
+func quoteGlob(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\\\`, `"`, `\"`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(s) + `"`
+}
+
+// Строка вывода ls -l: права, ссылки, владелец, группа, размер, дата и имя
+var longLine = regexp.MustCompile(`^([-dl])\S*\s+\d+\s+\S+\s+\S+\s+(\d+)\s+\S+\s+\S+\s+\S+\s+(.+)$`)
+
+// List возвращает содержимое директории dir без скрытых файлов.
+func (c *Client) List(ctx context.Context, dir string) ([]Entry, error) {
+	out, err := c.run(ctx, "ls -l "+quoteGlob(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, line := range strings.Split(out, "\n") {
+		m := longLine.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		// Ссылки пропускаем
+		if m == nil || m[1] == "l" {
+			continue
+		}
+		size, _ := strconv.ParseInt(m[2], 10, 64)
+		// sftp выводит имена вместе с путем директории
+		entries = append(entries, Entry{Name: path.Base(m[3]), Dir: m[1] == "d", Size: size})
+	}
+	return entries, nil
+}
+
+// Retrieve скачивает файл name в локальный файл local.
+func (c *Client) Retrieve(ctx context.Context, name, local string) error {
+	_, err := c.run(ctx, "get "+quoteGlob(name)+" "+quote(local))
+	return err
+}
+
+// Store загружает локальный файл local в файл name. Файл сначала
+// загружается под временным именем, чтобы на сервере не появился
+// недописанный файл.
+func (c *Client) Store(ctx context.Context, local, name string) error {
+	tmp := path.Join(path.Dir(name), ".tmp-"+path.Base(name))
+	_, err := c.run(ctx,
+		"put "+quoteGlob(local)+" "+quote(tmp),
+		"-rm "+quoteGlob(name),
+		"rename "+quote(tmp)+" "+quote(name),
+	)
+	return err
+}
+
+// Rename переименовывает файл from в to.
+func (c *Client) Rename(ctx context.Context, from, to string) error {
+	_, err := c.run(ctx, "rename "+quote(from)+" "+quote(to))
+	return err
+}
+
+// Delete удаляет файл name.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	_, err := c.run(ctx, "rm "+quoteGlob(name))
+	return err
+}
+
+// MakeDirAll создает директорию dir вместе с недостающими родительскими.
+func (c *Client) MakeDirAll(ctx context.Context, dir string) error {
+	var commands []string
+	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		current = path.Join(current, part)
+		// Ошибки для существующих директорий игнорируются
+		commands = append(commands, "-mkdir "+quote(current))
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	_, err := c.run(ctx, commands...)
+	return err
+}
+
+// Available сообщает, найдена ли утилита sftp.
+func (c *Client) Available() error {
+	_, err := exec.LookPath(c.cfg.Command)
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("утилита %s не найдена", c.cfg.Command)
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package sftp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		path, quoted, glob string
+	}{
+		{"a.jpg", `"a.jpg"`, `"a.jpg"`},
+		{"dir/a b.jpg", `"dir/a b.jpg"`, `"dir/a b.jpg"`},
+		{`say "hi".jpg`, `"say \"hi\".jpg"`, `"say \"hi\".jpg"`},
+		{`a\b.jpg`, `"a\\b.jpg"`, `"a\\\\b.jpg"`},
+		{"a[1].jpg", `"a[1].jpg"`, `"a\[1].jpg"`},
+		{"*?.jpg", `"*?.jpg"`, `"\*\?.jpg"`},
+		{"!cmd", `"!cmd"`, `"!cmd"`},
+	}
+	for _, tt := range tests {
+		if got := quote(tt.path); got != tt.quoted {
+			t.Errorf("quote(%q) = %s, want %s", tt.path, got, tt.quoted)
+		}
+		if got := quoteGlob(tt.path); got != tt.glob {
+			t.Errorf("quoteGlob(%q) = %s, want %s", tt.path, got, tt.glob)
+		}
+	}
+}
+
+// fakeSFTP возвращает клиент, у которого вместо sftp запускается скрипт,
+// сохраняющий пакетный файл в batch
+func fakeSFTP(t *testing.T) (*Client, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("нужен sh")
+	}
+	dir := t.TempDir()
+	batch := filepath.Join(dir, "batch")
+	script := filepath.Join(dir, "sftp")
+	err := os.WriteFile(script, []byte("#!/bin/sh\ncat > "+batch+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(Config{Addr: "example.com", Command: script}), batch
+}
+
+func TestControlCharactersRejected(t *testing.T) {
+	c, batch := fakeSFTP(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"MakeDirAll", func() error { return c.MakeDirAll(ctx, "in/x\n!touch /tmp/pwned #") }},
+		{"Store", func() error { return c.Store(ctx, "/tmp/a.jpg", "out/a\r.jpg") }},
+		{"Retrieve", func() error { return c.Retrieve(ctx, "in/a.jpg", "/tmp/a\x00.jpg") }},
+		{"Rename", func() error { return c.Rename(ctx, "a.jpg", "b\t.jpg") }},
+		{"Delete", func() error { return c.Delete(ctx, "a.jpg\x1b") }},
+		{"List", func() error { _, err := c.List(ctx, "in\n"); return err }},
+	}
+	for _, tt := range tests {
+		if err := tt.run(); err == nil || !strings.Contains(err.Error(), "управляющий символ") {
+			t.Errorf("%s: err = %v, want control character error", tt.name, err)
+		}
+	}
+	// sftp не запускался ни разу
+	if _, err := os.Stat(batch); !os.IsNotExist(err) {
+		t.Errorf("batch written: %v", err)
+	}
+}
+
+func TestBatchCommands(t *testing.T) {
+	c, batch := fakeSFTP(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		run  func() error
+		want string
+	}{
+		{"MakeDirAll", func() error { return c.MakeDirAll(ctx, "/out/a b") }, "-mkdir \"/out\"\n-mkdir \"/out/a b\"\n"},
+		{"Retrieve", func() error { return c.Retrieve(ctx, "in/a[1].jpg", "/tmp/a[1].jpg") }, "get \"in/a\\[1].jpg\" \"/tmp/a[1].jpg\"\n"},
+		{"Store", func() error { return c.Store(ctx, "/tmp/*.jpg", "out/*.jpg") },
+			"put \"/tmp/\\*.jpg\" \"out/.tmp-*.jpg\"\n-rm \"out/\\*.jpg\"\nrename \"out/.tmp-*.jpg\" \"out/*.jpg\"\n"},
+		{"Delete", func() error { return c.Delete(ctx, "in/a?.jpg") }, "rm \"in/a\\?.jpg\"\n"},
+	}
+	for _, tt := range tests {
+		err := tt.run()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		data, err := os.ReadFile(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: batch = %q, want %q", tt.name, data, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Расширения sidecar-файлов с параметрами для одного изображения,
+// например photo.jpg.yaml рядом с photo.jpg
+var sidecarExts = []string{".yaml", ".yml", ".json"}
+
+// sidecarPath возвращает путь к sidecar-файлу изображения или "", если его нет
+func sidecarPath(filePath string) string {
+	for _, ext := range sidecarExts {
+		path := filePath + ext
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// isSidecar сообщает, похож ли файл на sidecar: расширение параметров
+// после расширения изображения, как в photo.jpg.yaml
+func isSidecar(filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if !slices.Contains(sidecarExts, ext) {
+		return false
+	}
+	return filepath.Ext(strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))) != ""
+}
+
+// loadSidecar читает параметры изображения из его sidecar-файла.
+// Если файла нет, возвращает пустые параметры.
+func loadSidecar(filePath string) (profileParams, error) {
+	var params profileParams
+
+	path := sidecarPath(filePath)
+	if path == "" {
+		return params, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return params, err
+	}
+
+	// JSON является подмножеством YAML, поэтому оба формата читаются одинаково
+	err = yaml.Unmarshal(data, &params)
+	if err != nil {
+		return params, fmt.Errorf("не удалось разобрать %s: %w", filepath.Base(path), err)
+	}
+	params.Overrides, err = confineOverrides(params.Overrides)
+	if err != nil {
+		return params, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return params, nil
+}
+
+// sidecarParams возвращает содержимое sidecar-файла path (его может не быть),
+// дополненное профилем и параметрами и проверенное, как параметры манифеста
+func sidecarParams(path, profile string, params map[string]string) ([]byte, error) {
+	fields := make(map[string]any)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = yaml.Unmarshal(data, &fields)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if profile != "" {
+		fields["profile"] = profile
+	}
+	for key, value := range params {
+		if alias, ok := manifestAliases[key]; ok {
+			key = alias
+		}
+		setParam(fields, paramKeys(key), csvValue(value))
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var checked profileParams
+	err = yaml.Unmarshal(data, &checked)
+	if err == nil {
+		checked.Overrides, err = confineOverrides(checked.Overrides)
+	}
+	if err == nil {
+		_, err = buildProfile(checked.Profile, checked.Overrides)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return data, nil
+	}
+	return yaml.Marshal(fields)
+}
+
+// returnSource возвращает исходник src в source по пути target вместе
+// с sidecar-файлом, дополняя его непустыми profile и params
+func returnSource(src, target, profile string, params map[string]string) error {
+	// Параметры проверяются до переноса исходника
+	sidecar := sidecarPath(src)
+	var data []byte
+	if profile != "" || len(params) > 0 {
+		var err error
+		data, err = sidecarParams(sidecar, profile, params)
+		if err != nil {
+			return fmt.Errorf("неверные параметры: %w", err)
+		}
+	}
+
+	// Sidecar переносится раньше изображения, чтобы вотчер
+	// не взял изображение со старыми параметрами
+	err := os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	sidecarTarget := target + ".yaml"
+	if sidecar != "" {
+		sidecarTarget = target + filepath.Ext(sidecar)
+	}
+	if sidecar != "" && sidecar != sidecarTarget {
+		err = renameFile(sidecar, sidecarTarget)
+	}
+	if err == nil && data != nil {
+		err = os.WriteFile(sidecarTarget, data, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if src == target {
+		// Исходник оставлен в source политикой copy: новое время изменения
+		// не дает счесть его уже обработанным
+		now := time.Now()
+		return os.Chtimes(src, now, now)
+	}
+	return renameFile(src, target)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// handleIntakeSignals: на этой платформе прием управляется
+// только через служебный HTTP-сервер
+func handleIntakeSignals(ctx context.Context) {}
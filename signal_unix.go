@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleIntakeSignals приостанавливает прием по SIGUSR1, возобновляет
+// по SIGUSR2 и запускает повторный обход source по SIGHUP
+func handleIntakeSignals(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigs:
+				switch sig {
+				case syscall.SIGUSR1:
+					pauseIntake()
+					continue
+				case syscall.SIGHUP:
+					requestRescan()
+					continue
+				}
+				err := resumeIntake()
+				if err != nil {
+					slog.Error("failed to resume intake", "error", err)
+				}
+			}
+		}
+	}()
+}
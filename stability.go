@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Настройки проверки, что файл дописан
+type Stability struct {
+	// Интервал между проверками размера файла
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Сколько проверок подряд размер и время изменения должны совпасть
+	StablePolls int `yaml:"stable_polls"`
+	// Максимальное время ожидания
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// waitStable ждет, пока размер и время изменения файла перестанут меняться.
+// Нужно для больших файлов, которые копируются по сети дольше секунды.
+func waitStable(ctx context.Context, filePath string, s Stability) error {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastSize int64 = -1
+	var lastMod time.Time
+	stable := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("файл %s не перестал изменяться: %w", filePath, ctx.Err())
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+
+		if info.Size() == lastSize && info.ModTime().Equal(lastMod) {
+			stable++
+		} else {
+			stable = 0
+			lastSize, lastMod = info.Size(), info.ModTime()
+		}
+		if stable >= s.StablePolls {
+			return nil
+		}
+	}
+}
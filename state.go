@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Состояния файла в базе
+const (
+	statusPending   = "pending"
+	statusUploading = "uploading"
+	statusDone      = "done"
+	statusFailed    = "failed"
+	// Обработан и оставлен в source политикой архивирования copy
+	statusKept = "kept"
+	// Не обработан из-за временной ошибки, повтор запланирован
+	statusRetry = "retry"
+)
+
+var filesBucket = []byte("files")
+
+// Запись о файле в базе состояния
+type fileState struct {
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts"`
+	// Неудачные попытки перенести исходник после обработки
+	MoveAttempts int `json:"move_attempts,omitempty"`
+	// Размер и время изменения оставленного в source файла: измененный
+	// файл обрабатывается заново
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mod_time,omitempty"`
+	// Отложенные повторы: их число, время первой временной ошибки
+	// и время следующей попытки
+	Retries      int       `json:"retries,omitempty"`
+	FirstFailure time.Time `json:"first_failure,omitempty"`
+	NextAttempt  time.Time `json:"next_attempt,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Хранилище состояния обработки файлов. Позволяет после сбоя понять,
+// на каком шаге остановилась обработка каждого файла.
+type stateStore struct {
+	db *bolt.DB
+}
+
+var states *stateStore
+
+func openState(path string) (*stateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, hashesBucket, scanBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func stateKey(filePath string) []byte {
+	return []byte(absPath(filePath))
+}
+
+// get возвращает запись о файле; ok равен false, если записи нет
+func (s *stateStore) get(filePath string) (st fileState, ok bool) {
+	if s == nil {
+		return st, false
+	}
+
+	s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(filesBucket).Get(stateKey(filePath))
+		if data != nil {
+			ok = json.Unmarshal(data, &st) == nil
+		}
+		return nil
+	})
+	return st, ok
+}
+
+// update изменяет запись о файле с помощью fn
+func (s *stateStore) update(filePath string, fn func(st *fileState)) {
+	if s == nil {
+		return
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket)
+		key := stateKey(filePath)
+
+		var st fileState
+		if data := b.Get(key); data != nil {
+			json.Unmarshal(data, &st)
+		}
+		fn(&st)
+		st.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+	if err != nil {
+		slog.Error("failed to update file state", "file", filePath, "error", err)
+	}
+}
+
+// markPending отмечает файл как ожидающий обработки. Статусы done и kept
+// сохраняются, чтобы не загружать повторно уже обработанный файл,
+// а retry - чтобы не повторять отложенный файл раньше времени.
+func (s *stateStore) markPending(filePath string) {
+	s.update(filePath, func(st *fileState) {
+		if st.Status != statusDone && st.Status != statusKept && st.Status != statusRetry {
+			st.Status = statusPending
+		}
+	})
+}
+
+// restore возвращает запись, полученную от get до изменения: при ok,
+// равном false, запись удаляется
+func (s *stateStore) restore(filePath string, prev fileState, ok bool) {
+	if !ok {
+		s.remove(filePath)
+		return
+	}
+	s.update(filePath, func(st *fileState) {
+		*st = prev
+	})
+}
+
+// remove удаляет запись о файле
+func (s *stateStore) remove(filePath string) {
+	if s == nil {
+		return
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Delete(stateKey(filePath))
+	})
+	if err != nil {
+		slog.Error("failed to update file state", "file", filePath, "error", err)
+	}
+}
+
+func (s *stateStore) setStatus(filePath, status string) {
+	s.update(filePath, func(st *fileState) {
+		st.Status = status
+	})
+}
+
+// each вызывает fn для каждой записи с путем файла
+func (s *stateStore) each(fn func(filePath string, st fileState)) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			var st fileState
+			if json.Unmarshal(v, &st) == nil {
+				fn(string(k), st)
+			}
+			return nil
+		})
+	})
+}
+
+// resumeFromState ставит в очередь файлы, обработка которых была прервана
+// сбоем или остановкой: ожидавшие очереди, загружавшиеся и те, чей результат
+// сохранен, но исходник не перенесен
+func resumeFromState() {
+	var paths []string
+	err := states.each(func(filePath string, st fileState) {
+		switch st.Status {
+		case statusPending, statusUploading, statusDone:
+			if _, err := os.Stat(filePath); err == nil {
+				paths = append(paths, filePath)
+			}
+		}
+	})
+	if err != nil {
+		slog.Error("failed to read state database", "error", err)
+		return
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	slog.Info("resuming interrupted files", "count", len(paths))
+	for _, filePath := range paths {
+		if !jobs.enqueue(filePath) {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"photoroom/storage"
+)
+
+// Настройки отправки результатов HTTP-приемнику: каждый результат
+// отправляется запросом POST с изображением в теле и именем в X-File-Name
+type HTTPOutput struct {
+	// Адрес приемника; пустое значение отключает отправку
+	URL string `yaml:"url"`
+	// Токен в заголовке Authorization: Bearer <token>
+	Token string `yaml:"token"`
+}
+
+// Файлы, уже скачанные в source, но еще не убранные из хранилища,
+// по хранилищу и имени: версия файла при скачивании
+var (
+	fetchedMu sync.Mutex
+	fetched   = make(map[string]string)
+)
+
+// fetchSource скачивает в dir все файлы хранилища src и убирает их
+// из хранилища. Путь файла в хранилище становится путем относительно dir,
+// поэтому профили по поддиректориям работают и для внешних хранилищ.
+// Файл, который не удалось убрать, не скачивается повторно, пока
+// не изменится его версия. label обозначает хранилище в логах.
+func fetchSource(ctx context.Context, src storage.Source, label, dir string) {
+	defer src.Close()
+
+	objects, err := src.List(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to list input storage", "source", label, "error", err)
+		}
+		return
+	}
+
+	for _, obj := range objects {
+		if ctx.Err() != nil {
+			return
+		}
+		key := label + "\x00" + obj.Name
+		fetchedMu.Lock()
+		version, seen := fetched[key]
+		fetchedMu.Unlock()
+		if seen && version == obj.Version {
+			continue
+		}
+
+		target, err := storage.Download(ctx, src, obj, dir)
+		if errors.Is(err, storage.ErrUnsafeName) {
+			slog.Warn("skipping input file with unsafe name", "source", label, "file", obj.Name)
+			continue
+		}
+		if err != nil {
+			slog.Error("failed to download input file", "source", label, "file", obj.Name, "error", err)
+			continue
+		}
+		slog.Info("input file fetched", "source", label, "name", obj.Name, "file", target)
+
+		fetchedMu.Lock()
+		fetched[key] = obj.Version
+		fetchedMu.Unlock()
+
+		err = src.Done(ctx, obj.Name)
+		if err != nil {
+			slog.Error("failed to remove fetched input file", "source", label, "file", obj.Name, "error", err)
+			continue
+		}
+		fetchedMu.Lock()
+		delete(fetched, key)
+		fetchedMu.Unlock()
+	}
+}
+
+// Хранилище, в которое передаются результаты
+type outputSink struct {
+	storage.Sink
+	// Адрес результата в этом хранилище заменяет путь в processed
+	primary bool
+}
+
+// outputSinks возвращает внешние хранилища результатов директории w
+func outputSinks(w Watch) []outputSink {
+	var sinks []outputSink
+	if w.RemoteOutput.URL != "" {
+		sinks = append(sinks, outputSink{Sink: remoteSink{w.RemoteOutput}})
+	}
+	if uploader != nil {
+		// Для директорий из секции watches перед ключом добавляется имя директории
+		s3 := &storage.S3{Client: uploader, Prefix: path.Join(config.S3Output.Prefix, w.Name)}
+		sinks = append(sinks, outputSink{Sink: s3, primary: true})
+	}
+	if config.HTTPOutput.URL != "" {
+		sinks = append(sinks, outputSink{Sink: &storage.HTTP{
+			URL:    config.HTTPOutput.URL,
+			Token:  config.HTTPOutput.Token,
+			Client: &http.Client{Transport: transport, Timeout: config.Timeouts.Request},
+		}})
+	}
+	return sinks
+}
+
+// deliverOutput передает сохраненный в processed результат localPath
+// исходного файла filePath во внешние хранилища. Имя в хранилище повторяет
+// путь результата относительно processed. Возвращает адрес результата:
+// в S3, если он туда выгружен, иначе localPath.
+func deliverOutput(ctx context.Context, filePath, localPath, contentType string) (string, error) {
+	w := watchFor(filePath)
+	sinks := outputSinks(w)
+	if len(sinks) == 0 {
+		return localPath, nil
+	}
+
+	rel, err := filepath.Rel(w.ProcessedDir, localPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		rel = filepath.Base(localPath)
+	}
+	name := filepath.ToSlash(rel)
+
+	location := localPath
+	for _, sink := range sinks {
+		stored, err := sink.Put(ctx, localPath, name, contentType)
+		if err != nil {
+			return "", fmt.Errorf("не удалось выгрузить результат: %w", err)
+		}
+		slog.Info("output stored", "file", localPath, "location", stored)
+		if sink.primary {
+			location = stored
+		}
+	}
+
+	if uploader != nil && !config.S3Output.KeepLocal {
+		err = os.Remove(localPath)
+		if err != nil {
+			slog.Warn("failed to remove local output", "file", localPath, "error", err)
+		}
+	}
+	return location, nil
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dir - локальная директория.
+type Dir struct {
+	Root string
+	// Куда переносить забранные файлы; пусто - удалять их
+	ArchiveDir string
+	// Что делать в Put, если файл с таким именем уже есть
+	Conflict Conflict
+}
+
+// Conflict - действие при записи файла под занятым именем.
+type Conflict int
+
+const (
+	// Добавить к имени номер: _1, _2 и т.д.
+	Rename Conflict = iota
+	// Заменить существующий файл
+	Replace
+	// Оставить существующий файл и вернуть ошибку fs.ErrExist
+	Keep
+)
+
+// List возвращает файлы директории и ее поддиректорий. Скрытые
+// и временные файлы, а также директория архива пропускаются.
+func (d Dir) List(ctx context.Context) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(d.Root, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if path == d.Root {
+			return nil
+		}
+		if strings.HasPrefix(e.Name(), ".") || d.ArchiveDir != "" && path == filepath.Clean(d.ArchiveDir) {
+			if e.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if e.IsDir() {
+			return nil
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.Root, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Name: filepath.ToSlash(rel), Version: info.ModTime().String()})
+		return nil
+	})
+	return objects, err
+}
+
+// Fetch копирует файл name в local.
+func (d Dir) Fetch(ctx context.Context, name, local string) error {
+	return copyFile(filepath.Join(d.Root, filepath.FromSlash(name)), local)
+}
+
+// Done переносит файл name в архив или удаляет его.
+func (d Dir) Done(ctx context.Context, name string) error {
+	path := filepath.Join(d.Root, filepath.FromSlash(name))
+	if d.ArchiveDir == "" {
+		return os.Remove(path)
+	}
+	archived := filepath.Join(d.ArchiveDir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(archived), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, archived)
+}
+
+// Close ничего не делает: директории не нужен сеанс.
+func (d Dir) Close() error {
+	return nil
+}
+
+// Put переносит local в директорию под именем name. С занятым именем
+// поступает согласно Conflict. Если local на другой файловой системе,
+// он копируется. Возвращает путь результата.
+func (d Dir) Put(ctx context.Context, local, name, contentType string) (string, error) {
+	target := filepath.Join(d.Root, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	placed, err := d.place(local, target)
+	if err == nil || errors.Is(err, fs.ErrExist) {
+		return placed, err
+	}
+
+	// Копия пишется рядом с результатом и переносится на место целиком
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-"+filepath.Base(target)+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Close()
+
+	err = copyFile(local, tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	return d.place(tmp.Name(), target)
+}
+
+func (d Dir) place(src, target string) (string, error) {
+	switch d.Conflict {
+	case Replace:
+		err := os.Rename(src, target)
+		if err != nil {
+			return "", err
+		}
+		return target, nil
+	case Keep:
+		return PlaceNew(src, target)
+	}
+	return PlaceUnique(src, target)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
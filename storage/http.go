@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// HTTP - приемник результатов по HTTP: каждый результат отправляется
+// отдельным запросом POST с изображением в теле.
+type HTTP struct {
+	URL string
+	// Токен в заголовке Authorization: Bearer <token>; пусто - без него
+	Token  string
+	Client *http.Client
+}
+
+// Put отправляет local на URL. Имя результата передается в заголовке
+// X-File-Name. Возвращает адрес из заголовка Location ответа или URL.
+func (h *HTTP) Put(ctx context.Context, local, name, contentType string) (string, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, file)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-File-Name", name)
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", fmt.Errorf("приемник ответил %s", res.Status)
+	}
+	if location := res.Header.Get("Location"); location != "" {
+		return location, nil
+	}
+	return h.URL, nil
+}
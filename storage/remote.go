@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Entry - файл или директория на сервере.
+type Entry struct {
+	Name string
+	Dir  bool
+	Size int64
+}
+
+// Conn - сеанс работы с удаленной директорией: сервером FTP или SFTP,
+// папкой Dropbox или Google Drive.
+type Conn interface {
+	List(ctx context.Context, dir string) ([]Entry, error)
+	Get(ctx context.Context, name, local string) error
+	// Put загружает файл так, чтобы на сервере не появился недописанный
+	Put(ctx context.Context, local, name string) error
+	Rename(ctx context.Context, from, to string) error
+	Remove(ctx context.Context, name string) error
+	MkdirAll(ctx context.Context, dir string) error
+	Close() error
+}
+
+// Remote - директория на сервере в рамках одного сеанса.
+type Remote struct {
+	Conn Conn
+	Dir  string
+	// Куда на сервере переносить забранные файлы; пусто - удалять их
+	ArchiveDir string
+}
+
+// Глубина обхода поддиректорий на сервере
+const remoteMaxDepth = 16
+
+// List возвращает файлы директории и ее поддиректорий. Скрытые файлы,
+// недокачанные .tmp-* и директория архива пропускаются.
+func (r *Remote) List(ctx context.Context) ([]Object, error) {
+	return r.walk(ctx, "")
+}
+
+func (r *Remote) walk(ctx context.Context, rel string) ([]Object, error) {
+	if strings.Count(rel, "/") >= remoteMaxDepth {
+		return nil, nil
+	}
+	entries, err := r.Conn.List(ctx, path.Join(r.Dir, rel))
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name, ".") {
+			continue
+		}
+		name := path.Join(rel, e.Name)
+		if !e.Dir {
+			objects = append(objects, Object{Name: name, Version: strconv.FormatInt(e.Size, 10)})
+			continue
+		}
+		if r.ArchiveDir != "" && path.Clean(path.Join(r.Dir, name)) == path.Clean(r.ArchiveDir) {
+			continue
+		}
+		sub, err := r.walk(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, sub...)
+	}
+	return objects, nil
+}
+
+// Fetch скачивает файл name в local.
+func (r *Remote) Fetch(ctx context.Context, name, local string) error {
+	return r.Conn.Get(ctx, path.Join(r.Dir, name), local)
+}
+
+// Done переносит файл name в ArchiveDir или удаляет его.
+func (r *Remote) Done(ctx context.Context, name string) error {
+	remotePath := path.Join(r.Dir, name)
+	if r.ArchiveDir == "" {
+		return r.Conn.Remove(ctx, remotePath)
+	}
+	archived := path.Join(r.ArchiveDir, name)
+	err := r.Conn.MkdirAll(ctx, path.Dir(archived))
+	if err != nil {
+		return err
+	}
+	return r.Conn.Rename(ctx, remotePath, archived)
+}
+
+// Close завершает сеанс.
+func (r *Remote) Close() error {
+	return r.Conn.Close()
+}
+
+// Put загружает local в файл name директории и возвращает его путь на сервере.
+func (r *Remote) Put(ctx context.Context, local, name, contentType string) (string, error) {
+	remotePath := path.Join(r.Dir, name)
+	err := r.Conn.MkdirAll(ctx, path.Dir(remotePath))
+	if err != nil {
+		return "", err
+	}
+	err = r.Conn.Put(ctx, local, remotePath)
+	if err != nil {
+		return "", err
+	}
+	return remotePath, nil
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"photoroom/s3"
+)
+
+// S3 - объекты бакета S3 с общим префиксом ключей.
+type S3 struct {
+	Client *s3.Client
+	Prefix string
+	// Куда переносить забранные объекты; пусто - удалять их
+	ArchivePrefix string
+
+	mu sync.Mutex
+	// Ключи объектов последнего списка по именам
+	keys map[string]string
+}
+
+// List возвращает объекты префикса. Имя объекта - ключ без префикса.
+func (b *S3) List(ctx context.Context) ([]Object, error) {
+	list, err := b.Client.ListObjects(ctx, b.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Перенесенные объекты не забираются повторно, даже если архив
+	// лежит внутри префикса
+	archive := ""
+	if b.ArchivePrefix != "" {
+		archive = path.Join(b.ArchivePrefix, "") + "/"
+	}
+	keys := make(map[string]string)
+	var objects []Object
+	for _, obj := range list {
+		// Пропускаем "директории"
+		if strings.HasSuffix(obj.Key, "/") || archive != "" && strings.HasPrefix(obj.Key, archive) {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(obj.Key, b.Prefix), "/")
+		keys[name] = obj.Key
+		objects = append(objects, Object{Name: name, Version: obj.ETag})
+	}
+	b.mu.Lock()
+	b.keys = keys
+	b.mu.Unlock()
+	return objects, nil
+}
+
+func (b *S3) key(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if key, ok := b.keys[name]; ok {
+		return key
+	}
+	return path.Join(b.Prefix, name)
+}
+
+// Fetch скачивает объект name в local.
+func (b *S3) Fetch(ctx context.Context, name, local string) error {
+	body, err := b.Client.GetObject(ctx, b.key(name))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Done переносит объект name в ArchivePrefix или удаляет его.
+func (b *S3) Done(ctx context.Context, name string) error {
+	key := b.key(name)
+	if b.ArchivePrefix != "" {
+		err := b.Client.CopyObject(ctx, key, path.Join(b.ArchivePrefix, name))
+		if err != nil {
+			return err
+		}
+	}
+	return b.Client.DeleteObject(ctx, key)
+}
+
+// Close ничего не делает: запросы к S3 не требуют сеанса.
+func (b *S3) Close() error {
+	return nil
+}
+
+// Put выгружает local в объект с ключом Prefix/name и возвращает
+// адрес вида s3://bucket/key.
+func (b *S3) Put(ctx context.Context, local, name, contentType string) (string, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	key := path.Join(b.Prefix, name)
+	err = b.Client.PutObject(ctx, key, file, contentType)
+	if err != nil {
+		return "", err
+	}
+	return "s3://" + b.Client.Bucket() + "/" + key, nil
+}
@@ -0,0 +1,158 @@
+// Пакет storage описывает хранилища исходных файлов и результатов:
+// локальные директории, бакеты S3, серверы FTP и SFTP, облачные папки
+// и HTTP-приемники. Конвейер обработки работает с ними только через
+// интерфейсы Source и Sink, поэтому новое хранилище добавляется
+// без изменения конвейера.
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Object - файл в хранилище.
+type Object struct {
+	// Путь относительно корня хранилища через "/"
+	Name string
+	// Признак версии (ETag, размер), по которому замечают замену файла
+	Version string
+}
+
+// Source - хранилище, из которого забираются исходные файлы.
+// Забранный файл убирается из хранилища методом Done.
+type Source interface {
+	// List возвращает файлы, готовые к обработке
+	List(ctx context.Context) ([]Object, error)
+	// Fetch скачивает файл name в локальный файл local
+	Fetch(ctx context.Context, name, local string) error
+	// Done переносит забранный файл в архив хранилища или удаляет его
+	Done(ctx context.Context, name string) error
+	// Close завершает сеанс работы с хранилищем
+	Close() error
+}
+
+// Sink - хранилище результатов.
+type Sink interface {
+	// Put сохраняет локальный файл local под именем name (путь через "/")
+	// и возвращает адрес результата в хранилище
+	Put(ctx context.Context, local, name, contentType string) (string, error)
+}
+
+// Download скачивает файл obj из src в директорию dir под его путем
+// относительно хранилища. Файл пишется во временный скрытый файл
+// и переименовывается, только когда скачан целиком, чтобы следящие
+// за dir не увидели недописанный файл. Если имя занято, к нему
+// добавляется номер. Возвращает путь скачанного файла.
+func Download(ctx context.Context, src Source, obj Object, dir string) (string, error) {
+	rel := filepath.FromSlash(obj.Name)
+	if !filepath.IsLocal(rel) {
+		return "", ErrUnsafeName
+	}
+	target := filepath.Join(dir, rel)
+	err := os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".fetch-*.part")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = src.Fetch(ctx, obj.Name, tmp.Name())
+	if err != nil {
+		return "", err
+	}
+
+	placeholder, target, err := CreateUnique(target)
+	if err != nil {
+		return "", err
+	}
+	placeholder.Close()
+
+	err = os.Rename(tmp.Name(), target)
+	if err != nil {
+		os.Remove(target)
+		return "", err
+	}
+	return target, nil
+}
+
+// ErrUnsafeName - путь файла в хранилище выходит за пределы директории.
+var ErrUnsafeName = errors.New("небезопасное имя файла")
+
+// CreateUnique создает файл path, а если он уже существует - path с суффиксом
+// _1, _2 и т.д. перед расширением. Возвращает открытый файл и его путь.
+func CreateUnique(path string) (*os.File, string, error) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for n := 1; ; n++ {
+		file, err := os.OpenFile(candidate, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return file, candidate, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, "", err
+		}
+		candidate = stem + "_" + strconv.Itoa(n) + ext
+	}
+}
+
+// PlaceNew переносит файл src в path, если path еще не существует,
+// иначе возвращает ошибку fs.ErrExist.
+func PlaceNew(src, path string) (string, error) {
+	// Жесткая ссылка не перезаписывает существующий файл
+	err := os.Link(src, path)
+	if err == nil {
+		os.Remove(src)
+		return path, nil
+	}
+	if !errors.Is(err, os.ErrExist) {
+		// Файловая система без жестких ссылок
+		if _, statErr := os.Lstat(path); errors.Is(statErr, os.ErrNotExist) {
+			err = os.Rename(src, path)
+			if err != nil {
+				return "", err
+			}
+			return path, nil
+		}
+	}
+	return "", &os.PathError{Op: "place", Path: path, Err: os.ErrExist}
+}
+
+// PlaceUnique переносит файл src в path, а если path уже существует - в path
+// с суффиксом _1, _2 и т.д. Существующие файлы не перезаписываются.
+// Возвращает новый путь файла.
+func PlaceUnique(src, path string) (string, error) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for n := 1; ; n++ {
+		// Жесткая ссылка не перезаписывает существующий файл
+		err := os.Link(src, candidate)
+		if err == nil {
+			os.Remove(src)
+			return candidate, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			// Файловая система без жестких ссылок
+			if _, statErr := os.Lstat(candidate); errors.Is(statErr, os.ErrNotExist) {
+				err = os.Rename(src, candidate)
+				if err != nil {
+					return "", err
+				}
+				return candidate, nil
+			}
+		}
+		candidate = stem + "_" + strconv.Itoa(n) + ext
+	}
+}
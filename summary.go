@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Коды завершения команд once и process
+const (
+	// Все файлы обработаны или пропущены фильтрами
+	exitOK = 0
+	// Часть файлов не обработана: ошибка, отложенный повтор или прерывание
+	exitFailures = 1
+	// Ошибка конфигурации или аргументов: обработка не начиналась
+	exitConfig = 2
+)
+
+// Итоги обработки по отслеживаемой директории
+type watchSummary struct {
+	Name      string `json:"name,omitempty"`
+	SourceDir string `json:"source_dir"`
+	Processed int    `json:"processed"`
+	Failed    int    `json:"failed"`
+	Skipped   int    `json:"skipped"`
+	Deferred  int    `json:"deferred"`
+}
+
+// Итог команды once или process, выводимый в stdout
+type runSummary struct {
+	Status      string          `json:"status"`
+	ExitCode    int             `json:"exit_code"`
+	Duration    float64         `json:"duration_seconds"`
+	Processed   int64           `json:"processed"`
+	Failed      int64           `json:"failed"`
+	Skipped     int64           `json:"skipped"`
+	Deferred    int64           `json:"deferred"`
+	Queued      int             `json:"queued"`
+	Interrupted bool            `json:"interrupted,omitempty"`
+	Watches     []*watchSummary `json:"watches"`
+}
+
+// Счетчики итогов по директориям source
+type watchCounters struct {
+	mu      sync.Mutex
+	started time.Time
+	byDir   map[string]*watchSummary
+}
+
+var watchTotals = &watchCounters{started: time.Now(), byDir: make(map[string]*watchSummary)}
+
+// add учитывает итог обработки файла по его отслеживаемой директории
+func (c *watchCounters) add(filePath string, err error) {
+	w := watchFor(filePath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.get(w)
+	switch {
+	case errors.Is(err, errKept):
+	case errors.Is(err, errSkipped):
+		s.Skipped++
+	case errors.Is(err, errDeferred):
+		s.Deferred++
+	case err != nil:
+		s.Failed++
+	default:
+		s.Processed++
+	}
+}
+
+func (c *watchCounters) get(w Watch) *watchSummary {
+	s, ok := c.byDir[w.SourceDir]
+	if !ok {
+		s = &watchSummary{Name: w.Name, SourceDir: w.SourceDir}
+		c.byDir[w.SourceDir] = s
+	}
+	return s
+}
+
+// summarize возвращает итог запуска. queued - файлы, оставшиеся в очереди
+// после остановки, interrupted - запуск прерван сигналом.
+func summarize(queued int, interrupted bool) runSummary {
+	s := runSummary{
+		Status:      "ok",
+		ExitCode:    exitOK,
+		Duration:    time.Since(watchTotals.started).Seconds(),
+		Processed:   jobs.processed.Load(),
+		Failed:      jobs.failed.Load(),
+		Skipped:     jobs.skipped.Load(),
+		Deferred:    jobs.deferred.Load(),
+		Queued:      queued,
+		Interrupted: interrupted,
+	}
+	if s.Failed > 0 || s.Deferred > 0 || s.Queued > 0 || interrupted {
+		s.Status = "partial"
+		s.ExitCode = exitFailures
+	}
+
+	watchTotals.mu.Lock()
+	defer watchTotals.mu.Unlock()
+	// Директории без файлов тоже попадают в итог
+	for _, w := range allWatches() {
+		s.Watches = append(s.Watches, watchTotals.get(w))
+	}
+	return s
+}
+
+// writeSummary выводит итог запуска в JSON и возвращает код завершения
+func writeSummary(w io.Writer, queued int, interrupted bool) int {
+	s := summarize(queued, interrupted)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s)
+	return s.ExitCode
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"photoroom/photoroom"
+)
+
+// Клиент агентства со своим аккаунтом PhotoRoom: свои директории,
+// ключи API, параметры обработки, учет кредитов и отчеты. Позволяет
+// обслуживать несколько аккаунтов одним процессом.
+type Tenant struct {
+	// Директории и параметры, как у watches; name обязателен
+	Watch `yaml:",inline"`
+	// Ключи аккаунта клиента; стратегия смены ключей - key_strategy
+	APIKey  string   `yaml:"api_key"`
+	APIKeys []string `yaml:"api_keys"`
+	// Директория отчетов клиента, по умолчанию <report.dir>/<name>.
+	// Отчеты клиентов пишутся, только если задан report.dir.
+	ReportDir string `yaml:"report_dir"`
+}
+
+// Клиент API и остаток кредитов аккаунта клиента
+type tenantAccount struct {
+	client  *photoroom.Client
+	credits *creditTracker
+}
+
+var tenantAccounts = make(map[string]*tenantAccount)
+
+// setupTenants проверяет секцию tenants и добавляет директории клиентов
+// к watches. Вызывается из setupWatches до проверки watches.
+func setupTenants(c *Config) error {
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		if t.Name == "" {
+			return fmt.Errorf("tenants: не задано имя")
+		}
+		if t.APIKey == "" && len(t.APIKeys) == 0 {
+			return fmt.Errorf("tenants: %s: не задан api_key", t.Name)
+		}
+		if t.ReportDir == "" && c.Report.Dir != "" {
+			t.ReportDir = filepath.Join(c.Report.Dir, t.Name)
+		}
+		w := t.Watch
+		w.Tenant = t.Name
+		c.Watches = append(c.Watches, w)
+	}
+	return nil
+}
+
+// setupTenantAccounts создает клиенты API клиентов агентства. Временные
+// файлы ответов пишутся в processed_dir клиента.
+func setupTenantAccounts(c *Config) {
+	tenantAccounts = make(map[string]*tenantAccount)
+	for _, t := range c.Tenants {
+		cfg := *c
+		cfg.APIKey, cfg.APIKeys = t.APIKey, t.APIKeys
+		cfg.ProcessedDir = watchByName(c, t.Name).ProcessedDir
+		tenantAccounts[t.Name] = &tenantAccount{
+			client:  newAPIClient(&cfg),
+			credits: &creditTracker{tenant: t.Name},
+		}
+	}
+}
+
+// watchByName возвращает директорию из watches с именем name
+func watchByName(c *Config, name string) Watch {
+	for _, w := range c.Watches {
+		if w.Name == name {
+			return w
+		}
+	}
+	return Watch{}
+}
+
+type tenantKey struct{}
+
+// withTenant добавляет в контекст клиента агентства, к директории
+// которого относится файл
+func withTenant(ctx context.Context, filePath string) context.Context {
+	if tenant := watchFor(filePath).Tenant; tenant != "" {
+		return context.WithValue(ctx, tenantKey{}, tenant)
+	}
+	return ctx
+}
+
+// tenantAccountFor возвращает аккаунт клиента из контекста или nil
+func tenantAccountFor(ctx context.Context) *tenantAccount {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenantAccounts[tenant]
+}
+
+// apiClient возвращает клиент API аккаунта, на который относится запрос
+func apiClient(ctx context.Context) *photoroom.Client {
+	if a := tenantAccountFor(ctx); a != nil {
+		return a.client
+	}
+	return client
+}
+
+// creditsFor возвращает остаток кредитов аккаунта, на который относится запрос
+func creditsFor(ctx context.Context) *creditTracker {
+	if a := tenantAccountFor(ctx); a != nil {
+		return a.credits
+	}
+	return &credits
+}
+
+// tenantReportDir возвращает директорию отчетов клиента или пустую строку
+func tenantReportDir(name string) string {
+	for _, t := range config.Tenants {
+		if t.Name == name {
+			return t.ReportDir
+		}
+	}
+	return ""
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"photoroom/otlp"
+)
+
+// Трассировка обработки файлов в формате OpenTelemetry. Трасса файла:
+// file - от события вотчера до переноса исходника, внутри нее stable
+// (ожидание конца записи), queue (ожидание воркера), process, upload
+// (отправка запроса до заголовков ответа), download (чтение ответа),
+// write (сохранение результата) и move (перенос исходника).
+type Tracing struct {
+	// Адрес приема трасс по OTLP/HTTP, например
+	// http://localhost:4318/v1/traces; пусто - трассировка отключена
+	Endpoint string `yaml:"endpoint"`
+	// Заголовки запросов к коллектору, например авторизация
+	Headers map[string]string `yaml:"headers"`
+	// Имя сервиса в трассах
+	ServiceName string `yaml:"service_name"`
+	// Доля записываемых трасс от 0 до 1
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+var tracer *otlp.Tracer
+
+func validTracing(t Tracing) error {
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		return fmt.Errorf("sample_ratio должен быть от 0 до 1")
+	}
+	return nil
+}
+
+// setupTracing запускает отправку трасс, если задан адрес коллектора
+func setupTracing(t Tracing) {
+	if t.Endpoint == "" {
+		tracer = nil
+		return
+	}
+	tracer = otlp.NewTracer(otlp.Config{
+		Endpoint:    t.Endpoint,
+		Headers:     t.Headers,
+		ServiceName: t.ServiceName,
+		SampleRatio: t.SampleRatio,
+		HTTPClient:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		OnError: func(err error) {
+			slog.Warn("failed to export traces", "error", err)
+		},
+	})
+}
+
+// shutdownTracing отправляет оставшиеся спаны
+func shutdownTracing() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tracer.Shutdown(ctx)
+}
+
+// Время обнаружения файла и постановки в очередь: спаны ожидания
+// создаются задним числом, когда воркер берет файл
+type fileTimes struct {
+	detected time.Time
+	queued   time.Time
+}
+
+var (
+	fileTimesMu sync.Mutex
+	traceTimes  = make(map[string]*fileTimes)
+)
+
+// traceDetected запоминает время события вотчера о файле
+func traceDetected(filePath string, t time.Time) {
+	if tracer == nil {
+		return
+	}
+	fileTimesMu.Lock()
+	defer fileTimesMu.Unlock()
+	// Файл может быть уже в очереди по прежнему событию
+	if _, ok := traceTimes[absPath(filePath)]; !ok {
+		traceTimes[absPath(filePath)] = &fileTimes{detected: t}
+	}
+}
+
+// traceQueued запоминает время постановки файла в очередь
+func traceQueued(filePath string) {
+	if tracer == nil {
+		return
+	}
+	fileTimesMu.Lock()
+	defer fileTimesMu.Unlock()
+	key := absPath(filePath)
+	times := traceTimes[key]
+	if times == nil {
+		times = &fileTimes{}
+		traceTimes[key] = times
+	}
+	times.queued = time.Now()
+}
+
+// traceForget удаляет времена файла, который не попал в очередь
+func traceForget(filePath string) {
+	if tracer == nil {
+		return
+	}
+	fileTimesMu.Lock()
+	defer fileTimesMu.Unlock()
+	delete(traceTimes, absPath(filePath))
+}
+
+// startFileSpan начинает трассу файла, взятого воркером, со спанами
+// ожидания конца записи и ожидания в очереди
+func startFileSpan(ctx context.Context, filePath string) (context.Context, *otlp.Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	fileTimesMu.Lock()
+	times := traceTimes[absPath(filePath)]
+	delete(traceTimes, absPath(filePath))
+	fileTimesMu.Unlock()
+	if times == nil {
+		times = &fileTimes{}
+	}
+
+	w := watchFor(filePath)
+	attrs := []otlp.Attr{otlp.String("file.path", filePath), otlp.String("watch", w.Name)}
+	if w.Tenant != "" {
+		attrs = append(attrs, otlp.String("tenant", w.Tenant))
+	}
+	start := times.detected
+	if start.IsZero() {
+		start = times.queued
+	}
+	ctx, span := tracer.Start(ctx, "file", otlp.WithStartTime(start), otlp.WithAttributes(attrs...))
+
+	if !times.detected.IsZero() && !times.queued.IsZero() {
+		_, stable := tracer.Start(ctx, "stable", otlp.WithStartTime(times.detected))
+		stable.EndAt(times.queued)
+	}
+	if !times.queued.IsZero() {
+		_, queue := tracer.Start(ctx, "queue", otlp.WithStartTime(times.queued))
+		queue.End()
+	}
+	return ctx, span
+}
+
+// startSpan начинает спан этапа обработки, если файл трассируется
+func startSpan(ctx context.Context, name string, opts ...otlp.StartOption) (context.Context, *otlp.Span) {
+	if otlp.SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// endSpan завершает спан; пропуск и отложенный повтор ошибками не считаются
+func endSpan(span *otlp.Span, err error) {
+	if err != nil && !errors.Is(err, errSkipped) && !errors.Is(err, errDeferred) && !errors.Is(err, errKept) {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// tracedBody завершает спан download, когда ответ прочитан или закрыт
+type tracedBody struct {
+	io.ReadCloser
+	span *otlp.Span
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.span.End()
+	} else if err != nil {
+		b.span.SetError(err)
+		b.span.End()
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	b.span.End()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Преобразование исходников в форматах, которые API не принимает
+// (HEIC/HEIF с iPhone, RAW с камер), в JPEG перед отправкой.
+// Преобразует внешняя утилита: в стандартной библиотеке и x/image
+// нет декодеров HEIF и RAW.
+type Transcode struct {
+	// Ограничение времени одного преобразования; 0 - 2 минуты
+	Timeout time.Duration   `yaml:"timeout"`
+	Rules   []TranscodeRule `yaml:"rules"`
+}
+
+// Правило преобразования для группы расширений
+type TranscodeRule struct {
+	// Расширения исходников без точки, например [heic, heif]
+	Extensions []string `yaml:"extensions"`
+	// Команда и ее аргументы. В аргументах {input} заменяется путем
+	// к исходнику, {output} - путем к JPEG, который должна записать команда.
+	Command []string `yaml:"command"`
+}
+
+// transcodeRule возвращает правило для расширения файла или nil
+func transcodeRule(filePath string) *TranscodeRule {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filePath), "."))
+	if ext == "" {
+		return nil
+	}
+	for i, rule := range config.Transcode.Rules {
+		if slices.Contains(rule.Extensions, ext) {
+			return &config.Transcode.Rules[i]
+		}
+	}
+	return nil
+}
+
+type transcodedKey struct{}
+
+// uploadPath возвращает путь к файлу, который отправляется в API:
+// преобразованный JPEG или сам исходник
+func uploadPath(ctx context.Context, filePath string) string {
+	if path, ok := ctx.Value(transcodedKey{}).(string); ok {
+		return path
+	}
+	return filePath
+}
+
+// transcodeSource преобразует исходник во временной директории: в JPEG,
+// если для его расширения задано правило, TIFF, PSD и GIF - в PNG согласно
+// input_formats. Возвращает контекст, в котором uploadPath указывает
+// на результат, и функцию удаления временных файлов.
+func transcodeSource(ctx context.Context, filePath string) (context.Context, func(), error) {
+	rule := transcodeRule(filePath)
+	var format string
+	if rule == nil {
+		var err error
+		format, err = flattenFormat(filePath)
+		if err != nil || format == "" {
+			return ctx, func() {}, err
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "photoroom-transcode-")
+	if err != nil {
+		return ctx, func() {}, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	// Имя в форме запроса повторяет имя исходника с расширением результата
+	base := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	if rule != nil {
+		out := filepath.Join(dir, base+".jpg")
+		err = runTranscode(ctx, rule.Command, absPath(filePath), out)
+		if err != nil {
+			cleanup()
+			return ctx, func() {}, fmt.Errorf("не удалось преобразовать %s в JPEG: %w", filepath.Ext(filePath), err)
+		}
+		return context.WithValue(ctx, transcodedKey{}, out), cleanup, nil
+	}
+
+	flattened, err := flattenSource(ctx, filePath, format, filepath.Join(dir, base))
+	if err != nil {
+		cleanup()
+		return ctx, func() {}, fmt.Errorf("%w: не удалось свести %s в PNG: %v", errInvalidImage, strings.ToUpper(format), err)
+	}
+	slog.Debug("source flattened", "file", filePath, "format", format)
+	return flattened, cleanup, nil
+}
+
+func runTranscode(ctx context.Context, command []string, in, out string) error {
+	timeout := config.Transcode.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = strings.NewReplacer("{input}", in, "{output}", out).Replace(arg)
+	}
+
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		return fmt.Errorf("команда не записала результат: %w", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("команда записала пустой файл")
+	}
+	slog.Debug("source transcoded", "file", in, "command", command[0], "duration", time.Since(start))
+	return nil
+}
+
+// validTranscode проверяет секцию transcode при загрузке конфигурации
+func validTranscode(t *Transcode) error {
+	for i := range t.Rules {
+		rule := &t.Rules[i]
+		if len(rule.Extensions) == 0 {
+			return fmt.Errorf("не указаны расширения")
+		}
+		for j, ext := range rule.Extensions {
+			rule.Extensions[j] = strings.ToLower(strings.TrimPrefix(ext, "."))
+		}
+		if len(rule.Command) == 0 || rule.Command[0] == "" {
+			return fmt.Errorf("не указана команда для %s", strings.Join(rule.Extensions, ", "))
+		}
+		if !slices.ContainsFunc(rule.Command, func(arg string) bool { return strings.Contains(arg, "{output}") }) {
+			return fmt.Errorf("в команде для %s нет {output}", strings.Join(rule.Extensions, ", "))
+		}
+	}
+	return nil
+}
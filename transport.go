@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// Настройки исходящих HTTP-соединений: к API, S3 и вебхукам
+type HTTP struct {
+	// Прокси для всех запросов, например http://proxy.corp:3128.
+	// Если не задан, используются переменные HTTPS_PROXY, HTTP_PROXY и NO_PROXY.
+	ProxyURL string `yaml:"proxy_url"`
+	// Файл с дополнительными корневыми сертификатами в формате PEM
+	CACertFile string `yaml:"ca_cert_file"`
+	// Не проверять сертификат сервера; только для отладки
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+
+	// Пул соединений. Неактивных соединений с одним хостом по умолчанию
+	// хранится столько же, сколько воркеров.
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	HTTP2               bool          `yaml:"http2"`
+
+	// Выводить в лог запросы к API и ответы на них (флаг -debug-http)
+	Debug bool `yaml:"debug"`
+
+	// User-Agent и дополнительные заголовки запросов к API, например
+	// для авторизации на шлюзе или прокси перед API
+	UserAgent string            `yaml:"user_agent"`
+	Headers   map[string]string `yaml:"headers"`
+}
+
+// validHTTP проверяет имена и значения заголовков запросов к API
+func validHTTP(h HTTP) error {
+	for name, value := range h.Headers {
+		if name == "" || strings.ContainsFunc(name, func(r rune) bool {
+			return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+		}) {
+			return fmt.Errorf("недопустимое имя заголовка %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("значение заголовка %s содержит перевод строки", name)
+		}
+	}
+	if strings.ContainsAny(h.UserAgent, "\r\n") {
+		return fmt.Errorf("user_agent содержит перевод строки")
+	}
+	return nil
+}
+
+// Общий транспорт исходящих запросов. Соединения переиспользуются
+// всеми клиентами, поэтому он создается один раз при запуске.
+var transport *http.Transport
+
+// setupTransport создает общий транспорт по конфигурации
+func setupTransport(cfg *Config) error {
+	dialer := &net.Dialer{
+		Timeout:   cfg.Timeouts.Connect,
+		KeepAlive: 30 * time.Second,
+	}
+
+	perHost := cfg.HTTP.MaxIdleConnsPerHost
+	if perHost <= 0 {
+		// По одному соединению на воркер, но не больше, чем одновременных запросов
+		perHost = cfg.Workers
+		for _, w := range cfg.Watches {
+			perHost += w.Workers
+		}
+		if cfg.MaxConcurrentRequests > 0 {
+			perHost = min(perHost, cfg.MaxConcurrentRequests)
+		}
+	}
+	t := photoroom.NewTransport(photoroom.TransportOptions{
+		MaxIdleConns:        cfg.HTTP.MaxIdleConns,
+		MaxIdleConnsPerHost: perHost,
+		MaxConnsPerHost:     cfg.HTTP.MaxConnsPerHost,
+		IdleConnTimeout:     cfg.HTTP.IdleConnTimeout,
+		DisableHTTP2:        !cfg.HTTP.HTTP2,
+	})
+	t.DialContext = dialer.DialContext
+	if cfg.Timeouts.Connect > 0 {
+		t.TLSHandshakeTimeout = cfg.Timeouts.Connect
+	}
+
+	if cfg.HTTP.ProxyURL != "" {
+		proxy, err := url.Parse(cfg.HTTP.ProxyURL)
+		if err != nil || proxy.Host == "" {
+			return fmt.Errorf("неверный адрес прокси %q", cfg.HTTP.ProxyURL)
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.HTTP.InsecureSkipVerify}
+	if cfg.HTTP.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.HTTP.CACertFile)
+		if err != nil {
+			return fmt.Errorf("не удалось прочитать ca_cert_file: %w", err)
+		}
+		// Системные сертификаты дополняются, а не заменяются
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("в %s нет сертификатов в формате PEM", cfg.HTTP.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	t.TLSClientConfig = tlsConfig
+
+	transport = t
+	webhookClient.Transport = t
+	return nil
+}
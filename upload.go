@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"photoroom/s3"
+)
+
+// Настройки выгрузки результатов в S3-совместимое хранилище
+type S3Output struct {
+	s3.Config `yaml:",inline"`
+	// Префикс ключей, например "photos/processed/"
+	Prefix string `yaml:"prefix"`
+	// Оставлять копию результата в processed
+	KeepLocal bool `yaml:"keep_local"`
+}
+
+// Клиент хранилища для выгрузки результатов; nil, если выгрузка выключена
+var uploader *s3.Client
+
+func setupUploader(cfg S3Output) error {
+	if cfg.Bucket == "" {
+		return nil
+	}
+
+	var err error
+	uploader, err = s3.New(cfg.Config, &http.Client{Transport: transport})
+	return err
+}
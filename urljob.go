@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Как обрабатывать изображения по адресу из манифеста и очереди заданий
+const (
+	// Скачивать изображение в source и отправлять в API как файл
+	imageURLsDownload = "download"
+	// Передавать в API только адрес (imageUrl): изображение не скачивается
+	imageURLsDirect = "direct"
+)
+
+func validImageURLs(mode string) error {
+	switch mode {
+	case "", imageURLsDownload, imageURLsDirect:
+		return nil
+	}
+	return fmt.Errorf("неизвестный режим image_urls %q, ожидается %s или %s", mode, imageURLsDownload, imageURLsDirect)
+}
+
+// directURLs сообщает, что изображения по адресу передаются в API без скачивания
+func directURLs() bool {
+	return config.ImageURLs == imageURLsDirect
+}
+
+// Задание с изображением по адресу - файл <имя>.url в source с адресом
+// внутри. Он проходит обычный путь файла (очередь, sidecar, перенос
+// в destination, отчеты), но в API передается только адрес.
+const urlJobExt = ".url"
+
+// isURLJob сообщает, что файл - задание с изображением по адресу.
+// Такие файлы обрабатываются только при image_urls: direct.
+func isURLJob(filePath string) bool {
+	return directURLs() && strings.EqualFold(filepath.Ext(filePath), urlJobExt)
+}
+
+// urlJobName возвращает имя файла задания для изображения name
+func urlJobName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + urlJobExt
+}
+
+// readURLJob возвращает адрес изображения из файла задания
+func readURLJob(filePath string) (string, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	imageURL := strings.TrimSpace(string(data))
+	if !isURL(imageURL) {
+		return "", errors.New("в файле задания нет адреса http(s) изображения")
+	}
+	return imageURL, nil
+}
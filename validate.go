@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+var (
+	// errInvalidImage - файл не подходит для отправки в API
+	errInvalidImage = errors.New("недопустимое изображение")
+	// errCorruptOutput - результат API не удалось декодировать
+	errCorruptOutput = errors.New("поврежденный результат")
+)
+
+// Проверка изображения перед отправкой в API. Заголовок изображения
+// читается локально, чтобы поврежденные и неподдерживаемые файлы
+// отклонялись с понятной ошибкой, а не ответом API 400.
+type Validate struct {
+	Enabled bool `yaml:"enabled"`
+	// Допустимые форматы: jpeg, png, webp
+	Formats []string `yaml:"formats"`
+	// Минимальный размер меньшей стороны в пикселях; 0 - без ограничения
+	MinDimension int `yaml:"min_dimension"`
+	// Максимальный размер большей стороны в пикселях; 0 - без ограничения.
+	// Не проверяется, если изображение уменьшается в preprocess.
+	MaxDimension int `yaml:"max_dimension"`
+	// Максимальное число пикселей; 0 - без ограничения
+	MaxPixels int `yaml:"max_pixels"`
+	// Декодировать результат API целиком перед сохранением;
+	// действует независимо от enabled
+	Output bool `yaml:"output"`
+}
+
+// validateImage проверяет формат и размеры изображения по его заголовку
+func validateImage(filePath string, cfg Validate) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return checkImage(file, cfg)
+}
+
+// checkImage проверяет формат и размеры изображения, читая его заголовок из r
+func checkImage(r io.Reader, cfg Validate) error {
+	ic, format, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return fmt.Errorf("%w: неизвестный формат", errInvalidImage)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: не удалось прочитать заголовок: %v", errInvalidImage, err)
+	}
+	if len(cfg.Formats) > 0 && !slices.Contains(cfg.Formats, format) {
+		return fmt.Errorf("%w: формат %s не поддерживается", errInvalidImage, format)
+	}
+	if ic.Width <= 0 || ic.Height <= 0 {
+		return fmt.Errorf("%w: размер %dx%d", errInvalidImage, ic.Width, ic.Height)
+	}
+
+	if cfg.MinDimension > 0 && min(ic.Width, ic.Height) < cfg.MinDimension {
+		return fmt.Errorf("%w: размер %dx%d меньше минимального %d", errInvalidImage, ic.Width, ic.Height, cfg.MinDimension)
+	}
+	// Слишком большое изображение будет уменьшено перед отправкой
+	if config.Preprocess.MaxDimension > 0 {
+		return nil
+	}
+	if cfg.MaxDimension > 0 && max(ic.Width, ic.Height) > cfg.MaxDimension {
+		return fmt.Errorf("%w: размер %dx%d больше максимального %d", errInvalidImage, ic.Width, ic.Height, cfg.MaxDimension)
+	}
+	if cfg.MaxPixels > 0 && ic.Width*ic.Height > cfg.MaxPixels {
+		return fmt.Errorf("%w: %d пикселей, максимум %d", errInvalidImage, ic.Width*ic.Height, cfg.MaxPixels)
+	}
+	return nil
+}
+
+// keepCorruptOutput переносит поврежденный результат path в failed
+// рядом с исходником как <имя исходника>.output<ext>
+func keepCorruptOutput(filePath, path, ext string) {
+	failedDir := watchFor(filePath).FailedDir
+	if failedDir == "" {
+		return
+	}
+
+	target := filepath.Join(failedDir, relPath(filePath)) + ".output" + ext
+	err := os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err == nil {
+		err = renameFile(path, target)
+	}
+	if err != nil {
+		slog.Warn("failed to keep corrupt output", "file", filePath, "error", err)
+		return
+	}
+	slog.Info("corrupt output kept", "file", filePath, "output", target)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Набор параметров для A/B-сравнения: каждый исходный файл
+// обрабатывается отдельно с каждым набором из секции variants
+type Variant struct {
+	// Имя набора, добавляется к имени результата: photo_v1.png.
+	// По умолчанию v1, v2 и т.д. по порядку в секции.
+	Name string `yaml:"name"`
+	// Параметры, дополняющие профиль файла
+	Overrides Profile `yaml:",inline"`
+}
+
+// setupVariants задает имена наборов по умолчанию и проверяет их
+func setupVariants(variants []Variant) error {
+	names := make(map[string]bool)
+	for i := range variants {
+		v := &variants[i]
+		if v.Name == "" {
+			v.Name = "v" + strconv.Itoa(i+1)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("набор %q указан дважды", v.Name)
+		}
+		names[v.Name] = true
+
+		if strings.ContainsAny(v.Name, `/\`) {
+			return fmt.Errorf("недопустимое имя набора %q", v.Name)
+		}
+		if err := validMode(v.Overrides.Mode); err != nil {
+			return fmt.Errorf("набор %s: %w", v.Name, err)
+		}
+		if err := validPrompts(v.Overrides); err != nil {
+			return fmt.Errorf("набор %s: %w", v.Name, err)
+		}
+		if err := validEditParams(v.Overrides); err != nil {
+			return fmt.Errorf("набор %s: %w", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// Параметры обработки файла с одним набором из variants
+type variantProfile struct {
+	// Имя набора; пустое, если секция variants не задана
+	name string
+	Profile
+}
+
+// applyVariants возвращает параметры файла для каждого набора из variants
+// или единственный набор с параметрами профиля
+func applyVariants(profile Profile) []variantProfile {
+	if len(config.Variants) == 0 {
+		return []variantProfile{{Profile: profile}}
+	}
+
+	variants := make([]variantProfile, 0, len(config.Variants))
+	for _, v := range config.Variants {
+		variants = append(variants, variantProfile{name: v.Name, Profile: profile.merge(v.Overrides)})
+	}
+	return variants
+}
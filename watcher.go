@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Способы отслеживания новых файлов
+const (
+	watchFSNotify = "fsnotify"
+	watchPoll     = "poll"
+	watchHybrid   = "hybrid"
+)
+
+func validWatchMode(mode string) error {
+	switch mode {
+	case "", watchFSNotify, watchPoll, watchHybrid:
+		return nil
+	}
+	return fmt.Errorf("неизвестный watch_mode %q, ожидается %s, %s или %s", mode, watchFSNotify, watchPoll, watchHybrid)
+}
+
+// dirWatcher следит за source до отмены ctx: по событиям файловой системы,
+// периодическим сканированием или обоими способами
+func dirWatcher(ctx context.Context) {
+	switch config.WatchMode {
+	case watchPoll:
+		health.watcherStarted.Store(true)
+		health.watcherAlive.Store(true)
+		defer health.watcherAlive.Store(false)
+		pollSource(ctx, config.PollInterval, rescans)
+		return
+	case watchHybrid:
+		go pollSource(ctx, config.PollInterval, nil)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fatal("failed to create watcher", "error", err)
+	}
+	defer watcher.Close()
+
+	health.watcherStarted.Store(true)
+	health.watcherAlive.Store(true)
+	go func() {
+		defer health.watcherAlive.Store(false)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					filePath := event.Name
+					if isDirectory(filePath) {
+						// Новая поддиректория: подписываемся на нее и забираем
+						// файлы, успевшие появиться до подписки
+						go watchTree(watcher, filePath)
+						continue
+					}
+
+					if !accepted(filePath) {
+						continue
+					}
+
+					// Ждем, пока файл допишется, не блокируя обработку событий
+					go enqueueWhenStable(ctx, filePath)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("watcher error", "error", err)
+			}
+		}
+	}()
+
+	// Подписываемся на все поддиректории и ставим в очередь файлы,
+	// появившиеся до запуска. Дубли с событиями вотчера отсечет очередь.
+	for _, w := range allWatches() {
+		err = watchTree(watcher, w.SourceDir)
+		if err != nil && ctx.Err() == nil {
+			fatal("failed to watch source directory", "dir", w.SourceDir, "error", err)
+		}
+	}
+
+	// В режиме hybrid директории без подписки и так сканируются
+	if config.WatchMode != watchHybrid {
+		go pollFallbackDirs(ctx)
+	}
+	// Обход может ждать места в очереди, а она освобождается только
+	// после выхода из dirWatcher
+	go rescanWatches(ctx, watcher)
+	<-ctx.Done()
+}
+
+// Запросы повторного обхода source (SIGHUP, POST /rescan)
+var rescans = make(chan struct{}, 1)
+
+// requestRescan запрашивает полный обход source. Запросы, пришедшие,
+// пока обход еще не начался, объединяются в один.
+func requestRescan() {
+	select {
+	case rescans <- struct{}{}:
+	default:
+	}
+}
+
+// rescanWatches до отмены ctx обходит source по запросам requestRescan:
+// заново подписывается на поддиректории (например, после того как вотчер
+// потерял подписки из-за лимита inotify) и ставит в очередь найденные файлы,
+// в том числе восстановленные из резервной копии без событий вотчера
+func rescanWatches(ctx context.Context, watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rescans:
+		}
+
+		slog.Info("rescanning source directories")
+		// Лимит подписок мог быть поднят
+		watchFallback.reset()
+		for _, w := range allWatches() {
+			if ctx.Err() != nil {
+				return
+			}
+			err := watchTree(watcher, w.SourceDir)
+			if err != nil && ctx.Err() == nil {
+				// Подписаться не удалось, но файлы все равно забираем
+				watchTree(nil, w.SourceDir)
+			}
+		}
+	}
+}
+
+// watchTree добавляет root и все его поддиректории в вотчер
+// и ставит в очередь найденные в них файлы. Если watcher равен nil,
+// файлы только ставятся в очередь.
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	var wd fs.WalkDirFunc = func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if watcher == nil || watchFallback.contains(absPath(path)) {
+				return nil
+			}
+			err := watcher.Add(path)
+			if isWatchLimit(err) {
+				// Файлы директории по-прежнему ставятся в очередь,
+				// а новые будут найдены сканированием
+				watchFallback.add(absPath(path), err)
+				return nil
+			}
+			return err
+		}
+		if !accepted(path) {
+			return nil
+		}
+
+		if !jobs.enqueue(path) {
+			return filepath.SkipAll
+		}
+
+		return nil
+	}
+
+	err := filepath.WalkDir(root, wd)
+	if err != nil {
+		slog.Error("failed to scan directory", "dir", root, "error", err)
+	}
+	return err
+}
+
+// enqueueWhenStable ставит файл в очередь, когда он перестанет изменяться.
+// При заполненной очереди ждет места: в режиме fsnotify о пропущенном
+// файле больше никто не напомнит.
+func enqueueWhenStable(ctx context.Context, filePath string) {
+	traceDetected(filePath, time.Now())
+	err := waitStable(ctx, filePath, config.Stability)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("file is not ready", "file", filePath, "error", err)
+		}
+		if !jobs.isQueued(filePath) {
+			traceForget(filePath)
+		}
+		return
+	}
+	jobs.enqueue(filePath)
+}
+
+// pollSource периодически сканирует source до отмены ctx, а также по каждому
+// запросу из rescan. На сетевых файловых системах (NFS, SMB) события
+// fsnotify приходят не всегда.
+func pollSource(ctx context.Context, interval time.Duration, rescan <-chan struct{}) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	// Файлы, для которых уже ждем окончания записи
+	var waiting sync.Map
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		scanSource(ctx, &waiting)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-rescan:
+			slog.Info("rescanning source directories")
+		}
+	}
+}
+
+// scanSource ставит в очередь новые файлы из отслеживаемых директорий
+// по мере их готовности
+func scanSource(ctx context.Context, waiting *sync.Map) {
+	for _, w := range allWatches() {
+		scanDir(ctx, w.SourceDir, waiting)
+	}
+}
+
+func scanDir(ctx context.Context, dir string, waiting *sync.Map) {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		// Файл мог исчезнуть во время обхода
+		if err != nil || d.IsDir() || !accepted(path) || jobs.isQueued(path) {
+			return nil
+		}
+
+		key := absPath(path)
+		if _, loaded := waiting.LoadOrStore(key, struct{}{}); loaded {
+			return nil
+		}
+		go func() {
+			defer waiting.Delete(key)
+			enqueueWhenStable(ctx, path)
+		}()
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to scan directory", "dir", dir, "error", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Отслеживаемая директория со своими выходными директориями и параметрами
+// обработки. Позволяет обслуживать несколько директорий одним процессом.
+type Watch struct {
+	// Имя, по умолчанию - имя директории source_dir
+	Name      string `yaml:"name"`
+	SourceDir string `yaml:"source_dir"`
+	// Выходные директории, по умолчанию - поддиректории <имя>
+	// в соответствующих директориях верхнего уровня
+	DestDir      string `yaml:"destination_dir"`
+	ProcessedDir string `yaml:"processed_dir"`
+	FailedDir    string `yaml:"failed_dir"`
+	// Директории на сервере FTP или SFTP: откуда забирать исходные файлы
+	// в source_dir и куда выгружать результаты
+	RemoteInput  Remote `yaml:"remote_input"`
+	RemoteOutput Remote `yaml:"remote_output"`
+	// Файлы директории обрабатываются раньше файлов других директорий
+	HighPriority bool `yaml:"high_priority"`
+	// Свои воркеры для файлов директории; 0 - общие воркеры workers
+	Workers int `yaml:"workers"`
+	// Профиль для файлов директории; поддиректории и sidecar-файлы
+	// могут указать другой
+	Profile string `yaml:"profile"`
+	// Параметры, дополняющие профиль
+	Overrides Profile `yaml:",inline"`
+	// Клиент агентства из секции tenants, которому принадлежит директория
+	Tenant string `yaml:"-"`
+}
+
+// setupWatches проверяет секцию watches и заполняет
+// незаданные директории значениями по умолчанию
+func setupWatches(c *Config) error {
+	err := setupTenants(c)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i := range c.Watches {
+		w := &c.Watches[i]
+		if w.SourceDir == "" {
+			return fmt.Errorf("watches: не задан source_dir")
+		}
+		if w.Name == "" {
+			w.Name = filepath.Base(filepath.Clean(w.SourceDir))
+		}
+		if names[w.Name] {
+			return fmt.Errorf("watches: имя %s используется дважды", w.Name)
+		}
+		names[w.Name] = true
+
+		if w.DestDir == "" {
+			w.DestDir = filepath.Join(c.DestDir, w.Name)
+		}
+		if w.ProcessedDir == "" {
+			w.ProcessedDir = filepath.Join(c.ProcessedDir, w.Name)
+		}
+		if w.FailedDir == "" && c.FailedDir != "" {
+			w.FailedDir = filepath.Join(c.FailedDir, w.Name)
+		}
+
+		if w.Workers < 0 {
+			return fmt.Errorf("watches: %s: workers не может быть отрицательным", w.Name)
+		}
+		if w.Profile != "" {
+			if _, ok := c.Profiles[w.Profile]; !ok {
+				return fmt.Errorf("watches: %s: неизвестный профиль %s", w.Name, w.Profile)
+			}
+		}
+		if err := validMode(w.Overrides.Mode); err != nil {
+			return fmt.Errorf("watches: %s: %w", w.Name, err)
+		}
+		if err := validPrompts(w.Overrides); err != nil {
+			return fmt.Errorf("watches: %s: %w", w.Name, err)
+		}
+		if err := validEditParams(w.Overrides); err != nil {
+			return fmt.Errorf("watches: %s: %w", w.Name, err)
+		}
+		if err := validRemote(w.RemoteInput); err != nil {
+			return fmt.Errorf("watches: %s: remote_input: %w", w.Name, err)
+		}
+		if err := validRemote(w.RemoteOutput); err != nil {
+			return fmt.Errorf("watches: %s: remote_output: %w", w.Name, err)
+		}
+	}
+	return nil
+}
+
+// allWatches возвращает все отслеживаемые директории:
+// source_dir верхнего уровня и директории из секции watches
+func allWatches() []Watch {
+	main := Watch{
+		SourceDir:    config.SourceDir,
+		DestDir:      config.DestDir,
+		ProcessedDir: config.ProcessedDir,
+		FailedDir:    config.FailedDir,
+		RemoteInput:  config.RemoteInput,
+		RemoteOutput: config.RemoteOutput,
+	}
+	return append([]Watch{main}, config.Watches...)
+}
+
+// watchFor возвращает отслеживаемую директорию, в которой лежит файл.
+// Для вложенных директорий выбирается самая глубокая. Файлы вне
+// отслеживаемых директорий относятся к source_dir верхнего уровня.
+func watchFor(filePath string) Watch {
+	watches := allWatches()
+	best, bestLen := watches[0], -1
+	for _, w := range watches {
+		root := absPath(w.SourceDir)
+		rel, err := filepath.Rel(root, absPath(filePath))
+		if err == nil && filepath.IsLocal(rel) && len(root) > bestLen {
+			best, bestLen = w, len(root)
+		}
+	}
+	return best
+}
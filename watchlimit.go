@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Директории, на которые вотчер не смог подписаться из-за лимита подписок
+// (fs.inotify.max_user_watches в Linux). Они вместе с поддиректориями
+// сканируются периодически, как при watch_mode: poll.
+type pollFallback struct {
+	mu   sync.Mutex
+	dirs []string
+	// Подсказка, как поднять лимит, пишется в лог один раз
+	hinted bool
+}
+
+var watchFallback = &pollFallback{}
+
+// add переводит dir на периодическое сканирование
+func (f *pollFallback) add(dir string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.covers(dir) {
+		return
+	}
+	f.dirs = append(f.dirs, dir)
+
+	slog.Warn("watch limit reached, directory will be polled", "dir", dir, "interval", fallbackInterval(), "error", err)
+	if !f.hinted {
+		f.hinted = true
+		slog.Warn("raise the watch limit to get events for all directories: " + watchLimitHint())
+	}
+}
+
+// contains сообщает, что dir уже сканируется периодически
+func (f *pollFallback) contains(dir string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.covers(dir)
+}
+
+func (f *pollFallback) covers(dir string) bool {
+	return slices.ContainsFunc(f.dirs, func(root string) bool {
+		return dir == root || strings.HasPrefix(dir, root+string(filepath.Separator))
+	})
+}
+
+func (f *pollFallback) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.dirs)
+}
+
+func (f *pollFallback) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.dirs)
+}
+
+// reset снова пробует подписаться на все директории при следующем обходе
+func (f *pollFallback) reset() {
+	f.mu.Lock()
+	f.dirs = nil
+	f.mu.Unlock()
+}
+
+// fallbackInterval возвращает интервал сканирования директорий без подписки
+func fallbackInterval() time.Duration {
+	if config.PollInterval > 0 {
+		return config.PollInterval
+	}
+	return 30 * time.Second
+}
+
+// pollFallbackDirs до отмены ctx сканирует директории, на которые
+// не удалось подписаться
+func pollFallbackDirs(ctx context.Context) {
+	var waiting sync.Map
+
+	ticker := time.NewTicker(fallbackInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, dir := range watchFallback.list() {
+			scanDir(ctx, dir, &waiting)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const maxUserWatches = "/proc/sys/fs/inotify/max_user_watches"
+
+// isWatchLimit сообщает, что подписка не удалась из-за лимита inotify
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+func watchLimitHint() string {
+	current := "unknown"
+	if data, err := os.ReadFile(maxUserWatches); err == nil {
+		current = strings.TrimSpace(string(data))
+	}
+	return fmt.Sprintf("fs.inotify.max_user_watches is %s; run "+
+		"'sudo sysctl fs.inotify.max_user_watches=524288' and add the same setting "+
+		"to /etc/sysctl.d/99-inotify.conf to keep it after reboot, then send SIGHUP "+
+		"or POST /rescan to subscribe again", current)
+}
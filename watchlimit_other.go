@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+// isWatchLimit: лимит подписок inotify есть только в Linux
+func isWatchLimit(err error) bool {
+	return false
+}
+
+func watchLimitHint() string {
+	return ""
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"photoroom/photoroom"
+)
+
+// События, о которых сообщают вебхуки
+const (
+	eventCompleted = "completed"
+	eventFailed    = "failed"
+)
+
+// Настройки вебхука
+type Webhook struct {
+	URL string `yaml:"url"`
+	// Ключ для подписи тела запроса (HMAC-SHA256) в заголовке X-Signature-256
+	Secret string `yaml:"secret"`
+	// События, на которые отправляется вебхук; пусто - все
+	Events []string `yaml:"events"`
+	// Заголовки ответа API, передаваемые в поле api_headers.
+	// Пусто - все заголовки X-*.
+	Headers []string `yaml:"headers"`
+}
+
+// Событие обработки файла: тело запроса вебхука и входные данные хуков
+type eventPayload struct {
+	Event      string            `json:"event"`
+	JobID      string            `json:"job_id,omitempty"`
+	File       string            `json:"file"`
+	Output     string            `json:"output,omitempty"`
+	Outputs    []string          `json:"outputs,omitempty"`
+	Profile    string            `json:"profile,omitempty"`
+	Duration   float64           `json:"duration_seconds"`
+	Error      string            `json:"error,omitempty"`
+	StatusCode int               `json:"status_code,omitempty"`
+	APIHeaders map[string]string `json:"api_headers,omitempty"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// Число попыток доставки вебхука
+const webhookAttempts = 3
+
+var (
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+	// Отправляемые вебхуки, которые нужно дождаться при остановке
+	webhooksWG sync.WaitGroup
+)
+
+// notify отправляет вебхуки о результате обработки файла в фоне
+func notify(filePath string, res outcome, duration time.Duration, cause error) {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+
+	payload, header := newEvent(filePath, res, duration, cause)
+	for _, hook := range config.Webhooks {
+		if len(hook.Events) > 0 && !slices.Contains(hook.Events, payload.Event) {
+			continue
+		}
+
+		p := payload
+		p.APIHeaders = pickHeaders(header, hook.Headers)
+		body, err := json.Marshal(p)
+		if err != nil {
+			slog.Error("failed to encode webhook payload", "error", err)
+			return
+		}
+
+		webhooksWG.Add(1)
+		go func() {
+			defer webhooksWG.Done()
+			err := deliverWebhook(hook, body)
+			if err != nil {
+				slog.Error("webhook delivery failed", "url", hook.URL, "event", p.Event, "file", p.File, "error", err)
+			}
+		}()
+	}
+}
+
+// newEvent описывает итог обработки файла и возвращает заголовки
+// ответа API, из которых выбираются api_headers
+func newEvent(filePath string, res outcome, duration time.Duration, cause error) (eventPayload, http.Header) {
+	payload := eventPayload{
+		Event:     eventCompleted,
+		JobID:     res.JobID,
+		File:      relPath(filePath),
+		Output:    res.Location,
+		Outputs:   res.Outputs,
+		Profile:   res.Profile,
+		Duration:  duration.Seconds(),
+		Timestamp: time.Now(),
+	}
+	header := res.Header
+	if cause != nil {
+		payload.Event = eventFailed
+		payload.Error = cause.Error()
+		var apiErr *photoroom.APIError
+		if errors.As(cause, &apiErr) {
+			payload.StatusCode = apiErr.StatusCode
+			header = apiErr.Header
+		}
+	}
+	return payload, header
+}
+
+// waitWebhooks дожидается отправки вебхуков, но не дольше timeout
+func waitWebhooks(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		webhooksWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("webhook delivery timeout exceeded")
+	}
+}
+
+// pickHeaders выбирает заголовки ответа API для вебхука
+func pickHeaders(header http.Header, names []string) map[string]string {
+	values := make(map[string]string)
+	if len(names) == 0 {
+		for name := range header {
+			if strings.HasPrefix(name, "X-") {
+				values[strings.ToLower(name)] = header.Get(name)
+			}
+		}
+	}
+	for _, name := range names {
+		if v := header.Get(name); v != "" {
+			values[strings.ToLower(name)] = v
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// deliverWebhook отправляет тело на адрес вебхука,
+// повторяя запрос при сетевых ошибках и ответах 5xx
+func deliverWebhook(hook Webhook, body []byte) error {
+	var err error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		var retry bool
+		retry, err = postWebhook(hook, body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func postWebhook(hook Webhook, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return res.StatusCode >= 500, fmt.Errorf("вебхук вернул код %d", res.StatusCode)
+	}
+	return false, nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"photoroom/otlp"
+	"photoroom/photoroom"
+)
+
+// Пул воркеров, обрабатывающих файлы из ограниченных очередей.
+// Директории из watches со своим числом воркеров получают отдельные
+// очереди, остальные файлы стоят в общей.
+type pool struct {
+	// Очереди по имени отслеживаемой директории; "" - общая
+	lanes map[string]*lane
+	quit  chan struct{}
+	wg    sync.WaitGroup
+
+	// Контекст текущих загрузок, отменяется при остановке по таймауту
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Файлы, которые стоят в очереди или обрабатываются, по пути
+	// и по идентификатору файла
+	mu      sync.Mutex
+	queued  map[string]fileID
+	ids     map[fileID]string
+	pending sync.WaitGroup
+
+	// Всего файлов, поставленных в очередь
+	total     atomic.Int64
+	processed atomic.Int64
+	failed    atomic.Int64
+	skipped   atomic.Int64
+	deferred  atomic.Int64
+}
+
+// Очередь со своими воркерами. Срочные файлы стоят в отдельной
+// очереди и берутся в первую очередь.
+type lane struct {
+	jobs   chan string
+	urgent chan string
+}
+
+func newPool(workers, queueSize int, watches []Watch) *pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pool{
+		ctx:    ctx,
+		cancel: cancel,
+		lanes:  make(map[string]*lane),
+		quit:   make(chan struct{}),
+		queued: make(map[string]fileID),
+		ids:    make(map[fileID]string),
+	}
+	p.addLane("", workers, queueSize)
+	for _, w := range watches {
+		if w.Workers > 0 {
+			p.addLane(w.Name, w.Workers, queueSize)
+		}
+	}
+	return p
+}
+
+func (p *pool) addLane(name string, workers, queueSize int) {
+	l := &lane{
+		jobs:   make(chan string, queueSize),
+		urgent: make(chan string, queueSize),
+	}
+	p.lanes[name] = l
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.worker(l)
+	}
+}
+
+func (p *pool) worker(l *lane) {
+	defer p.wg.Done()
+	for {
+		// После остановки новые файлы из очереди не берем
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+		// Пока прием приостановлен, файлы остаются в очереди
+		if !intake.wait(p.quit) {
+			return
+		}
+
+		var filePath string
+		select {
+		case filePath = <-l.urgent:
+		default:
+			select {
+			case <-p.quit:
+				return
+			case filePath = <-l.urgent:
+			case filePath = <-l.jobs:
+			}
+		}
+		// Прием мог быть приостановлен, пока воркер ждал файл
+		if !intake.wait(p.quit) {
+			p.release(filePath)
+			return
+		}
+		ctx, span := startFileSpan(p.ctx, filePath)
+		err := handleFile(ctx, filePath)
+		endSpan(span, err)
+		watchTotals.add(filePath, err)
+		switch {
+		case errors.Is(err, errKept):
+		case errors.Is(err, errSkipped):
+			p.skipped.Add(1)
+			metricFilesSkipped.inc("")
+		case errors.Is(err, errDeferred):
+			p.deferred.Add(1)
+		case err != nil:
+			p.failed.Add(1)
+			metricFilesFailed.inc(failureStatus(err))
+		default:
+			p.processed.Add(1)
+			metricFilesProcessed.inc("")
+		}
+		p.release(filePath)
+	}
+}
+
+// queue возвращает очередь для файла: срочную или обычную
+// в очереди его отслеживаемой директории или в общей
+func (p *pool) queue(filePath string) chan string {
+	l, ok := p.lanes[watchFor(filePath).Name]
+	if !ok {
+		l = p.lanes[""]
+	}
+	if isUrgent(filePath) {
+		return l.urgent
+	}
+	return l.jobs
+}
+
+// active возвращает число файлов в очереди и в обработке
+func (p *pool) active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queued)
+}
+
+// depth возвращает число файлов во всех очередях
+func (p *pool) depth() int {
+	n := 0
+	for _, l := range p.lanes {
+		n += len(l.jobs) + len(l.urgent)
+	}
+	return n
+}
+
+// enqueue ставит файл в очередь, ожидая свободного места.
+// Файл, который уже в очереди или в обработке, повторно не добавляется.
+// Возвращает false, если пул остановлен.
+func (p *pool) enqueue(filePath string) bool {
+	if !p.claim(filePath) {
+		return true
+	}
+	// Запись отмечается до отправки: иначе воркер может обработать файл
+	// раньше, и отметка вернет или создаст запись о нем заново
+	prev, ok := states.get(filePath)
+	states.markPending(filePath)
+	select {
+	case p.queue(filePath) <- filePath:
+		return true
+	case <-p.quit:
+		states.restore(filePath, prev, ok)
+		p.release(filePath)
+		return false
+	}
+}
+
+// tryEnqueue ставит файл в очередь без ожидания.
+// Возвращает false, если очередь заполнена или пул остановлен.
+func (p *pool) tryEnqueue(filePath string) bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+	}
+
+	if !p.claim(filePath) {
+		return true
+	}
+	prev, ok := states.get(filePath)
+	states.markPending(filePath)
+	select {
+	case p.queue(filePath) <- filePath:
+		return true
+	default:
+		states.restore(filePath, prev, ok)
+		p.release(filePath)
+		return false
+	}
+}
+
+// claim отмечает файл как поставленный в очередь. Возвращает false, если
+// он уже был отмечен по тому же пути или под другим путем: fsnotify может
+// сообщить о файле несколько раз, в том числе после его переименования.
+func (p *pool) claim(filePath string) bool {
+	key := absPath(filePath)
+	id, hasID := fileIdentity(filePath)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.queued[key]; ok {
+		return false
+	}
+	if other, ok := p.ids[id]; hasID && ok {
+		slog.Debug("file already queued under another path", "file", filePath, "queued", other)
+		return false
+	}
+	p.queued[key] = id
+	if hasID {
+		p.ids[id] = key
+	}
+	p.pending.Add(1)
+	p.total.Add(1)
+	traceQueued(filePath)
+	return true
+}
+
+// isQueued сообщает, стоит ли файл в очереди или обрабатывается
+func (p *pool) isQueued(filePath string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.queued[absPath(filePath)]
+	return ok
+}
+
+func (p *pool) release(filePath string) {
+	key := absPath(filePath)
+	scans.release(key)
+	traceForget(filePath)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id, ok := p.queued[key]; ok {
+		delete(p.queued, key)
+		if p.ids[id] == key {
+			delete(p.ids, id)
+		}
+		p.pending.Done()
+	}
+}
+
+// wait ждет, пока все поставленные в очередь файлы будут обработаны
+func (p *pool) wait() {
+	p.pending.Wait()
+}
+
+// stop прекращает прием файлов, дожидается завершения текущих загрузок
+// и возвращает число файлов, оставшихся в очереди. Они остаются в source
+// и будут обработаны при следующем запуске. Загрузки, не успевшие
+// завершиться за timeout, отменяются; 0 - ждать без ограничения.
+func (p *pool) stop(timeout time.Duration) int {
+	close(p.quit)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	if timeout > 0 {
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			slog.Warn("shutdown timeout exceeded, cancelling in-flight uploads")
+			p.cancel()
+		}
+	}
+	<-done
+	p.cancel()
+
+	return p.depth()
+}
+
+func handleFile(ctx context.Context, filePath string) error {
+	// Файл мог быть уже обработан по другому событию
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	st, ok := states.get(filePath)
+	// Результат уже сохранен, но до переноса исходника дело не дошло
+	if ok && st.Status == statusDone {
+		slog.Info("file already processed, finishing move", "file", filePath, "output", st.Output)
+		archiveSource(filePath)
+		return nil
+	}
+	if ok && keptUnchanged(filePath, st) {
+		slog.Debug("file already processed and kept in source", "file", filePath)
+		return errKept
+	}
+	if ok && retryPending(st) {
+		slog.Debug("file waiting for retry", "file", filePath, "retry_at", st.NextAttempt)
+		return errDeferred
+	}
+	recallQueueJob(filePath)
+
+	jobID := newJobID()
+	log := slog.With("job_id", jobID)
+	ctx = photoroom.WithRequestID(ctx, jobID)
+	if span := otlp.SpanFromContext(ctx); span != nil {
+		span.SetAttributes(otlp.String("job_id", jobID))
+		if id := span.TraceID(); id != "" {
+			log = log.With("trace_id", id)
+		}
+	}
+
+	err := checkContent(filePath)
+	if errors.Is(err, errSkipped) {
+		skipFile(log, filePath, outcome{JobID: jobID}, err)
+		return err
+	}
+	if err != nil {
+		log.Error("failed to check file", "file", filePath, "error", err)
+		return err
+	}
+
+	states.update(filePath, func(st *fileState) {
+		st.Status = statusUploading
+		st.Attempts++
+	})
+
+	batches.assign(filePath)
+	defer batches.release(filePath)
+
+	start := time.Now()
+	processCtx, span := startSpan(ctx, "process")
+	res, err := processFileWithDeadline(processCtx, filePath)
+	endSpan(span, err)
+	if errors.Is(err, context.Canceled) {
+		// Файл остается в source и будет обработан при следующем запуске
+		log.Warn("file processing cancelled", "file", filePath)
+		states.setStatus(filePath, statusPending)
+		return err
+	}
+	if errors.Is(err, errSkipped) {
+		states.remove(filePath)
+		skipFile(log, filePath, res, err)
+		return err
+	}
+	if err != nil {
+		attrs := []any{"file", filePath, "duration", time.Since(start), "error", err}
+		var apiErr *photoroom.APIError
+		if errors.As(err, &apiErr) {
+			attrs = append(attrs, "status", apiErr.StatusCode)
+		}
+		// Файл остается в source и обрабатывается позже
+		if deferRetry(filePath, err) {
+			return errDeferred
+		}
+		log.Error("file processing failed", attrs...)
+		states.update(filePath, func(st *fileState) {
+			st.Status = statusFailed
+			st.Error = err.Error()
+			st.Retries = 0
+			st.FirstFailure = time.Time{}
+			st.NextAttempt = time.Time{}
+		})
+		// Хуки запускаются, пока исходник еще на месте
+		runPostHooks(filePath, res, time.Since(start), err)
+		quarantine(filePath, err)
+		notify(filePath, res, time.Since(start), err)
+		reports.add(filePath, res, time.Since(start), err)
+		queueDone(filePath, res, err)
+		return err
+	}
+	duration := time.Since(start)
+	log.Info("file processed", "file", filePath, "duration", duration)
+	health.lastSuccess.Store(time.Now().UnixNano())
+	states.update(filePath, func(st *fileState) {
+		st.Status = statusDone
+		st.Output = res.Location
+		st.Error = ""
+		st.Retries = 0
+		st.FirstFailure = time.Time{}
+		st.NextAttempt = time.Time{}
+	})
+
+	runPostHooks(filePath, res, duration, nil)
+
+	// Запись нужна только до переноса исходника
+	_, span = startSpan(ctx, "move")
+	archived := archiveSource(filePath)
+	span.End()
+	holdForReview(filePath, archived, res)
+	notify(filePath, res, duration, nil)
+	reports.add(filePath, res, duration, nil)
+	queueDone(filePath, res, nil)
+	return nil
+}
+
+// skipFile переносит пропущенный файл в skipped_dir
+func skipFile(log *slog.Logger, filePath string, res outcome, reason error) {
+	log.Warn("file skipped", "file", filePath, "reason", reason)
+	if config.Filter.SkippedDir != "" {
+		moveFile(filePath, config.Filter.SkippedDir)
+	}
+	reports.add(filePath, res, 0, reason)
+	queueDone(filePath, res, reason)
+}
+
+// Сколько раз пытаться перенести исходник после успешной обработки
+const moveAttempts = 5
+
+// retryMove снова ставит в очередь обработанный файл, который не удалось
+// перенести в destination. В API он повторно не отправляется: результат
+// уже отмечен в базе состояния. Без базы состояния файл остается в source.
+func retryMove(filePath string) {
+	if states == nil {
+		return
+	}
+
+	var attempts int
+	states.update(filePath, func(st *fileState) {
+		st.MoveAttempts++
+		attempts = st.MoveAttempts
+	})
+	if attempts >= moveAttempts {
+		slog.Error("giving up moving processed file", "file", filePath, "attempts", attempts)
+		return
+	}
+
+	time.AfterFunc(time.Duration(attempts)*30*time.Second, func() {
+		jobs.tryEnqueue(filePath)
+	})
+}
+
+// processFileWithDeadline обрабатывает файл, ограничивая время
+// обработки таймаутом timeouts.file. Файл, не уложившийся в него,
+// считается необработанным.
+func processFileWithDeadline(ctx context.Context, filePath string) (outcome, error) {
+	timeout := config.Timeouts.File
+	if timeout <= 0 {
+		return processFile(ctx, filePath)
+	}
+
+	fileCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, err := processFile(fileCtx, filePath)
+	if err != nil && ctx.Err() == nil && errors.Is(fileCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("превышено время обработки файла (%s): %w", timeout, err)
+	}
+	return res, err
+}
+
+// failureStatus возвращает код ответа API для метрик или "error",
+// если ошибка произошла не на стороне API
+func failureStatus(err error) string {
+	var apiErr *photoroom.APIError
+	if errors.As(err, &apiErr) {
+		return strconv.Itoa(apiErr.StatusCode)
+	}
+	return "error"
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Периоды и сжатие zip-архивов исходников (archive.policy: zip)
+const (
+	zipMonth   = "month"
+	zipDay     = "day"
+	zipDeflate = "deflate"
+	zipStore   = "store"
+)
+
+// Дописывание в архивы выполняется по одному файлу
+var zipMu sync.Mutex
+
+// zipArchivePath возвращает путь к архиву исходников, обработанных в момент t:
+// destination_dir/2024-06.zip или destination_dir/2024-06-01.zip
+func zipArchivePath(destDir string, t time.Time) string {
+	layout := "2006-01"
+	if config.Archive.ZipPeriod == zipDay {
+		layout = time.DateOnly
+	}
+	return filepath.Join(destDir, t.Format(layout)+".zip")
+}
+
+// zipSource дописывает исходник и его sidecar-файл в архив за период
+// и удаляет их из source. Возвращает путь к архиву.
+func zipSource(filePath, destDir string, t time.Time) (string, error) {
+	archive := zipArchivePath(destDir, t)
+	err := os.MkdirAll(destDir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	files := []string{filePath}
+	if sidecar := sidecarPath(filePath); sidecar != "" {
+		files = append(files, sidecar)
+	}
+	name := filepath.ToSlash(relPath(filePath))
+
+	zipMu.Lock()
+	defer zipMu.Unlock()
+	err = recoverZip(archive)
+	if err != nil {
+		return "", err
+	}
+	names, err := zipNames(archive)
+	if err != nil {
+		return "", err
+	}
+	name = uniqueZipName(names, name)
+	for i, file := range files {
+		entry := name
+		if i > 0 {
+			entry += filepath.Ext(file)
+		}
+		err = appendZip(archive, file, entry)
+		if err != nil {
+			return "", fmt.Errorf("не удалось дописать %s в %s: %w", file, archive, err)
+		}
+	}
+
+	for _, file := range files {
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove archived file", "file", file, "error", err)
+		}
+	}
+	slog.Info("file archived", "file", filePath, "archive", archive, "entry", name)
+	return archive, nil
+}
+
+// zipNames возвращает имена файлов в архиве; архива может еще не быть
+func zipNames(archive string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	r, err := zip.OpenReader(archive)
+	if errors.Is(err, os.ErrNotExist) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		names[f.Name] = true
+	}
+	return names, nil
+}
+
+// uniqueZipName добавляет к имени, уже занятому в архиве, суффикс _1, _2...
+func uniqueZipName(names map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; names[name]; i++ {
+		name = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+	return name
+}
+
+// Каталог zip-архива: записи о файлах и их число
+type zipDirectory struct {
+	offset  int64
+	records uint64
+	data    []byte
+}
+
+// appendZip дописывает файл src в архив под именем name, не переписывая
+// уже сжатые данные. Новая запись пишется на место каталога архива,
+// после нее - прежний каталог с записью о новом файле. Прежний каталог
+// до записи нового на диск хранится в журнале: если дописать не удалось
+// или программа прервалась, он восстанавливается.
+func appendZip(archive, src, name string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(archive, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	old, err := readZipDirectory(f)
+	if err != nil {
+		return err
+	}
+	err = writeZipJournal(archive, old)
+	if err != nil {
+		return fmt.Errorf("не удалось записать журнал: %w", err)
+	}
+
+	err = writeZipEntry(f, old, in, info, name)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// Прежние записи остаются на месте, восстанавливается только каталог
+		restoreErr := writeZipDirectory(f, old.offset, old.records, old.data)
+		if restoreErr == nil {
+			restoreErr = f.Sync()
+		}
+		if restoreErr != nil {
+			// Журнал остается: каталог восстановит следующее дописывание
+			slog.Error("failed to restore zip directory", "archive", archive, "error", restoreErr)
+			return err
+		}
+	}
+	os.Remove(zipJournalPath(archive))
+	return err
+}
+
+// zipJournalPath возвращает путь к журналу дописывания архива
+func zipJournalPath(archive string) string {
+	return archive + ".journal"
+}
+
+// Заголовок журнала: смещение каталога, число записей, размер каталога
+// и его контрольная сумма
+const zipJournalHeaderLen = 28
+
+// writeZipJournal сохраняет на диск каталог архива перед его изменением
+func writeZipJournal(archive string, dir zipDirectory) error {
+	var buf bytes.Buffer
+	put := func(v any) { binary.Write(&buf, binary.LittleEndian, v) }
+	put(uint64(dir.offset))
+	put(dir.records)
+	put(uint64(len(dir.data)))
+	put(crc32.ChecksumIEEE(dir.data))
+	buf.Write(dir.data)
+
+	f, err := os.Create(zipJournalPath(archive))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// recoverZip восстанавливает каталог архива из журнала, оставшегося после
+// прерванного дописывания. Недописанный журнал означает, что архив еще
+// не менялся, и просто удаляется.
+func recoverZip(archive string) error {
+	journal := zipJournalPath(archive)
+	data, err := os.ReadFile(journal)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) < zipJournalHeaderLen {
+		return os.Remove(journal)
+	}
+	offset := binary.LittleEndian.Uint64(data)
+	records := binary.LittleEndian.Uint64(data[8:])
+	size := binary.LittleEndian.Uint64(data[16:])
+	dir := data[zipJournalHeaderLen:]
+	if size != uint64(len(dir)) || crc32.ChecksumIEEE(dir) != binary.LittleEndian.Uint32(data[24:]) {
+		return os.Remove(journal)
+	}
+
+	f, err := os.OpenFile(archive, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = writeZipDirectory(f, int64(offset), records, dir)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("не удалось восстановить каталог %s: %w", archive, err)
+	}
+	slog.Warn("zip directory restored after interrupted append", "archive", archive, "records", records)
+	return os.Remove(journal)
+}
+
+// writeZipEntry пишет запись о файле с offset прежнего каталога и
+// объединяет каталоги
+func writeZipEntry(f *os.File, old zipDirectory, in io.Reader, info os.FileInfo, name string) error {
+	_, err := f.Seek(old.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	zw.SetOffset(old.offset)
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	if config.Archive.ZipMethod == zipStore {
+		header.Method = zip.Store
+	}
+	w, err := zw.CreateHeader(header)
+	if err == nil {
+		_, err = io.Copy(w, in)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return err
+	}
+	// За концом новой записи могли остаться байты прежнего каталога
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = f.Truncate(end)
+	}
+	if err != nil {
+		return err
+	}
+
+	// zip.Writer записал каталог только из новой записи
+	added, err := readZipDirectory(f)
+	if err != nil {
+		return err
+	}
+	data := append(bytes.Clone(old.data), added.data...)
+	return writeZipDirectory(f, added.offset, old.records+added.records, data)
+}
+
+// Сигнатуры и размеры служебных записей zip
+const (
+	zipEndSig         = 0x06054b50
+	zip64EndSig       = 0x06064b50
+	zip64LocatorSig   = 0x07064b50
+	zipEndLen         = 22
+	zip64EndLen       = 56
+	zip64LocatorLen   = 20
+	zipMaxCommentLen  = 0xffff
+	zipUint16Overflow = 0xffff
+	zipUint32Overflow = 0xffffffff
+)
+
+// readZipDirectory читает каталог архива по записи о его конце,
+// включая расширение zip64. Для пустого файла возвращает пустой каталог.
+func readZipDirectory(f *os.File) (zipDirectory, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return zipDirectory{}, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return zipDirectory{}, nil
+	}
+
+	tail := make([]byte, min(size, zipEndLen+zipMaxCommentLen))
+	_, err = f.ReadAt(tail, size-int64(len(tail)))
+	if err != nil {
+		return zipDirectory{}, err
+	}
+	pos := -1
+	for i := len(tail) - zipEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == zipEndSig {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return zipDirectory{}, errors.New("zip: не найден конец каталога")
+	}
+	end := tail[pos:]
+	records := uint64(binary.LittleEndian.Uint16(end[10:]))
+	dirSize := uint64(binary.LittleEndian.Uint32(end[12:]))
+	offset := uint64(binary.LittleEndian.Uint32(end[16:]))
+
+	if records == zipUint16Overflow || dirSize == zipUint32Overflow || offset == zipUint32Overflow {
+		endPos := size - int64(len(tail)) + int64(pos)
+		var locator [zip64LocatorLen]byte
+		_, err = f.ReadAt(locator[:], endPos-zip64LocatorLen)
+		if err != nil || binary.LittleEndian.Uint32(locator[:]) != zip64LocatorSig {
+			return zipDirectory{}, errors.New("zip: не найдена запись zip64")
+		}
+		var end64 [zip64EndLen]byte
+		_, err = f.ReadAt(end64[:], int64(binary.LittleEndian.Uint64(locator[8:])))
+		if err != nil || binary.LittleEndian.Uint32(end64[:]) != zip64EndSig {
+			return zipDirectory{}, errors.New("zip: поврежденная запись zip64")
+		}
+		records = binary.LittleEndian.Uint64(end64[32:])
+		dirSize = binary.LittleEndian.Uint64(end64[40:])
+		offset = binary.LittleEndian.Uint64(end64[48:])
+	}
+	if offset+dirSize > uint64(size) {
+		return zipDirectory{}, errors.New("zip: каталог за пределами файла")
+	}
+
+	data := make([]byte, dirSize)
+	_, err = f.ReadAt(data, int64(offset))
+	if err != nil {
+		return zipDirectory{}, err
+	}
+	return zipDirectory{offset: int64(offset), records: records, data: data}, nil
+}
+
+// writeZipDirectory пишет каталог data с offset и запись о его конце,
+// при необходимости в формате zip64, и обрезает файл после нее
+func writeZipDirectory(f *os.File, offset int64, records uint64, data []byte) error {
+	var buf bytes.Buffer
+	buf.Write(data)
+	put := func(v any) { binary.Write(&buf, binary.LittleEndian, v) }
+
+	start, size := offset, uint64(len(data))
+	if records >= zipUint16Overflow || size >= zipUint32Overflow || uint64(offset) >= zipUint32Overflow {
+		end64 := offset + int64(size)
+		put(uint32(zip64EndSig))
+		put(uint64(zip64EndLen - 12))
+		put(uint16(45)) // версия, создавшая архив
+		put(uint16(45)) // версия для распаковки
+		put(uint32(0))  // номер диска
+		put(uint32(0))  // диск с каталогом
+		put(records)
+		put(records)
+		put(size)
+		put(uint64(offset))
+
+		put(uint32(zip64LocatorSig))
+		put(uint32(0))
+		put(uint64(end64))
+		put(uint32(1)) // всего дисков
+
+		records, size, offset = zipUint16Overflow, zipUint32Overflow, zipUint32Overflow
+	}
+	put(uint32(zipEndSig))
+	put(uint16(0))
+	put(uint16(0))
+	put(uint16(records))
+	put(uint16(records))
+	put(uint32(size))
+	put(uint32(offset))
+	put(uint16(0)) // длина комментария
+
+	_, err := f.WriteAt(buf.Bytes(), start)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(start + int64(buf.Len()))
+}